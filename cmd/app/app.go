@@ -7,8 +7,11 @@ import (
 	"time"
 
 	"github.com/kudzaitsapo/fileflow-server/internal/auth"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
 	"github.com/kudzaitsapo/fileflow-server/internal/cache"
 	"github.com/kudzaitsapo/fileflow-server/internal/config"
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
+	"github.com/kudzaitsapo/fileflow-server/internal/jobs"
 	"github.com/kudzaitsapo/fileflow-server/internal/store"
 )
 
@@ -23,8 +26,14 @@ type Application struct {
 	middleware []func(http.Handler) http.Handler
 	AppConfig config.ApplicationConfig
 	Authenticator auth.Authenticator
+	Signer *auth.URLSigner
 	Store *store.Storage
 	Cache *cache.Storage
+	Blobs blobstore.BlobStore
+	Keyring *encryption.Keyring
+	Scrubber *jobs.Scrubber
+	Tierer *jobs.Tierer
+	Purger *jobs.Purger
 }
 
 func CreateApplication(config config.ApplicationConfig) *Application {
@@ -52,6 +61,10 @@ func (a *Application) SetAuthenticator(auth auth.Authenticator) {
 	a.Authenticator = auth
 }
 
+func (a *Application) SetSigner(signer *auth.URLSigner) {
+	a.Signer = signer
+}
+
 func (a *Application) SetStore(store *store.Storage) {
 	a.Store = store
 }
@@ -60,6 +73,26 @@ func (a *Application) SetCache(cache *cache.Storage) {
 	a.Cache = cache
 }
 
+func (a *Application) SetBlobStore(blobs blobstore.BlobStore) {
+	a.Blobs = blobs
+}
+
+func (a *Application) SetKeyring(keyring *encryption.Keyring) {
+	a.Keyring = keyring
+}
+
+func (a *Application) SetScrubber(scrubber *jobs.Scrubber) {
+	a.Scrubber = scrubber
+}
+
+func (a *Application) SetTierer(tierer *jobs.Tierer) {
+	a.Tierer = tierer
+}
+
+func (a *Application) SetPurger(purger *jobs.Purger) {
+	a.Purger = purger
+}
+
 func (app *Application) Use(middleware func(http.Handler) http.Handler) {
 	app.middleware = append(app.middleware, middleware)
 }
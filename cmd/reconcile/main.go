@@ -0,0 +1,82 @@
+// Command reconcile finds and repairs drift between stored_files rows and the
+// blob store: uploads that were never finalised, files whose blob is gone,
+// blobs that no file references and shared blobs with a wrong reference
+// count. Run it with -dry-run first to see what would change.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/config"
+	"github.com/kudzaitsapo/fileflow-server/internal/database"
+	"github.com/kudzaitsapo/fileflow-server/internal/jobs"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report drift without repairing it")
+	gracePeriod := flag.Duration("grace", 24*time.Hour, "leave pending uploads and unreferenced blobs younger than this alone")
+	deleteMissing := flag.Bool("delete-missing", false, "delete files whose blob is gone instead of marking them as missing")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+
+	db, err := database.Initialise(&cfg.DbConfig)
+	if err != nil {
+		log.Fatalf("error initialising database: %v", err)
+	}
+	defer db.Close()
+
+	blobs, err := blobstore.InitialiseTiered(cfg.StorageConfig, cfg.ColdStorageConfig)
+	if err != nil {
+		log.Fatalf("error initialising blob storage: %v", err)
+	}
+
+	reconciler := jobs.NewReconciler(store.InitialiseStorage(db), blobs)
+	report, err := reconciler.Run(context.Background(), jobs.ReconcileOptions{
+		DryRun:        *dryRun,
+		GracePeriod:   *gracePeriod,
+		DeleteMissing: *deleteMissing,
+	})
+	if err != nil {
+		log.Fatalf("error reconciling: %v", err)
+	}
+
+	action := func(repair string) string {
+		if *dryRun {
+			return "would be " + repair
+		}
+		return repair
+	}
+
+	for _, storedFile := range report.StalePending {
+		log.Printf("Pending upload %s (%s) was never finalised, %s", storedFile.ID, storedFile.FileName, action("removed"))
+	}
+
+	for _, drift := range report.ReferenceDrift {
+		log.Printf("Blob %s has %d references recorded but %d files, %s", drift.Key, drift.RefCount, drift.References, action("recounted"))
+	}
+
+	missingRepair := "marked as missing"
+	if *deleteMissing {
+		missingRepair = "deleted"
+	}
+	for _, storedFile := range report.MissingBlobs {
+		log.Printf("File %s (%s) points at missing blob %s, %s", storedFile.ID, storedFile.FileName, utils.StoredFileKey(storedFile), action(missingRepair))
+	}
+
+	for _, blob := range report.OrphanedBlobs {
+		log.Printf("Blob %s (%d bytes) is not referenced by any file, %s", blob.Key, blob.Size, action("deleted"))
+	}
+
+	log.Printf("%d stale pending uploads, %d blobs with wrong reference counts, %d files with missing blobs, %d orphaned blobs",
+		len(report.StalePending), len(report.ReferenceDrift), len(report.MissingBlobs), len(report.OrphanedBlobs))
+}
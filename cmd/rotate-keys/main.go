@@ -0,0 +1,80 @@
+// Command rotate-keys re-wraps every project data key with the current master
+// key. To rotate the master key, restart the server with the new key in
+// ENCRYPTION_MASTER_KEY and the old one in ENCRYPTION_PREVIOUS_MASTER_KEYS,
+// run this command with the same configuration, then drop the old key. The
+// server keeps reading data keys wrapped by the old key and wraps new ones
+// with the new key throughout. Stored files are encrypted with the data keys,
+// so none of them need to be rewritten.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/config"
+	"github.com/kudzaitsapo/fileflow-server/internal/database"
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+func main() {
+	generate := flag.Bool("generate", false, "print a new random master key and exit")
+	flag.Parse()
+
+	if *generate {
+		key, err := encryption.GenerateKey()
+		if err != nil {
+			log.Fatalf("error generating key: %v", err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+
+	masterKey, err := encryption.ParseKey(cfg.EncryptionConfig.MasterKey)
+	if err != nil {
+		log.Fatalf("error loading master key from ENCRYPTION_MASTER_KEY: %v", err)
+	}
+
+	previousMasterKeys, err := encryption.ParseKeys(cfg.EncryptionConfig.PreviousMasterKeys)
+	if err != nil {
+		log.Fatalf("error loading previous master keys from ENCRYPTION_PREVIOUS_MASTER_KEYS: %v", err)
+	}
+
+	db, err := database.Initialise(&cfg.DbConfig)
+	if err != nil {
+		log.Fatalf("error initialising database: %v", err)
+	}
+	defer db.Close()
+
+	storage := store.InitialiseStorage(db)
+
+	keyring, err := encryption.NewKeyring(masterKey, previousMasterKeys, storage.ProjectKeys)
+	if err != nil {
+		log.Fatalf("error initialising keyring: %v", err)
+	}
+
+	// Keys already wrapped by the current master key, including those the
+	// server creates while this runs, are left as they are, so an interrupted
+	// rotation can simply be run again
+	rewrapped, err := storage.ProjectKeys.RewrapAll(context.Background(), func(projectKey *store.ProjectKey) ([]byte, string, error) {
+		wrappedKey, masterKeyId, err := keyring.Rewrap(projectKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("project %d: %w", projectKey.ProjectID, err)
+		}
+		return wrappedKey, masterKeyId, nil
+	})
+	if err != nil {
+		log.Fatalf("error rotating keys, no keys were changed: %v", err)
+	}
+
+	log.Printf("Checked %d project keys, all are now wrapped by master key %s", rewrapped, keyring.MasterKeyID())
+	log.Printf("ENCRYPTION_PREVIOUS_MASTER_KEYS can now be emptied")
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
+	"time"
 
 	server "github.com/kudzaitsapo/fileflow-server"
 	"github.com/kudzaitsapo/fileflow-server/cmd/app"
 	"github.com/kudzaitsapo/fileflow-server/internal/auth"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
 	"github.com/kudzaitsapo/fileflow-server/internal/cache"
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
 	"github.com/kudzaitsapo/fileflow-server/internal/config"
 	"github.com/kudzaitsapo/fileflow-server/internal/database"
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
+	"github.com/kudzaitsapo/fileflow-server/internal/jobs"
 	"github.com/kudzaitsapo/fileflow-server/internal/middleware"
 	"github.com/kudzaitsapo/fileflow-server/internal/routes"
 	"github.com/kudzaitsapo/fileflow-server/internal/seeds"
@@ -38,6 +44,21 @@ func main() {
 	defer redis.Close()
 	log.Printf("Redis connection established")
 
+	// Initialise the blob storage backend
+	blobs, err := blobstore.InitialiseTiered(cfg.StorageConfig, cfg.ColdStorageConfig)
+	if err != nil {
+		log.Fatalf("error initialising blob storage: %v", err)
+	}
+	application.SetBlobStore(blobs)
+	log.Printf("Blob storage initialised with %q driver", cfg.StorageConfig.Driver)
+	if cfg.ColdStorageConfig.Driver != "" {
+		log.Printf("Cold storage initialised with %q driver", cfg.ColdStorageConfig.Driver)
+	}
+
+	if _, err := compression.Lookup(cfg.CompressionConfig.DefaultCodec); err != nil {
+		log.Fatalf("error loading compression settings: %v", err)
+	}
+
 	// Register middleware
 	middlewares := middleware.GetMiddlewares()
 	for _, middleware := range middlewares {
@@ -59,6 +80,9 @@ func main() {
 	JwtAuthenticator := auth.Initialise(cfg.Config.SecretKey)
 	application.SetAuthenticator(JwtAuthenticator)
 
+	// Presigned URLs are signed with a key derived from the same secret
+	application.SetSigner(auth.NewURLSigner(cfg.Config.SecretKey))
+
 	// Run database migrations
 	if !cfg.DbConfig.SkipMigrations {
 		if err := database.RunMigrations(db, server.MigrationsDir); err != nil {
@@ -73,6 +97,100 @@ func main() {
 	cache := cache.InitialiseStorage(db)
 	application.SetCache(cache)
 
+	// Encrypt uploads when a master key is configured
+	if cfg.EncryptionConfig.Enabled() {
+		masterKey, err := encryption.ParseKey(cfg.EncryptionConfig.MasterKey)
+		if err != nil {
+			log.Fatalf("error loading encryption master key: %v", err)
+		}
+
+		previousMasterKeys, err := encryption.ParseKeys(cfg.EncryptionConfig.PreviousMasterKeys)
+		if err != nil {
+			log.Fatalf("error loading previous encryption master keys: %v", err)
+		}
+
+		keyring, err := encryption.NewKeyring(masterKey, previousMasterKeys, store.ProjectKeys)
+		if err != nil {
+			log.Fatalf("error initialising keyring: %v", err)
+		}
+		application.SetKeyring(keyring)
+		log.Printf("Encryption at rest enabled with master key %s", encryption.KeyID(masterKey))
+	}
+
+
+	// Check the integrity of stored files in the background
+	scrubber := jobs.NewScrubber(store, blobs, application.Keyring)
+	application.SetScrubber(scrubber)
+	jobs.Every(context.Background(), cfg.JobsConfig.ScrubInterval, func(ctx context.Context) {
+		if _, err := scrubber.Start(); err != nil {
+			log.Printf("Error starting integrity scrub: %v", err)
+		}
+	})
+
+	// Move files that are no longer downloaded to cold storage
+	if cfg.ColdStorageConfig.Driver != "" {
+		tierer := jobs.NewTierer(store, blobs)
+		application.SetTierer(tierer)
+		if cfg.JobsConfig.ColdAfter > 0 {
+			jobs.Every(context.Background(), cfg.JobsConfig.TieringInterval, func(ctx context.Context) {
+				report, err := tierer.Archive(ctx, time.Now().Add(-cfg.JobsConfig.ColdAfter))
+				if err != nil {
+					log.Printf("Error moving files to cold storage: %v", err)
+					return
+				}
+				log.Printf("Moved %d blobs (%d bytes) to cold storage, %d failed", report.Archived, report.Bytes, report.Failed)
+			})
+		}
+	}
+
+	// Remove files and projects for good once they have been in the trash
+	// for longer than the retention period
+	purger := jobs.NewPurger(store, blobs)
+	application.SetPurger(purger)
+	jobs.Every(context.Background(), cfg.JobsConfig.TrashPurgeInterval, func(ctx context.Context) {
+		report, err := purger.Purge(ctx, time.Now().Add(-cfg.JobsConfig.TrashRetention))
+		if err != nil {
+			log.Printf("Error purging the trash: %v", err)
+			return
+		}
+		log.Printf("Purged %d projects and %d files from the trash, %d failed", report.Projects, report.Files, report.Failed)
+	})
+
+	// Expire files and previous versions as set by the lifecycle rules of
+	// every project
+	lifecycleRunner := jobs.NewLifecycleRunner(store, blobs)
+	jobs.Every(context.Background(), cfg.JobsConfig.LifecycleInterval, func(ctx context.Context) {
+		if err := lifecycleRunner.RunAll(ctx, time.Now()); err != nil {
+			log.Printf("Error applying lifecycle rules: %v", err)
+		}
+	})
+
+	// Remove resumable uploads that were not completed in time, and abort
+	// multipart uploads that were left idle
+	uploadJanitor := jobs.NewUploadJanitor(store, blobs)
+	jobs.Every(context.Background(), cfg.JobsConfig.UploadCleanupInterval, func(ctx context.Context) {
+		report, err := uploadJanitor.Clean(ctx, time.Now())
+		if err != nil {
+			log.Printf("Error removing expired uploads: %v", err)
+			return
+		}
+		log.Printf("Removed %d expired uploads with %d chunks and aborted %d multipart uploads with %d parts, %d failed",
+			report.Uploads, report.Chunks, report.MultipartUploads, report.Parts, report.Failed)
+	})
+
+	// Restore the redundancy of replicated and erasure coded blobs in the
+	// background
+	if repairer, ok := blobs.(blobstore.Repairer); ok {
+		jobs.Every(context.Background(), cfg.JobsConfig.ReplicaRepairInterval, func(ctx context.Context) {
+			report, err := repairer.Repair(ctx, time.Now().Add(-jobs.ReplicaRepairGrace))
+			if err != nil {
+				log.Printf("Error repairing replicas: %v", err)
+				return
+			}
+			log.Printf("Replica repair checked %d blobs: %d repaired, %d damaged copies removed, %d degraded, %d lost",
+				report.Checked, report.Repaired, report.Corrupt, report.Degraded, len(report.LostKeys))
+		})
+	}
 
 	// Seed the database
 	if !cfg.DbConfig.SkipSeeding {
@@ -0,0 +1,89 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/config"
+)
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+	ErrInvalidKey   = errors.New("invalid blob key")
+)
+
+// BlobInfo describes a stored blob without reading its content
+type BlobInfo struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// BlobStore is implemented by every storage driver. Keys are slash separated
+// paths relative to the root of the store, e.g. "invoices/<uuid>.ffs".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange reads length bytes starting at offset, or up to the end of the
+	// blob when length is negative
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// Move renames a blob, replacing any blob already stored under dstKey
+	Move(ctx context.Context, srcKey string, dstKey string) error
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	List(ctx context.Context, prefix string) ([]*BlobInfo, error)
+}
+
+// Initialise creates the blob store selected by the storage driver setting
+func Initialise(cfg config.StorageConfig) (BlobStore, error) {
+	switch cfg.Driver {
+	case "", "local":
+		return NewLocalStore(cfg.LocalPath)
+	case "s3":
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return NewS3Store(ctx, cfg)
+	case "replicated":
+		replicated, err := NewReplicatedStore(cfg.Volumes, cfg.Replicas, cfg.WriteQuorum)
+		if err != nil || cfg.DataShards == 0 {
+			return replicated, err
+		}
+
+		erasure, err := NewErasureStore(cfg.Volumes, cfg.DataShards, cfg.ParityShards)
+		if err != nil {
+			return nil, err
+		}
+		return NewDurabilityStore(replicated, erasure), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", cfg.Driver)
+	}
+}
+
+// InitialiseTiered creates the hot blob store and, when a cold storage driver
+// is configured, puts it in front of the cold store
+func InitialiseTiered(hot config.StorageConfig, cold config.StorageConfig) (BlobStore, error) {
+	hotStore, err := Initialise(hot)
+	if err != nil || cold.Driver == "" {
+		return hotStore, err
+	}
+
+	coldStore, err := Initialise(cold)
+	if err != nil {
+		return nil, fmt.Errorf("cold storage: %w", err)
+	}
+	return NewTieredStore(hotStore, coldStore), nil
+}
+
+// cleanKey normalises a blob key and rejects keys that point outside the store
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || !filepath.IsLocal(filepath.FromSlash(cleaned)) {
+		return "", ErrInvalidKey
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,141 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Durability policies a project can choose between
+const (
+	// DurabilityReplication keeps full copies of every blob
+	DurabilityReplication = "replication"
+	// DurabilityErasure splits blobs into data and parity shards
+	DurabilityErasure = "erasure"
+)
+
+// ErasureKeyPrefix marks the keys of blobs stored with erasure coding
+const ErasureKeyPrefix = "ec/"
+
+var ErrUnsupportedDurability = errors.New("durability policy is not supported by the storage driver")
+
+// Repairer is implemented by stores that can restore lost redundancy
+type Repairer interface {
+	Repair(ctx context.Context, before time.Time) (*RepairReport, error)
+}
+
+// ValidDurability reports whether policy names a durability policy
+func ValidDurability(policy string) bool {
+	return policy == DurabilityReplication || policy == DurabilityErasure
+}
+
+// SupportsDurability reports whether blobs can be stored in a store with the
+// given policy. Every store keeps blobs with its own redundancy, only the
+// replicated driver with erasure coding configured offers the erasure policy.
+func SupportsDurability(store BlobStore, policy string) bool {
+	switch policy {
+	case "", DurabilityReplication:
+		return true
+	case DurabilityErasure:
+		if tiered, ok := store.(*TieredStore); ok {
+			store = tiered.hot
+		}
+		_, ok := store.(*DurabilityStore)
+		return ok
+	default:
+		return false
+	}
+}
+
+// DurabilityKey returns the key a blob stored with the given policy is kept
+// under
+func DurabilityKey(policy string, key string) string {
+	if policy == DurabilityErasure {
+		return ErasureKeyPrefix + key
+	}
+	return key
+}
+
+// DurabilityStore lets every blob choose between replication and erasure
+// coding over the same volumes. Blobs whose key starts with ErasureKeyPrefix
+// are erasure coded, all others are replicated.
+type DurabilityStore struct {
+	replicated *ReplicatedStore
+	erasure    *ErasureStore
+}
+
+func NewDurabilityStore(replicated *ReplicatedStore, erasure *ErasureStore) *DurabilityStore {
+	return &DurabilityStore{replicated: replicated, erasure: erasure}
+}
+
+func (s *DurabilityStore) route(key string) BlobStore {
+	if strings.HasPrefix(key, ErasureKeyPrefix) {
+		return s.erasure
+	}
+	return s.replicated
+}
+
+func (s *DurabilityStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	return s.route(key).Put(ctx, key, r)
+}
+
+func (s *DurabilityStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.route(key).Get(ctx, key)
+}
+
+func (s *DurabilityStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.route(key).GetRange(ctx, key, offset, length)
+}
+
+func (s *DurabilityStore) Delete(ctx context.Context, key string) error {
+	return s.route(key).Delete(ctx, key)
+}
+
+// Move renames within a backend, or copies the blob over when the keys use
+// different policies
+func (s *DurabilityStore) Move(ctx context.Context, srcKey string, dstKey string) error {
+	source, destination := s.route(srcKey), s.route(dstKey)
+	if source == destination {
+		return source.Move(ctx, srcKey, dstKey)
+	}
+
+	if _, err := Copy(ctx, s, srcKey, dstKey); err != nil {
+		return err
+	}
+	return source.Delete(ctx, srcKey)
+}
+
+func (s *DurabilityStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	return s.route(key).Stat(ctx, key)
+}
+
+func (s *DurabilityStore) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	replicated, err := s.replicated.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	erasure, err := s.erasure.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(replicated, erasure...), nil
+}
+
+// Repair repairs the replicated blobs, then the erasure coded ones
+func (s *DurabilityStore) Repair(ctx context.Context, before time.Time) (*RepairReport, error) {
+	report, err := s.replicated.Repair(ctx, before)
+	if err != nil {
+		return report, err
+	}
+
+	erasure, err := s.erasure.Repair(ctx, before)
+	if erasure != nil {
+		report.add(erasure)
+	}
+
+	return report, err
+}
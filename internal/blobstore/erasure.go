@@ -0,0 +1,935 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// erasureBlockSize is the largest block of a shard. Objects smaller than
+	// one full stripe use smaller blocks so they are not padded out.
+	erasureBlockSize = replicaBlockSize
+	// erasureBlockAlign keeps small blocks a multiple of a cache line
+	erasureBlockAlign = 64
+	// erasureDir is the directory below each volume holding shards, kept
+	// apart from the replicas stored in the volume itself
+	erasureDir = ".erasure"
+	// shardManifestPrefix holds the manifest of every shard
+	shardManifestPrefix = ".shards/"
+)
+
+var (
+	shardMagic = []byte("FFEC")
+
+	errTooFewShards = errors.New("not enough intact shards to rebuild blob")
+)
+
+// ErasureStore splits every blob into data shards and adds parity shards
+// with Reed-Solomon coding, keeping each shard on a different volume. Any
+// DataShards intact shards are enough to rebuild the blob, for a fraction of
+// the space taken by full replicas.
+type ErasureStore struct {
+	volumes      []BlobStore
+	names        []string
+	dataShards   int
+	parityShards int
+	writeQuorum  int
+}
+
+// shardManifest describes one shard of a blob. writeID ties together the
+// shards written by the same Put, so that shards left over from an older
+// version of a key are never combined with newer ones.
+type shardManifest struct {
+	writeID      [16]byte
+	dataShards   int
+	parityShards int
+	index        int
+	size         int64
+	blockSize    int
+	blocks       [][sha256.Size]byte
+}
+
+// shardManifestHeaderSize is magic | write id | data | parity | index |
+// block size (4) | size (8) | block count (4)
+const shardManifestHeaderSize = 4 + 16 + 3 + 4 + 8 + 4
+
+func shardManifestKey(key string) string {
+	return shardManifestPrefix + key + ".manifest"
+}
+
+func (m *shardManifest) stripeSize() int64 {
+	return int64(m.dataShards) * int64(m.blockSize)
+}
+
+func (m *shardManifest) stripes() int64 {
+	return (m.size + m.stripeSize() - 1) / m.stripeSize()
+}
+
+func (m *shardManifest) marshal() []byte {
+	buf := make([]byte, 0, shardManifestHeaderSize+len(m.blocks)*sha256.Size)
+	buf = append(buf, shardMagic...)
+	buf = append(buf, m.writeID[:]...)
+	buf = append(buf, byte(m.dataShards), byte(m.parityShards), byte(m.index))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(m.blockSize))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(m.size))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.blocks)))
+	for _, sum := range m.blocks {
+		buf = append(buf, sum[:]...)
+	}
+	return buf
+}
+
+func unmarshalShardManifest(data []byte) (*shardManifest, error) {
+	if len(data) < shardManifestHeaderSize || !bytes.Equal(data[:4], shardMagic) {
+		return nil, errCorruptReplica
+	}
+
+	manifest := &shardManifest{
+		dataShards:   int(data[20]),
+		parityShards: int(data[21]),
+		index:        int(data[22]),
+		blockSize:    int(binary.BigEndian.Uint32(data[23:])),
+		size:         int64(binary.BigEndian.Uint64(data[27:])),
+	}
+	copy(manifest.writeID[:], data[4:20])
+
+	count := int64(binary.BigEndian.Uint32(data[35:]))
+	if manifest.dataShards == 0 || manifest.index >= manifest.dataShards+manifest.parityShards ||
+		manifest.blockSize <= 0 || manifest.blockSize > erasureBlockSize || manifest.size < 0 ||
+		count != manifest.stripes() || int64(len(data)) != shardManifestHeaderSize+count*sha256.Size {
+		return nil, errCorruptReplica
+	}
+
+	manifest.blocks = make([][sha256.Size]byte, count)
+	for i := range manifest.blocks {
+		copy(manifest.blocks[i][:], data[shardManifestHeaderSize+i*sha256.Size:])
+	}
+
+	return manifest, nil
+}
+
+// sameObject reports whether two shard manifests were written together
+func (m *shardManifest) sameObject(other *shardManifest) bool {
+	return m.writeID == other.writeID && m.dataShards == other.dataShards &&
+		m.parityShards == other.parityShards && m.size == other.size && m.blockSize == other.blockSize
+}
+
+// NewErasureStore keeps shards in a directory below each volume. Writes
+// succeed once all data shards and at least half of the parity shards are
+// stored.
+func NewErasureStore(volumes []string, dataShards int, parityShards int) (*ErasureStore, error) {
+	if dataShards < 1 || parityShards < 1 {
+		return nil, errors.New("erasure coding needs at least one data and one parity shard")
+	}
+	if dataShards+parityShards > len(volumes) {
+		return nil, fmt.Errorf("erasure coding with %d data and %d parity shards needs at least %d volumes", dataShards, parityShards, dataShards+parityShards)
+	}
+	if dataShards+parityShards > 256 {
+		return nil, errors.New("erasure coding supports at most 256 shards")
+	}
+
+	store := &ErasureStore{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		writeQuorum:  dataShards + (parityShards+1)/2,
+	}
+	seen := make(map[string]bool, len(volumes))
+
+	for _, volume := range volumes {
+		name := filepath.Clean(volume)
+		if seen[name] {
+			return nil, fmt.Errorf("volume %s is listed more than once", volume)
+		}
+		seen[name] = true
+
+		local, err := NewLocalStore(filepath.Join(name, erasureDir))
+		if err != nil {
+			return nil, fmt.Errorf("opening volume %s: %w", volume, err)
+		}
+
+		store.volumes = append(store.volumes, local)
+		store.names = append(store.names, name)
+	}
+
+	return store, nil
+}
+
+func (s *ErasureStore) encoder() (reedsolomon.Encoder, error) {
+	return reedsolomon.New(s.dataShards, s.parityShards)
+}
+
+// shardTarget is a volume a shard is being written to
+type shardTarget struct {
+	index  int
+	volume int
+	writer *io.PipeWriter
+	result chan error
+	err    error
+	blocks [][sha256.Size]byte
+}
+
+// shardWriter streams shards of a blob to their volumes at once
+type shardWriter struct {
+	store   *ErasureStore
+	ctx     context.Context
+	key     string
+	targets []*shardTarget
+}
+
+func (s *ErasureStore) openShards(ctx context.Context, key string, volumes map[int]int) *shardWriter {
+	writer := &shardWriter{store: s, ctx: ctx, key: key}
+
+	for index, volume := range volumes {
+		pipeReader, pipeWriter := io.Pipe()
+		target := &shardTarget{index: index, volume: volume, writer: pipeWriter, result: make(chan error, 1)}
+
+		go func(store BlobStore) {
+			_, err := store.Put(ctx, key, pipeReader)
+			// Unblock the writer if the volume gave up before the end
+			pipeReader.CloseWithError(err)
+			target.result <- err
+		}(s.volumes[volume])
+
+		writer.targets = append(writer.targets, target)
+	}
+
+	return writer
+}
+
+// writeStripe writes one block to each target and returns how many targets
+// are still healthy
+func (w *shardWriter) writeStripe(shards [][]byte) int {
+	healthy := 0
+	for _, target := range w.targets {
+		if target.err != nil {
+			continue
+		}
+		if _, err := target.writer.Write(shards[target.index]); err != nil {
+			target.err = err
+			continue
+		}
+		target.blocks = append(target.blocks, sha256.Sum256(shards[target.index]))
+		healthy++
+	}
+	return healthy
+}
+
+// finish completes the shards, stores their manifests and returns the
+// targets that were written. Shards are removed again if writing failed.
+func (w *shardWriter) finish(writeErr error, header shardManifest) []*shardTarget {
+	for _, target := range w.targets {
+		target.writer.CloseWithError(writeErr)
+	}
+
+	written := make([]*shardTarget, 0, len(w.targets))
+	for _, target := range w.targets {
+		err := <-target.result
+		if writeErr != nil || target.err != nil {
+			if err == nil {
+				removeFromVolume(w.ctx, w.store.volumes[target.volume], w.key, shardManifestKey(w.key))
+			}
+			continue
+		}
+
+		if err == nil {
+			manifest := header
+			manifest.index = target.index
+			manifest.blocks = target.blocks
+			_, err = w.store.volumes[target.volume].Put(w.ctx, shardManifestKey(w.key), bytes.NewReader(manifest.marshal()))
+		}
+		if err != nil {
+			removeFromVolume(w.ctx, w.store.volumes[target.volume], w.key, shardManifestKey(w.key))
+			continue
+		}
+		written = append(written, target)
+	}
+
+	return written
+}
+
+// shardBlockSize picks the block size for a blob that fits in one stripe
+func shardBlockSize(size int, dataShards int) int {
+	blockSize := (size + dataShards - 1) / dataShards
+	blockSize = (blockSize + erasureBlockAlign - 1) / erasureBlockAlign * erasureBlockAlign
+	return max(blockSize, erasureBlockAlign)
+}
+
+// Put encodes the blob stripe by stripe while streaming the shards to their
+// volumes. Shards of the key on any other volume are removed afterwards.
+func (s *ErasureStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if _, err := cleanKey(key); err != nil {
+		return 0, err
+	}
+
+	encoder, err := s.encoder()
+	if err != nil {
+		return 0, err
+	}
+
+	header := shardManifest{dataShards: s.dataShards, parityShards: s.parityShards, blockSize: erasureBlockSize}
+	if _, err := rand.Read(header.writeID[:]); err != nil {
+		return 0, err
+	}
+
+	// The first stripe decides the block size, so small blobs are not padded
+	// to a full stripe
+	stripe := make([]byte, s.dataShards*erasureBlockSize)
+	n, readErr := io.ReadFull(r, stripe)
+	last := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+	if readErr != nil && !last {
+		return 0, readErr
+	}
+	if last {
+		header.blockSize = shardBlockSize(n, s.dataShards)
+		stripe = stripe[:s.dataShards*header.blockSize]
+	}
+
+	placement := s.placement(key)
+	volumes := make(map[int]int, s.dataShards+s.parityShards)
+	for index := range s.dataShards + s.parityShards {
+		volumes[index] = placement[index]
+	}
+	writer := s.openShards(ctx, key, volumes)
+
+	shards := make([][]byte, s.dataShards+s.parityShards)
+	for index := range shards {
+		if index < s.dataShards {
+			shards[index] = stripe[index*header.blockSize : (index+1)*header.blockSize]
+		} else {
+			shards[index] = make([]byte, header.blockSize)
+		}
+	}
+
+	var writeErr error
+	for n > 0 {
+		clear(stripe[n:])
+		header.size += int64(n)
+
+		if writeErr = encoder.Encode(shards); writeErr != nil {
+			break
+		}
+		if writer.writeStripe(shards) < s.writeQuorum {
+			writeErr = ErrWriteQuorum
+			break
+		}
+		if last {
+			break
+		}
+
+		n, readErr = io.ReadFull(r, stripe)
+		last = readErr == io.ErrUnexpectedEOF
+		if readErr != nil && readErr != io.EOF && !last {
+			writeErr = readErr
+			break
+		}
+	}
+
+	written := writer.finish(writeErr, header)
+	if writeErr != nil {
+		return 0, writeErr
+	}
+	if len(written) < s.writeQuorum {
+		for _, target := range written {
+			removeFromVolume(ctx, s.volumes[target.volume], key, shardManifestKey(key))
+		}
+		return 0, fmt.Errorf("%w: %d of %d shards", ErrWriteQuorum, len(written), s.writeQuorum)
+	}
+
+	for volume := range s.volumes {
+		if !slices.ContainsFunc(written, func(target *shardTarget) bool { return target.volume == volume }) {
+			removeFromVolume(ctx, s.volumes[volume], key, shardManifestKey(key))
+		}
+	}
+
+	return header.size, nil
+}
+
+// placement orders the volumes for a key by rendezvous hashing, shard i
+// going to the i-th volume
+func (s *ErasureStore) placement(key string) []int {
+	return rendezvous(s.names, key)
+}
+
+// shardSource is a shard a blob can be rebuilt from
+type shardSource struct {
+	volume   int
+	manifest *shardManifest
+}
+
+// loadShards finds the shards of the most complete version of a blob, indexed
+// by shard number. Volumes holding other shards of the key are returned as
+// stale.
+func (s *ErasureStore) loadShards(ctx context.Context, key string) ([]*shardSource, []int, error) {
+	groups := make([][]*shardSource, 0, 1)
+	unreadable := make([]int, 0)
+	found := false
+
+	for volume := range s.volumes {
+		manifest, err := readShardManifest(ctx, s.volumes[volume], key)
+		if errors.Is(err, ErrBlobNotFound) {
+			if _, statErr := s.volumes[volume].Stat(ctx, key); statErr == nil {
+				found = true
+				unreadable = append(unreadable, volume)
+			}
+			continue
+		}
+		found = true
+		if err != nil {
+			unreadable = append(unreadable, volume)
+			continue
+		}
+
+		source := &shardSource{volume: volume, manifest: manifest}
+		matched := false
+		for i, group := range groups {
+			if group[0].manifest.sameObject(manifest) {
+				groups[i] = append(group, source)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			groups = append(groups, []*shardSource{source})
+		}
+	}
+
+	if !found {
+		return nil, nil, ErrBlobNotFound
+	}
+
+	var best []*shardSource
+	stale := unreadable
+	bestCount := 0
+	for _, group := range groups {
+		count := distinctShards(group)
+		if count > bestCount {
+			if best != nil {
+				stale = append(stale, volumesOf(best)...)
+			}
+			best, bestCount = group, count
+		} else {
+			stale = append(stale, volumesOf(group)...)
+		}
+	}
+
+	if best == nil || bestCount < best[0].manifest.dataShards {
+		return nil, nil, fmt.Errorf("%w: %s", errTooFewShards, key)
+	}
+
+	manifest := best[0].manifest
+	shards := make([]*shardSource, manifest.dataShards+manifest.parityShards)
+	for _, source := range best {
+		if shards[source.manifest.index] == nil {
+			shards[source.manifest.index] = source
+		} else {
+			stale = append(stale, source.volume)
+		}
+	}
+
+	return shards, stale, nil
+}
+
+func distinctShards(group []*shardSource) int {
+	seen := make(map[int]bool, len(group))
+	for _, source := range group {
+		seen[source.manifest.index] = true
+	}
+	return len(seen)
+}
+
+func volumesOf(group []*shardSource) []int {
+	volumes := make([]int, len(group))
+	for i, source := range group {
+		volumes[i] = source.volume
+	}
+	return volumes
+}
+
+func readShardManifest(ctx context.Context, volume BlobStore, key string) (*shardManifest, error) {
+	body, err := volume.Get(ctx, shardManifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, shardManifestHeaderSize+(1<<20)*sha256.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalShardManifest(data)
+}
+
+func (s *ErasureStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange rebuilds the requested stripes from the data shards, reading
+// parity shards only when a data shard is missing or damaged
+func (s *ErasureStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if _, err := cleanKey(key); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset %d", offset)
+	}
+
+	reader, err := s.openReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.position = offset
+	reader.end = reader.manifest.size
+	if length >= 0 {
+		reader.end = min(reader.end, offset+length)
+	}
+
+	return reader, nil
+}
+
+func (s *ErasureStore) openReader(ctx context.Context, key string) (*erasureReader, error) {
+	sources, _, err := s.loadShards(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest *shardManifest
+	shards := make([]*shardReader, len(sources))
+	for index, source := range sources {
+		if source != nil {
+			manifest = source.manifest
+			shards[index] = &shardReader{volume: s.volumes[source.volume], manifest: source.manifest}
+		}
+	}
+
+	encoder, err := reedsolomon.New(manifest.dataShards, manifest.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([][]byte, len(shards))
+	for index := range blocks {
+		blocks[index] = make([]byte, manifest.blockSize)
+	}
+
+	return &erasureReader{
+		ctx:      ctx,
+		key:      key,
+		manifest: manifest,
+		encoder:  encoder,
+		shards:   shards,
+		buffers:  blocks,
+		current:  -1,
+		out:      make([]byte, 0, manifest.stripeSize()),
+	}, nil
+}
+
+// shardReader reads the blocks of one shard in order
+type shardReader struct {
+	volume   BlobStore
+	manifest *shardManifest
+	body     io.ReadCloser
+	next     int64
+	failed   bool
+}
+
+func (r *shardReader) readBlock(ctx context.Context, key string, stripe int64, dst []byte) error {
+	if r.body == nil || r.next != stripe {
+		r.close()
+
+		body, err := r.volume.GetRange(ctx, key, stripe*int64(r.manifest.blockSize), -1)
+		if err != nil {
+			return err
+		}
+		r.body = body
+		r.next = stripe
+	}
+
+	if _, err := io.ReadFull(r.body, dst); err != nil {
+		r.close()
+		return err
+	}
+	r.next++
+
+	if sha256.Sum256(dst) != r.manifest.blocks[stripe] {
+		r.close()
+		return errCorruptReplica
+	}
+	return nil
+}
+
+func (r *shardReader) close() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+// erasureReader decodes a blob one stripe at a time
+type erasureReader struct {
+	ctx      context.Context
+	key      string
+	manifest *shardManifest
+	encoder  reedsolomon.Encoder
+	shards   []*shardReader
+	buffers  [][]byte
+	stripe   [][]byte
+	current  int64
+	out      []byte
+	position int64
+	end      int64
+	pending  []byte
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.position >= r.end {
+			return 0, io.EOF
+		}
+
+		stripeSize := r.manifest.stripeSize()
+		index := r.position / stripeSize
+		if err := r.loadStripe(index, false); err != nil {
+			return 0, err
+		}
+
+		start := r.position - index*stripeSize
+		stop := min(stripeSize, r.end-index*stripeSize)
+		r.pending = r.out[:0]
+		for shard := range r.manifest.dataShards {
+			blockStart := int64(shard * r.manifest.blockSize)
+			blockEnd := blockStart + int64(r.manifest.blockSize)
+			if blockEnd <= start || blockStart >= stop {
+				continue
+			}
+			r.pending = append(r.pending, r.stripe[shard][max(start, blockStart)-blockStart:min(stop, blockEnd)-blockStart]...)
+		}
+		r.out = r.pending[:0]
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.position += int64(n)
+	return n, nil
+}
+
+// loadStripe reads enough intact blocks of a stripe to decode it. With all
+// set, parity blocks are rebuilt as well.
+func (r *erasureReader) loadStripe(index int64, all bool) error {
+	if r.current == index && !all {
+		return nil
+	}
+
+	stripe := make([][]byte, len(r.shards))
+	have := 0
+
+	// Data shards are preferred as they need no decoding
+	for shard, reader := range r.shards {
+		if have == r.manifest.dataShards {
+			break
+		}
+		if reader == nil || reader.failed {
+			continue
+		}
+
+		if err := reader.readBlock(r.ctx, r.key, index, r.buffers[shard]); err != nil {
+			if r.ctx.Err() != nil {
+				return r.ctx.Err()
+			}
+			reader.failed = true
+			continue
+		}
+		stripe[shard] = r.buffers[shard]
+		have++
+	}
+
+	if have < r.manifest.dataShards {
+		return fmt.Errorf("%w: %s", errTooFewShards, r.key)
+	}
+
+	for shard := range stripe {
+		if stripe[shard] == nil {
+			stripe[shard] = r.buffers[shard][:0]
+		}
+	}
+
+	var err error
+	if all {
+		err = r.encoder.Reconstruct(stripe)
+	} else {
+		err = r.encoder.ReconstructData(stripe)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.stripe = stripe
+	r.current = index
+	return nil
+}
+
+func (r *erasureReader) Close() error {
+	for _, shard := range r.shards {
+		if shard != nil {
+			shard.close()
+		}
+	}
+	return nil
+}
+
+// Delete removes every shard of the blob
+func (s *ErasureStore) Delete(ctx context.Context, key string) error {
+	return deleteFromVolumes(ctx, s.volumes, key, shardManifestKey(key))
+}
+
+// Move renames the shards on every volume holding one. Shards keep their
+// volumes even if dstKey would be placed elsewhere.
+func (s *ErasureStore) Move(ctx context.Context, srcKey string, dstKey string) error {
+	if _, err := cleanKey(dstKey); err != nil {
+		return err
+	}
+	return moveOnVolumes(ctx, s.volumes, srcKey, dstKey, shardManifestKey(srcKey), shardManifestKey(dstKey))
+}
+
+func (s *ErasureStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	if _, err := cleanKey(key); err != nil {
+		return nil, err
+	}
+
+	sources, _, err := s.loadShards(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range sources {
+		if source == nil {
+			continue
+		}
+		if info, err := s.volumes[source.volume].Stat(ctx, key); err == nil {
+			return &BlobInfo{Key: key, Size: source.manifest.size, ModifiedAt: info.ModifiedAt}, nil
+		}
+	}
+
+	return nil, ErrBlobNotFound
+}
+
+// List merges the shards of all volumes, reading the size of each blob from
+// one of its shard manifests
+func (s *ErasureStore) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	holders, err := listVolumes(ctx, s.volumes, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]*BlobInfo, 0, len(holders))
+	for _, key := range sortedKeys(holders) {
+		holder := holders[key]
+		for _, volume := range holder.volumes {
+			manifest, err := readShardManifest(ctx, s.volumes[volume], key)
+			if err != nil {
+				continue
+			}
+			blobs = append(blobs, &BlobInfo{Key: key, Size: manifest.size, ModifiedAt: holder.modifiedAt})
+			break
+		}
+	}
+
+	return blobs, nil
+}
+
+// Repair verifies every shard of every blob last written before the given
+// time, removes damaged and stale shards and rebuilds missing ones on other
+// volumes. Blobs with fewer intact shards than data shards are reported and
+// left untouched.
+func (s *ErasureStore) Repair(ctx context.Context, before time.Time) (*RepairReport, error) {
+	holders, err := listVolumes(ctx, s.volumes, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{LostKeys: make([]string, 0)}
+	for _, key := range sortedKeys(holders) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if !holders[key].modifiedAt.Before(before) {
+			continue
+		}
+		report.Checked++
+
+		if err := s.repairBlob(ctx, key, report); err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.LostKeys = append(report.LostKeys, key)
+		}
+	}
+
+	return report, nil
+}
+
+func (s *ErasureStore) repairBlob(ctx context.Context, key string, report *RepairReport) error {
+	sources, stale, err := s.loadShards(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	manifest := (*shardManifest)(nil)
+	healthy := 0
+	for index, source := range sources {
+		if source == nil {
+			continue
+		}
+		if err := verifyShard(ctx, s.volumes[source.volume], key, source.manifest); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			stale = append(stale, source.volume)
+			sources[index] = nil
+			continue
+		}
+		manifest = source.manifest
+		healthy++
+	}
+
+	if manifest == nil || healthy < manifest.dataShards {
+		return fmt.Errorf("%w: %s", errTooFewShards, key)
+	}
+
+	for _, volume := range stale {
+		removeFromVolume(ctx, s.volumes[volume], key, shardManifestKey(key))
+	}
+	report.Corrupt += len(stale)
+
+	// Missing shards go to the first free volumes in placement order
+	used := make([]int, 0, len(sources))
+	for _, source := range sources {
+		if source != nil {
+			used = append(used, source.volume)
+		}
+	}
+	targets := make(map[int]int)
+	free := slices.DeleteFunc(s.placement(key), func(volume int) bool { return slices.Contains(used, volume) })
+	for index, source := range sources {
+		if source == nil && len(free) > 0 {
+			targets[index] = free[0]
+			free = free[1:]
+		}
+	}
+
+	rebuilt := 0
+	if len(targets) > 0 {
+		rebuilt, err = s.rebuildShards(ctx, key, sources, targets)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	switch {
+	case healthy+rebuilt < len(sources):
+		report.Degraded++
+	case rebuilt > 0:
+		report.Repaired++
+	case len(stale) == 0:
+		report.Healthy++
+	}
+
+	return nil
+}
+
+// rebuildShards decodes every stripe from the intact shards and writes the
+// missing shards to their target volumes
+func (s *ErasureStore) rebuildShards(ctx context.Context, key string, sources []*shardSource, targets map[int]int) (int, error) {
+	reader, err := s.openReader(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	for index, source := range sources {
+		if source == nil {
+			reader.shards[index] = nil
+		}
+	}
+
+	writer := s.openShards(ctx, key, targets)
+	header := *reader.manifest
+	header.blocks = nil
+
+	var writeErr error
+	for stripe := range reader.manifest.stripes() {
+		if writeErr = reader.loadStripe(stripe, true); writeErr != nil {
+			break
+		}
+		if writer.writeStripe(reader.stripe) == 0 {
+			writeErr = ErrWriteQuorum
+			break
+		}
+	}
+
+	written := writer.finish(writeErr, header)
+	if writeErr != nil {
+		return 0, writeErr
+	}
+
+	rebuilt := 0
+	for _, target := range written {
+		manifest := header
+		manifest.index = target.index
+		manifest.blocks = target.blocks
+		if err := verifyShard(ctx, s.volumes[target.volume], key, &manifest); err != nil {
+			removeFromVolume(ctx, s.volumes[target.volume], key, shardManifestKey(key))
+			continue
+		}
+		rebuilt++
+	}
+
+	return rebuilt, nil
+}
+
+// verifyShard reads a whole shard and checks every block
+func verifyShard(ctx context.Context, volume BlobStore, key string, manifest *shardManifest) error {
+	body, err := volume.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	block := make([]byte, manifest.blockSize)
+	for index := range manifest.blocks {
+		if _, err := io.ReadFull(body, block); err != nil {
+			return fmt.Errorf("%w: %v", errCorruptReplica, err)
+		}
+		if sha256.Sum256(block) != manifest.blocks[index] {
+			return fmt.Errorf("%w: block %d", errCorruptReplica, index)
+		}
+	}
+
+	if n, _ := body.Read(block[:1]); n > 0 {
+		return fmt.Errorf("%w: longer than recorded", errCorruptReplica)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a listing in a stable order
+func sortedKeys(holders map[string]*volumeHolders) []string {
+	keys := make([]string, 0, len(holders))
+	for key := range holders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,170 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+)
+
+const (
+	testDataShards   = 4
+	testParityShards = 2
+)
+
+// newTestErasureStore creates a store with one volume per shard, so that
+// every volume holds a shard of every blob
+func newTestErasureStore(t *testing.T) (*blobstore.ErasureStore, []string) {
+	t.Helper()
+
+	root := t.TempDir()
+	volumes := make([]string, 0, testDataShards+testParityShards)
+	for i := 0; i < testDataShards+testParityShards; i++ {
+		volumes = append(volumes, filepath.Join(root, string(rune('a'+i))))
+	}
+
+	store, err := blobstore.NewErasureStore(volumes, testDataShards, testParityShards)
+	if err != nil {
+		t.Fatalf("creating erasure store: %v", err)
+	}
+	return store, volumes
+}
+
+// testBlob returns content spanning several stripes that ends part way
+// through one
+func testBlob() []byte {
+	random := rand.New(rand.NewSource(1))
+	content := make([]byte, 5<<20+1234)
+	random.Read(content)
+	return content
+}
+
+func putTestBlob(t *testing.T, store *blobstore.ErasureStore, key string, content []byte) {
+	t.Helper()
+
+	size, err := store.Put(context.Background(), key, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("storing blob: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("stored %d bytes, expected %d", size, len(content))
+	}
+}
+
+func readTestBlob(t *testing.T, store *blobstore.ErasureStore, key string, offset int64, length int64) ([]byte, error) {
+	t.Helper()
+
+	reader, err := store.GetRange(context.Background(), key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	store, _ := newTestErasureStore(t)
+	content := testBlob()
+	putTestBlob(t, store, "files/blob.ffs", content)
+
+	reader, err := store.Get(context.Background(), "files/blob.ffs")
+	if err != nil {
+		t.Fatalf("opening blob: %v", err)
+	}
+	defer reader.Close()
+
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Fatalf("read %d bytes that do not match the %d written", len(read), len(content))
+	}
+
+	info, err := store.Stat(context.Background(), "files/blob.ffs")
+	if err != nil {
+		t.Fatalf("stat of blob: %v", err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Fatalf("stat size is %d, expected %d", info.Size, len(content))
+	}
+
+	if _, err := store.Get(context.Background(), "files/missing.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Fatalf("opening a missing blob returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+}
+
+func TestErasureGetRange(t *testing.T) {
+	store, _ := newTestErasureStore(t)
+	content := testBlob()
+	putTestBlob(t, store, "blob.ffs", content)
+
+	size := int64(len(content))
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+		want   []byte
+	}{
+		{"start", 0, 100, content[:100]},
+		{"across a stripe boundary", 1<<20 - 50, 100, content[1<<20-50 : 1<<20+50]},
+		{"to the end", size - 300, -1, content[size-300:]},
+		{"past the end", size - 10, 100, content[size-10:]},
+		{"empty", 1000, 0, []byte{}},
+	}
+
+	for _, test := range tests {
+		read, err := readTestBlob(t, store, "blob.ffs", test.offset, test.length)
+		if err != nil {
+			t.Fatalf("%s: reading range: %v", test.name, err)
+		}
+		if !bytes.Equal(read, test.want) {
+			t.Fatalf("%s: read %d bytes that do not match the %d expected", test.name, len(read), len(test.want))
+		}
+	}
+}
+
+func TestErasureMissingVolumes(t *testing.T) {
+	store, volumes := newTestErasureStore(t)
+	content := testBlob()
+	putTestBlob(t, store, "blob.ffs", content)
+
+	// Losing as many volumes as there are parity shards, whichever shards
+	// they held, still leaves enough to rebuild the blob
+	for _, volume := range volumes[:testParityShards] {
+		if err := os.RemoveAll(volume); err != nil {
+			t.Fatalf("removing volume: %v", err)
+		}
+	}
+
+	read, err := readTestBlob(t, store, "blob.ffs", 0, -1)
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Fatalf("read %d bytes that do not match the %d written", len(read), len(content))
+	}
+
+	read, err = readTestBlob(t, store, "blob.ffs", 3<<20, 4096)
+	if err != nil {
+		t.Fatalf("reading range: %v", err)
+	}
+	if !bytes.Equal(read, content[3<<20:3<<20+4096]) {
+		t.Fatal("read range does not match")
+	}
+
+	// One more is too many
+	if err := os.RemoveAll(volumes[testParityShards]); err != nil {
+		t.Fatalf("removing volume: %v", err)
+	}
+	if _, err := readTestBlob(t, store, "blob.ffs", 0, -1); err == nil {
+		t.Fatal("reading with too few shards succeeded")
+	}
+}
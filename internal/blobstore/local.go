@@ -0,0 +1,221 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempFilePrefix marks blobs that are still being written
+const tempFilePrefix = ".tmp-"
+
+// rangeReadCloser limits reads to a section of a blob while closing the
+// underlying file
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// LocalStore keeps blobs as plain files below a root directory
+type LocalStore struct {
+	root string
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		root = "uploads"
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{root}, nil
+}
+
+// Put streams into a temporary file next to the destination and renames it
+// into place once complete, so readers never observe a partial blob
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	fullPath, err := s.resolve(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return 0, err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(fullPath), tempFilePrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tempFile.Name())
+
+	written, err := io.Copy(tempFile, r)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFile.Name(), 0644)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tempFile.Name(), fullPath); err != nil {
+		return 0, err
+	}
+
+	return written, nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	fullPath, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+
+	return file, err
+}
+
+func (s *LocalStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if length < 0 {
+		return file, nil
+	}
+
+	return &rangeReadCloser{
+		Reader: io.LimitReader(file, length),
+		Closer: file,
+	}, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	fullPath, err := s.resolve(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+
+	return err
+}
+
+func (s *LocalStore) Move(ctx context.Context, srcKey string, dstKey string) error {
+	srcPath, err := s.resolve(srcKey)
+	if err != nil {
+		return err
+	}
+
+	dstPath, err := s.resolve(dstKey)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+
+	err = os.Rename(srcPath, dstPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+
+	return err
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	fullPath, err := s.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobInfo{
+		Key:        key,
+		Size:       info.Size(),
+		ModifiedAt: info.ModTime(),
+	}, nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	blobs := make([]*BlobInfo, 0)
+
+	err := filepath.WalkDir(s.root, func(fullPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(s.root, fullPath)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relativePath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		blobs = append(blobs, &BlobInfo{
+			Key:        key,
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime(),
+		})
+		return nil
+	})
+
+	return blobs, err
+}
+
+// resolve maps a blob key onto a path below the root, refusing keys that
+// would escape it
+func (s *LocalStore) resolve(key string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(cleaned)), nil
+}
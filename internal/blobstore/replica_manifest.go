@@ -0,0 +1,274 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// replicaBlockSize is the unit replicas are verified in. Reads of any range
+// fetch and check whole blocks.
+const replicaBlockSize = 256 << 10
+
+// manifestPrefix holds the manifest of every replica, next to the data
+const manifestPrefix = ".replicas/"
+
+var (
+	manifestMagic = []byte("FFRM")
+
+	errCorruptReplica = errors.New("replica does not match its manifest")
+)
+
+// replicaManifest records the size and block checksums of a replica so that
+// damaged replicas can be detected while reading
+type replicaManifest struct {
+	size   int64
+	blocks [][sha256.Size]byte
+}
+
+func manifestKey(key string) string {
+	return manifestPrefix + key + ".manifest"
+}
+
+// blockHasher builds a manifest from data written in any chunk sizes
+type blockHasher struct {
+	manifest replicaManifest
+	block    []byte
+}
+
+func (h *blockHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	h.manifest.size += int64(written)
+
+	for len(p) > 0 {
+		n := min(replicaBlockSize-len(h.block), len(p))
+		h.block = append(h.block, p[:n]...)
+		p = p[n:]
+
+		if len(h.block) == replicaBlockSize {
+			h.manifest.blocks = append(h.manifest.blocks, sha256.Sum256(h.block))
+			h.block = h.block[:0]
+		}
+	}
+
+	return written, nil
+}
+
+func (h *blockHasher) finish() *replicaManifest {
+	if len(h.block) > 0 {
+		h.manifest.blocks = append(h.manifest.blocks, sha256.Sum256(h.block))
+		h.block = h.block[:0]
+	}
+	return &h.manifest
+}
+
+// marshal encodes the manifest as magic | size (8) | block count (4) | sums
+func (m *replicaManifest) marshal() []byte {
+	buf := make([]byte, 0, 16+len(m.blocks)*sha256.Size)
+	buf = append(buf, manifestMagic...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(m.size))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.blocks)))
+	for _, sum := range m.blocks {
+		buf = append(buf, sum[:]...)
+	}
+	return buf
+}
+
+func unmarshalManifest(data []byte) (*replicaManifest, error) {
+	if len(data) < 16 || !bytes.Equal(data[:4], manifestMagic) {
+		return nil, errCorruptReplica
+	}
+
+	manifest := &replicaManifest{size: int64(binary.BigEndian.Uint64(data[4:]))}
+	count := int64(binary.BigEndian.Uint32(data[12:]))
+	if manifest.size < 0 || count != (manifest.size+replicaBlockSize-1)/replicaBlockSize || int64(len(data)) != 16+count*sha256.Size {
+		return nil, errCorruptReplica
+	}
+
+	manifest.blocks = make([][sha256.Size]byte, count)
+	for i := range manifest.blocks {
+		copy(manifest.blocks[i][:], data[16+i*sha256.Size:])
+	}
+
+	return manifest, nil
+}
+
+func (m *replicaManifest) blockLength(index int64) int64 {
+	return min(replicaBlockSize, m.size-index*replicaBlockSize)
+}
+
+// readManifest loads the manifest of the replica of key on a volume
+func readManifest(ctx context.Context, volume BlobStore, key string) (*replicaManifest, error) {
+	body, err := volume.Get(ctx, manifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, 16+(1<<20)*sha256.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalManifest(data)
+}
+
+// verifyReplica reads a whole replica and checks every block
+func verifyReplica(ctx context.Context, volume BlobStore, key string) (*replicaManifest, error) {
+	manifest, err := readManifest(ctx, volume, key)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := volume.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	block := make([]byte, replicaBlockSize)
+	for index := range manifest.blocks {
+		data := block[:manifest.blockLength(int64(index))]
+		if _, err := io.ReadFull(body, data); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptReplica, err)
+		}
+		if sha256.Sum256(data) != manifest.blocks[index] {
+			return nil, fmt.Errorf("%w: block %d", errCorruptReplica, index)
+		}
+	}
+
+	// Trailing data means the replica was changed after it was written
+	if n, _ := body.Read(block[:1]); n > 0 {
+		return nil, fmt.Errorf("%w: longer than recorded", errCorruptReplica)
+	}
+
+	return manifest, nil
+}
+
+// replicaReader reads a range of a blob block by block, verifying each block
+// and failing over to the next replica when one is missing, unreadable or
+// damaged
+type replicaReader struct {
+	ctx        context.Context
+	key        string
+	candidates []BlobStore
+	volume     BlobStore
+	manifest   *replicaManifest
+	body       io.ReadCloser
+	bodyBlock  int64
+	position   int64
+	end        int64
+	block      []byte
+	pending    []byte
+}
+
+func (r *replicaReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.position >= r.end {
+			return 0, io.EOF
+		}
+		if err := r.loadBlock(r.position / replicaBlockSize); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.position += int64(n)
+	return n, nil
+}
+
+// loadBlock fills pending with the part of a block that is still to be read
+func (r *replicaReader) loadBlock(index int64) error {
+	for {
+		if r.volume != nil {
+			data, err := r.readBlock(index)
+			if err == nil {
+				skip := r.position - index*replicaBlockSize
+				keep := min(int64(len(data)), r.end-index*replicaBlockSize)
+				r.pending = data[skip:keep]
+				return nil
+			}
+			if r.ctx.Err() != nil {
+				return r.ctx.Err()
+			}
+		}
+
+		if err := r.nextReplica(); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *replicaReader) readBlock(index int64) ([]byte, error) {
+	if r.body == nil || r.bodyBlock != index {
+		r.closeBody()
+
+		body, err := r.volume.GetRange(r.ctx, r.key, index*replicaBlockSize, -1)
+		if err != nil {
+			return nil, err
+		}
+		r.body = body
+		r.bodyBlock = index
+	}
+
+	data := r.block[:r.manifest.blockLength(index)]
+	if _, err := io.ReadFull(r.body, data); err != nil {
+		r.closeBody()
+		return nil, err
+	}
+	r.bodyBlock++
+
+	if sha256.Sum256(data) != r.manifest.blocks[index] {
+		r.closeBody()
+		return nil, errCorruptReplica
+	}
+
+	return data, nil
+}
+
+// nextReplica switches to the next replica. Once reading has started only
+// replicas with an identical manifest are used, so that a stale copy is never
+// stitched into the content of a newer one.
+func (r *replicaReader) nextReplica() error {
+	r.closeBody()
+
+	for len(r.candidates) > 0 {
+		volume := r.candidates[0]
+		r.candidates = r.candidates[1:]
+
+		manifest, err := readManifest(r.ctx, volume, r.key)
+		if err != nil {
+			continue
+		}
+		if r.manifest != nil && !bytes.Equal(manifest.marshal(), r.manifest.marshal()) {
+			continue
+		}
+
+		r.volume = volume
+		r.manifest = manifest
+		return nil
+	}
+
+	r.volume = nil
+	if r.manifest == nil {
+		return ErrBlobNotFound
+	}
+	return fmt.Errorf("no healthy replica of %s: %w", r.key, errCorruptReplica)
+}
+
+func (r *replicaReader) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+func (r *replicaReader) Close() error {
+	r.closeBody()
+	return nil
+}
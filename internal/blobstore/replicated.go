@@ -0,0 +1,405 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+var ErrWriteQuorum = errors.New("blob was not written to enough volumes")
+
+// ReplicatedStore keeps every blob on several local volumes, e.g. directories
+// on separate disks. Each blob is placed on the first Replicas volumes of an
+// order derived from its key, and a write succeeds once WriteQuorum of them
+// have the blob. Every replica has a manifest of block checksums, so reads
+// notice a damaged or missing replica and continue from another one.
+type ReplicatedStore struct {
+	volumes     []BlobStore
+	names       []string
+	replicas    int
+	writeQuorum int
+}
+
+// RepairReport summarises one pass of ReplicatedStore.Repair
+type RepairReport struct {
+	// Checked is the number of blobs looked at
+	Checked int `json:"checked"`
+	// Healthy blobs already had enough intact replicas
+	Healthy int `json:"healthy"`
+	// Repaired blobs had replicas copied or shards rebuilt to bring them back
+	// to the target
+	Repaired int `json:"repaired"`
+	// Corrupt is the number of damaged or stale replicas and shards that
+	// were removed
+	Corrupt int `json:"corrupt"`
+	// Degraded blobs still have fewer replicas or shards than configured
+	Degraded int `json:"degraded"`
+	// LostKeys are blobs without enough intact replicas or shards to recover
+	LostKeys []string `json:"lost_keys"`
+}
+
+// add merges the report of another store into r
+func (r *RepairReport) add(other *RepairReport) {
+	r.Checked += other.Checked
+	r.Healthy += other.Healthy
+	r.Repaired += other.Repaired
+	r.Corrupt += other.Corrupt
+	r.Degraded += other.Degraded
+	r.LostKeys = append(r.LostKeys, other.LostKeys...)
+}
+
+// NewReplicatedStore opens a local store on each volume directory. A write
+// quorum of 0 means a majority of the replicas.
+func NewReplicatedStore(volumes []string, replicas int, writeQuorum int) (*ReplicatedStore, error) {
+	if len(volumes) == 0 {
+		return nil, errors.New("replicated storage needs at least one volume")
+	}
+	if replicas < 1 || replicas > len(volumes) {
+		return nil, fmt.Errorf("replica count must be between 1 and the number of volumes (%d)", len(volumes))
+	}
+	if writeQuorum == 0 {
+		writeQuorum = replicas/2 + 1
+	}
+	if writeQuorum < 1 || writeQuorum > replicas {
+		return nil, fmt.Errorf("write quorum must be between 1 and the replica count (%d)", replicas)
+	}
+
+	store := &ReplicatedStore{replicas: replicas, writeQuorum: writeQuorum}
+	seen := make(map[string]bool, len(volumes))
+
+	for _, volume := range volumes {
+		name := filepath.Clean(volume)
+		if seen[name] {
+			return nil, fmt.Errorf("volume %s is listed more than once", volume)
+		}
+		seen[name] = true
+
+		local, err := NewLocalStore(name)
+		if err != nil {
+			return nil, fmt.Errorf("opening volume %s: %w", volume, err)
+		}
+
+		store.volumes = append(store.volumes, local)
+		store.names = append(store.names, name)
+	}
+
+	return store, nil
+}
+
+// placement orders the volumes for a key by rendezvous hashing. The first
+// Replicas volumes hold the blob.
+func (s *ReplicatedStore) placement(key string) []int {
+	return rendezvous(s.names, key)
+}
+
+// replicaTarget is one volume a Put is streaming to
+type replicaTarget struct {
+	volume int
+	writer *io.PipeWriter
+	result chan error
+	err    error
+}
+
+// fanOutWriter copies every write to all targets that are still healthy and
+// gives up once fewer than quorum remain
+type fanOutWriter struct {
+	targets []*replicaTarget
+	hasher  *blockHasher
+	quorum  int
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	f.hasher.Write(p)
+
+	healthy := 0
+	for _, target := range f.targets {
+		if target.err != nil {
+			continue
+		}
+		if _, err := target.writer.Write(p); err != nil {
+			target.err = err
+			continue
+		}
+		healthy++
+	}
+
+	if healthy < f.quorum {
+		return 0, ErrWriteQuorum
+	}
+	return len(p), nil
+}
+
+// Put streams the blob to its replica volumes at once, then stores the
+// manifest next to each copy. Copies on any other volume are removed, as
+// they hold older content.
+func (s *ReplicatedStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if _, err := cleanKey(key); err != nil {
+		return 0, err
+	}
+
+	fanOut := &fanOutWriter{hasher: &blockHasher{}, quorum: s.writeQuorum}
+	for _, volume := range s.placement(key)[:s.replicas] {
+		pipeReader, pipeWriter := io.Pipe()
+		target := &replicaTarget{volume: volume, writer: pipeWriter, result: make(chan error, 1)}
+
+		go func(store BlobStore) {
+			_, err := store.Put(ctx, key, pipeReader)
+			// Unblock the fan out if the volume gave up before the end
+			pipeReader.CloseWithError(err)
+			target.result <- err
+		}(s.volumes[volume])
+
+		fanOut.targets = append(fanOut.targets, target)
+	}
+
+	_, copyErr := io.Copy(fanOut, r)
+	for _, target := range fanOut.targets {
+		target.writer.CloseWithError(copyErr)
+	}
+
+	manifest := fanOut.hasher.finish().marshal()
+	written := make([]int, 0, len(fanOut.targets))
+
+	for _, target := range fanOut.targets {
+		err := <-target.result
+		if copyErr != nil {
+			if err == nil {
+				removeFromVolume(ctx, s.volumes[target.volume], key, manifestKey(key))
+			}
+			continue
+		}
+		if err == nil {
+			_, err = s.volumes[target.volume].Put(ctx, manifestKey(key), bytes.NewReader(manifest))
+		}
+		if err != nil {
+			removeFromVolume(ctx, s.volumes[target.volume], key, manifestKey(key))
+			continue
+		}
+		written = append(written, target.volume)
+	}
+
+	if copyErr != nil {
+		return 0, copyErr
+	}
+	if len(written) < s.writeQuorum {
+		for _, volume := range written {
+			removeFromVolume(ctx, s.volumes[volume], key, manifestKey(key))
+		}
+		return 0, fmt.Errorf("%w: %d of %d", ErrWriteQuorum, len(written), s.writeQuorum)
+	}
+
+	for volume := range s.volumes {
+		if !slices.Contains(written, volume) {
+			removeFromVolume(ctx, s.volumes[volume], key, manifestKey(key))
+		}
+	}
+
+	return fanOut.hasher.manifest.size, nil
+}
+
+func (s *ReplicatedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRange(ctx, key, 0, -1)
+}
+
+// GetRange reads from the first volume in placement order with an intact
+// replica, moving on to the next one whenever a block fails to verify
+func (s *ReplicatedStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if _, err := cleanKey(key); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset %d", offset)
+	}
+
+	reader := &replicaReader{
+		ctx:        ctx,
+		key:        key,
+		candidates: s.ordered(key),
+		position:   offset,
+		block:      make([]byte, replicaBlockSize),
+	}
+	if err := reader.nextReplica(); err != nil {
+		return nil, err
+	}
+
+	reader.end = reader.manifest.size
+	if length >= 0 {
+		reader.end = min(reader.end, offset+length)
+	}
+
+	return reader, nil
+}
+
+// Delete removes the blob from every volume
+func (s *ReplicatedStore) Delete(ctx context.Context, key string) error {
+	return deleteFromVolumes(ctx, s.volumes, key, manifestKey(key))
+}
+
+// Move renames the blob on every volume holding it and removes stale copies
+// of dstKey from the others. The replicas keep their volumes even if dstKey
+// would be placed elsewhere; Repair adds copies where they are missing.
+func (s *ReplicatedStore) Move(ctx context.Context, srcKey string, dstKey string) error {
+	if _, err := cleanKey(dstKey); err != nil {
+		return err
+	}
+	return moveOnVolumes(ctx, s.volumes, srcKey, dstKey, manifestKey(srcKey), manifestKey(dstKey))
+}
+
+// Stat describes the first replica whose size matches its manifest
+func (s *ReplicatedStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	if _, err := cleanKey(key); err != nil {
+		return nil, err
+	}
+
+	for _, volume := range s.ordered(key) {
+		manifest, err := readManifest(ctx, volume, key)
+		if err != nil {
+			continue
+		}
+
+		info, err := volume.Stat(ctx, key)
+		if err != nil || info.Size != manifest.size {
+			continue
+		}
+		return info, nil
+	}
+
+	return nil, ErrBlobNotFound
+}
+
+// List merges the blobs of all volumes. Volumes that cannot be listed are
+// skipped as long as at least one can.
+func (s *ReplicatedStore) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	holders, err := listVolumes(ctx, s.volumes, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]*BlobInfo, 0, len(holders))
+	for _, key := range sortedKeys(holders) {
+		blobs = append(blobs, &BlobInfo{Key: key, Size: holders[key].size, ModifiedAt: holders[key].modifiedAt})
+	}
+	return blobs, nil
+}
+
+// Repair verifies every replica of every blob last written before the given
+// time, removes damaged replicas and copies intact ones until each blob is
+// back on Replicas volumes. Blobs without any intact replica are reported and
+// left untouched.
+func (s *ReplicatedStore) Repair(ctx context.Context, before time.Time) (*RepairReport, error) {
+	holders, err := listVolumes(ctx, s.volumes, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{LostKeys: make([]string, 0)}
+	for _, key := range sortedKeys(holders) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if !holders[key].modifiedAt.Before(before) {
+			continue
+		}
+		report.Checked++
+
+		healthy := make([]int, 0, len(holders[key].volumes))
+		corrupt := make([]int, 0)
+		for _, volume := range holders[key].volumes {
+			if _, err := verifyReplica(ctx, s.volumes[volume], key); err != nil {
+				if ctx.Err() != nil {
+					return report, ctx.Err()
+				}
+				corrupt = append(corrupt, volume)
+				continue
+			}
+			healthy = append(healthy, volume)
+		}
+
+		if len(healthy) == 0 {
+			report.LostKeys = append(report.LostKeys, key)
+			continue
+		}
+
+		for _, volume := range corrupt {
+			removeFromVolume(ctx, s.volumes[volume], key, manifestKey(key))
+		}
+		report.Corrupt += len(corrupt)
+
+		copied := 0
+		for _, volume := range s.placement(key) {
+			if len(healthy) >= s.replicas {
+				break
+			}
+			if slices.Contains(healthy, volume) {
+				continue
+			}
+			if err := s.copyReplica(ctx, healthy[0], volume, key); err != nil {
+				continue
+			}
+			healthy = append(healthy, volume)
+			copied++
+		}
+
+		switch {
+		case len(healthy) < s.replicas:
+			report.Degraded++
+		case copied > 0:
+			report.Repaired++
+		case len(corrupt) == 0:
+			report.Healthy++
+		}
+	}
+
+	return report, nil
+}
+
+// copyReplica copies the blob and its manifest between volumes and checks
+// the new replica before keeping it
+func (s *ReplicatedStore) copyReplica(ctx context.Context, from int, to int, key string) error {
+	source := s.volumes[from]
+	destination := s.volumes[to]
+
+	manifest, err := source.Get(ctx, manifestKey(key))
+	if err != nil {
+		return err
+	}
+	manifestData, err := io.ReadAll(manifest)
+	manifest.Close()
+	if err != nil {
+		return err
+	}
+
+	body, err := source.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = destination.Put(ctx, key, body)
+	body.Close()
+	if err == nil {
+		_, err = destination.Put(ctx, manifestKey(key), bytes.NewReader(manifestData))
+	}
+	if err == nil {
+		_, err = verifyReplica(ctx, destination, key)
+	}
+	if err != nil {
+		removeFromVolume(ctx, s.volumes[to], key, manifestKey(key))
+		return err
+	}
+
+	return nil
+}
+
+// ordered returns the volumes in placement order, replicas first
+func (s *ReplicatedStore) ordered(key string) []BlobStore {
+	placement := s.placement(key)
+	volumes := make([]BlobStore, len(placement))
+	for i, volume := range placement {
+		volumes[i] = s.volumes[volume]
+	}
+	return volumes
+}
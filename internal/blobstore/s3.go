@@ -0,0 +1,250 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize bounds the memory used per upload, since blob sizes are not
+// known up front and the client would otherwise buffer very large parts
+const s3PartSize = 16 << 20
+
+// s3MaxCopySize is the largest object S3 copies in a single request
+const s3MaxCopySize = 5 << 30
+
+// S3Store keeps blobs in a bucket on any S3 compatible service (AWS, MinIO, ...)
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Store(ctx context.Context, cfg config.StorageConfig) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("a storage bucket is required for the s3 driver")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+		BucketLookup: func() minio.BucketLookupType {
+			if cfg.PathStyle {
+				return minio.BucketLookupPath
+			}
+			return minio.BucketLookupAuto
+		}(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check storage bucket: %w", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create storage bucket: %w", err)
+		}
+	}
+
+	return &S3Store{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: strings.Trim(cfg.Prefix, "/"),
+	}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Payloads are streamed, so skip the aws-chunked payload signing which not
+	// every S3 compatible server understands
+	info, err := s.client.PutObject(ctx, s.bucket, objectName, r, -1, minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		PartSize:             s3PartSize,
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, so stat first to surface missing objects up front
+	if _, err := s.client.StatObject(ctx, s.bucket, objectName, minio.StatObjectOptions{}); err != nil {
+		return nil, s.translateError(err)
+	}
+
+	object, err := s.client.GetObject(ctx, s.bucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+
+	return object, nil
+}
+
+func (s *S3Store) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	options := minio.GetObjectOptions{}
+	switch {
+	case length > 0:
+		err = options.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = options.SetRange(offset, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The lazy Client.GetObject drops the range when it is asked for a stat
+	// first, Core sends the ranged request straight away so that missing
+	// objects surface here rather than on the first read
+	object, _, _, err := minio.Core{Client: s.client}.GetObject(ctx, s.bucket, objectName, options)
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+
+	return object, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+
+	// RemoveObject succeeds for missing objects, keep the local driver semantics
+	if _, err := s.client.StatObject(ctx, s.bucket, objectName, minio.StatObjectOptions{}); err != nil {
+		return s.translateError(err)
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, objectName, minio.RemoveObjectOptions{})
+}
+
+// Move copies the object server side and removes the source, S3 has no rename
+func (s *S3Store) Move(ctx context.Context, srcKey string, dstKey string) error {
+	srcName, err := s.objectName(srcKey)
+	if err != nil {
+		return err
+	}
+
+	dstName, err := s.objectName(dstKey)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, srcName, minio.StatObjectOptions{})
+	if err != nil {
+		return s.translateError(err)
+	}
+
+	// A single copy request is limited to 5GiB, ComposeObject copies larger
+	// objects in parts
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: dstName}
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: srcName}
+	if info.Size <= s3MaxCopySize {
+		_, err = s.client.CopyObject(ctx, dst, src)
+	} else {
+		_, err = s.client.ComposeObject(ctx, dst, src)
+	}
+	if err != nil {
+		return s.translateError(err)
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, srcName, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	objectName, err := s.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.translateError(err)
+	}
+
+	return &BlobInfo{
+		Key:        key,
+		Size:       info.Size,
+		ModifiedAt: info.LastModified,
+	}, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	blobs := make([]*BlobInfo, 0)
+
+	objectPrefix := prefix
+	if s.prefix != "" {
+		objectPrefix = s.prefix + "/" + prefix
+	}
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    objectPrefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		key := object.Key
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+
+		blobs = append(blobs, &BlobInfo{
+			Key:        key,
+			Size:       object.Size,
+			ModifiedAt: object.LastModified,
+		})
+	}
+
+	return blobs, nil
+}
+
+func (s *S3Store) objectName(key string) (string, error) {
+	cleanKey, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if s.prefix != "" {
+		return s.prefix + "/" + cleanKey, nil
+	}
+	return cleanKey, nil
+}
+
+func (s *S3Store) translateError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrBlobNotFound
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/config"
+)
+
+// newTestS3Store creates a store on an in memory S3 server, under a prefix
+// so that object names are mapped as they would be in a shared bucket
+func newTestS3Store(t *testing.T) *blobstore.S3Store {
+	t.Helper()
+
+	server := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	t.Cleanup(server.Close)
+
+	store, err := blobstore.NewS3Store(context.Background(), config.StorageConfig{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "fileflow",
+		Prefix:    "blobs",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("creating s3 store: %v", err)
+	}
+	return store
+}
+
+func readS3Blob(t *testing.T, reader io.ReadCloser, err error) []byte {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("opening blob: %v", err)
+	}
+	defer reader.Close()
+
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	return read
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	store := newTestS3Store(t)
+	ctx := context.Background()
+	content := testBlob()
+
+	size, err := store.Put(ctx, "files/blob.ffs", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("storing blob: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("stored %d bytes, expected %d", size, len(content))
+	}
+
+	reader, err := store.Get(ctx, "files/blob.ffs")
+	if read := readS3Blob(t, reader, err); !bytes.Equal(read, content) {
+		t.Fatalf("read %d bytes that do not match the %d written", len(read), len(content))
+	}
+
+	info, err := store.Stat(ctx, "files/blob.ffs")
+	if err != nil {
+		t.Fatalf("stat of blob: %v", err)
+	}
+	if info.Key != "files/blob.ffs" || info.Size != int64(len(content)) {
+		t.Fatalf("stat returned %s of %d bytes, expected files/blob.ffs of %d", info.Key, info.Size, len(content))
+	}
+
+	blobs, err := store.List(ctx, "files/")
+	if err != nil {
+		t.Fatalf("listing blobs: %v", err)
+	}
+	if len(blobs) != 1 || blobs[0].Key != "files/blob.ffs" {
+		t.Fatalf("listed %d blobs, expected files/blob.ffs only", len(blobs))
+	}
+}
+
+func TestS3GetRange(t *testing.T) {
+	store := newTestS3Store(t)
+	ctx := context.Background()
+	content := testBlob()
+
+	if _, err := store.Put(ctx, "blob.ffs", bytes.NewReader(content)); err != nil {
+		t.Fatalf("storing blob: %v", err)
+	}
+
+	size := int64(len(content))
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+		want   []byte
+	}{
+		{"start", 0, 100, content[:100]},
+		{"middle", 1<<20 - 50, 100, content[1<<20-50 : 1<<20+50]},
+		{"to the end", size - 300, -1, content[size-300:]},
+		{"whole blob", 0, -1, content},
+		{"empty", 1000, 0, []byte{}},
+	}
+
+	for _, test := range tests {
+		reader, err := store.GetRange(ctx, "blob.ffs", test.offset, test.length)
+		if read := readS3Blob(t, reader, err); !bytes.Equal(read, test.want) {
+			t.Fatalf("%s: read %d bytes that do not match the %d expected", test.name, len(read), len(test.want))
+		}
+	}
+}
+
+func TestS3DeleteAndMove(t *testing.T) {
+	store := newTestS3Store(t)
+	ctx := context.Background()
+	content := []byte("moved content")
+
+	if _, err := store.Put(ctx, "uploads/tmp.ffs", bytes.NewReader(content)); err != nil {
+		t.Fatalf("storing blob: %v", err)
+	}
+
+	if err := store.Move(ctx, "uploads/tmp.ffs", "files/blob.ffs"); err != nil {
+		t.Fatalf("moving blob: %v", err)
+	}
+	reader, err := store.Get(ctx, "files/blob.ffs")
+	if read := readS3Blob(t, reader, err); !bytes.Equal(read, content) {
+		t.Fatalf("moved blob holds %q, expected %q", read, content)
+	}
+	if _, err := store.Stat(ctx, "uploads/tmp.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Fatalf("stat of the moved source returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+
+	if err := store.Delete(ctx, "files/blob.ffs"); err != nil {
+		t.Fatalf("deleting blob: %v", err)
+	}
+	if _, err := store.Stat(ctx, "files/blob.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Fatalf("stat of a deleted blob returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+}
+
+func TestS3MissingBlob(t *testing.T) {
+	store := newTestS3Store(t)
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "files/missing.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Errorf("get returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+	if _, err := store.GetRange(ctx, "files/missing.ffs", 10, 100); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Errorf("get range returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+	if _, err := store.Stat(ctx, "files/missing.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Errorf("stat returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+	if err := store.Delete(ctx, "files/missing.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Errorf("delete returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+	if err := store.Move(ctx, "files/missing.ffs", "files/other.ffs"); !errors.Is(err, blobstore.ErrBlobNotFound) {
+		t.Errorf("move returned %v, expected %v", err, blobstore.ErrBlobNotFound)
+	}
+}
@@ -0,0 +1,120 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// ColdKeyPrefix marks the keys of blobs kept in cold storage
+const ColdKeyPrefix = "cold/"
+
+// ColdKey returns the key a hot blob is kept under once moved to cold storage
+func ColdKey(key string) string {
+	return ColdKeyPrefix + key
+}
+
+// HotKey returns the key a cold blob is kept under once restored
+func HotKey(key string) string {
+	return strings.TrimPrefix(key, ColdKeyPrefix)
+}
+
+// TieredStore keeps blobs whose key starts with ColdKeyPrefix in a cheaper
+// cold store and all others in the hot store. Cold blobs can be read like any
+// other, only more slowly.
+type TieredStore struct {
+	hot  BlobStore
+	cold BlobStore
+}
+
+func NewTieredStore(hot BlobStore, cold BlobStore) *TieredStore {
+	return &TieredStore{hot: hot, cold: cold}
+}
+
+func (s *TieredStore) route(key string) BlobStore {
+	if strings.HasPrefix(key, ColdKeyPrefix) {
+		return s.cold
+	}
+	return s.hot
+}
+
+func (s *TieredStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	return s.route(key).Put(ctx, key, r)
+}
+
+func (s *TieredStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.route(key).Get(ctx, key)
+}
+
+func (s *TieredStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.route(key).GetRange(ctx, key, offset, length)
+}
+
+func (s *TieredStore) Delete(ctx context.Context, key string) error {
+	return s.route(key).Delete(ctx, key)
+}
+
+// Move renames within a tier, or copies the blob over between tiers
+func (s *TieredStore) Move(ctx context.Context, srcKey string, dstKey string) error {
+	source, destination := s.route(srcKey), s.route(dstKey)
+	if source == destination {
+		return source.Move(ctx, srcKey, dstKey)
+	}
+
+	if _, err := Copy(ctx, s, srcKey, dstKey); err != nil {
+		return err
+	}
+	return source.Delete(ctx, srcKey)
+}
+
+func (s *TieredStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	return s.route(key).Stat(ctx, key)
+}
+
+func (s *TieredStore) List(ctx context.Context, prefix string) ([]*BlobInfo, error) {
+	hot, err := s.hot.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	cold, err := s.cold.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(hot, cold...), nil
+}
+
+// Repair restores the redundancy of both tiers where they support it
+func (s *TieredStore) Repair(ctx context.Context, before time.Time) (*RepairReport, error) {
+	report := &RepairReport{LostKeys: make([]string, 0)}
+
+	for _, tier := range []BlobStore{s.hot, s.cold} {
+		repairer, ok := tier.(Repairer)
+		if !ok {
+			continue
+		}
+
+		tierReport, err := repairer.Repair(ctx, before)
+		if tierReport != nil {
+			report.add(tierReport)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// Copy copies a blob to another key of the same store
+func Copy(ctx context.Context, store BlobStore, srcKey string, dstKey string) (int64, error) {
+	body, err := store.Get(ctx, srcKey)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	return store.Put(ctx, dstKey, body)
+}
@@ -0,0 +1,166 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Helpers shared by the stores that spread blobs over several local volumes.
+// Every copy of a blob on a volume has a sidecar manifest stored under a key
+// starting with a dot, which is never listed as a blob.
+
+// isInternalKey reports whether a key holds bookkeeping rather than a blob
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, ".")
+}
+
+// rendezvous orders volumes for a key by highest random weight, so that
+// adding a volume only moves the keys that now rank it first
+func rendezvous(names []string, key string) []int {
+	scores := make([][sha256.Size]byte, len(names))
+	order := make([]int, len(names))
+	for i, name := range names {
+		scores[i] = sha256.Sum256([]byte(name + "/" + key))
+		order[i] = i
+	}
+
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(scores[order[a]][:], scores[order[b]][:]) > 0
+	})
+	return order
+}
+
+// removeFromVolume deletes a copy and its manifest from one volume, ignoring
+// a copy that is not there
+func removeFromVolume(ctx context.Context, volume BlobStore, key string, sidecar string) {
+	volume.Delete(ctx, key)
+	volume.Delete(ctx, sidecar)
+}
+
+// deleteFromVolumes removes a blob from every volume, returning
+// ErrBlobNotFound if no volume had it
+func deleteFromVolumes(ctx context.Context, volumes []BlobStore, key string, sidecar string) error {
+	found := false
+	var firstErr error
+
+	for _, volume := range volumes {
+		err := volume.Delete(ctx, key)
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, ErrBlobNotFound) && firstErr == nil {
+			firstErr = err
+		}
+
+		if err := volume.Delete(ctx, sidecar); err != nil && !errors.Is(err, ErrBlobNotFound) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if !found {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+// moveOnVolumes renames the copies of a blob on every volume holding one and
+// removes stale copies of dstKey from the others. It succeeds if at least
+// one copy was moved.
+func moveOnVolumes(ctx context.Context, volumes []BlobStore, srcKey string, dstKey string, srcSidecar string, dstSidecar string) error {
+	holders := make([]int, 0, len(volumes))
+	for i, volume := range volumes {
+		if _, err := volume.Stat(ctx, srcKey); err == nil {
+			holders = append(holders, i)
+		}
+	}
+	if len(holders) == 0 {
+		return ErrBlobNotFound
+	}
+
+	moved := 0
+	var firstErr error
+
+	for i, volume := range volumes {
+		if !slices.Contains(holders, i) {
+			removeFromVolume(ctx, volume, dstKey, dstSidecar)
+			continue
+		}
+
+		err := volume.Move(ctx, srcKey, dstKey)
+		if err == nil {
+			err = volume.Move(ctx, srcSidecar, dstSidecar)
+		}
+		if err != nil {
+			removeFromVolume(ctx, volume, dstKey, dstSidecar)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		moved++
+	}
+
+	if moved == 0 {
+		return firstErr
+	}
+	return nil
+}
+
+// volumeHolders records which volumes have a copy of a key
+type volumeHolders struct {
+	volumes    []int
+	size       int64
+	modifiedAt time.Time
+}
+
+// listVolumes collects the blobs of all volumes with the volumes holding
+// each. With tolerant set, volumes that cannot be listed are skipped as long
+// as at least one can.
+func listVolumes(ctx context.Context, volumes []BlobStore, prefix string, tolerant bool) (map[string]*volumeHolders, error) {
+	holders := make(map[string]*volumeHolders)
+	listed := 0
+	var firstErr error
+
+	for i, volume := range volumes {
+		infos, err := volume.List(ctx, prefix)
+		if err != nil {
+			if !tolerant {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		listed++
+
+		for _, info := range infos {
+			if isInternalKey(info.Key) {
+				continue
+			}
+
+			holder, ok := holders[info.Key]
+			if !ok {
+				holder = &volumeHolders{size: info.Size}
+				holders[info.Key] = holder
+			}
+			holder.volumes = append(holder.volumes, i)
+			if info.ModifiedAt.After(holder.modifiedAt) {
+				holder.modifiedAt = info.ModifiedAt
+			}
+		}
+	}
+
+	if listed == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return holders, nil
+}
@@ -0,0 +1,343 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of the supported codecs
+const (
+	CodecNone    = "none"
+	CodecDeflate = "deflate"
+	CodecGzip    = "gzip"
+	CodecZstd    = "zstd"
+	CodecSnappy  = "snappy"
+)
+
+// DefaultLevel asks a codec to use its own default compression level
+const DefaultLevel = 0
+
+// Compressor compresses a single frame. Implementations are reused for every
+// frame of a file but are not safe for concurrent use.
+type Compressor interface {
+	Compress(dst []byte, src []byte) ([]byte, error)
+}
+
+// Decompressor reverses a Compressor. dst must have the length of the
+// uncompressed frame.
+type Decompressor interface {
+	Decompress(dst []byte, src []byte) error
+}
+
+// Codec is a compression algorithm that can be used for the frames of a file
+type Codec interface {
+	Name() string
+	ID() byte
+	// ValidateLevel reports whether the level can be used with the codec
+	ValidateLevel(level int) error
+	NewCompressor(level int) (Compressor, error)
+	NewDecompressor() (Decompressor, error)
+}
+
+var (
+	codecsByName = map[string]Codec{}
+	codecsByID   = map[byte]Codec{}
+)
+
+func init() {
+	for _, codec := range []Codec{noneCodec{}, deflateCodec{}, gzipCodec{}, zstdCodec{}, snappyCodec{}} {
+		codecsByName[codec.Name()] = codec
+		codecsByID[codec.ID()] = codec
+	}
+}
+
+// Lookup returns the codec registered under the given name
+func Lookup(name string) (Codec, error) {
+	codec, ok := codecsByName[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec: %s", name)
+	}
+	return codec, nil
+}
+
+// CodecNames lists the names of all registered codecs
+func CodecNames() []string {
+	names := make([]string, 0, len(codecsByName))
+	for name := range codecsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupID(id byte) (Codec, error) {
+	codec, ok := codecsByID[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidContainer, id)
+	}
+	return codec, nil
+}
+
+// none stores frames as they are, for content that does not compress
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string                  { return CodecNone }
+func (noneCodec) ID() byte                      { return 0 }
+func (noneCodec) ValidateLevel(level int) error { return nil }
+
+func (noneCodec) NewCompressor(level int) (Compressor, error) {
+	return noneCompressor{}, nil
+}
+
+func (noneCodec) NewDecompressor() (Decompressor, error) {
+	return noneCompressor{}, nil
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	return append(dst[:0], src...), nil
+}
+
+func (noneCompressor) Decompress(dst []byte, src []byte) error {
+	if len(src) != len(dst) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(dst, src)
+	return nil
+}
+
+// deflate is raw deflate, the format all files were stored in originally
+
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string { return CodecDeflate }
+func (deflateCodec) ID() byte     { return 1 }
+
+func (deflateCodec) ValidateLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("deflate level must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+	return nil
+}
+
+func (deflateCodec) NewCompressor(level int) (Compressor, error) {
+	if level == DefaultLevel {
+		level = flate.DefaultCompression
+	}
+
+	writer, err := flate.NewWriter(io.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	return &deflateCompressor{writer: writer}, nil
+}
+
+func (deflateCodec) NewDecompressor() (Decompressor, error) {
+	return &deflateDecompressor{}, nil
+}
+
+type deflateCompressor struct {
+	writer *flate.Writer
+	buffer bytes.Buffer
+}
+
+func (c *deflateCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	c.buffer.Reset()
+	c.writer.Reset(&c.buffer)
+
+	if _, err := c.writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return append(dst[:0], c.buffer.Bytes()...), nil
+}
+
+type deflateDecompressor struct {
+	reader io.ReadCloser
+}
+
+func (d *deflateDecompressor) Decompress(dst []byte, src []byte) error {
+	if d.reader == nil {
+		d.reader = flate.NewReader(bytes.NewReader(src))
+	} else if err := d.reader.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return err
+	}
+
+	_, err := io.ReadFull(d.reader, dst)
+	return err
+}
+
+// gzip adds a header and checksum to every deflate frame
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CodecGzip }
+func (gzipCodec) ID() byte     { return 2 }
+
+func (gzipCodec) ValidateLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("gzip level must be between %d and %d", gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+func (gzipCodec) NewCompressor(level int) (Compressor, error) {
+	if level == DefaultLevel {
+		level = gzip.DefaultCompression
+	}
+
+	writer, err := gzip.NewWriterLevel(io.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipCompressor{writer: writer}, nil
+}
+
+func (gzipCodec) NewDecompressor() (Decompressor, error) {
+	return &gzipDecompressor{}, nil
+}
+
+type gzipCompressor struct {
+	writer *gzip.Writer
+	buffer bytes.Buffer
+}
+
+func (c *gzipCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	c.buffer.Reset()
+	c.writer.Reset(&c.buffer)
+
+	if _, err := c.writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return append(dst[:0], c.buffer.Bytes()...), nil
+}
+
+type gzipDecompressor struct {
+	reader *gzip.Reader
+}
+
+func (d *gzipDecompressor) Decompress(dst []byte, src []byte) error {
+	if d.reader == nil {
+		reader, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return err
+		}
+		d.reader = reader
+	} else if err := d.reader.Reset(bytes.NewReader(src)); err != nil {
+		return err
+	}
+
+	_, err := io.ReadFull(d.reader, dst)
+	return err
+}
+
+// zstd gives better ratios than deflate at a fraction of the CPU cost
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return CodecZstd }
+func (zstdCodec) ID() byte     { return 3 }
+
+func (zstdCodec) ValidateLevel(level int) error {
+	if level < 0 || level > 22 {
+		return errors.New("zstd level must be between 1 and 22, or 0 for the default")
+	}
+	return nil
+}
+
+func (zstdCodec) NewCompressor(level int) (Compressor, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level != DefaultLevel {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{encoder: encoder}, nil
+}
+
+func (zstdCodec) NewDecompressor() (Decompressor, error) {
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdDecompressor{decoder: decoder}, nil
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+}
+
+func (c *zstdCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(src, dst[:0]), nil
+}
+
+type zstdDecompressor struct {
+	decoder *zstd.Decoder
+}
+
+func (d *zstdDecompressor) Decompress(dst []byte, src []byte) error {
+	decoded, err := d.decoder.DecodeAll(src, dst[:0])
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(dst) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// snappy is very fast with a modest ratio and has no levels
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string                  { return CodecSnappy }
+func (snappyCodec) ID() byte                      { return 4 }
+func (snappyCodec) ValidateLevel(level int) error { return nil }
+
+func (snappyCodec) NewCompressor(level int) (Compressor, error) {
+	return snappyCompressor{}, nil
+}
+
+func (snappyCodec) NewDecompressor() (Decompressor, error) {
+	return snappyCompressor{}, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	return snappy.Encode(dst[:cap(dst)], src), nil
+}
+
+func (snappyCompressor) Decompress(dst []byte, src []byte) error {
+	decodedLength, err := snappy.DecodedLen(src)
+	if err != nil {
+		return err
+	}
+	if decodedLength != len(dst) {
+		return io.ErrUnexpectedEOF
+	}
+
+	_, err = snappy.Decode(dst, src)
+	return err
+}
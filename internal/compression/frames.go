@@ -0,0 +1,533 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A framed container stores a file as independently compressed frames of a
+// fixed uncompressed size, all compressed with the same codec, followed by an index of the frames and a footer:
+//
+//	header: magic "FFC1" | version (1) | codec (1) | frame size (4) | flags (1) | salt (16)
+//	frames: compressed frame 0 | compressed frame 1 | ...
+//	index:  per frame: compressed offset (8) | compressed size (4) | uncompressed size (4)
+//	footer: index offset (8) | frame count (4) | uncompressed size (8) | magic "FFCI"
+//
+// All integers are big endian. Any byte range of the original file can be
+// read by inflating only the frames that cover it. Version 1 headers stop
+// after the frame size. When the encrypted flag is set, every compressed frame
+// is sealed by a FrameSealer derived from the salt. From version 3 the frames
+// are sealed with additional data marking the final frame and the
+// uncompressed size, and an encrypted container has at least one frame, so a
+// container can not be truncated or extended without the key.
+const (
+	DefaultFrameSize = 1 << 20
+	SaltSize         = 16
+
+	containerVersion = 3
+	headerSizeV1     = 10
+	headerSize       = headerSizeV1 + 1 + SaltSize
+	indexEntrySize   = 16
+	footerSize       = 24
+	maxFrameSize     = 64 << 20
+)
+
+var (
+	headerMagic = []byte("FFC1")
+	footerMagic = []byte("FFCI")
+
+	ErrInvalidContainer = errors.New("invalid compressed container")
+	ErrMissingKey       = errors.New("container is encrypted but no key was provided")
+)
+
+// flagEncrypted marks containers whose frames are sealed
+const flagEncrypted = 1
+
+// FrameSealer encrypts and authenticates compressed frames. The frame index
+// is bound into every frame so frames cannot be reordered, and additionalData
+// is authenticated along with it.
+type FrameSealer interface {
+	Seal(dst []byte, frame []byte, index uint64, additionalData []byte) []byte
+	Open(dst []byte, sealed []byte, index uint64, additionalData []byte) ([]byte, error)
+}
+
+// frameAdditionalData is the additional data the frames of a version 3
+// container are sealed with: whether the frame is the final one and, for the
+// final frame, the uncompressed size of the content
+func frameAdditionalData(final bool, size int64) []byte {
+	if !final {
+		return []byte{0}
+	}
+
+	additionalData := make([]byte, 9)
+	additionalData[0] = 1
+	binary.BigEndian.PutUint64(additionalData[1:], uint64(size))
+	return additionalData
+}
+
+// SealerFactory derives the sealer of an encrypted container from its salt
+type SealerFactory func(salt []byte) (FrameSealer, error)
+
+// FrameOptions configures a FrameWriter
+type FrameOptions struct {
+	FrameSize int
+	Codec     Codec
+	Level     int
+	// Sealer encrypts the frames when set, Salt is recorded in the header so
+	// the reader can derive the same sealer
+	Sealer FrameSealer
+	Salt   []byte
+}
+
+type frameEntry struct {
+	offset             int64
+	compressedSize     int64
+	uncompressedOffset int64
+	uncompressedSize   int64
+}
+
+// FrameWriter compresses everything written to it into a framed container.
+// Close must be called to flush the last frame and write the index.
+type FrameWriter struct {
+	w          io.Writer
+	frameSize  int
+	buffer     []byte
+	compressed []byte
+	sealed     []byte
+	compressor Compressor
+	sealer     FrameSealer
+	offset     int64
+	total      int64
+	frames     []frameEntry
+	closed     bool
+}
+
+func NewFrameWriter(w io.Writer, options FrameOptions) (*FrameWriter, error) {
+	frameSize := options.FrameSize
+	if frameSize <= 0 || frameSize > maxFrameSize {
+		frameSize = DefaultFrameSize
+	}
+
+	if options.Codec == nil {
+		return nil, errors.New("a compression codec is required")
+	}
+
+	compressor, err := options.Codec.NewCompressor(options.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, headerMagic)
+	header[4] = containerVersion
+	header[5] = options.Codec.ID()
+	binary.BigEndian.PutUint32(header[6:], uint32(frameSize))
+	if options.Sealer != nil {
+		if len(options.Salt) != SaltSize {
+			return nil, fmt.Errorf("encryption salt must be %d bytes", SaltSize)
+		}
+		header[10] = flagEncrypted
+		copy(header[11:], options.Salt)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &FrameWriter{
+		w:          w,
+		frameSize:  frameSize,
+		buffer:     make([]byte, 0, frameSize),
+		compressor: compressor,
+		sealer:     options.Sealer,
+		offset:     headerSize,
+	}, nil
+}
+
+func (f *FrameWriter) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errors.New("write to closed frame writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full frame is only flushed once more data arrives, so that Close
+		// knows which frame is the final one
+		if len(f.buffer) == f.frameSize {
+			if err := f.flushFrame(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(f.buffer[len(f.buffer):f.frameSize], p)
+		f.buffer = f.buffer[:len(f.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (f *FrameWriter) flushFrame(final bool) error {
+	compressed, err := f.compressor.Compress(f.compressed, f.buffer)
+	if err != nil {
+		return err
+	}
+	f.compressed = compressed
+
+	if f.sealer != nil {
+		additionalData := frameAdditionalData(final, f.total+int64(len(f.buffer)))
+		f.sealed = f.sealer.Seal(f.sealed[:0], compressed, uint64(len(f.frames)), additionalData)
+		compressed = f.sealed
+	}
+
+	if _, err := f.w.Write(compressed); err != nil {
+		return err
+	}
+
+	f.frames = append(f.frames, frameEntry{
+		offset:             f.offset,
+		compressedSize:     int64(len(compressed)),
+		uncompressedOffset: f.total,
+		uncompressedSize:   int64(len(f.buffer)),
+	})
+	f.offset += int64(len(compressed))
+	f.total += int64(len(f.buffer))
+	f.buffer = f.buffer[:0]
+
+	return nil
+}
+
+// Close flushes the remaining data and writes the index and footer. It does
+// not close the underlying writer.
+func (f *FrameWriter) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	// An encrypted container always has a final frame, even an empty one, so
+	// that its end is authenticated
+	if len(f.buffer) > 0 || (f.sealer != nil && len(f.frames) == 0) {
+		if err := f.flushFrame(true); err != nil {
+			return err
+		}
+	}
+
+	index := make([]byte, len(f.frames)*indexEntrySize+footerSize)
+	for i, frame := range f.frames {
+		entry := index[i*indexEntrySize:]
+		binary.BigEndian.PutUint64(entry, uint64(frame.offset))
+		binary.BigEndian.PutUint32(entry[8:], uint32(frame.compressedSize))
+		binary.BigEndian.PutUint32(entry[12:], uint32(frame.uncompressedSize))
+	}
+
+	footer := index[len(f.frames)*indexEntrySize:]
+	binary.BigEndian.PutUint64(footer, uint64(f.offset))
+	binary.BigEndian.PutUint32(footer[8:], uint32(len(f.frames)))
+	binary.BigEndian.PutUint64(footer[12:], uint64(f.total))
+	copy(footer[20:], footerMagic)
+
+	_, err := f.w.Write(index)
+	return err
+}
+
+// Source gives random access to the bytes of a stored container
+type Source interface {
+	Size() int64
+	ReadRange(offset int64, length int64) (io.ReadCloser, error)
+}
+
+// FrameReader reads the original content back out of a framed container. It
+// implements io.ReadSeeker, so it can be handed to http.ServeContent to answer
+// Range requests. Sequential reads share a single request to the source.
+type FrameReader struct {
+	src        Source
+	frames     []frameEntry
+	framesEnd  int64
+	size       int64
+	position   int64
+	current    int
+	frame      []byte
+	compressed []byte
+	codec      Codec
+	inflater   Decompressor
+	sealer     FrameSealer
+	// sealedEnd is set when the frames are sealed with frameAdditionalData
+	sealedEnd  bool
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+// NewFrameReader opens a container. sealers is only needed for encrypted
+// containers and may be nil otherwise.
+func NewFrameReader(src Source, sealers SealerFactory) (*FrameReader, error) {
+	containerSize := src.Size()
+	if containerSize < headerSizeV1+footerSize {
+		return nil, ErrInvalidContainer
+	}
+
+	header, err := readRange(src, 0, headerSizeV1)
+	if err != nil {
+		return nil, err
+	}
+	version := header[4]
+	if !bytes.Equal(header[:4], headerMagic) || version < 1 || version > containerVersion {
+		return nil, ErrInvalidContainer
+	}
+	codec, err := lookupID(header[5])
+	if err != nil {
+		return nil, err
+	}
+	frameSize := int64(binary.BigEndian.Uint32(header[6:]))
+	if frameSize == 0 || frameSize > maxFrameSize {
+		return nil, ErrInvalidContainer
+	}
+
+	dataStart := int64(headerSizeV1)
+	var sealer FrameSealer
+	if version >= 2 {
+		extension, err := readRange(src, headerSizeV1, headerSize-headerSizeV1)
+		if err != nil {
+			return nil, err
+		}
+		dataStart = headerSize
+
+		if extension[0]&flagEncrypted != 0 {
+			if sealers == nil {
+				return nil, ErrMissingKey
+			}
+			sealer, err = sealers(extension[1:])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	footer, err := readRange(src, containerSize-footerSize, footerSize)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[20:], footerMagic) {
+		return nil, ErrInvalidContainer
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(footer))
+	frameCount := int64(binary.BigEndian.Uint32(footer[8:]))
+	size := int64(binary.BigEndian.Uint64(footer[12:]))
+
+	if indexOffset < dataStart || indexOffset+frameCount*indexEntrySize+footerSize != containerSize {
+		return nil, ErrInvalidContainer
+	}
+
+	sealedEnd := sealer != nil && version >= 3
+	if sealedEnd && frameCount == 0 {
+		return nil, ErrInvalidContainer
+	}
+
+	frames := make([]frameEntry, 0, frameCount)
+	if frameCount > 0 {
+		index, err := readRange(src, indexOffset, frameCount*indexEntrySize)
+		if err != nil {
+			return nil, err
+		}
+
+		var uncompressedOffset int64
+		for i := int64(0); i < frameCount; i++ {
+			entry := index[i*indexEntrySize:]
+			frame := frameEntry{
+				offset:             int64(binary.BigEndian.Uint64(entry)),
+				compressedSize:     int64(binary.BigEndian.Uint32(entry[8:])),
+				uncompressedOffset: uncompressedOffset,
+				uncompressedSize:   int64(binary.BigEndian.Uint32(entry[12:])),
+			}
+			// Only the single frame of an empty encrypted container is empty
+			if (frame.uncompressedSize == 0 && frameCount > 1) || frame.uncompressedSize > frameSize ||
+				frame.compressedSize > 2*maxFrameSize || frame.offset+frame.compressedSize > indexOffset {
+				return nil, ErrInvalidContainer
+			}
+			frames = append(frames, frame)
+			uncompressedOffset += frame.uncompressedSize
+		}
+
+		if uncompressedOffset != size {
+			return nil, ErrInvalidContainer
+		}
+	}
+
+	reader := &FrameReader{
+		src:       src,
+		frames:    frames,
+		framesEnd: indexOffset,
+		size:      size,
+		current:   -1,
+		codec:     codec,
+		sealer:    sealer,
+		sealedEnd: sealedEnd,
+	}
+
+	// Reading empty content never opens its frame, so it is authenticated
+	// here instead
+	if sealedEnd && size == 0 {
+		if err := reader.loadFrame(0); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
+
+// Encrypted reports whether the frames of the container are sealed
+func (f *FrameReader) Encrypted() bool {
+	return f.sealer != nil
+}
+
+// Codec returns the codec the frames were compressed with
+func (f *FrameReader) Codec() Codec {
+	return f.codec
+}
+
+// Size returns the uncompressed size of the content
+func (f *FrameReader) Size() int64 {
+	return f.size
+}
+
+func (f *FrameReader) Read(p []byte) (int, error) {
+	if f.position >= f.size {
+		return 0, io.EOF
+	}
+
+	index := sort.Search(len(f.frames), func(i int) bool {
+		return f.frames[i].uncompressedOffset+f.frames[i].uncompressedSize > f.position
+	})
+	if index != f.current {
+		if err := f.loadFrame(index); err != nil {
+			return 0, err
+		}
+	}
+
+	frame := f.frames[index]
+	n := copy(p, f.frame[f.position-frame.uncompressedOffset:])
+	f.position += int64(n)
+
+	return n, nil
+}
+
+func (f *FrameReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = f.position + offset
+	case io.SeekEnd:
+		position = f.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if position < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	f.position = position
+	return position, nil
+}
+
+func (f *FrameReader) Close() error {
+	var err error
+	if f.body != nil {
+		err = f.body.Close()
+		f.body = nil
+	}
+	return err
+}
+
+func (f *FrameReader) loadFrame(index int) error {
+	frame := f.frames[index]
+
+	// Keep reading from the open body when frames are read in order,
+	// otherwise start a new read at the requested frame
+	if f.body == nil || f.bodyOffset != frame.offset {
+		if f.body != nil {
+			f.body.Close()
+		}
+
+		body, err := f.src.ReadRange(frame.offset, f.framesEnd-frame.offset)
+		if err != nil {
+			f.body = nil
+			return err
+		}
+		f.body = body
+		f.bodyOffset = frame.offset
+	}
+
+	if int64(cap(f.compressed)) < frame.compressedSize {
+		f.compressed = make([]byte, frame.compressedSize)
+	}
+	f.compressed = f.compressed[:frame.compressedSize]
+
+	if _, err := io.ReadFull(f.body, f.compressed); err != nil {
+		f.body.Close()
+		f.body = nil
+		return fmt.Errorf("failed to read frame %d: %w", index, err)
+	}
+	f.bodyOffset += frame.compressedSize
+
+	if f.inflater == nil {
+		inflater, err := f.codec.NewDecompressor()
+		if err != nil {
+			return err
+		}
+		f.inflater = inflater
+	}
+
+	if int64(cap(f.frame)) < frame.uncompressedSize {
+		f.frame = make([]byte, frame.uncompressedSize)
+	}
+	f.frame = f.frame[:frame.uncompressedSize]
+
+	compressed := f.compressed
+	if f.sealer != nil {
+		// Frames are decrypted in place
+		var additionalData []byte
+		if f.sealedEnd {
+			additionalData = frameAdditionalData(index == len(f.frames)-1, f.size)
+		}
+
+		opened, err := f.sealer.Open(compressed[:0], compressed, uint64(index), additionalData)
+		if err != nil {
+			f.current = -1
+			return fmt.Errorf("failed to decrypt frame %d: %w", index, err)
+		}
+		compressed = opened
+	}
+
+	if err := f.inflater.Decompress(f.frame, compressed); err != nil {
+		f.current = -1
+		return fmt.Errorf("failed to inflate frame %d: %w", index, err)
+	}
+
+	f.current = index
+	return nil
+}
+
+func readRange(src Source, offset int64, length int64) ([]byte, error) {
+	body, err := src.ReadRange(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(body, buffer); err != nil {
+		return nil, err
+	}
+
+	return buffer, nil
+}
@@ -0,0 +1,328 @@
+package compression_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
+)
+
+// testFrameSize keeps the test content spread over several frames
+const testFrameSize = 4096
+
+// bytesSource serves a container held in memory
+type bytesSource []byte
+
+func (s bytesSource) Size() int64 {
+	return int64(len(s))
+}
+
+func (s bytesSource) ReadRange(offset int64, length int64) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(s[offset : offset+length])), nil
+}
+
+// testContent returns content that compresses a little, ending part way
+// through a frame
+func testContent() []byte {
+	random := rand.New(rand.NewSource(1))
+	content := make([]byte, 3*testFrameSize+1234)
+	for i := range content {
+		content[i] = byte('a' + random.Intn(8))
+	}
+	return content
+}
+
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return key
+}
+
+func sealersFor(key []byte) compression.SealerFactory {
+	return func(salt []byte) (compression.FrameSealer, error) {
+		return encryption.NewFrameSealer(key, salt)
+	}
+}
+
+// writeContainer compresses content with the named codec, sealing the frames
+// when key is not nil
+func writeContainer(t *testing.T, codecName string, key []byte, content []byte) []byte {
+	t.Helper()
+
+	codec, err := compression.Lookup(codecName)
+	if err != nil {
+		t.Fatalf("looking up codec: %v", err)
+	}
+
+	options := compression.FrameOptions{FrameSize: testFrameSize, Codec: codec}
+	if key != nil {
+		salt, err := encryption.NewSalt()
+		if err != nil {
+			t.Fatalf("generating salt: %v", err)
+		}
+		sealer, err := encryption.NewFrameSealer(key, salt)
+		if err != nil {
+			t.Fatalf("creating sealer: %v", err)
+		}
+		options.Sealer = sealer
+		options.Salt = salt
+	}
+
+	var container bytes.Buffer
+	writer, err := compression.NewFrameWriter(&container, options)
+	if err != nil {
+		t.Fatalf("creating frame writer: %v", err)
+	}
+	if _, err := writer.Write(content); err != nil {
+		t.Fatalf("writing content: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("closing frame writer: %v", err)
+	}
+
+	return container.Bytes()
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	content := testContent()
+
+	for _, codecName := range compression.CodecNames() {
+		for _, encrypted := range []bool{false, true} {
+			name := codecName
+			if encrypted {
+				name += "/encrypted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				var key []byte
+				var sealers compression.SealerFactory
+				if encrypted {
+					key = newTestKey(t)
+					sealers = sealersFor(key)
+				}
+
+				container := writeContainer(t, codecName, key, content)
+				reader, err := compression.NewFrameReader(bytesSource(container), sealers)
+				if err != nil {
+					t.Fatalf("opening container: %v", err)
+				}
+				defer reader.Close()
+
+				if reader.Codec().Name() != codecName {
+					t.Errorf("codec is %s, expected %s", reader.Codec().Name(), codecName)
+				}
+				if reader.Encrypted() != encrypted {
+					t.Errorf("encrypted is %t, expected %t", reader.Encrypted(), encrypted)
+				}
+				if reader.Size() != int64(len(content)) {
+					t.Errorf("size is %d, expected %d", reader.Size(), len(content))
+				}
+
+				read, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("reading container: %v", err)
+				}
+				if !bytes.Equal(read, content) {
+					t.Fatalf("read %d bytes that do not match the %d written", len(read), len(content))
+				}
+			})
+		}
+	}
+}
+
+func TestFrameReaderSeek(t *testing.T) {
+	content := testContent()
+	key := newTestKey(t)
+	container := writeContainer(t, compression.CodecZstd, key, content)
+
+	reader, err := compression.NewFrameReader(bytesSource(container), sealersFor(key))
+	if err != nil {
+		t.Fatalf("opening container: %v", err)
+	}
+	defer reader.Close()
+
+	size := int64(len(content))
+	tests := []struct {
+		name     string
+		offset   int64
+		whence   int
+		position int64
+		length   int64
+	}{
+		{"start of a later frame", 2 * testFrameSize, io.SeekStart, 2 * testFrameSize, 100},
+		{"across a frame boundary", testFrameSize - 10, io.SeekStart, testFrameSize - 10, 20},
+		{"back to the start", 0, io.SeekStart, 0, 10},
+		{"relative to the current position", 5, io.SeekCurrent, 15, 10},
+		{"relative to the end", -50, io.SeekEnd, size - 50, 50},
+	}
+
+	for _, test := range tests {
+		position, err := reader.Seek(test.offset, test.whence)
+		if err != nil {
+			t.Fatalf("%s: seeking: %v", test.name, err)
+		}
+		if position != test.position {
+			t.Fatalf("%s: position is %d, expected %d", test.name, position, test.position)
+		}
+
+		read := make([]byte, test.length)
+		if _, err := io.ReadFull(reader, read); err != nil {
+			t.Fatalf("%s: reading: %v", test.name, err)
+		}
+		if !bytes.Equal(read, content[test.position:test.position+test.length]) {
+			t.Fatalf("%s: read content does not match", test.name)
+		}
+	}
+
+	if _, err := reader.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("seeking to the end: %v", err)
+	}
+	if n, err := reader.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("read at the end returned %d, %v, expected 0, EOF", n, err)
+	}
+
+	if _, err := reader.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("seeking before the start succeeded")
+	}
+}
+
+func TestFrameFlippedByte(t *testing.T) {
+	content := testContent()
+	// The first frame starts straight after the header
+	firstFrame := 11 + compression.SaltSize
+
+	for _, codecName := range compression.CodecNames() {
+		t.Run(codecName, func(t *testing.T) {
+			key := newTestKey(t)
+			container := writeContainer(t, codecName, key, content)
+			container[firstFrame+3] ^= 0x01
+
+			reader, err := compression.NewFrameReader(bytesSource(container), sealersFor(key))
+			if err != nil {
+				t.Fatalf("opening container: %v", err)
+			}
+			defer reader.Close()
+
+			if _, err := io.ReadAll(reader); err == nil {
+				t.Fatal("reading a damaged frame succeeded")
+			}
+		})
+	}
+
+	t.Run("footer", func(t *testing.T) {
+		container := writeContainer(t, compression.CodecDeflate, nil, content)
+		container[len(container)-1] ^= 0x01
+
+		if _, err := compression.NewFrameReader(bytesSource(container), nil); !errors.Is(err, compression.ErrInvalidContainer) {
+			t.Fatalf("opening a damaged container returned %v, expected %v", err, compression.ErrInvalidContainer)
+		}
+	})
+}
+
+// truncateContainer keeps the first frames of a container, rebuilding the
+// index and footer as if it had been written that way
+func truncateContainer(container []byte, frames int) []byte {
+	footer := container[len(container)-24:]
+	indexOffset := binary.BigEndian.Uint64(footer)
+	frameCount := int(binary.BigEndian.Uint32(footer[8:]))
+	index := container[indexOffset : len(container)-24]
+
+	end := indexOffset
+	if frames < frameCount {
+		end = binary.BigEndian.Uint64(index[frames*16:])
+	}
+
+	truncated := append([]byte{}, container[:end]...)
+	var size uint64
+	for i := 0; i < frames; i++ {
+		entry := index[i*16 : (i+1)*16]
+		truncated = append(truncated, entry...)
+		size += uint64(binary.BigEndian.Uint32(entry[12:]))
+	}
+
+	truncated = binary.BigEndian.AppendUint64(truncated, end)
+	truncated = binary.BigEndian.AppendUint32(truncated, uint32(frames))
+	truncated = binary.BigEndian.AppendUint64(truncated, size)
+	return append(truncated, "FFCI"...)
+}
+
+func TestFrameTruncated(t *testing.T) {
+	content := testContent()
+	key := newTestKey(t)
+	container := writeContainer(t, compression.CodecZstd, key, content)
+
+	// Unsealed frames can be dropped, which is why encrypted ones are not
+	plain := truncateContainer(writeContainer(t, compression.CodecZstd, nil, content), 2)
+	reader, err := compression.NewFrameReader(bytesSource(plain), nil)
+	if err != nil {
+		t.Fatalf("opening truncated unencrypted container: %v", err)
+	}
+	read, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(read, content[:2*testFrameSize]) {
+		t.Fatalf("reading truncated unencrypted container returned %d bytes, %v", len(read), err)
+	}
+
+	for frames := 0; frames < 4; frames++ {
+		truncated := truncateContainer(container, frames)
+
+		reader, err := compression.NewFrameReader(bytesSource(truncated), sealersFor(key))
+		if err != nil {
+			continue
+		}
+		_, err = io.ReadAll(reader)
+		reader.Close()
+		if err == nil {
+			t.Fatalf("reading a container truncated to %d frames succeeded", frames)
+		}
+	}
+}
+
+func TestFrameEmpty(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		var key []byte
+		var sealers compression.SealerFactory
+		if encrypted {
+			key = newTestKey(t)
+			sealers = sealersFor(key)
+		}
+
+		container := writeContainer(t, compression.CodecSnappy, key, nil)
+		reader, err := compression.NewFrameReader(bytesSource(container), sealers)
+		if err != nil {
+			t.Fatalf("opening empty container, encrypted %t: %v", encrypted, err)
+		}
+		read, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || len(read) != 0 {
+			t.Fatalf("reading empty container, encrypted %t, returned %d bytes, %v", encrypted, len(read), err)
+		}
+	}
+}
+
+func TestFrameWrongKey(t *testing.T) {
+	content := testContent()
+	container := writeContainer(t, compression.CodecSnappy, newTestKey(t), content)
+
+	reader, err := compression.NewFrameReader(bytesSource(container), sealersFor(newTestKey(t)))
+	if err != nil {
+		t.Fatalf("opening container: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Fatal("reading with the wrong key succeeded")
+	}
+
+	if _, err := compression.NewFrameReader(bytesSource(container), nil); !errors.Is(err, compression.ErrMissingKey) {
+		t.Fatalf("opening without a key returned %v, expected %v", err, compression.ErrMissingKey)
+	}
+}
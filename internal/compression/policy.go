@@ -0,0 +1,72 @@
+package compression
+
+import "strings"
+
+// alreadyCompressedTypes lists formats that are compressed internally and
+// gain nothing from another pass, apart from using CPU
+var alreadyCompressedTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"image/heic",
+	"video/*",
+	"audio/mpeg",
+	"audio/aac",
+	"audio/mp4",
+	"audio/ogg",
+	"audio/opus",
+	"audio/webm",
+	"audio/flac",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/epub+zip",
+	"application/vnd.openxmlformats-officedocument.*",
+}
+
+// IsAlreadyCompressed reports whether a MIME type is a compressed format
+func IsAlreadyCompressed(mimeType string) bool {
+	for _, pattern := range alreadyCompressedTypes {
+		if MatchMimeType(pattern, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchMimeType matches a MIME type against a pattern. Patterns are either an
+// exact type ("image/png"), a prefix ending in "*" ("video/*") or "*".
+func MatchMimeType(pattern string, mimeType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+
+	// Ignore parameters such as "; charset=utf-8"
+	if base, _, found := strings.Cut(mimeType, ";"); found {
+		mimeType = strings.TrimSpace(base)
+	}
+
+	if prefix, found := strings.CutSuffix(pattern, "*"); found {
+		return strings.HasPrefix(mimeType, prefix)
+	}
+	return pattern == mimeType
+}
+
+// MatchSpecificity ranks how closely a pattern matches, so that "image/png"
+// wins over "image/*" which wins over "*". It returns -1 when there is no match.
+func MatchSpecificity(pattern string, mimeType string) int {
+	if !MatchMimeType(pattern, mimeType) {
+		return -1
+	}
+	if !strings.HasSuffix(pattern, "*") {
+		return len(pattern) + 1
+	}
+	return len(pattern) - 1
+}
@@ -0,0 +1,7 @@
+package config
+
+type CompressionConfig struct {
+	// Codec and level used when no project policy matches an upload
+	DefaultCodec string
+	DefaultLevel int
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -11,12 +13,20 @@ import (
 type ApplicationConfig struct {
 	DbConfig DBConfig
 	RedisConfig RedisConfig
+	StorageConfig StorageConfig
+	ColdStorageConfig StorageConfig
+	CompressionConfig CompressionConfig
+	EncryptionConfig EncryptionConfig
+	JobsConfig JobsConfig
 	Config Config
 }
 
 type Config struct {
 	Port int
 	SecretKey string
+	// Range requests for files up to this size (in bytes) are served from a
+	// decompressed temporary file; everything else is streamed
+	DownloadTempFileThreshold int64
 }
 
 
@@ -60,6 +70,13 @@ func LoadConfig() (*ApplicationConfig, error) {
 			return port
 		}(),
 		SecretKey: os.Getenv("SECRET_KEY"),
+		DownloadTempFileThreshold: func() int64 {
+			threshold, err := strconv.ParseInt(os.Getenv("DOWNLOAD_TEMP_FILE_THRESHOLD_MB"), 10, 64)
+			if err != nil {
+				return 32 << 20
+			}
+			return threshold << 20
+		}(),
 	}
 
 	redisConfig := RedisConfig{
@@ -80,11 +97,192 @@ func LoadConfig() (*ApplicationConfig, error) {
 			return db
 		}(),
 	}
+	storageConfig := loadStorageConfig("STORAGE_")
+	if storageConfig.Driver == "" {
+		storageConfig.Driver = "local"
+	}
+	if storageConfig.LocalPath == "" {
+		storageConfig.LocalPath = "uploads"
+	}
+
+	// Cold storage is disabled unless COLD_STORAGE_DRIVER is set
+	coldStorageConfig := loadStorageConfig("COLD_STORAGE_")
+	if coldStorageConfig.LocalPath == "" {
+		coldStorageConfig.LocalPath = "uploads-cold"
+	}
+
+	compressionConfig := CompressionConfig{
+		DefaultCodec: func() string {
+			codec := os.Getenv("COMPRESSION_CODEC")
+			if codec == "" {
+				return "zstd"
+			}
+			return codec
+		}(),
+		DefaultLevel: func() int {
+			level, err := strconv.Atoi(os.Getenv("COMPRESSION_LEVEL"))
+			if err != nil {
+				return 0
+			}
+			return level
+		}(),
+	}
+
+	encryptionConfig := EncryptionConfig{
+		MasterKey: os.Getenv("ENCRYPTION_MASTER_KEY"),
+		PreviousMasterKeys: func() []string {
+			keys := make([]string, 0)
+			for _, key := range strings.Split(os.Getenv("ENCRYPTION_PREVIOUS_MASTER_KEYS"), ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					keys = append(keys, key)
+				}
+			}
+			return keys
+		}(),
+	}
+
+	jobsConfig := JobsConfig{
+		ScrubInterval: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("SCRUB_INTERVAL_HOURS"))
+			if err != nil {
+				return 24 * time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+		ReplicaRepairInterval: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("REPLICA_REPAIR_INTERVAL_HOURS"))
+			if err != nil {
+				return 24 * time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+		TieringInterval: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("TIERING_INTERVAL_HOURS"))
+			if err != nil {
+				return 24 * time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+		ColdAfter: func() time.Duration {
+			days, err := strconv.Atoi(os.Getenv("TIERING_COLD_AFTER_DAYS"))
+			if err != nil {
+				return 30 * 24 * time.Hour
+			}
+			return time.Duration(days) * 24 * time.Hour
+		}(),
+		TrashPurgeInterval: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("TRASH_PURGE_INTERVAL_HOURS"))
+			if err != nil {
+				return 24 * time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+		TrashRetention: func() time.Duration {
+			days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+			if err != nil {
+				return 30 * 24 * time.Hour
+			}
+			return time.Duration(days) * 24 * time.Hour
+		}(),
+		LifecycleInterval: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("LIFECYCLE_INTERVAL_HOURS"))
+			if err != nil {
+				return 24 * time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+		UploadCleanupInterval: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("UPLOAD_CLEANUP_INTERVAL_HOURS"))
+			if err != nil {
+				return time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+		UploadExpiry: func() time.Duration {
+			hours, err := strconv.Atoi(os.Getenv("UPLOAD_EXPIRY_HOURS"))
+			if err != nil {
+				return 24 * time.Hour
+			}
+			return time.Duration(hours) * time.Hour
+		}(),
+	}
+
 	cfg := &ApplicationConfig{
 		DbConfig: dbConfig,
 		Config: appConfig,
 		RedisConfig: redisConfig,
+		StorageConfig: storageConfig,
+		ColdStorageConfig: coldStorageConfig,
+		CompressionConfig: compressionConfig,
+		EncryptionConfig: encryptionConfig,
+		JobsConfig: jobsConfig,
 	}
 
 	return cfg, nil;
-}
\ No newline at end of file
+}
+
+// loadStorageConfig reads the settings of a storage backend from the
+// environment variables starting with prefix
+func loadStorageConfig(prefix string) StorageConfig {
+	return StorageConfig{
+		Driver: os.Getenv(prefix + "DRIVER"),
+		LocalPath: os.Getenv(prefix + "PATH"),
+		Endpoint: os.Getenv(prefix + "ENDPOINT"),
+		Region: os.Getenv(prefix + "REGION"),
+		Bucket: os.Getenv(prefix + "BUCKET"),
+		Prefix: os.Getenv(prefix + "PREFIX"),
+		AccessKey: os.Getenv(prefix + "ACCESS_KEY"),
+		SecretKey: os.Getenv(prefix + "SECRET_KEY"),
+		UseSSL: func() bool {
+			useSSL, err := strconv.ParseBool(os.Getenv(prefix + "USE_SSL"))
+			if err != nil {
+				return true
+			}
+			return useSSL
+		}(),
+		PathStyle: func() bool {
+			pathStyle, err := strconv.ParseBool(os.Getenv(prefix + "PATH_STYLE"))
+			if err != nil {
+				return false
+			}
+			return pathStyle
+		}(),
+		Volumes: func() []string {
+			volumes := make([]string, 0)
+			for _, volume := range strings.Split(os.Getenv(prefix + "VOLUMES"), ",") {
+				if volume = strings.TrimSpace(volume); volume != "" {
+					volumes = append(volumes, volume)
+				}
+			}
+			return volumes
+		}(),
+		Replicas: func() int {
+			replicas, err := strconv.Atoi(os.Getenv(prefix + "REPLICAS"))
+			if err != nil {
+				return 2
+			}
+			return replicas
+		}(),
+		WriteQuorum: func() int {
+			quorum, err := strconv.Atoi(os.Getenv(prefix + "WRITE_QUORUM"))
+			if err != nil {
+				return 0
+			}
+			return quorum
+		}(),
+		DataShards: func() int {
+			shards, err := strconv.Atoi(os.Getenv(prefix + "DATA_SHARDS"))
+			if err != nil {
+				return 0
+			}
+			return shards
+		}(),
+		ParityShards: func() int {
+			shards, err := strconv.Atoi(os.Getenv(prefix + "PARITY_SHARDS"))
+			if err != nil {
+				return 2
+			}
+			return shards
+		}(),
+	}
+}
@@ -0,0 +1,16 @@
+package config
+
+type EncryptionConfig struct {
+	// MasterKey is a base64 encoded 32 byte key that wraps the project data
+	// keys. Uploads are stored unencrypted when it is empty.
+	MasterKey string
+	// PreviousMasterKeys are the base64 encoded keys MasterKey replaced. Data
+	// keys still wrapped by them stay readable until rotate-keys re-wraps
+	// them with MasterKey.
+	PreviousMasterKeys []string
+}
+
+// Enabled reports whether uploads should be encrypted
+func (c EncryptionConfig) Enabled() bool {
+	return c.MasterKey != ""
+}
@@ -0,0 +1,32 @@
+package config
+
+import "time"
+
+type JobsConfig struct {
+	// ScrubInterval is the time between integrity scrubs, 0 disables them
+	ScrubInterval time.Duration
+	// ReplicaRepairInterval is the time between repairs of replicated
+	// storage, 0 disables them
+	ReplicaRepairInterval time.Duration
+	// TieringInterval is the time between moves of idle files to cold
+	// storage, 0 disables them
+	TieringInterval time.Duration
+	// ColdAfter is how long a file has to go without a download before it is
+	// moved to cold storage
+	ColdAfter time.Duration
+	// TrashPurgeInterval is the time between purges of the trash, 0 disables
+	// them
+	TrashPurgeInterval time.Duration
+	// TrashRetention is how long deleted files and projects stay in the trash
+	// before they are purged
+	TrashRetention time.Duration
+	// LifecycleInterval is the time between applications of the lifecycle
+	// rules of every project, 0 disables them
+	LifecycleInterval time.Duration
+	// UploadCleanupInterval is the time between removals of expired
+	// resumable uploads, 0 disables them
+	UploadCleanupInterval time.Duration
+	// UploadExpiry is how long a resumable upload can take before it expires
+	// with the chunks received so far
+	UploadExpiry time.Duration
+}
@@ -0,0 +1,24 @@
+package config
+
+type StorageConfig struct {
+	Driver    string
+	LocalPath string
+
+	// S3 compatible object storage
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	PathStyle bool
+
+	// Replicated storage across local volumes
+	Volumes     []string
+	Replicas    int
+	WriteQuorum int
+	// Erasure coding over the same volumes, disabled when DataShards is 0
+	DataShards   int
+	ParityShards int
+}
@@ -0,0 +1,45 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+const customerKeyFingerprintMessage = "fileflow customer key fingerprint"
+
+var ErrKeyChecksumMismatch = errors.New("encryption key does not match its MD5 checksum")
+
+// ParseCustomerKey decodes a key supplied by a client with its request. The
+// base64 encoded MD5 of the key is optional and guards against keys that were
+// mangled in transit.
+func ParseCustomerKey(encodedKey string, encodedMD5 string) ([]byte, error) {
+	key, err := ParseKey(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if encodedMD5 != "" {
+		sum := md5.Sum(key)
+		if encodedMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, ErrKeyChecksumMismatch
+		}
+	}
+
+	return key, nil
+}
+
+// CustomerKeyFingerprint identifies a customer supplied key so that it can be
+// checked on download without storing the key itself
+func CustomerKeyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(customerKeyFingerprintMessage))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// MatchesFingerprint reports whether key is the one the fingerprint was made from
+func MatchesFingerprint(key []byte, fingerprint string) bool {
+	return hmac.Equal([]byte(CustomerKeyFingerprint(key)), []byte(fingerprint))
+}
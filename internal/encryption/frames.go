@@ -0,0 +1,58 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+)
+
+const frameKeyInfo = "fileflow frame encryption"
+
+// frameSealer encrypts the frames of one file with AES-256-GCM. Every file
+// gets its own key derived from the data key and a random salt, so the frame
+// index can safely be used as the nonce.
+type frameSealer struct {
+	aead cipher.AEAD
+}
+
+// NewSalt returns a random salt for a new file
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, compression.SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// NewFrameSealer derives the sealer for a file from a data key and its salt
+func NewFrameSealer(dataKey []byte, salt []byte) (compression.FrameSealer, error) {
+	fileKey, err := hkdf.Key(sha256.New, dataKey, salt, frameKeyInfo, KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &frameSealer{aead}, nil
+}
+
+func (s *frameSealer) Seal(dst []byte, frame []byte, index uint64, additionalData []byte) []byte {
+	return s.aead.Seal(dst, s.nonce(index), frame, additionalData)
+}
+
+func (s *frameSealer) Open(dst []byte, sealed []byte, index uint64, additionalData []byte) ([]byte, error) {
+	return s.aead.Open(dst, s.nonce(index), sealed, additionalData)
+}
+
+func (s *frameSealer) nonce(index uint64) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
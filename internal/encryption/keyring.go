@@ -0,0 +1,154 @@
+package encryption
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+// DataKeyStore persists the wrapped data keys of projects
+type DataKeyStore interface {
+	GetByProjectId(ctx context.Context, projectId int64) (*store.ProjectKey, error)
+	Create(ctx context.Context, projectKey *store.ProjectKey) error
+}
+
+// Keyring hands out the data keys of projects, creating them on first use.
+// Data keys are only ever stored wrapped by a master key: new ones by the
+// current master key, older ones possibly by a previous master key until
+// they are re-wrapped.
+type Keyring struct {
+	masterKey   []byte
+	masterKeyID string
+	// masterKeys holds the current and previous master keys by their id
+	masterKeys map[string][]byte
+	keys       DataKeyStore
+}
+
+func NewKeyring(masterKey []byte, previousMasterKeys [][]byte, keys DataKeyStore) (*Keyring, error) {
+	if len(masterKey) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	masterKeys := map[string][]byte{KeyID(masterKey): masterKey}
+	for _, previousKey := range previousMasterKeys {
+		if len(previousKey) != KeySize {
+			return nil, ErrInvalidKey
+		}
+		masterKeys[KeyID(previousKey)] = previousKey
+	}
+
+	return &Keyring{
+		masterKey:   masterKey,
+		masterKeyID: KeyID(masterKey),
+		masterKeys:  masterKeys,
+		keys:        keys,
+	}, nil
+}
+
+// MasterKeyID is the id of the master key new data keys are wrapped by
+func (k *Keyring) MasterKeyID() string {
+	return k.masterKeyID
+}
+
+// unwrap returns the data key of projectKey, unwrapped by whichever master
+// key wrapped it
+func (k *Keyring) unwrap(projectKey *store.ProjectKey) ([]byte, error) {
+	masterKey, ok := k.masterKeys[projectKey.MasterKeyID]
+	if !ok {
+		return nil, ErrKeyMismatch
+	}
+
+	return UnwrapKey(masterKey, projectKey.WrappedKey)
+}
+
+// Rewrap returns the data key of projectKey wrapped by the current master
+// key, with the id of that key. Keys it already wraps are returned as they
+// are.
+func (k *Keyring) Rewrap(projectKey *store.ProjectKey) ([]byte, string, error) {
+	if projectKey.MasterKeyID == k.masterKeyID {
+		return projectKey.WrappedKey, k.masterKeyID, nil
+	}
+
+	dataKey, err := k.unwrap(projectKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	wrappedKey, err := WrapKey(k.masterKey, dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return wrappedKey, k.masterKeyID, nil
+}
+
+// DataKey returns the unwrapped data key of a project
+func (k *Keyring) DataKey(ctx context.Context, projectId int64) ([]byte, error) {
+	projectKey, err := k.keys.GetByProjectId(ctx, projectId)
+	if errors.Is(err, sql.ErrNoRows) {
+		projectKey, err = k.createDataKey(ctx, projectId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return k.unwrap(projectKey)
+}
+
+func (k *Keyring) createDataKey(ctx context.Context, projectId int64) (*store.ProjectKey, error) {
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := WrapKey(k.masterKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	projectKey := &store.ProjectKey{
+		ProjectID:   projectId,
+		WrappedKey:  wrappedKey,
+		MasterKeyID: k.masterKeyID,
+	}
+	if err := k.keys.Create(ctx, projectKey); err != nil {
+		return nil, err
+	}
+
+	// Another upload may have created the key first, always use the stored one
+	return k.keys.GetByProjectId(ctx, projectId)
+}
+
+// NewSealer returns a sealer for a new file of the project and its salt
+func (k *Keyring) NewSealer(ctx context.Context, projectId int64) (compression.FrameSealer, []byte, error) {
+	dataKey, err := k.DataKey(ctx, projectId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	salt, err := NewSalt()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealer, err := NewFrameSealer(dataKey, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sealer, salt, nil
+}
+
+// Sealers returns the factory that opens encrypted files of the project
+func (k *Keyring) Sealers(ctx context.Context, projectId int64) compression.SealerFactory {
+	return func(salt []byte) (compression.FrameSealer, error) {
+		dataKey, err := k.DataKey(ctx, projectId)
+		if err != nil {
+			return nil, err
+		}
+		return NewFrameSealer(dataKey, salt)
+	}
+}
@@ -0,0 +1,109 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, for AES-256
+const KeySize = 32
+
+var (
+	ErrInvalidKey  = fmt.Errorf("encryption keys must be %d bytes", KeySize)
+	ErrKeyMismatch = errors.New("data key was wrapped with a master key that is not configured")
+)
+
+// GenerateKey returns a new random key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// ParseKey decodes a base64 encoded key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("keys must be base64 encoded: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// ParseKeys decodes a list of base64 encoded keys
+func ParseKeys(encoded []string) ([][]byte, error) {
+	keys := make([][]byte, 0, len(encoded))
+	for _, encodedKey := range encoded {
+		key, err := ParseKey(encodedKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// KeyID identifies a key without revealing it
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WrapKey encrypts a data key with a master key
+func WrapKey(masterKey []byte, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// UnwrapKey decrypts a data key produced by WrapKey
+func UnwrapKey(masterKey []byte, wrappedKey []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
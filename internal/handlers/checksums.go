@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// Headers a client can send to have the content of an upload verified. Both
+// accept hex or base64 encoded digests.
+const (
+	contentMD5Header    = "Content-MD5"
+	contentSHA256Header = "ff-checksum-sha256"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// expectedChecksums holds the hex encoded digests sent with an upload
+type expectedChecksums struct {
+	sha256 string
+	md5    string
+}
+
+func checksumsFromRequest(r *http.Request) (*expectedChecksums, error) {
+	sha256Digest, err := decodeDigest(r.Header.Get(contentSHA256Header), 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", contentSHA256Header, err)
+	}
+
+	md5Digest, err := decodeDigest(r.Header.Get(contentMD5Header), 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", contentMD5Header, err)
+	}
+
+	return &expectedChecksums{sha256: sha256Digest, md5: md5Digest}, nil
+}
+
+// verify compares the digests with those of the received content
+func (e *expectedChecksums) verify(result *utils.SaveResult) error {
+	if e.sha256 != "" && e.sha256 != result.SHA256 {
+		return fmt.Errorf("%w: received content has SHA-256 %s", errChecksumMismatch, result.SHA256)
+	}
+	if e.md5 != "" && e.md5 != result.MD5 {
+		return fmt.Errorf("%w: received content has MD5 %s", errChecksumMismatch, result.MD5)
+	}
+	return nil
+}
+
+// decodeDigest normalises a hex or base64 encoded digest of the given size
+// to lower case hex
+func decodeDigest(value string, size int) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	if len(value) == hex.EncodedLen(size) {
+		if digest, err := hex.DecodeString(value); err == nil {
+			return hex.EncodeToString(digest), nil
+		}
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(digest) != size {
+		return "", fmt.Errorf("expected a %d byte digest in hex or base64", size)
+	}
+
+	return hex.EncodeToString(digest), nil
+}
+
+// setChecksumHeaders sets the ETag and Digest headers of a download. Files
+// uploaded before checksums were recorded get neither.
+func setChecksumHeaders(w http.ResponseWriter, storedFile *store.StoredFile) {
+	if storedFile.MD5 != "" {
+		w.Header().Set("ETag", `"`+storedFile.MD5+`"`)
+	}
+
+	digests := make([]string, 0, 2)
+	for _, checksum := range []struct{ algorithm, value string }{
+		{"sha-256", storedFile.SHA256},
+		{"md5", storedFile.MD5},
+	} {
+		if checksum.value == "" {
+			continue
+		}
+		digest, err := hex.DecodeString(checksum.value)
+		if err != nil {
+			continue
+		}
+		digests = append(digests, checksum.algorithm+"="+base64.StdEncoding.EncodeToString(digest))
+	}
+
+	if len(digests) > 0 {
+		w.Header().Set("Digest", strings.Join(digests, ","))
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+type CompressionPolicyCreateRequest struct {
+	MimeType   string `json:"mime_type"`
+	FileTypeID int64  `json:"file_type_id"`
+	Codec      string `json:"codec"`
+	Level      int    `json:"level"`
+}
+
+// resolveCompression picks the codec and level for an upload. A policy for
+// the project's file type wins, then the most specific MIME type pattern.
+// Without a matching policy, formats that are already compressed are stored
+// as they are and everything else uses the configured default codec.
+func resolveCompression(ctx context.Context, projectId int64, mimeType string) (compression.Codec, int, error) {
+	currentApp := app.GetCurrentApplication()
+
+	policies, err := currentApp.Store.CompressionPolicies.GetByProjectId(ctx, projectId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var chosen *store.CompressionPolicy
+	bestMatch := -1
+	for _, policy := range policies {
+		if policy.FileTypeID != 0 {
+			if compression.MatchMimeType(policy.FileType.MimeType, mimeType) {
+				chosen = policy
+				break
+			}
+			continue
+		}
+
+		if specificity := compression.MatchSpecificity(policy.MimeType, mimeType); specificity > bestMatch {
+			chosen = policy
+			bestMatch = specificity
+		}
+	}
+
+	if chosen != nil {
+		codec, err := compression.Lookup(chosen.Codec)
+		return codec, chosen.Level, err
+	}
+
+	if compression.IsAlreadyCompressed(mimeType) {
+		codec, err := compression.Lookup(compression.CodecNone)
+		return codec, compression.DefaultLevel, err
+	}
+
+	compressionConfig := currentApp.AppConfig.CompressionConfig
+	codec, err := compression.Lookup(compressionConfig.DefaultCodec)
+	return codec, compressionConfig.DefaultLevel, err
+}
+
+func HandleGetCompressionCodecs(w http.ResponseWriter, r *http.Request) {
+	SendJsonWithoutMeta(w, http.StatusOK, compression.CodecNames())
+}
+
+func HandleGetCompressionPolicies(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStorage := currentApp.Store
+
+	policies, err := appStorage.CompressionPolicies.GetByProjectId(r.Context(), project.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get compression policies: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, policies)
+}
+
+func HandleCreateCompressionPolicy(w http.ResponseWriter, r *http.Request) {
+	var payload CompressionPolicyCreateRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	if (payload.MimeType == "") == (payload.FileTypeID == 0) {
+		WriteJsonError(w, http.StatusBadRequest, "Either mime_type or file_type_id is required, but not both")
+		return
+	}
+
+	codec, codecErr := compression.Lookup(payload.Codec)
+	if codecErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, codecErr.Error())
+		return
+	}
+	if levelErr := codec.ValidateLevel(payload.Level); levelErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, levelErr.Error())
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStorage := currentApp.Store
+
+	policy := &store.CompressionPolicy{
+		ProjectID:  project.ID,
+		MimeType:   payload.MimeType,
+		FileTypeID: payload.FileTypeID,
+		Codec:      codec.Name(),
+		Level:      payload.Level,
+	}
+
+	if payload.FileTypeID != 0 {
+		fileType, typeGetErr := appStorage.FileTypes.GetById(r.Context(), payload.FileTypeID)
+		if typeGetErr != nil {
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Failed to get file type: %v", typeGetErr))
+			return
+		}
+		policy.FileType = *fileType
+	}
+
+	if err := appStorage.CompressionPolicies.Create(r.Context(), policy); err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create compression policy: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusCreated, policy)
+}
+
+func HandleDeleteCompressionPolicy(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStorage := currentApp.Store
+
+	policyId, convErr := strconv.ParseInt(r.PathValue("policyId"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid policy ID")
+		return
+	}
+
+	err := appStorage.CompressionPolicies.Delete(r.Context(), project.ID, policyId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Compression policy not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete compression policy: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, nil)
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
+)
+
+// Headers carrying a customer supplied encryption key, in the style of S3 SSE-C
+const (
+	customerKeyHeader    = "ff-encryption-key"
+	customerKeyMD5Header = "ff-encryption-key-md5"
+)
+
+// customerKeyFromRequest returns the encryption key sent with the request, or
+// nil when the client did not send one
+func customerKeyFromRequest(r *http.Request) ([]byte, error) {
+	encodedKey := r.Header.Get(customerKeyHeader)
+	if encodedKey == "" {
+		return nil, nil
+	}
+
+	return encryption.ParseCustomerKey(encodedKey, r.Header.Get(customerKeyMD5Header))
+}
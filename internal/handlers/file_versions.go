@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// projectFileFromRequest loads the file named by the id in the path that
+// belongs to the project of the ff-project-key header, writing the error
+// response when there is none
+func projectFileFromRequest(w http.ResponseWriter, r *http.Request) (*store.StoredFile, bool) {
+	fileID := r.PathValue("id")
+	if fileID == "" {
+		WriteJsonError(w, http.StatusBadRequest, "File ID is required")
+		return nil, false
+	}
+
+	// get project key from the headers
+	projectKey := r.Header.Get("ff-project-key")
+	if projectKey == "" {
+		WriteJsonError(w, http.StatusBadRequest, "Project key is required")
+		return nil, false
+	}
+
+	uuidFileId, convErr := uuid.Parse(fileID)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	storedFile, storErr := currentApp.Store.StoredFiles.GetByIdAndProjectKey(r.Context(), uuidFileId, projectKey)
+	if storErr != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
+		return nil, false
+	}
+
+	return storedFile, true
+}
+
+// versionFromRequest parses the version number in the path
+func versionFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	version, convErr := strconv.Atoi(r.PathValue("version"))
+	if convErr != nil || version < 1 {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid version")
+		return 0, false
+	}
+	return version, true
+}
+
+// removeFileContent deletes the content of a file that is being deleted,
+// treating content that is already gone as removed
+func removeFileContent(ctx context.Context, storedFile *store.StoredFile) error {
+	currentApp := app.GetCurrentApplication()
+
+	if err := currentApp.Blobs.Delete(ctx, utils.StoredFileKey(storedFile)); err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+		return err
+	}
+	return nil
+}
+
+// pruneVersions deletes the oldest versions of a file beyond the number its
+// project keeps. Failures are only logged, the versions are pruned again
+// with the next upload.
+func pruneVersions(ctx context.Context, fileID uuid.UUID, keep int) {
+	currentApp := app.GetCurrentApplication()
+
+	_, err := currentApp.Store.StoredFiles.PruneVersions(ctx, fileID, keep, func(storedFile *store.StoredFile) error {
+		return removeFileContent(ctx, storedFile)
+	})
+	if err != nil {
+		log.Printf("Error pruning versions of file %s: %v", fileID, err)
+	}
+}
+
+// HandleFileVersions lists every version of a file, newest first
+func HandleFileVersions(w http.ResponseWriter, r *http.Request) {
+	storedFile, ok := projectFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+
+	versions, err := currentApp.Store.StoredFiles.GetVersions(r.Context(), storedFile.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get file versions: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, versions)
+}
+
+// HandleFileVersionRestore makes a copy of a previous version the current
+// version of a file
+func HandleFileVersionRestore(w http.ResponseWriter, r *http.Request) {
+	storedFile, ok := projectFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	version, ok := versionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if version == storedFile.Version {
+		SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	restoreErr := appStore.StoredFiles.RestoreVersion(r.Context(), storedFile.ID, version)
+	if refuseLocked(w, r, storedFile.ProjectID, "restore_version", restoreErr) {
+		return
+	}
+	if errors.Is(restoreErr, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find version %d of file %s", version, storedFile.ID))
+		return
+	}
+	if errors.Is(restoreErr, store.ErrVersionNotShared) {
+		WriteJsonError(w, http.StatusConflict, restoreErr.Error())
+		return
+	}
+	if restoreErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to restore version: %v", restoreErr))
+		return
+	}
+
+	project, projErr := appStore.Projects.GetById(r.Context(), storedFile.ProjectID)
+	if projErr == nil {
+		pruneVersions(r.Context(), storedFile.ID, project.MaxVersions)
+	}
+
+	restored, storErr := appStore.StoredFiles.GetByIdAndProjectKey(r.Context(), storedFile.ID, r.Header.Get("ff-project-key"))
+	if storErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get restored file: %v", storErr))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, restored)
+}
+
+// HandleFileVersionDeletion deletes one version of a file. Deleting the
+// current version makes the previous one current again.
+func HandleFileVersionDeletion(w http.ResponseWriter, r *http.Request) {
+	storedFile, ok := projectFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	version, ok := versionFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	versions, err := appStore.StoredFiles.GetVersions(r.Context(), storedFile.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get file versions: %v", err))
+		return
+	}
+
+	var target *store.StoredFile
+	for _, candidate := range versions {
+		if candidate.Version == version {
+			target = candidate
+			break
+		}
+	}
+	if target == nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find version %d of file %s", version, storedFile.ID))
+		return
+	}
+	if len(versions) == 1 {
+		WriteJsonError(w, http.StatusConflict, "The only version of a file can not be deleted")
+		return
+	}
+
+	deleteErr := appStore.StoredFiles.Delete(r.Context(), target.ID, func(deleted *store.StoredFile) error {
+		return removeFileContent(r.Context(), deleted)
+	})
+	if refuseLocked(w, r, storedFile.ProjectID, "delete_version", deleteErr) {
+		return
+	}
+	if errors.Is(deleteErr, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find version %d of file %s", version, storedFile.ID))
+		return
+	}
+	if deleteErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete version: %v", deleteErr))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusNoContent, nil)
+}
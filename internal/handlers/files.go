@@ -1,67 +1,283 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
 	"github.com/kudzaitsapo/fileflow-server/internal/store"
 	"github.com/kudzaitsapo/fileflow-server/internal/utils"
 )
 
-func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
-	// Parse the multipart form data
+// maxFormFieldSize caps the size of the plain form values sent alongside the file
+const maxFormFieldSize = 4096
 
-	// get project key from the headers
-	projectKey := r.Header.Get("ff-project-key")
-	if projectKey == "" {
-		WriteJsonError(w, http.StatusBadRequest, "Project key is required")
+// maxFormSize caps everything sent before the file part of an upload form
+const maxFormSize = 1 << 20
+
+// uploadBody caps how much of the body of an upload form is read. The limit
+// starts at maxFormSize for the fields sent before the file, and is raised by
+// the maximum size of the file once the project, and any policy, are known.
+type uploadBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	// Reading a byte past the limit tells a body that ends right at the
+	// limit from one that goes on
+	if b.read > b.limit {
+		return 0, &http.MaxBytesError{Limit: b.limit}
+	}
+	if remaining := b.limit - b.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n - int(b.read-b.limit), &http.MaxBytesError{Limit: b.limit}
+	}
+	return n, err
+}
+
+// allow raises the limit by n bytes
+func (b *uploadBody) allow(n int64) {
+	b.limit += n
+}
+
+func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
+	// A presigned URL or the project key names the project. Without either,
+	// it is named by an upload policy in the form.
+	var project *store.Project
+	var ok bool
+	if isPresigned(r) {
+		project, ok = presignedProjectFromRequest(w, r)
+	} else if r.Header.Get("ff-project-key") != "" {
+		project, ok = projectFromRequest(w, r)
+	} else {
+		ok = true
+	}
+	if !ok {
 		return
 	}
 
-	currentApp := app.GetCurrentApplication()
-	appStore := currentApp.Store
+	// Clients may encrypt the file with their own key instead of the project's
+	customerKey, keyErr := customerKeyFromRequest(r)
+	if keyErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid encryption key: %s", keyErr))
+		return
+	}
 
-	// validate project key by getting the project
-	project, projErr := appStore.Projects.GetByKey(r.Context(), projectKey)
-	if projErr != nil {
-		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Project not found for key: %s", projectKey))
+	// Checksums the client expects the received content to have
+	checksums, checksumErr := checksumsFromRequest(r)
+	if checksumErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, checksumErr.Error())
 		return
 	}
 
-	// validate upload size based on project settings
-	err := r.ParseMultipartForm(project.MaxUploadSize << 20)
+	// Only the form fields are read until it is known how large the file may be
+	body := &uploadBody{ReadCloser: r.Body, limit: maxFormSize}
+	r.Body = body
+
+	// The form is streamed part by part, so fields must be sent before the file
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to upload file: %s", err), http.StatusBadRequest)
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Unable to upload file: %s", err))
 		return
 	}
 
-	// Get the file from the form data
-	file, handler, parseErr := r.FormFile("file")
-	// get folder from form data
-	folder := r.FormValue("folder")
-	storedFileName := uuid.New().String() + ".ffs"
+	var folder, encodedPolicy, policySignature string
+	var filePart *multipart.Part
+	for filePart == nil {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			break
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(partErr, &maxBytesErr) {
+			WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Form fields exceed the maximum size of %d bytes", maxFormSize))
+			return
+		}
+		if partErr != nil {
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Unable to upload file: %s", partErr))
+			return
+		}
+
+		switch part.FormName() {
+		case "file":
+			filePart = part
+		case "folder":
+			value, readErr := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if readErr != nil {
+				WriteJsonError(w, http.StatusBadRequest, "Unable to read folder")
+				return
+			}
+			folder = string(value)
+		case "policy", "signature":
+			value, readErr := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if readErr != nil {
+				WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Unable to read %s", part.FormName()))
+				return
+			}
+			if part.FormName() == "policy" {
+				encodedPolicy = string(value)
+			} else {
+				policySignature = string(value)
+			}
+		}
+	}
 
-	if parseErr != nil {
+	if filePart == nil {
 		WriteJsonError(w, http.StatusBadRequest, "Unable to get file")
 		return
 	}
-	defer file.Close()
+	defer filePart.Close()
+
+	var policy *UploadPolicy
+	if project == nil {
+		if encodedPolicy == "" {
+			WriteJsonError(w, http.StatusBadRequest, "Project key is required")
+			return
+		}
+		project, policy, ok = policyProjectFromForm(w, r, encodedPolicy, policySignature)
+		if !ok {
+			return
+		}
+	}
+
+	// validate upload size based on project settings, or the policy when it
+	// allows less
+	maxUploadSize := project.MaxUploadSize << 20
+	if policy != nil && policy.MaxSize > 0 && policy.MaxSize < maxUploadSize {
+		maxUploadSize = policy.MaxSize
+	}
+	body.allow(maxUploadSize)
+
+	// Large uploads take longer than the server wide read timeout
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	// Folders are created as needed, and their path can not leave the project
+	folder, folderErr := utils.CleanFolderPath(folder)
+	if folderErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder")
+		return
+	}
+
+	// A presigned URL fixes the folder files are uploaded into
+	if isPresigned(r) {
+		signedFolder := r.URL.Query().Get("folder")
+		if folder != "" && folder != signedFolder {
+			WriteJsonError(w, http.StatusForbidden, "Folder does not match the presigned URL")
+			return
+		}
+		folder = signedFolder
+	}
+
+	mimeType := filePart.Header.Get("Content-Type")
+	fileUpload := &upload{
+		project:     project,
+		content:     filePart,
+		fileName:    filePart.FileName(),
+		mimeType:    mimeType,
+		folder:      folder,
+		customerKey: customerKey,
+		checksums:   checksums,
+	}
+
+	// An upload policy narrows what the project allows
+	if policy != nil {
+		if !policy.allowsFolder(folder) {
+			WriteJsonError(w, http.StatusForbidden, "Folder is not allowed by the policy")
+			return
+		}
+		if !policy.allowsMimeType(mimeType) {
+			WriteJsonError(w, http.StatusForbidden, "File type is not allowed by the policy")
+			return
+		}
+		fileUpload.minSize = policy.MinSize
+		fileUpload.maxSize = policy.MaxSize
+	}
+
+	storedFile, ok := storeUpload(w, r, fileUpload)
+	if !ok {
+		return
+	}
+
+	// 4. Return the stored file to the client
+	SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+}
+
+// upload is the content of a file received by one of the upload endpoints,
+// with what is known about it
+type upload struct {
+	project  *store.Project
+	content  io.Reader
+	fileName string
+	mimeType string
+	// folder is a cleaned folder path, created when it does not exist yet
+	folder string
+	// customerKey encrypts the file instead of the project's key when set
+	customerKey []byte
+	checksums   *expectedChecksums
+	// minSize and maxSize bound the size of the file in bytes within the
+	// maximum upload size of the project, when set
+	minSize int64
+	maxSize int64
+}
+
+// storeUpload checks an upload against the settings of its project and
+// stores it as a file, adding a version when a file already exists at its
+// path. The error response is written when it fails.
+func storeUpload(w http.ResponseWriter, r *http.Request, u *upload) (*store.StoredFile, bool) {
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	project := u.project
+
+	// The storage driver may have changed since the project chose its policy
+	if !blobstore.SupportsDurability(currentApp.Blobs, project.DurabilityPolicy) {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Durability policy %s is not supported by the storage driver", project.DurabilityPolicy))
+		return nil, false
+	}
+
+	storedFileName := uuid.New().String() + ".ffs"
+	mimeType := u.mimeType
 
 	// File type validation based on project settings
-	isAllowed, validationErr := appStore.ProjectAllowedFileTypes.FileTypeIsAllowed(r.Context(), project.ID, handler.Header.Get("Content-Type"))
+	isAllowed, validationErr := appStore.ProjectAllowedFileTypes.FileTypeIsAllowed(r.Context(), project.ID, mimeType)
 
 	if !isAllowed || validationErr != nil {
 		WriteJsonError(w, http.StatusBadRequest, "File type not allowed")
-		return
+		return nil, false
+	}
+
+	var folderId int64
+	if u.folder != "" {
+		projectFolder, ensureErr := appStore.Folders.EnsurePath(r.Context(), project.ID, u.folder)
+		if ensureErr != nil {
+			log.Printf("Error creating folder %s: %v", u.folder, ensureErr)
+			WriteJsonError(w, http.StatusInternalServerError, "Unable to create folder")
+			return nil, false
+		}
+		folderId = projectFolder.ID
 	}
 
 	// Assign Icons based on file type
-	fileType, fileTypeRetrievalErr := appStore.FileTypes.GetByMimeType(r.Context(), handler.Header.Get("Content-Type"))
+	fileType, fileTypeRetrievalErr := appStore.FileTypes.GetByMimeType(r.Context(), mimeType)
 	var fileIcon string
 	if fileTypeRetrievalErr != nil {
 		fileIcon = ""
@@ -73,34 +289,177 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 1. Get file information => file name, size, etc.
+	// Pick the codec from the project's compression policies
+	codec, level, codecErr := resolveCompression(r.Context(), project.ID, mimeType)
+	if codecErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to choose compression: %s", codecErr))
+		return nil, false
+	}
+
+	maxUploadSize := project.MaxUploadSize << 20
+	if u.maxSize > 0 && u.maxSize < maxUploadSize {
+		maxUploadSize = u.maxSize
+	}
+	saveOptions := utils.SaveOptions{
+		MaxSize: maxUploadSize,
+		Codec:   codec,
+		Level:   level,
+	}
+
+	// Encrypt the frames with the customer's key, or with the project's data
+	// key when encryption at rest is enabled. Only files encrypted with the
+	// same key can share content.
+	var keyFingerprint, blobScope string
+	if u.customerKey != nil {
+		salt, saltErr := encryption.NewSalt()
+		if saltErr != nil {
+			WriteJsonError(w, http.StatusInternalServerError, "Unable to encrypt file")
+			return nil, false
+		}
+		sealer, sealerErr := encryption.NewFrameSealer(u.customerKey, salt)
+		if sealerErr != nil {
+			WriteJsonError(w, http.StatusInternalServerError, "Unable to encrypt file")
+			return nil, false
+		}
+		saveOptions.Sealer = sealer
+		saveOptions.Salt = salt
+		keyFingerprint = encryption.CustomerKeyFingerprint(u.customerKey)
+		blobScope = "key:" + keyFingerprint
+	} else if currentApp.Keyring != nil {
+		sealer, salt, keyErr := currentApp.Keyring.NewSealer(r.Context(), project.ID)
+		if keyErr != nil {
+			log.Printf("Error loading data key for project %d: %v", project.ID, keyErr)
+			WriteJsonError(w, http.StatusInternalServerError, "Unable to encrypt file")
+			return nil, false
+		}
+		saveOptions.Sealer = sealer
+		saveOptions.Salt = salt
+		blobScope = fmt.Sprintf("project:%d", project.ID)
+	}
+
+	// Blobs are only shared between files stored with the same policy
+	if project.DurabilityPolicy == blobstore.DurabilityErasure {
+		blobScope = path.Join(blobScope, blobstore.DurabilityErasure)
+	}
+
+	// 1. Record the upload as pending, so that it can be cleaned up if the
+	// server stops before it is finalised
 	storedFile := &store.StoredFile{
-		FileName:          handler.Filename,
-		FileSize:          handler.Size,
-		MimeType:          handler.Header.Get("Content-Type"),
-		Folder:            folder,
+		FileName:          u.fileName,
+		MimeType:          mimeType,
+		Folder:            u.folder,
+		FolderID:          folderId,
 		SavedAs:           storedFileName,
-		OriginalExtension: utils.GetFileExtension(handler.Filename),
+		OriginalExtension: utils.GetFileExtension(u.fileName),
 		ProjectID:         project.ID,
 		Icon:              fileIcon,
+		KeyFingerprint:    keyFingerprint,
+		DurabilityPolicy:  project.DurabilityPolicy,
 	}
-	// 2. Store the file in the database
-	storErr := appStore.StoredFiles.Create(r.Context(), storedFile)
-	if storErr != nil {
-		log.Printf("Error storing file: %v", storErr)
+	if pendingErr := appStore.StoredFiles.CreatePending(r.Context(), storedFile); pendingErr != nil {
+		log.Printf("Error storing file: %v", pendingErr)
 		WriteJsonError(w, http.StatusInternalServerError, "Unable to store file")
-		return
+		return nil, false
 	}
 
-	// 3. Compress the file and save it
-	saveErr := utils.CompressAndSaveFile(file, storedFileName, folder)
+	// 2. Compress the file and save it while it is being received. The content
+	// hash is only known at the end, so it is written to a temporary key first
+	uploadKey := utils.StoredFileKey(storedFile)
+	saveResult, saveErr := utils.CompressAndSaveFile(r.Context(), currentApp.Blobs, u.content, uploadKey, saveOptions)
 	if saveErr != nil {
+		discardUpload(storedFile, uploadKey)
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(saveErr, utils.ErrFileTooLarge) || errors.As(saveErr, &maxBytesErr) {
+			if maxUploadSize < project.MaxUploadSize<<20 {
+				WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File exceeds the maximum size of %d bytes", maxUploadSize))
+				return nil, false
+			}
+			WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File exceeds the maximum upload size of %d MB", project.MaxUploadSize))
+			return nil, false
+		}
 		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to save file: %s", saveErr))
-		return
+		return nil, false
 	}
 
-	// 4. Return the stored file to the client
-	SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+	if saveResult.Size < u.minSize {
+		discardUpload(storedFile, uploadKey)
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("File is smaller than the minimum upload size of %d bytes", u.minSize))
+		return nil, false
+	}
+
+	if u.checksums != nil {
+		if verifyErr := u.checksums.verify(saveResult); verifyErr != nil {
+			discardUpload(storedFile, uploadKey)
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("File was not received intact: %s", verifyErr))
+			return nil, false
+		}
+	}
+
+	// 3. Finalise the file, sharing the blob of identical content. The blob is
+	// moved into place and the file made available in one transaction.
+	storedFile.FileSize = saveResult.Size
+	storedFile.SHA256 = saveResult.SHA256
+	storedFile.MD5 = saveResult.MD5
+	blob := &store.Blob{
+		SHA256:           saveResult.SHA256,
+		Scope:            blobScope,
+		Key:              blobstore.DurabilityKey(project.DurabilityPolicy, utils.ContentBlobKey(saveResult.SHA256, blobScope)),
+		Size:             saveResult.Size,
+		StoredSize:       saveResult.StoredSize,
+		StorageFormat:    utils.StorageFormatFramed,
+		CompressionCodec: codec.Name(),
+		CompressionLevel: level,
+		Encrypted:        saveOptions.Sealer != nil,
+	}
+
+	reused, storErr := appStore.StoredFiles.Finalise(r.Context(), storedFile, blob, func(blob *store.Blob) error {
+		return currentApp.Blobs.Move(r.Context(), uploadKey, blob.Key)
+	})
+	if storErr != nil {
+		discardUpload(storedFile, uploadKey)
+		if refuseLocked(w, r, project.ID, "upload", storErr) {
+			return nil, false
+		}
+		log.Printf("Error finalising file %s: %v", storedFile.ID, storErr)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to store file")
+		return nil, false
+	}
+	if reused {
+		removeBlob(r.Context(), uploadKey)
+	}
+
+	// Uploads to an existing path add a version, of which only so many are kept
+	if storedFile.Version > 1 {
+		pruneVersions(r.Context(), storedFile.ID, project.MaxVersions)
+	}
+
+	return storedFile, true
+}
+
+// discardUpload removes a pending file and whatever was saved of its content.
+// Anything left behind is cleaned up by the reconcile command.
+func discardUpload(storedFile *store.StoredFile, uploadKey string) {
+	currentApp := app.GetCurrentApplication()
+
+	// The request may have been cancelled, which must not stop the clean up
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := currentApp.Store.StoredFiles.DeletePending(ctx, storedFile.ID); err != nil {
+		log.Printf("Error removing pending file %s: %v", storedFile.ID, err)
+	}
+	removeBlob(ctx, uploadKey)
+}
+
+// removeBlob deletes a blob that is no longer needed, ignoring blobs that
+// were never written
+func removeBlob(ctx context.Context, key string) {
+	currentApp := app.GetCurrentApplication()
+
+	if err := currentApp.Blobs.Delete(ctx, key); err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+		log.Printf("Error removing blob %s: %v", key, err)
+	}
 }
 
 func HandleFileDownload(w http.ResponseWriter, r *http.Request) {
@@ -111,13 +470,6 @@ func HandleFileDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get project key from the headers
-	projectKey := r.Header.Get("ff-project-key")
-	if projectKey == "" {
-		WriteJsonError(w, http.StatusBadRequest, "Project key is required")
-		return
-	}
-
 	uuidFileId, convErr := uuid.Parse(fileID)
 	if convErr != nil {
 		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
@@ -127,33 +479,171 @@ func HandleFileDownload(w http.ResponseWriter, r *http.Request) {
 	currentApp := app.GetCurrentApplication()
 	appStore := currentApp.Store
 
-	// Get the file from the database
-	storedFile, storErr := appStore.StoredFiles.GetByIdAndProjectKey(r.Context(), uuidFileId, projectKey)
+	// Get the file from the database, with the project named by a presigned
+	// URL or the project key
+	var storedFile *store.StoredFile
+	var storErr error
+	if isPresigned(r) {
+		projectId, ok := presignedProjectId(w, r, http.MethodGet)
+		if !ok {
+			return
+		}
+		storedFile, storErr = appStore.StoredFiles.GetByIdAndProjectId(r.Context(), uuidFileId, projectId)
+	} else {
+		projectKey := r.Header.Get("ff-project-key")
+		if projectKey == "" {
+			WriteJsonError(w, http.StatusBadRequest, "Project key is required")
+			return
+		}
+		storedFile, storErr = appStore.StoredFiles.GetByIdAndProjectKey(r.Context(), uuidFileId, projectKey)
+	}
 	if storErr != nil {
 		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
 		return
 	}
 
-	// Decompress the file
-	// TODO: implement a way to choose between file based and stream based file serving
-	// depending on file size
-	filePath, decompressErr := utils.DecompressFile(storedFile.SavedAs, storedFile.Folder)
-	if decompressErr != nil {
-		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to decompress file: %s", decompressErr))
+	// A previous version can be downloaded by its number
+	if versionParam := r.URL.Query().Get("version"); versionParam != "" {
+		version, versionErr := strconv.Atoi(versionParam)
+		if versionErr != nil || version < 1 {
+			WriteJsonError(w, http.StatusBadRequest, "Invalid version")
+			return
+		}
+		storedFile, storErr = appStore.StoredFiles.GetVersion(r.Context(), uuidFileId, version)
+		if storErr != nil {
+			WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find version %d of file %s", version, fileID))
+			return
+		}
+	}
+
+	// Files encrypted with a customer key can only be read with the same key
+	customerKey, keyErr := customerKeyFromRequest(r)
+	if keyErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid encryption key: %s", keyErr))
+		return
+	}
+	if storedFile.KeyFingerprint != "" {
+		if customerKey == nil {
+			WriteJsonError(w, http.StatusBadRequest, "File is encrypted with a customer key, which is required to download it")
+			return
+		}
+		if !encryption.MatchesFingerprint(customerKey, storedFile.KeyFingerprint) {
+			WriteJsonError(w, http.StatusForbidden, "Encryption key does not match the key the file was uploaded with")
+			return
+		}
+	} else if customerKey != nil {
+		WriteJsonError(w, http.StatusBadRequest, "File was not encrypted with a customer key")
 		return
 	}
 
-	// Return the file to the client
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", storedFile.FileName))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", storedFile.FileSize))
-	w.Header().Set("Content-Type", storedFile.MimeType)
+	// A presigned URL may fix the disposition, e.g. to show the file inline
+	disposition := fmt.Sprintf("attachment; filename=%s", storedFile.FileName)
+	if signedDisposition := r.URL.Query().Get("disposition"); signedDisposition != "" && isPresigned(r) {
+		disposition = signedDisposition
+	}
+
+	serveFile(w, r, storedFile, customerKey, disposition)
+}
+
+// serveFile writes the content of a file, answering Range requests where it
+// can. customerKey decrypts files encrypted with a customer key.
+func serveFile(w http.ResponseWriter, r *http.Request, storedFile *store.StoredFile, customerKey []byte, disposition string) {
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
 
 	uploadedAt, err := time.Parse(time.RFC3339, storedFile.UploadedAt)
 	if err != nil {
 		WriteJsonError(w, http.StatusInternalServerError, "Invalid upload time format")
 		return
 	}
-	http.ServeContent(w, r, storedFile.FileName, uploadedAt, filePath)
+
+	// Downloads keep a file in hot storage
+	if touchErr := appStore.StoredFiles.TouchAccessed(r.Context(), storedFile.ID); touchErr != nil {
+		log.Printf("Error recording download of file %s: %v", storedFile.ID, touchErr)
+	}
+
+	// Large downloads take longer than the server wide write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", storedFile.MimeType)
+	setChecksumHeaders(w, storedFile)
+
+	// Framed files can be read from any offset, which lets ServeContent answer
+	// Range and If-Range requests by inflating only the frames it needs
+	if storedFile.StorageFormat == utils.StorageFormatFramed {
+		var sealers compression.SealerFactory
+		if storedFile.KeyFingerprint != "" {
+			sealers = func(salt []byte) (compression.FrameSealer, error) {
+				return encryption.NewFrameSealer(customerKey, salt)
+			}
+		} else if storedFile.Encrypted {
+			if currentApp.Keyring == nil {
+				WriteJsonError(w, http.StatusInternalServerError, "File is encrypted but no master key is configured")
+				return
+			}
+			sealers = currentApp.Keyring.Sealers(r.Context(), storedFile.ProjectID)
+		}
+
+		framedFile, openErr := utils.OpenFramedFile(r.Context(), currentApp.Blobs, utils.StoredFileKey(storedFile), sealers)
+		if openErr != nil {
+			WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to open file: %s", openErr))
+			return
+		}
+		defer framedFile.Close()
+
+		// A file recorded as encrypted must never be served from a container
+		// that is not, and the other way round
+		if framedFile.Encrypted() != (sealers != nil) {
+			log.Printf("Refusing to serve file %s: container encryption does not match the file record", storedFile.ID)
+			WriteJsonError(w, http.StatusInternalServerError, "Unable to open file: encryption does not match")
+			return
+		}
+
+		http.ServeContent(w, r, storedFile.FileName, uploadedAt, framedFile)
+		return
+	}
+
+	// Older files are single deflate streams. Range requests need a seekable
+	// copy of those, which is only worth making for small files. Everything
+	// else is streamed as it is inflated.
+	if r.Header.Get("Range") != "" && storedFile.FileSize <= currentApp.AppConfig.Config.DownloadTempFileThreshold {
+		serveFromTempFile(w, r, storedFile, uploadedAt)
+		return
+	}
+
+	stream, decompressErr := utils.DecompressFileAndReturnStream(r.Context(), currentApp.Blobs, storedFile.SavedAs, storedFile.StorageFolder)
+	if decompressErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to decompress file: %s", decompressErr))
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", storedFile.FileSize))
+	w.Header().Set("Last-Modified", uploadedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+
+	if _, copyErr := io.Copy(w, stream); copyErr != nil {
+		// Headers are already sent, so all that can be done is to log it
+		log.Printf("Error streaming file %s: %v", storedFile.ID, copyErr)
+	}
+}
+
+// serveFromTempFile inflates the file to a temporary file so that
+// http.ServeContent can answer Range requests, and removes it afterwards
+func serveFromTempFile(w http.ResponseWriter, r *http.Request, storedFile *store.StoredFile, uploadedAt time.Time) {
+	currentApp := app.GetCurrentApplication()
+
+	tempFile, decompressErr := utils.DecompressFile(r.Context(), currentApp.Blobs, storedFile.SavedAs, storedFile.StorageFolder)
+	if decompressErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to decompress file: %s", decompressErr))
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	http.ServeContent(w, r, storedFile.FileName, uploadedAt, tempFile)
 }
 
 func HandleFilesList(w http.ResponseWriter, r *http.Request) {
@@ -225,3 +715,95 @@ func HandleFileInfo(w http.ResponseWriter, r *http.Request) {
 	// Return the file to the client
 	SendJsonWithoutMeta(w, http.StatusOK, storedFile)
 }
+
+// HandleFileRestore moves a file in cold storage back to hot storage. The
+// move runs in the background, so 202 is returned until the file is hot.
+func HandleFileRestore(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("id")
+	if fileID == "" {
+		WriteJsonError(w, http.StatusBadRequest, "File ID is required")
+		return
+	}
+
+	// get project key from the headers
+	projectKey := r.Header.Get("ff-project-key")
+	if projectKey == "" {
+		WriteJsonError(w, http.StatusBadRequest, "Project key is required")
+		return
+	}
+
+	uuidFileId, convErr := uuid.Parse(fileID)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	storedFile, storErr := appStore.StoredFiles.GetByIdAndProjectKey(r.Context(), uuidFileId, projectKey)
+	if storErr != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
+		return
+	}
+
+	if storedFile.StorageClass != store.StorageClassCold {
+		SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+		return
+	}
+
+	if currentApp.Tierer == nil {
+		WriteJsonError(w, http.StatusInternalServerError, "File is in cold storage but no cold storage is configured")
+		return
+	}
+
+	if _, restoreErr := currentApp.Tierer.Restore(storedFile); restoreErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Unable to restore file: %s", restoreErr))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusAccepted, storedFile)
+}
+
+// blobsReader reads blobs one after the other, as the parts of one file
+type blobsReader struct {
+	ctx     context.Context
+	blobs   blobstore.BlobStore
+	keys    []string
+	current io.ReadCloser
+}
+
+func (b *blobsReader) Read(p []byte) (int, error) {
+	for {
+		if b.current == nil {
+			if len(b.keys) == 0 {
+				return 0, io.EOF
+			}
+
+			reader, err := b.blobs.Get(b.ctx, b.keys[0])
+			if err != nil {
+				return 0, fmt.Errorf("blob %s: %w", b.keys[0], err)
+			}
+			b.current = reader
+			b.keys = b.keys[1:]
+		}
+
+		n, err := b.current.Read(p)
+		if err == io.EOF {
+			b.current.Close()
+			b.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (b *blobsReader) Close() error {
+	if b.current == nil {
+		return nil
+	}
+	return b.current.Close()
+}
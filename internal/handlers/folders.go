@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+type FolderCreateRequest struct {
+	Name string `json:"name"`
+	// ParentID is the folder to create the folder in, 0 for the root
+	ParentID int64 `json:"parent_id"`
+}
+
+type FolderRenameRequest struct {
+	Name string `json:"name"`
+}
+
+type FolderMoveRequest struct {
+	// ParentID is the folder to move the folder into, 0 for the root
+	ParentID int64 `json:"parent_id"`
+}
+
+type FileMoveRequest struct {
+	// FolderID is the folder to move the file into, 0 for the root
+	FolderID int64 `json:"folder_id"`
+}
+
+// FolderChildrenResponse lists what is directly inside a folder. Folder is
+// nil for the root of the project.
+type FolderChildrenResponse struct {
+	Folder  *store.Folder       `json:"folder"`
+	Folders []*store.Folder     `json:"folders"`
+	Files   []*store.StoredFile `json:"files"`
+}
+
+// projectFromRequest loads the project of the ff-project-key header, writing
+// the error response when there is none
+func projectFromRequest(w http.ResponseWriter, r *http.Request) (*store.Project, bool) {
+	projectKey := r.Header.Get("ff-project-key")
+	if projectKey == "" {
+		WriteJsonError(w, http.StatusBadRequest, "Project key is required")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	project, projErr := currentApp.Store.Projects.GetByKey(r.Context(), projectKey)
+	if projErr != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Project not found for key: %s", projectKey))
+		return nil, false
+	}
+
+	return project, true
+}
+
+// folderFromRequest loads the folder named by the id in the path, writing the
+// error response when the project has no such folder
+func folderFromRequest(w http.ResponseWriter, r *http.Request, project *store.Project) (*store.Folder, bool) {
+	folderId, convErr := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder ID")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	folder, err := currentApp.Store.Folders.GetById(r.Context(), project.ID, folderId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find folder with id: %d", folderId))
+		return nil, false
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get folder: %v", err))
+		return nil, false
+	}
+
+	return folder, true
+}
+
+// writeFolderError writes the response for an error changing a folder or
+// moving a file
+func writeFolderError(w http.ResponseWriter, err error, conflict string) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		WriteJsonError(w, http.StatusNotFound, "Unable to find the destination folder")
+	case errors.Is(err, store.ErrConflict):
+		WriteJsonError(w, http.StatusConflict, conflict)
+	case errors.Is(err, store.ErrFolderCycle):
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+	default:
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update folders: %v", err))
+	}
+}
+
+// HandleFolderChildren lists the folders and files directly inside a folder,
+// or at the root of the project when no folder id is given. Files are
+// paginated, folders are always listed in full.
+func HandleFolderChildren(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	response := &FolderChildrenResponse{}
+	folderId := int64(0)
+	if r.PathValue("id") != "" {
+		folder, ok := folderFromRequest(w, r, project)
+		if !ok {
+			return
+		}
+		response.Folder = folder
+		folderId = folder.ID
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	folders, err := appStore.Folders.GetChildren(r.Context(), project.ID, folderId)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get folders: %v", err))
+		return
+	}
+	response.Folders = folders
+
+	files, err := appStore.StoredFiles.GetByFolder(r.Context(), project.ID, folderId, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get files: %v", err))
+		return
+	}
+	response.Files = files
+
+	filesCount, countErr := appStore.StoredFiles.CountByFolder(r.Context(), project.ID, folderId)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get files count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, response, JsonMeta{
+		TotalRecords: filesCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+func HandleGetFolder(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	folder, ok := folderFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, folder)
+}
+
+func HandleFolderCreation(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload FolderCreateRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	if !utils.ValidFolderName(payload.Name) {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder name")
+		return
+	}
+
+	folder := &store.Folder{
+		ProjectID: project.ID,
+		Name:      payload.Name,
+	}
+	if payload.ParentID != 0 {
+		folder.ParentID = &payload.ParentID
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.Folders.Create(r.Context(), folder); err != nil {
+		writeFolderError(w, err, fmt.Sprintf("A folder called %s already exists there", payload.Name))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusCreated, folder)
+}
+
+// HandleFolderRename renames a folder, changing the path of everything inside
+// it
+func HandleFolderRename(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload FolderRenameRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	if !utils.ValidFolderName(payload.Name) {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder name")
+		return
+	}
+
+	folder, ok := folderFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	parentId := int64(0)
+	if folder.ParentID != nil {
+		parentId = *folder.ParentID
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.Folders.Relocate(r.Context(), folder, parentId, payload.Name); err != nil {
+		writeFolderError(w, err, fmt.Sprintf("A folder called %s already exists there", payload.Name))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, folder)
+}
+
+// HandleFolderMove moves a folder, with everything inside it, into another
+// folder
+func HandleFolderMove(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload FolderMoveRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	folder, ok := folderFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.Folders.Relocate(r.Context(), folder, payload.ParentID, folder.Name); err != nil {
+		writeFolderError(w, err, fmt.Sprintf("A folder called %s already exists there", folder.Name))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, folder)
+}
+
+// HandleFileMove moves a file, with its previous versions, into another
+// folder
+func HandleFileMove(w http.ResponseWriter, r *http.Request) {
+	storedFile, ok := projectFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload FileMoveRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.StoredFiles.Move(r.Context(), storedFile, payload.FolderID); err != nil {
+		writeFolderError(w, err, fmt.Sprintf("A file called %s already exists there", storedFile.FileName))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+}
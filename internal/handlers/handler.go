@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -104,3 +105,67 @@ func GetCurrentProject(r *http.Request) (*store.Project, error) {
 
 	return project, nil
 }
+
+// projectFromPath loads the project named by the id in the path, writing the
+// error response when there is none
+func projectFromPath(w http.ResponseWriter, r *http.Request) (*store.Project, bool) {
+	projectId, convErr := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid project ID")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	project, projectErr := currentApp.Store.Projects.GetById(r.Context(), projectId)
+	if projectErr != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find project with id: %d", projectId))
+		return nil, false
+	}
+
+	return project, true
+}
+
+// assignedProjectFromPath is projectFromPath for requests that hand out
+// access to the project, which only users assigned to it may make
+func assignedProjectFromPath(w http.ResponseWriter, r *http.Request) (*store.Project, bool) {
+	currentUser, userErr := GetCurrentUser(r)
+	if userErr != nil {
+		WriteJsonError(w, http.StatusUnauthorized, fmt.Sprintf("error getting current user: %v", userErr))
+		return nil, false
+	}
+
+	project, ok := projectFromPath(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	assigned, err := currentApp.Store.UserAssignedProjects.ProjectIsAssignedToUser(r.Context(), project.ID, currentUser.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check project assignment: %v", err))
+		return nil, false
+	}
+	if !assigned {
+		WriteJsonError(w, http.StatusForbidden, "You are not assigned to this project")
+		return nil, false
+	}
+
+	return project, true
+}
+
+// requireAdmin returns the current user when it has the admin role, writing
+// the error response otherwise
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*store.User, bool) {
+	currentUser, err := GetCurrentUser(r)
+	if err != nil {
+		WriteJsonError(w, http.StatusUnauthorized, fmt.Sprintf("error getting current user: %v", err))
+		return nil, false
+	}
+
+	if currentUser.Role.Name != store.AdminRole {
+		WriteJsonError(w, http.StatusForbidden, "Only an admin can do this")
+		return nil, false
+	}
+
+	return currentUser, true
+}
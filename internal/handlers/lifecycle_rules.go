@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+type LifecycleRuleRequest struct {
+	Name string `json:"name"`
+	// Action is "expire_files" or "expire_versions"
+	Action string `json:"action"`
+	// Folder limits the rule to a folder and everything inside it, the whole
+	// project when empty
+	Folder string `json:"folder"`
+	Days   int    `json:"days"`
+	// Enabled is true when left out. Disabled rules can still be previewed.
+	Enabled *bool `json:"enabled"`
+}
+
+// LifecycleRulePreviewResponse lists the files a rule would expire if it ran
+// now
+type LifecycleRulePreviewResponse struct {
+	Rule *store.LifecycleRule `json:"rule"`
+	// Cutoff is the time the files are older than
+	Cutoff string              `json:"cutoff"`
+	Files  []*store.StoredFile `json:"files"`
+}
+
+// lifecycleRuleFromRequest loads the rule named by the ruleId in the path,
+// writing the error response when the project has no such rule
+func lifecycleRuleFromRequest(w http.ResponseWriter, r *http.Request, project *store.Project) (*store.LifecycleRule, bool) {
+	ruleId, convErr := strconv.ParseInt(r.PathValue("ruleId"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid rule ID")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	rule, err := currentApp.Store.LifecycleRules.GetById(r.Context(), project.ID, ruleId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Lifecycle rule not found")
+		return nil, false
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle rule: %v", err))
+		return nil, false
+	}
+
+	return rule, true
+}
+
+// applyLifecycleRuleRequest validates a requested rule and copies it onto
+// rule
+func applyLifecycleRuleRequest(payload *LifecycleRuleRequest, rule *store.LifecycleRule) error {
+	if payload.Action != store.LifecycleExpireFiles && payload.Action != store.LifecycleExpireVersions {
+		return fmt.Errorf("action must be %q or %q", store.LifecycleExpireFiles, store.LifecycleExpireVersions)
+	}
+	if payload.Days < 1 {
+		return errors.New("days must be at least 1")
+	}
+
+	folder, err := utils.CleanFolderPath(payload.Folder)
+	if err != nil {
+		return errors.New("invalid folder")
+	}
+
+	rule.Name = payload.Name
+	rule.Action = payload.Action
+	rule.Folder = folder
+	rule.Days = payload.Days
+	if payload.Enabled != nil {
+		rule.Enabled = *payload.Enabled
+	}
+	return nil
+}
+
+func HandleGetLifecycleRules(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	rules, err := currentApp.Store.LifecycleRules.GetByProjectId(r.Context(), project.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle rules: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, rules)
+}
+
+func HandleCreateLifecycleRule(w http.ResponseWriter, r *http.Request) {
+	var payload LifecycleRuleRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	rule := &store.LifecycleRule{
+		ProjectID: project.ID,
+		Enabled:   true,
+	}
+	if err := applyLifecycleRuleRequest(&payload, rule); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.LifecycleRules.Create(r.Context(), rule); err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create lifecycle rule: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusCreated, rule)
+}
+
+// HandleUpdateLifecycleRule replaces a rule. Leaving out enabled keeps the
+// rule enabled or disabled as it was.
+func HandleUpdateLifecycleRule(w http.ResponseWriter, r *http.Request) {
+	var payload LifecycleRuleRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	rule, ok := lifecycleRuleFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	if err := applyLifecycleRuleRequest(&payload, rule); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	err := currentApp.Store.LifecycleRules.Update(r.Context(), rule)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Lifecycle rule not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update lifecycle rule: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, rule)
+}
+
+func HandleDeleteLifecycleRule(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	ruleId, convErr := strconv.ParseInt(r.PathValue("ruleId"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid rule ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	err := currentApp.Store.LifecycleRules.Delete(r.Context(), project.ID, ruleId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Lifecycle rule not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete lifecycle rule: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusNoContent, nil)
+}
+
+// HandlePreviewLifecycleRule lists the files or previous versions a rule
+// would expire if it ran now, without changing anything
+func HandlePreviewLifecycleRule(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	rule, ok := lifecycleRuleFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+	now := time.Now()
+
+	files, err := appStore.LifecycleRules.GetMatches(r.Context(), rule, now, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get matching files: %v", err))
+		return
+	}
+
+	filesCount, countErr := appStore.LifecycleRules.CountMatches(r.Context(), rule, now)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get matching files count: %v", countErr))
+		return
+	}
+
+	response := &LifecycleRulePreviewResponse{
+		Rule:   rule,
+		Cutoff: rule.Cutoff(now).Format(time.RFC3339),
+		Files:  files,
+	}
+
+	SendJson(w, http.StatusOK, response, JsonMeta{
+		TotalRecords: filesCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+// HandleGetLifecycleRuns lists the runs of the lifecycle rules of a project,
+// newest first
+func HandleGetLifecycleRuns(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	runs, err := appStore.LifecycleRules.GetRuns(r.Context(), project.ID, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle runs: %v", err))
+		return
+	}
+
+	runsCount, countErr := appStore.LifecycleRules.CountRuns(r.Context(), project.ID)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle runs count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, runs, JsonMeta{
+		TotalRecords: runsCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+// HandleGetLifecycleRunItems lists the files a run expired or failed to
+// expire
+func HandleGetLifecycleRunItems(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	runId, convErr := strconv.ParseInt(r.PathValue("runId"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid run ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	run, err := appStore.LifecycleRules.GetRun(r.Context(), project.ID, runId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Lifecycle run not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle run: %v", err))
+		return
+	}
+
+	items, err := appStore.LifecycleRules.GetRunItems(r.Context(), run.ID, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle run files: %v", err))
+		return
+	}
+
+	itemsCount, countErr := appStore.LifecycleRules.CountRunItems(r.Context(), run.ID)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lifecycle run files count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, items, JsonMeta{
+		TotalRecords: itemsCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
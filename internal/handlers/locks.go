@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+type LegalHoldRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type RetentionRequest struct {
+	// RetentionDays is how long every new version is kept from its upload, 0
+	// for no retention
+	RetentionDays int `json:"retention_days"`
+}
+
+// recordLockEvent records event with who made the request and from where.
+// The event is recorded even when the client has gone away.
+func recordLockEvent(r *http.Request, event *store.LockAuditEvent) {
+	event.Actor = "project key"
+	if currentUser, userErr := GetCurrentUser(r); userErr == nil {
+		event.Actor = "user:" + currentUser.Email
+	}
+	event.RemoteAddr = r.RemoteAddr
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.LockAudit.Create(ctx, event); err != nil {
+		log.Printf("Error recording %s on project %d: %v", event.Operation, event.ProjectID, err)
+	}
+}
+
+// refuseLocked writes the response for an attempt to delete or overwrite a
+// locked file when err is a LockError, recording the attempt. It reports
+// whether it did.
+func refuseLocked(w http.ResponseWriter, r *http.Request, projectId int64, operation string, err error) bool {
+	var lockErr *store.LockError
+	if !errors.As(err, &lockErr) {
+		return false
+	}
+
+	recordLockEvent(r, &store.LockAuditEvent{
+		ProjectID: projectId,
+		FileID:    &lockErr.FileID,
+		Version:   lockErr.Version,
+		Operation: operation,
+		Lock:      lockErr.Lock,
+		Detail:    lockErr.Error(),
+	})
+
+	WriteJsonError(w, http.StatusForbidden, lockErr.Error())
+	return true
+}
+
+// HandleFileLegalHold switches the legal hold of a file on or off. A file
+// under legal hold can not be deleted or overwritten, whatever its retention.
+func HandleFileLegalHold(w http.ResponseWriter, r *http.Request) {
+	var payload LegalHoldRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	fileID, convErr := uuid.Parse(r.PathValue("fileId"))
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	storedFile, err := appStore.StoredFiles.GetById(r.Context(), fileID)
+	if err != nil || storedFile.ProjectID != project.ID {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
+		return
+	}
+
+	err = appStore.StoredFiles.SetLegalHold(r.Context(), storedFile.ID, payload.Enabled)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to change legal hold: %v", err))
+		return
+	}
+
+	operation, detail := store.LockOperationHoldOff, "legal hold switched off"
+	if payload.Enabled {
+		operation, detail = store.LockOperationHoldOn, "legal hold switched on"
+	}
+	recordLockEvent(r, &store.LockAuditEvent{
+		ProjectID: project.ID,
+		FileID:    &storedFile.ID,
+		Operation: operation,
+		Lock:      store.LockLegalHold,
+		Detail:    detail,
+	})
+
+	storedFile.LegalHold = payload.Enabled
+	SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+}
+
+// HandleProjectRetention changes the retention period of a project. It
+// applies to files uploaded from now on, the retention of stored versions is
+// never shortened. Only an admin can shorten the period.
+func HandleProjectRetention(w http.ResponseWriter, r *http.Request) {
+	var payload RetentionRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	if payload.RetentionDays < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "retention_days can not be negative")
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if payload.RetentionDays < project.RetentionDays {
+		if _, ok := requireAdmin(w, r); !ok {
+			return
+		}
+	}
+
+	previousDays := project.RetentionDays
+	project.RetentionDays = payload.RetentionDays
+
+	currentApp := app.GetCurrentApplication()
+	if err := currentApp.Store.Projects.Update(r.Context(), project); err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update project: %v", err))
+		return
+	}
+
+	recordLockEvent(r, &store.LockAuditEvent{
+		ProjectID: project.ID,
+		Operation: store.LockOperationRetention,
+		Lock:      store.LockRetention,
+		Detail:    fmt.Sprintf("retention changed from %d to %d days", previousDays, project.RetentionDays),
+	})
+
+	SendJsonWithoutMeta(w, http.StatusOK, project)
+}
+
+// HandleGetLockAuditEvents lists the attempts to delete or overwrite locked
+// files of a project and the changes to its locks, newest first
+func HandleGetLockAuditEvents(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	events, err := appStore.LockAudit.GetByProjectId(r.Context(), project.ID, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lock audit events: %v", err))
+		return
+	}
+
+	eventsCount, countErr := appStore.LockAudit.CountByProjectId(r.Context(), project.ID)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get lock audit events count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, events, JsonMeta{
+		TotalRecords: eventsCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/jobs"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+type MultipartInitiateRequest struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	// Folder is created as needed when the upload is completed, the root of
+	// the project when empty
+	Folder string `json:"folder"`
+}
+
+type MultipartCompletePart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// MultipartCompleteRequest lists the parts to stitch together, in ascending
+// order of their number. Parts that are left out are discarded.
+type MultipartCompleteRequest struct {
+	Parts []MultipartCompletePart `json:"parts"`
+}
+
+// multipartUploadFromRequest loads the upload named by the id in the path,
+// writing the error response when the project has no such upload or it has
+// expired
+func multipartUploadFromRequest(w http.ResponseWriter, r *http.Request, project *store.Project) (*store.MultipartUpload, bool) {
+	uploadID, convErr := uuid.Parse(r.PathValue("id"))
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid upload ID")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	multipart, err := currentApp.Store.MultipartUploads.GetById(r.Context(), project.ID, uploadID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && time.Now().After(multipart.ExpiresAt)) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find multipart upload with id: %s", uploadID))
+		return nil, false
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get multipart upload: %v", err))
+		return nil, false
+	}
+
+	return multipart, true
+}
+
+// HandleMultipartInitiate starts a multipart upload. The file type is checked
+// against the project straight away, the size once the upload is completed.
+func HandleMultipartInitiate(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload MultipartInitiateRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	fileName := filepath.Base(payload.FileName)
+	if payload.FileName == "" || fileName == "." || fileName == string(filepath.Separator) {
+		WriteJsonError(w, http.StatusBadRequest, "file_name is required")
+		return
+	}
+
+	mimeType := payload.MimeType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	// Folders are created as needed, and their path can not leave the project
+	folder, folderErr := utils.CleanFolderPath(payload.Folder)
+	if folderErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	// File type validation based on project settings
+	isAllowed, validationErr := appStore.ProjectAllowedFileTypes.FileTypeIsAllowed(r.Context(), project.ID, mimeType)
+	if !isAllowed || validationErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "File type not allowed")
+		return
+	}
+
+	multipart := &store.MultipartUpload{
+		ProjectID: project.ID,
+		FileName:  fileName,
+		MimeType:  mimeType,
+		Folder:    folder,
+		ExpiresAt: time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry),
+	}
+	if err := appStore.MultipartUploads.Create(r.Context(), multipart); err != nil {
+		log.Printf("Error creating multipart upload: %v", err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to create multipart upload")
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusCreated, multipart)
+}
+
+// HandleMultipartUploadPart stores one part of a multipart upload, replacing
+// any part sent before with the same number. The part is checked against the
+// Content-MD5 and ff-checksum-sha256 headers when they are sent, and its MD5
+// is returned as its ETag.
+func HandleMultipartUploadPart(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	partNumber, convErr := strconv.Atoi(r.PathValue("partNumber"))
+	if convErr != nil || partNumber < 1 || partNumber > store.MaxPartNumber {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Part number must be between 1 and %d", store.MaxPartNumber))
+		return
+	}
+
+	// Checksums the client expects the received part to have
+	checksums, checksumErr := checksumsFromRequest(r)
+	if checksumErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, checksumErr.Error())
+		return
+	}
+
+	multipart, ok := multipartUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+	if multipart.StoredFileID != nil || multipart.ClaimedAt != nil {
+		WriteJsonError(w, http.StatusConflict, "Multipart upload is being completed or has been completed")
+		return
+	}
+
+	// Large parts take longer than the server wide read timeout
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	// The parts together can be no larger than the whole file may be
+	maxUploadSize := project.MaxUploadSize << 20
+	parts, partsErr := appStore.MultipartUploads.GetParts(r.Context(), multipart.ID)
+	if partsErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get parts: %v", partsErr))
+		return
+	}
+	remaining := maxUploadSize
+	for _, other := range parts {
+		if other.PartNumber != partNumber {
+			remaining -= other.Size
+		}
+	}
+	if remaining <= 0 {
+		WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Parts exceed the maximum upload size of %d MB", project.MaxUploadSize))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, remaining)
+	sha256Hasher := sha256.New()
+	md5Hasher := md5.New()
+
+	part := &store.MultipartPart{
+		UploadID:   multipart.ID,
+		PartNumber: partNumber,
+		BlobKey:    utils.MultipartPartKey(multipart.ID, partNumber),
+	}
+	size, putErr := currentApp.Blobs.Put(r.Context(), part.BlobKey, io.TeeReader(body, io.MultiWriter(sha256Hasher, md5Hasher)))
+	if putErr != nil {
+		removeBlob(context.WithoutCancel(r.Context()), part.BlobKey)
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(putErr, &maxBytesErr) {
+			WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Parts exceed the maximum upload size of %d MB", project.MaxUploadSize))
+			return
+		}
+		log.Printf("Error saving part %d of multipart upload %s: %v", partNumber, multipart.ID, putErr)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to save part")
+		return
+	}
+
+	part.Size = size
+	part.SHA256 = hex.EncodeToString(sha256Hasher.Sum(nil))
+	part.MD5 = hex.EncodeToString(md5Hasher.Sum(nil))
+
+	if verifyErr := checksums.verify(&utils.SaveResult{SHA256: part.SHA256, MD5: part.MD5}); verifyErr != nil {
+		removeBlob(r.Context(), part.BlobKey)
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Part was not received intact: %s", verifyErr))
+		return
+	}
+
+	expiresAt := time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry)
+	replacedKey, err := appStore.MultipartUploads.PutPart(r.Context(), part, expiresAt, maxUploadSize)
+	if err != nil {
+		removeBlob(context.WithoutCancel(r.Context()), part.BlobKey)
+		if errors.Is(err, store.ErrConflict) {
+			WriteJsonError(w, http.StatusConflict, "Multipart upload is being completed or has been completed")
+			return
+		}
+		if errors.Is(err, store.ErrPartsTooLarge) {
+			WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Parts exceed the maximum upload size of %d MB", project.MaxUploadSize))
+			return
+		}
+		log.Printf("Error recording part %d of multipart upload %s: %v", partNumber, multipart.ID, err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to save part")
+		return
+	}
+	// PutPart refuses parts once a completion has claimed the upload, and a
+	// completion that claims it later reads the new part, so nothing reads the
+	// replaced part any more
+	if replacedKey != "" {
+		removeBlob(r.Context(), replacedKey)
+	}
+
+	w.Header().Set("ETag", part.ETag())
+	SendJsonWithoutMeta(w, http.StatusOK, part)
+}
+
+// HandleMultipartListParts lists the parts received so far, in the order of
+// their number
+func HandleMultipartListParts(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	multipart, ok := multipartUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	parts, err := currentApp.Store.MultipartUploads.GetParts(r.Context(), multipart.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get parts: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, parts)
+}
+
+// HandleMultipartComplete stitches the listed parts together and stores them
+// as one file, with the same checks as a single request upload. The parts
+// are removed once the file is stored.
+func HandleMultipartComplete(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var payload MultipartCompleteRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+	if len(payload.Parts) == 0 {
+		WriteJsonError(w, http.StatusBadRequest, "At least one part is required")
+		return
+	}
+
+	multipart, ok := multipartUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	// Claiming the upload keeps other completions, aborts and parts out while
+	// the parts are stitched together
+	expiresAt := time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry)
+	claimErr := appStore.MultipartUploads.Claim(r.Context(), multipart.ID, expiresAt)
+	if errors.Is(claimErr, store.ErrConflict) {
+		WriteJsonError(w, http.StatusConflict, "Multipart upload is being completed or has been completed")
+		return
+	}
+	if claimErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to claim multipart upload: %v", claimErr))
+		return
+	}
+
+	// A failed completion gives the upload back, so that it can be retried
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		if err := appStore.MultipartUploads.Release(context.WithoutCancel(r.Context()), multipart.ID); err != nil {
+			log.Printf("Error releasing multipart upload %s: %v", multipart.ID, err)
+		}
+	}()
+
+	parts, err := appStore.MultipartUploads.GetParts(r.Context(), multipart.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get parts: %v", err))
+		return
+	}
+
+	received := make(map[int]*store.MultipartPart, len(parts))
+	for _, part := range parts {
+		received[part.PartNumber] = part
+	}
+
+	// Every listed part must have been received with the given ETag
+	keys := make([]string, 0, len(payload.Parts))
+	previous := 0
+	for _, listed := range payload.Parts {
+		if listed.PartNumber <= previous {
+			WriteJsonError(w, http.StatusBadRequest, "Parts must be listed in ascending order of their number")
+			return
+		}
+		previous = listed.PartNumber
+
+		part, found := received[listed.PartNumber]
+		if !found {
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Part %d has not been received", listed.PartNumber))
+			return
+		}
+		if strings.Trim(listed.ETag, `"`) != part.MD5 {
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Part %d has ETag %s", listed.PartNumber, part.ETag()))
+			return
+		}
+		keys = append(keys, part.BlobKey)
+	}
+
+	// Stitching the parts takes longer than the server wide write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	content := &blobsReader{ctx: r.Context(), blobs: currentApp.Blobs, keys: keys}
+	defer content.Close()
+
+	storedFile, ok := storeUpload(w, r, &upload{
+		project:  project,
+		content:  content,
+		fileName: multipart.FileName,
+		mimeType: multipart.MimeType,
+		folder:   multipart.Folder,
+	})
+	if !ok {
+		return
+	}
+
+	// The file is stored, so the upload stays claimed whatever happens next
+	// and is left to the janitor if it can not be marked as completed
+	completed = true
+	if err := appStore.MultipartUploads.SetStoredFile(r.Context(), multipart.ID, storedFile.ID); err != nil {
+		log.Printf("Error recording the file of multipart upload %s: %v", multipart.ID, err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to complete multipart upload")
+		return
+	}
+
+	// Parts that were left out are discarded as well
+	for _, part := range parts {
+		removeBlob(r.Context(), part.BlobKey)
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, storedFile)
+}
+
+// HandleMultipartAbort cancels a multipart upload, deleting the parts
+// received so far
+func HandleMultipartAbort(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	multipart, ok := multipartUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+
+	// The parts of an upload that is being completed must stay until it is
+	if multipart.StoredFileID == nil {
+		expiresAt := time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry)
+		claimErr := currentApp.Store.MultipartUploads.Claim(r.Context(), multipart.ID, expiresAt)
+		if errors.Is(claimErr, store.ErrConflict) {
+			WriteJsonError(w, http.StatusConflict, "Multipart upload is being completed")
+			return
+		}
+		if claimErr != nil {
+			WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to claim multipart upload: %v", claimErr))
+			return
+		}
+	}
+
+	if err := jobs.AbortMultipartUpload(r.Context(), currentApp.Store, currentApp.Blobs, multipart, nil); err != nil {
+		log.Printf("Error aborting multipart upload %s: %v", multipart.ID, err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to abort multipart upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
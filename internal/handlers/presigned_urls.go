@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/auth"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+const (
+	// defaultPresignExpiry is how long a presigned URL lasts when the request
+	// for it does not say
+	defaultPresignExpiry = 15 * time.Minute
+	maxPresignExpiry     = 7 * 24 * time.Hour
+)
+
+type PresignedDownloadRequest struct {
+	FileID string `json:"file_id"`
+	// Version is a previous version of the file to download, the current
+	// version when 0
+	Version int `json:"version"`
+	// ContentDisposition replaces the Content-Disposition header of the
+	// download when set, e.g. inline; filename="report.pdf"
+	ContentDisposition string `json:"content_disposition"`
+	// ExpiresIn is the number of seconds the URL lasts
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type PresignedUploadRequest struct {
+	// Folder is the folder files are uploaded into, the root of the project
+	// when empty
+	Folder string `json:"folder"`
+	// ExpiresIn is the number of seconds the URL lasts
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type PresignedURLResponse struct {
+	Method string `json:"method"`
+	// URL is relative to the address of the server
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// presignExpiry returns when a URL requested to last expiresIn seconds expires
+func presignExpiry(expiresIn int64) (time.Time, error) {
+	if expiresIn == 0 {
+		return time.Now().Add(defaultPresignExpiry), nil
+	}
+	if expiresIn < 0 || expiresIn > int64(maxPresignExpiry/time.Second) {
+		return time.Time{}, fmt.Errorf("expires_in must be between 1 and %d seconds", int64(maxPresignExpiry/time.Second))
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+}
+
+// presignedURL signs a request with the given method, path and query
+func presignedURL(method string, path string, query url.Values, expiresAt time.Time) *PresignedURLResponse {
+	currentApp := app.GetCurrentApplication()
+	return &PresignedURLResponse{
+		Method:    method,
+		URL:       path + "?" + currentApp.Signer.Presign(method, path, query, expiresAt),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// isPresigned reports whether a request is made with a presigned URL rather
+// than the project key
+func isPresigned(r *http.Request) bool {
+	return r.URL.Query().Has("signature")
+}
+
+// presignedProjectId checks the signature of a presigned URL, writing the
+// error response when it is invalid or has expired, and returns the project
+// the URL was issued for
+func presignedProjectId(w http.ResponseWriter, r *http.Request, method string) (int64, bool) {
+	currentApp := app.GetCurrentApplication()
+
+	query := r.URL.Query()
+	err := currentApp.Signer.Verify(method, r.URL.Path, query)
+	if errors.Is(err, auth.ErrURLExpired) {
+		WriteJsonError(w, http.StatusForbidden, "Presigned URL has expired")
+		return 0, false
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusForbidden, "Invalid presigned URL signature")
+		return 0, false
+	}
+
+	projectId, convErr := strconv.ParseInt(query.Get("project"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusForbidden, "Invalid presigned URL signature")
+		return 0, false
+	}
+
+	return projectId, true
+}
+
+// HandlePresignDownload issues a URL that downloads one file of a project
+// without the project key until it expires
+func HandlePresignDownload(w http.ResponseWriter, r *http.Request) {
+	var payload PresignedDownloadRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	fileID, convErr := uuid.Parse(payload.FileID)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+
+	expiresAt, expiryErr := presignExpiry(payload.ExpiresIn)
+	if expiryErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, expiryErr.Error())
+		return
+	}
+
+	if payload.Version < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid version")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	if _, err := appStore.StoredFiles.GetByIdAndProjectId(r.Context(), fileID, project.ID); err != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
+		return
+	}
+
+	query := url.Values{}
+	query.Set("project", strconv.FormatInt(project.ID, 10))
+
+	if payload.Version > 0 {
+		if _, err := appStore.StoredFiles.GetVersion(r.Context(), fileID, payload.Version); err != nil {
+			WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find version %d of file %s", payload.Version, fileID))
+			return
+		}
+		query.Set("version", strconv.Itoa(payload.Version))
+	}
+
+	if payload.ContentDisposition != "" {
+		disposition, _, parseErr := mime.ParseMediaType(payload.ContentDisposition)
+		if parseErr != nil || (disposition != "inline" && disposition != "attachment") {
+			WriteJsonError(w, http.StatusBadRequest, "content_disposition must be an inline or attachment disposition")
+			return
+		}
+		query.Set("disposition", payload.ContentDisposition)
+	}
+
+	path := fmt.Sprintf("/v1/files/%s/download", fileID)
+	SendJsonWithoutMeta(w, http.StatusCreated, presignedURL(http.MethodGet, path, query, expiresAt))
+}
+
+// HandlePresignUpload issues a URL that uploads files into one folder of a
+// project without the project key until it expires. The files are checked
+// against the project like any other upload.
+func HandlePresignUpload(w http.ResponseWriter, r *http.Request) {
+	var payload PresignedUploadRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	folder, folderErr := utils.CleanFolderPath(payload.Folder)
+	if folderErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder")
+		return
+	}
+
+	expiresAt, expiryErr := presignExpiry(payload.ExpiresIn)
+	if expiryErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, expiryErr.Error())
+		return
+	}
+
+	query := url.Values{}
+	query.Set("project", strconv.FormatInt(project.ID, 10))
+	if folder != "" {
+		query.Set("folder", folder)
+	}
+
+	SendJsonWithoutMeta(w, http.StatusCreated, presignedURL(http.MethodPost, "/v1/files", query, expiresAt))
+}
+
+// presignedProjectFromRequest checks the signature of a presigned upload URL
+// and loads the project it was issued for, writing the error response when
+// either fails
+func presignedProjectFromRequest(w http.ResponseWriter, r *http.Request) (*store.Project, bool) {
+	projectId, ok := presignedProjectId(w, r, http.MethodPost)
+	if !ok {
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	project, projErr := currentApp.Store.Projects.GetById(r.Context(), projectId)
+	if projErr != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find project with id: %d", projectId))
+		return nil, false
+	}
+
+	return project, true
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
 	"github.com/kudzaitsapo/fileflow-server/internal/store"
 )
 
@@ -18,6 +20,13 @@ type ProjectCreateRequest struct {
 	Description      string   `json:"description"`
 	MaxUploadSize    int64    `json:"max_upload_size"`
 	AllowedFileTypes []string `json:"allowed_file_types"`
+	// DurabilityPolicy is "replication" (the default) or "erasure"
+	DurabilityPolicy string `json:"durability_policy"`
+	// MaxVersions is the number of versions kept of every file, 10 by default
+	MaxVersions int `json:"max_versions"`
+	// RetentionDays is how long every version of a file is kept from its
+	// upload before it can be deleted or overwritten, 0 for no retention
+	RetentionDays int `json:"retention_days"`
 }
 
 type ProjectResponse struct {
@@ -29,6 +38,14 @@ type ProjectResponse struct {
 	ProjectKey       string   `json:"project_key"`
 	MaxUploadSize    int64    `json:"max_upload_size"`
 	AllowedFileTypes []string `json:"allowed_file_types"`
+	DurabilityPolicy string   `json:"durability_policy"`
+	MaxVersions      int      `json:"max_versions"`
+	RetentionDays    int      `json:"retention_days"`
+	// StorageUsed is the total size of the project's files in bytes, before
+	// compression and deduplication
+	StorageUsed int64 `json:"storage_used"`
+	// DeletedAt is when the project was moved to the trash
+	DeletedAt *string `json:"deleted_at,omitempty"`
 }
 
 type ApiKeyRegenerationRequest struct {
@@ -49,6 +66,21 @@ func GenerateRandomKey() (string, error) {
 	return "proj_" + hex.EncodeToString(bytes), nil
 }
 
+// durabilityPolicyFromRequest validates a requested durability policy,
+// defaulting to replication
+func durabilityPolicyFromRequest(policy string) (string, error) {
+	if policy == "" {
+		return blobstore.DurabilityReplication, nil
+	}
+	if !blobstore.ValidDurability(policy) {
+		return "", fmt.Errorf("durability policy must be %q or %q", blobstore.DurabilityReplication, blobstore.DurabilityErasure)
+	}
+	if !blobstore.SupportsDurability(app.GetCurrentApplication().Blobs, policy) {
+		return "", fmt.Errorf("%w: %s", blobstore.ErrUnsupportedDurability, policy)
+	}
+	return policy, nil
+}
+
 func HandleProjectCreation(w http.ResponseWriter, r *http.Request) {
 	var payload ProjectCreateRequest
 	if err := ReadJson(w, r, &payload); err != nil {
@@ -56,6 +88,22 @@ func HandleProjectCreation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	durabilityPolicy, policyErr := durabilityPolicyFromRequest(payload.DurabilityPolicy)
+	if policyErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, policyErr.Error())
+		return
+	}
+
+	if payload.MaxVersions < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "max_versions must be at least 1")
+		return
+	}
+
+	if payload.RetentionDays < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "retention_days can not be negative")
+		return
+	}
+
 	currentApp := app.GetCurrentApplication()
 	appStorage := currentApp.Store
 	currentUser, userErr := GetCurrentUser(r)
@@ -73,12 +121,15 @@ func HandleProjectCreation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	project := &store.Project{
-		Name:          payload.Name,
-		Description:   payload.Description,
-		CreatedAt:     time.Now().Format(time.RFC3339),
-		CreatedById:   currentUser.ID,
-		ProjectKey:    projectKey,
-		MaxUploadSize: payload.MaxUploadSize,
+		Name:             payload.Name,
+		Description:      payload.Description,
+		CreatedAt:        time.Now().Format(time.RFC3339),
+		CreatedById:      currentUser.ID,
+		ProjectKey:       projectKey,
+		MaxUploadSize:    payload.MaxUploadSize,
+		DurabilityPolicy: durabilityPolicy,
+		MaxVersions:      payload.MaxVersions,
+		RetentionDays:    payload.RetentionDays,
 	}
 
 	err := appStorage.Projects.Create(r.Context(), project)
@@ -130,6 +181,9 @@ func HandleProjectCreation(w http.ResponseWriter, r *http.Request) {
 		ProjectKey:       project.ProjectKey,
 		MaxUploadSize:    project.MaxUploadSize,
 		AllowedFileTypes: payload.AllowedFileTypes,
+		DurabilityPolicy: project.DurabilityPolicy,
+		MaxVersions:      project.MaxVersions,
+		RetentionDays:    project.RetentionDays,
 	}
 
 	SendJsonWithoutMeta(w, http.StatusCreated, response)
@@ -151,13 +205,16 @@ func HandleProjectList(w http.ResponseWriter, r *http.Request) {
 	response := make([]*ProjectResponse, 0)
 	for _, project := range projects {
 		response = append(response, &ProjectResponse{
-			ID:            project.ID,
-			Name:          project.Name,
-			Description:   project.Description,
-			CreatedAt:     project.CreatedAt,
-			CreatedById:   project.CreatedById,
-			ProjectKey:    project.ProjectKey,
-			MaxUploadSize: project.MaxUploadSize,
+			ID:               project.ID,
+			Name:             project.Name,
+			Description:      project.Description,
+			CreatedAt:        project.CreatedAt,
+			CreatedById:      project.CreatedById,
+			ProjectKey:       project.ProjectKey,
+			MaxUploadSize:    project.MaxUploadSize,
+			DurabilityPolicy: project.DurabilityPolicy,
+			MaxVersions:      project.MaxVersions,
+			RetentionDays:    project.RetentionDays,
 		})
 	}
 
@@ -195,6 +252,25 @@ func HandleProjectUpdate(w http.ResponseWriter, r *http.Request) {
 	project.Description = payload.Description
 	project.MaxUploadSize = payload.MaxUploadSize
 
+	// Changing the policy applies to files uploaded from now on
+	if payload.DurabilityPolicy != "" {
+		durabilityPolicy, policyErr := durabilityPolicyFromRequest(payload.DurabilityPolicy)
+		if policyErr != nil {
+			WriteJsonError(w, http.StatusBadRequest, policyErr.Error())
+			return
+		}
+		project.DurabilityPolicy = durabilityPolicy
+	}
+
+	// Fewer versions are kept from the next upload of each file
+	if payload.MaxVersions < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "max_versions must be at least 1")
+		return
+	}
+	if payload.MaxVersions > 0 {
+		project.MaxVersions = payload.MaxVersions
+	}
+
 	err := appStorage.Projects.Update(r.Context(), project)
 	if err != nil {
 		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to update project: %v", err))
@@ -222,13 +298,16 @@ func HandleProjectUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := &ProjectResponse{
-		ID:            project.ID,
-		Name:          project.Name,
-		Description:   project.Description,
-		CreatedAt:     project.CreatedAt,
-		CreatedById:   project.CreatedById,
-		ProjectKey:    project.ProjectKey,
-		MaxUploadSize: project.MaxUploadSize,
+		ID:               project.ID,
+		Name:             project.Name,
+		Description:      project.Description,
+		CreatedAt:        project.CreatedAt,
+		CreatedById:      project.CreatedById,
+		ProjectKey:       project.ProjectKey,
+		MaxUploadSize:    project.MaxUploadSize,
+		DurabilityPolicy: project.DurabilityPolicy,
+		MaxVersions:      project.MaxVersions,
+		RetentionDays:    project.RetentionDays,
 	}
 
 	SendJsonWithoutMeta(w, http.StatusOK, response)
@@ -265,35 +344,45 @@ func HandleApiKeyRegeneration(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := &ProjectResponse{
-		ID:            project.ID,
-		Name:          project.Name,
-		Description:   project.Description,
-		CreatedAt:     project.CreatedAt,
-		CreatedById:   project.CreatedById,
-		ProjectKey:    project.ProjectKey,
-		MaxUploadSize: project.MaxUploadSize,
+		ID:               project.ID,
+		Name:             project.Name,
+		Description:      project.Description,
+		CreatedAt:        project.CreatedAt,
+		CreatedById:      project.CreatedById,
+		ProjectKey:       project.ProjectKey,
+		MaxUploadSize:    project.MaxUploadSize,
+		DurabilityPolicy: project.DurabilityPolicy,
+		MaxVersions:      project.MaxVersions,
+		RetentionDays:    project.RetentionDays,
 	}
 
 	SendJsonWithoutMeta(w, http.StatusOK, response)
 }
 
+// HandleProjectDeletion moves a project to the trash. It is removed for good,
+// with all of its files, once the trash retention period has passed.
 func HandleProjectDeletion(w http.ResponseWriter, r *http.Request) {
-	var payload ApiKeyRegenerationRequest
-	if err := ReadJson(w, r, &payload); err != nil {
-		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
 		return
 	}
+	projectId := project.ID
 
 	currentApp := app.GetCurrentApplication()
 	appStorage := currentApp.Store
 
-	project, projectErr := appStorage.Projects.GetById(r.Context(), payload.ID)
-	if projectErr != nil {
-		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get project: %v", projectErr))
+	// Files under retention or legal hold would be removed with the project
+	err := appStorage.StoredFiles.CheckProjectLocks(r.Context(), projectId)
+	if err == nil {
+		err = appStorage.Projects.Trash(r.Context(), projectId)
+	}
+	if refuseLocked(w, r, projectId, "delete_project", err) {
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find project with id: %d", projectId))
 		return
 	}
-
-	err := appStorage.Projects.Delete(r.Context(), project.ID)
 	if err != nil {
 		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete project: %v", err))
 		return
@@ -335,6 +424,12 @@ func HandleGetProjectInfo(w http.ResponseWriter, r *http.Request) {
 		fileTypes = append(fileTypes, dbSavedType.MimeType)
 	}
 
+	storageUsed, usageErr := appStorage.StoredFiles.StorageUsedByProject(r.Context(), project.ID)
+	if usageErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get storage usage: %v", usageErr))
+		return
+	}
+
 	response := &ProjectResponse{
 		ID:               project.ID,
 		Name:             project.Name,
@@ -344,6 +439,10 @@ func HandleGetProjectInfo(w http.ResponseWriter, r *http.Request) {
 		ProjectKey:       project.ProjectKey,
 		MaxUploadSize:    project.MaxUploadSize,
 		AllowedFileTypes: fileTypes,
+		DurabilityPolicy: project.DurabilityPolicy,
+		MaxVersions:      project.MaxVersions,
+		RetentionDays:    project.RetentionDays,
+		StorageUsed:      storageUsed,
 	}
 
 	SendJsonWithoutMeta(w, http.StatusOK, response)
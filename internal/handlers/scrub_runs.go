@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/jobs"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+// HandleGetScrubRuns lists the integrity scrub runs. Scrubs cover the files
+// of every project, so all of the scrub run routes are for admins only.
+func HandleGetScrubRuns(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	limit, offset := GetPaginationParams(r)
+
+	runs, err := currentApp.Store.ScrubRuns.GetAll(r.Context(), limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get scrub runs: %v", err))
+		return
+	}
+
+	totalRuns, countErr := currentApp.Store.ScrubRuns.Count(r.Context())
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to count scrub runs: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, runs, JsonMeta{
+		TotalRecords: totalRuns,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+// HandleStartScrubRun starts an integrity scrub without waiting for the
+// scheduled one. The run continues in the background.
+func HandleStartScrubRun(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+
+	run, err := currentApp.Scrubber.Start()
+	if errors.Is(err, jobs.ErrScrubInProgress) {
+		WriteJsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to start scrub: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusAccepted, run)
+}
+
+func HandleGetScrubRun(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	runId, convErr := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid scrub run ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+
+	run, err := currentApp.Store.ScrubRuns.GetById(r.Context(), runId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find scrub run with id: %d", runId))
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get scrub run: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, run)
+}
+
+func HandleGetScrubFindings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	runId, convErr := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid scrub run ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	limit, offset := GetPaginationParams(r)
+
+	findings, err := currentApp.Store.ScrubRuns.GetFindings(r.Context(), runId, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get scrub findings: %v", err))
+		return
+	}
+
+	totalFindings, countErr := currentApp.Store.ScrubRuns.CountFindings(r.Context(), runId)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to count scrub findings: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, findings, JsonMeta{
+		TotalRecords: totalFindings,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+type ShareLinkCreateRequest struct {
+	FileID string `json:"file_id"`
+	// ExpiresAt is when the link stops working, never when left out
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Password is asked for when the link is used, none when empty
+	Password string `json:"password"`
+	// MaxDownloads is the number of times the file can be downloaded, any
+	// number when left out
+	MaxDownloads *int64 `json:"max_downloads"`
+}
+
+// ShareLinkCreateResponse is the created link with its token, which is only
+// ever sent in this response
+type ShareLinkCreateResponse struct {
+	*store.ShareLink
+	Token string `json:"token"`
+}
+
+// shareLinkFromRequest loads the link named by the linkId in the path,
+// writing the error response when the project has no such link
+func shareLinkFromRequest(w http.ResponseWriter, r *http.Request, project *store.Project) (*store.ShareLink, bool) {
+	linkId, convErr := strconv.ParseInt(r.PathValue("linkId"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid share link ID")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	link, err := currentApp.Store.ShareLinks.GetById(r.Context(), project.ID, linkId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Share link not found")
+		return nil, false
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get share link: %v", err))
+		return nil, false
+	}
+
+	return link, true
+}
+
+// HandleCreateShareLink creates a public link to a file of the project, served
+// at /v1/s/{token}
+func HandleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	var payload ShareLinkCreateRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	fileID, convErr := uuid.Parse(payload.FileID)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		WriteJsonError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+	if payload.MaxDownloads != nil && *payload.MaxDownloads < 1 {
+		WriteJsonError(w, http.StatusBadRequest, "max_downloads must be at least 1")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	storedFile, err := appStore.StoredFiles.GetByIdAndProjectId(r.Context(), fileID, project.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", fileID))
+		return
+	}
+
+	// Only the client holds the key to these files, so they can not be served
+	// to anyone else
+	if storedFile.KeyFingerprint != "" {
+		WriteJsonError(w, http.StatusBadRequest, "Files encrypted with a customer key can not be shared")
+		return
+	}
+
+	link := &store.ShareLink{
+		ProjectID:    project.ID,
+		StoredFileID: storedFile.ID,
+		ExpiresAt:    payload.ExpiresAt,
+		MaxDownloads: payload.MaxDownloads,
+	}
+	if payload.Password != "" {
+		if passwordErr := link.SetPassword(payload.Password); passwordErr != nil {
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid password: %v", passwordErr))
+			return
+		}
+	}
+	if currentUser, userErr := GetCurrentUser(r); userErr == nil {
+		link.CreatedById = currentUser.ID
+	}
+
+	if err := appStore.ShareLinks.Create(r.Context(), link); err != nil {
+		log.Printf("Error creating share link for file %s: %v", storedFile.ID, err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to create share link")
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusCreated, &ShareLinkCreateResponse{
+		ShareLink: link,
+		Token:     link.Token,
+	})
+}
+
+func HandleGetShareLinks(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	links, err := appStore.ShareLinks.GetByProjectId(r.Context(), project.ID, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get share links: %v", err))
+		return
+	}
+
+	linksCount, countErr := appStore.ShareLinks.CountByProjectId(r.Context(), project.ID)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get share links count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, links, JsonMeta{
+		TotalRecords: linksCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+func HandleGetShareLink(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	link, ok := shareLinkFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, link)
+}
+
+// HandleRevokeShareLink stops a link from working. Unlike deleting it, its
+// counts are kept.
+func HandleRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	link, ok := shareLinkFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	err := appStore.ShareLinks.Revoke(r.Context(), project.ID, link.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to revoke share link: %v", err))
+		return
+	}
+
+	link, ok = shareLinkFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, link)
+}
+
+func HandleDeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	linkId, convErr := strconv.ParseInt(r.PathValue("linkId"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid share link ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	err := currentApp.Store.ShareLinks.Delete(r.Context(), project.ID, linkId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete share link: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refuseShareLink writes the response for a use of a link that does not
+// download the file, counting the use
+func refuseShareLink(w http.ResponseWriter, r *http.Request, link *store.ShareLink, status int, message string) {
+	currentApp := app.GetCurrentApplication()
+
+	// The use is counted even when the client has gone away
+	if err := currentApp.Store.ShareLinks.RecordAccess(context.WithoutCancel(r.Context()), link.ID); err != nil {
+		log.Printf("Error recording use of share link %d: %v", link.ID, err)
+	}
+
+	WriteJsonError(w, status, message)
+}
+
+// HandleShareLinkDownload serves the file of a share link to anyone with the
+// link, and its password when it has one. The password is sent with HTTP
+// basic authentication, so that browsers ask for it.
+func HandleShareLinkDownload(w http.ResponseWriter, r *http.Request) {
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	link, err := appStore.ShareLinks.GetByToken(r.Context(), r.PathValue("token"))
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get share link: %v", err))
+		return
+	}
+
+	if link.RevokedAt != nil {
+		refuseShareLink(w, r, link, http.StatusGone, "Share link has been revoked")
+		return
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		refuseShareLink(w, r, link, http.StatusGone, "Share link has expired")
+		return
+	}
+	if link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads {
+		refuseShareLink(w, r, link, http.StatusGone, "Share link has no downloads left")
+		return
+	}
+
+	if link.PasswordProtected {
+		_, password, hasPassword := r.BasicAuth()
+		if !hasPassword || !link.CheckPassword(password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="FileFlow share link", charset="UTF-8"`)
+			refuseShareLink(w, r, link, http.StatusUnauthorized, "Share link password is required")
+			return
+		}
+	}
+
+	// The link serves the current version, as long as the file is not in the
+	// trash
+	storedFile, fileErr := appStore.StoredFiles.GetByIdAndProjectId(r.Context(), link.StoredFileID, link.ProjectID)
+	if fileErr != nil || storedFile.KeyFingerprint != "" {
+		refuseShareLink(w, r, link, http.StatusNotFound, "Shared file is no longer available")
+		return
+	}
+
+	serveFile(&shareDownloadWriter{ResponseWriter: w, r: r, link: link}, r, storedFile, nil, fmt.Sprintf("attachment; filename=%s", storedFile.FileName))
+}
+
+// errShareLinkRefused stops serving a file once its share link has been
+// found to be used up
+var errShareLinkRefused = errors.New("share link is no longer usable")
+
+// shareDownloadWriter counts a download through a share link when the
+// response turns out to send the file from its start. HEAD requests, 304 Not
+// Modified answers and ranges that resume a download part way through are
+// not counted.
+type shareDownloadWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	link        *store.ShareLink
+	wroteHeader bool
+	refused     bool
+}
+
+// sendsFileFromStart reports whether a response with the given status sends
+// the file from its first byte. Multipart ranges are counted as a whole, as
+// they can cover the full file in any order.
+func (sw *shareDownloadWriter) sendsFileFromStart(status int) bool {
+	if sw.r.Method != http.MethodGet {
+		return false
+	}
+	switch status {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		return strings.HasPrefix(sw.Header().Get("Content-Range"), "bytes 0-") ||
+			strings.HasPrefix(sw.Header().Get("Content-Type"), "multipart/byteranges")
+	}
+	return false
+}
+
+// WriteHeader counts the download before the file is sent. Counting also
+// checks the link again, as another download may have used up the last one
+// since it was loaded, in which case the link is refused instead.
+func (sw *shareDownloadWriter) WriteHeader(status int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+
+	if !sw.sendsFileFromStart(status) {
+		sw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	err := currentApp.Store.ShareLinks.RecordDownload(sw.r.Context(), sw.link.ID)
+	if err == nil {
+		sw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	sw.refused = true
+	for _, header := range []string{"Content-Disposition", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Digest", "Last-Modified"} {
+		sw.Header().Del(header)
+	}
+	if errors.Is(err, store.ErrConflict) {
+		refuseShareLink(sw.ResponseWriter, sw.r, sw.link, http.StatusGone, "Share link is no longer usable")
+		return
+	}
+	log.Printf("Error recording download through share link %d: %v", sw.link.ID, err)
+	WriteJsonError(sw.ResponseWriter, http.StatusInternalServerError, "Unable to download file")
+}
+
+func (sw *shareDownloadWriter) Write(body []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.refused {
+		return 0, errShareLinkRefused
+	}
+	return sw.ResponseWriter.Write(body)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *shareDownloadWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+// HandleFileDeletion moves a file, with its previous versions, to the trash
+// of its project. It is removed for good once the trash retention period has
+// passed.
+func HandleFileDeletion(w http.ResponseWriter, r *http.Request) {
+	storedFile, ok := projectFileFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	err := currentApp.Store.StoredFiles.Trash(r.Context(), storedFile.ID)
+	if refuseLocked(w, r, storedFile.ProjectID, "delete", err) {
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id: %s", storedFile.ID))
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete file: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusNoContent, nil)
+}
+
+// HandleFileTrash lists the files in the trash of a project, most recently
+// deleted first
+func HandleFileTrash(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	files, err := appStore.StoredFiles.GetTrash(r.Context(), project.ID, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get files: %v", err))
+		return
+	}
+
+	filesCount, countErr := appStore.StoredFiles.CountTrash(r.Context(), project.ID)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get files count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, files, JsonMeta{
+		TotalRecords: filesCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+// HandleFileTrashRestore takes a file out of the trash of its project
+func HandleFileTrashRestore(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	fileID, convErr := uuid.Parse(r.PathValue("id"))
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	err := appStore.StoredFiles.RestoreFromTrash(r.Context(), project.ID, fileID)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find file with id %s in the trash", fileID))
+		return
+	}
+	if errors.Is(err, store.ErrConflict) {
+		WriteJsonError(w, http.StatusConflict, "Another file has been uploaded to the same path since the file was deleted")
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to restore file: %v", err))
+		return
+	}
+
+	restored, storErr := appStore.StoredFiles.GetByIdAndProjectKey(r.Context(), fileID, project.ProjectKey)
+	if storErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get restored file: %v", storErr))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, restored)
+}
+
+// HandleEmptyFileTrash removes every file in the trash of a project for good
+// without waiting for the retention period
+func HandleEmptyFileTrash(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if currentApp.Purger == nil {
+		WriteJsonError(w, http.StatusInternalServerError, "Trash purging is not configured")
+		return
+	}
+
+	report, err := currentApp.Purger.PurgeFiles(r.Context(), project.ID, time.Now())
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to empty the trash: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, report)
+}
+
+// HandleProjectTrash lists the projects in the trash that are assigned to the
+// current user, most recently deleted first
+func HandleProjectTrash(w http.ResponseWriter, r *http.Request) {
+	currentUser, userErr := GetCurrentUser(r)
+	if userErr != nil {
+		WriteJsonError(w, http.StatusUnauthorized, fmt.Sprintf("error getting current user: %v", userErr))
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStorage := currentApp.Store
+	limit, offset := GetPaginationParams(r)
+
+	projects, err := appStorage.Projects.GetTrash(r.Context(), currentUser.ID, limit, offset)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get projects: %v", err))
+		return
+	}
+
+	response := make([]*ProjectResponse, 0)
+	for _, project := range projects {
+		response = append(response, &ProjectResponse{
+			ID:               project.ID,
+			Name:             project.Name,
+			Description:      project.Description,
+			CreatedAt:        project.CreatedAt,
+			CreatedById:      project.CreatedById,
+			ProjectKey:       project.ProjectKey,
+			MaxUploadSize:    project.MaxUploadSize,
+			DurabilityPolicy: project.DurabilityPolicy,
+			MaxVersions:      project.MaxVersions,
+			RetentionDays:    project.RetentionDays,
+			DeletedAt:        project.DeletedAt,
+		})
+	}
+
+	projectsCount, countErr := appStorage.Projects.CountTrash(r.Context(), currentUser.ID)
+	if countErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get project count: %v", countErr))
+		return
+	}
+
+	SendJson(w, http.StatusOK, response, JsonMeta{
+		TotalRecords: projectsCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
+
+// HandleProjectTrashRestore takes a project out of the trash. Only users
+// assigned to the project can restore it.
+func HandleProjectTrashRestore(w http.ResponseWriter, r *http.Request) {
+	currentUser, userErr := GetCurrentUser(r)
+	if userErr != nil {
+		WriteJsonError(w, http.StatusUnauthorized, fmt.Sprintf("error getting current user: %v", userErr))
+		return
+	}
+
+	projectId, convErr := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if convErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid project ID")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStorage := currentApp.Store
+
+	// Projects in the trash keep their assignments until they are purged
+	assigned, assignErr := appStorage.UserAssignedProjects.ProjectIsAssignedToUser(r.Context(), projectId, currentUser.ID)
+	if assignErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to check project assignment: %v", assignErr))
+		return
+	}
+	if !assigned {
+		WriteJsonError(w, http.StatusForbidden, "You are not assigned to this project")
+		return
+	}
+
+	err := appStorage.Projects.Restore(r.Context(), projectId)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find project with id %d in the trash", projectId))
+		return
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to restore project: %v", err))
+		return
+	}
+
+	project, projectErr := appStorage.Projects.GetById(r.Context(), projectId)
+	if projectErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get project: %v", projectErr))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, &ProjectResponse{
+		ID:               project.ID,
+		Name:             project.Name,
+		Description:      project.Description,
+		CreatedAt:        project.CreatedAt,
+		CreatedById:      project.CreatedById,
+		ProjectKey:       project.ProjectKey,
+		MaxUploadSize:    project.MaxUploadSize,
+		DurabilityPolicy: project.DurabilityPolicy,
+		MaxVersions:      project.MaxVersions,
+		RetentionDays:    project.RetentionDays,
+	})
+}
+
+// HandleEmptyProjectTrash removes every project in the trash for good, with
+// all of their files, without waiting for the retention period. As it spans
+// every project, only an admin can empty it.
+func HandleEmptyProjectTrash(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	if currentApp.Purger == nil {
+		WriteJsonError(w, http.StatusInternalServerError, "Trash purging is not configured")
+		return
+	}
+
+	report, err := currentApp.Purger.PurgeProjects(r.Context(), time.Now())
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to empty the trash: %v", err))
+		return
+	}
+
+	SendJsonWithoutMeta(w, http.StatusOK, report)
+}
@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/jobs"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// The tus 1.0 resumable upload protocol, see https://tus.io/protocols/resumable-upload
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,expiration,checksum,termination"
+	tusChecksumAlgorithms = "sha1,sha256,md5"
+	tusOffsetContentType  = "application/offset+octet-stream"
+	// statusChecksumMismatch is answered when a chunk does not match its
+	// Upload-Checksum
+	statusChecksumMismatch = 460
+)
+
+// SetTusOptionsHeaders describes the tus support of the server, in answer to
+// an OPTIONS request
+func SetTusOptionsHeaders(header http.Header) {
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Tus-Version", tusVersion)
+	header.Set("Tus-Extension", tusExtensions)
+	header.Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+}
+
+// checkTusResumable rejects requests made with another version of the
+// protocol, writing the error response
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		WriteJsonError(w, http.StatusPreconditionFailed, fmt.Sprintf("Tus-Resumable must be %s", tusVersion))
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, a comma separated list
+// of keys each followed by a space and a base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// tusChecksumFromRequest returns a hasher for the Upload-Checksum of a chunk
+// and the digest it must produce, or a nil hasher when there is none
+func tusChecksumFromRequest(r *http.Request) (hash.Hash, []byte, error) {
+	header := r.Header.Get("Upload-Checksum")
+	if header == "" {
+		return nil, nil, nil
+	}
+
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, nil, errors.New("invalid Upload-Checksum digest")
+	}
+
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), digest, nil
+	case "sha256":
+		return sha256.New(), digest, nil
+	case "md5":
+		return md5.New(), digest, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q, use one of %s", algorithm, tusChecksumAlgorithms)
+	}
+}
+
+// resumableUploadFromRequest loads the upload named by the id in the path,
+// writing the error response when the project has no such upload or it has
+// expired
+func resumableUploadFromRequest(w http.ResponseWriter, r *http.Request, project *store.Project) (*store.ResumableUpload, bool) {
+	uploadID, convErr := uuid.Parse(r.PathValue("id"))
+	if convErr != nil {
+		WriteJsonError(w, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+
+	currentApp := app.GetCurrentApplication()
+	upload, err := currentApp.Store.ResumableUploads.GetById(r.Context(), project.ID, uploadID)
+	if errors.Is(err, store.ErrNotFound) {
+		WriteJsonError(w, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get upload: %v", err))
+		return nil, false
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		WriteJsonError(w, http.StatusGone, "Upload has expired")
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// setUploadHeaders describes the progress of an upload
+func setUploadHeaders(w http.ResponseWriter, upload *store.ResumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.StoredFileID != nil {
+		w.Header().Set("ff-file-id", upload.StoredFileID.String())
+	}
+}
+
+// HandleTusCreation starts a resumable upload. The project key, the size of
+// the file and the file type are checked before any content is sent.
+func HandleTusCreation(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		WriteJsonError(w, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+
+	length, convErr := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if convErr != nil || length < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid Upload-Length")
+		return
+	}
+	if maxUploadSize := project.MaxUploadSize << 20; length > maxUploadSize {
+		WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("File exceeds the maximum upload size of %d MB", project.MaxUploadSize))
+		return
+	}
+
+	metadata, metadataErr := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if metadataErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid Upload-Metadata: %s", metadataErr))
+		return
+	}
+
+	fileName := filepath.Base(metadata["filename"])
+	if fileName == "." || fileName == string(filepath.Separator) {
+		WriteJsonError(w, http.StatusBadRequest, "Upload-Metadata must include the filename")
+		return
+	}
+
+	mimeType := metadata["filetype"]
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	// Folders are created as needed, and their path can not leave the project
+	folder, folderErr := utils.CleanFolderPath(metadata["folder"])
+	if folderErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	// File type validation based on project settings
+	isAllowed, validationErr := appStore.ProjectAllowedFileTypes.FileTypeIsAllowed(r.Context(), project.ID, mimeType)
+	if !isAllowed || validationErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "File type not allowed")
+		return
+	}
+
+	upload := &store.ResumableUpload{
+		ProjectID: project.ID,
+		Length:    length,
+		FileName:  fileName,
+		MimeType:  mimeType,
+		Folder:    folder,
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry),
+	}
+	if err := appStore.ResumableUploads.Create(r.Context(), upload); err != nil {
+		log.Printf("Error creating upload: %v", err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to create upload")
+		return
+	}
+
+	// An empty file is complete as soon as it is created
+	if upload.Complete() {
+		if !finaliseResumableUpload(w, r, project, upload) {
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/v1/uploads/"+upload.ID.String())
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleTusHead reports how much of an upload has been received, so that a
+// client can resume it
+func HandleTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	upload, ok := resumableUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleTusPatch receives the next chunk of an upload. The bytes received
+// before a broken connection are kept, unless the chunk has a checksum that
+// can then not be verified. The upload is stored as a file once its last
+// byte has been received.
+func HandleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusOffsetContentType {
+		WriteJsonError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Type must be %s", tusOffsetContentType))
+		return
+	}
+
+	offset, convErr := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if convErr != nil || offset < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid Upload-Offset")
+		return
+	}
+
+	hasher, expectedDigest, checksumErr := tusChecksumFromRequest(r)
+	if checksumErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, checksumErr.Error())
+		return
+	}
+
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	upload, ok := resumableUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	if offset != upload.Offset {
+		setUploadHeaders(w, upload)
+		WriteJsonError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset must be %d", upload.Offset))
+		return
+	}
+	if upload.StoredFileID != nil {
+		setUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// A complete upload that failed to be stored is stored again
+	if upload.Complete() {
+		if finaliseResumableUpload(w, r, project, upload) {
+			setUploadHeaders(w, upload)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	// Chunks take longer than the server wide read timeout
+	_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	// What was received is stored even when the client has gone away
+	ctx := context.WithoutCancel(r.Context())
+
+	body := &receivedReader{reader: http.MaxBytesReader(w, r.Body, upload.Length-upload.Offset)}
+	var content io.Reader = body
+	if hasher != nil {
+		content = io.TeeReader(body, hasher)
+	}
+
+	chunk := &store.UploadChunk{
+		UploadID: upload.ID,
+		Offset:   upload.Offset,
+		BlobKey:  utils.UploadChunkKey(upload.ID, upload.Offset),
+	}
+	size, putErr := currentApp.Blobs.Put(ctx, chunk.BlobKey, content)
+	if putErr != nil {
+		removeBlob(ctx, chunk.BlobKey)
+		log.Printf("Error saving chunk of upload %s: %v", upload.ID, putErr)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to save chunk")
+		return
+	}
+	chunk.Size = size
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(body.err, &maxBytesErr):
+		removeBlob(ctx, chunk.BlobKey)
+		WriteJsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Chunk exceeds the Upload-Length of %d bytes", upload.Length))
+		return
+	case body.err != nil && hasher != nil:
+		removeBlob(ctx, chunk.BlobKey)
+		WriteJsonError(w, http.StatusBadRequest, "Chunk was not received in full")
+		return
+	case hasher != nil && subtle.ConstantTimeCompare(hasher.Sum(nil), expectedDigest) != 1:
+		removeBlob(ctx, chunk.BlobKey)
+		WriteJsonError(w, statusChecksumMismatch, "Checksum Mismatch")
+		return
+	case size == 0:
+		removeBlob(ctx, chunk.BlobKey)
+		setUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	addErr := appStore.ResumableUploads.AddChunk(ctx, upload, chunk)
+	if addErr != nil {
+		removeBlob(ctx, chunk.BlobKey)
+		if errors.Is(addErr, store.ErrConflict) {
+			WriteJsonError(w, http.StatusConflict, "Upload was changed by another request")
+			return
+		}
+		log.Printf("Error recording chunk of upload %s: %v", upload.ID, addErr)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to save chunk")
+		return
+	}
+
+	if upload.Complete() && !finaliseResumableUpload(w, r, project, upload) {
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleTusTermination cancels an upload, deleting what was received of it
+func HandleTusTermination(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	project, ok := projectFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	upload, ok := resumableUploadFromRequest(w, r, project)
+	if !ok {
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+
+	// The chunks of an upload that is being stored must stay until it is
+	if upload.StoredFileID == nil {
+		expiresAt := time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry)
+		claimErr := currentApp.Store.ResumableUploads.Claim(r.Context(), upload.ID, expiresAt)
+		if errors.Is(claimErr, store.ErrConflict) {
+			WriteJsonError(w, http.StatusConflict, "Upload is being stored")
+			return
+		}
+		if claimErr != nil {
+			WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to claim upload: %v", claimErr))
+			return
+		}
+	}
+
+	if err := jobs.RemoveResumableUpload(r.Context(), currentApp.Store, currentApp.Blobs, upload, nil); err != nil {
+		log.Printf("Error removing upload %s: %v", upload.ID, err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to remove upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finaliseResumableUpload stores a complete upload as a file, with the same
+// checks as a single request upload, then removes its chunks. The error
+// response is written when it fails, and unless the file was stored the
+// upload can be finalised again.
+func finaliseResumableUpload(w http.ResponseWriter, r *http.Request, project *store.Project, resumable *store.ResumableUpload) bool {
+	currentApp := app.GetCurrentApplication()
+	appStore := currentApp.Store
+
+	// Claiming the upload keeps concurrent requests and retries from storing
+	// it a second time
+	expiresAt := time.Now().Add(currentApp.AppConfig.JobsConfig.UploadExpiry)
+	claimErr := appStore.ResumableUploads.Claim(r.Context(), resumable.ID, expiresAt)
+	if errors.Is(claimErr, store.ErrConflict) {
+		WriteJsonError(w, http.StatusConflict, "Upload is being stored or has been stored")
+		return false
+	}
+	if claimErr != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to claim upload: %v", claimErr))
+		return false
+	}
+
+	// An upload that failed to be stored is given back, so that it can be
+	// retried
+	stored := false
+	defer func() {
+		if stored {
+			return
+		}
+		if err := appStore.ResumableUploads.Release(context.WithoutCancel(r.Context()), resumable.ID); err != nil {
+			log.Printf("Error releasing upload %s: %v", resumable.ID, err)
+		}
+	}()
+
+	chunks, err := appStore.ResumableUploads.GetChunks(r.Context(), resumable.ID)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get upload chunks: %v", err))
+		return false
+	}
+
+	// The chunks must follow each other up to the length of the upload
+	received := int64(0)
+	for _, chunk := range chunks {
+		if chunk.Offset != received {
+			break
+		}
+		received += chunk.Size
+	}
+	if received != resumable.Length {
+		log.Printf("Upload %s has %d of %d bytes in consecutive chunks", resumable.ID, received, resumable.Length)
+		WriteJsonError(w, http.StatusInternalServerError, "Upload is incomplete")
+		return false
+	}
+
+	keys := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		keys = append(keys, chunk.BlobKey)
+	}
+	content := &blobsReader{ctx: r.Context(), blobs: currentApp.Blobs, keys: keys}
+	defer content.Close()
+
+	storedFile, ok := storeUpload(w, r, &upload{
+		project:  project,
+		content:  content,
+		fileName: resumable.FileName,
+		mimeType: resumable.MimeType,
+		folder:   resumable.Folder,
+	})
+	if !ok {
+		return false
+	}
+
+	// The file is stored, so the upload stays claimed whatever happens next
+	// and is left to the janitor if it can not be marked as stored
+	stored = true
+
+	if err := appStore.ResumableUploads.SetStoredFile(r.Context(), resumable.ID, storedFile.ID); err != nil {
+		log.Printf("Error recording the file of upload %s: %v", resumable.ID, err)
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to finish upload")
+		return false
+	}
+	resumable.StoredFileID = &storedFile.ID
+
+	for _, chunk := range chunks {
+		removeBlob(r.Context(), chunk.BlobKey)
+	}
+	return true
+}
+
+// receivedReader ends a request body at the first read error instead of
+// failing, so that the bytes received before a connection broke can be
+// kept. The error is kept in err.
+type receivedReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *receivedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kudzaitsapo/fileflow-server/cmd/app"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// UploadPolicy limits what an HTML form can upload without the project key.
+// It is sent in the policy field of the form, as base64 encoded JSON, with
+// its signature in the signature field.
+type UploadPolicy struct {
+	ProjectID  int64     `json:"project_id"`
+	Expiration time.Time `json:"expiration"`
+	// FolderPrefix is the folder files must be uploaded into or below, any
+	// folder when empty
+	FolderPrefix string `json:"folder_prefix"`
+	// MinSize and MaxSize bound the size of the file in bytes
+	MinSize int64 `json:"min_size"`
+	MaxSize int64 `json:"max_size"`
+	// MimeTypes are the types the file may have, where image/* allows every
+	// image type. Any type the project allows when empty.
+	MimeTypes []string `json:"mime_types"`
+}
+
+type UploadPolicyRequest struct {
+	FolderPrefix string `json:"folder_prefix"`
+	MinSize      int64  `json:"min_size"`
+	// MaxSize is the maximum upload size of the project when 0
+	MaxSize   int64    `json:"max_size"`
+	MimeTypes []string `json:"mime_types"`
+	// ExpiresIn is the number of seconds the policy lasts
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type UploadPolicyResponse struct {
+	Policy    string    `json:"policy"`
+	Signature string    `json:"signature"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// allowsFolder reports whether a cleaned folder path is the folder prefix of
+// the policy or below it
+func (p *UploadPolicy) allowsFolder(folder string) bool {
+	return p.FolderPrefix == "" || folder == p.FolderPrefix || strings.HasPrefix(folder, p.FolderPrefix+"/")
+}
+
+// allowsMimeType reports whether the policy allows a file type
+func (p *UploadPolicy) allowsMimeType(mimeType string) bool {
+	if len(p.MimeTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.MimeTypes {
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleUploadPolicyCreation signs a policy that lets an HTML form upload
+// files to a project without the project key until it expires
+func HandleUploadPolicyCreation(w http.ResponseWriter, r *http.Request) {
+	var payload UploadPolicyRequest
+	if err := ReadJson(w, r, &payload); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("invalid request payload: %v", err))
+		return
+	}
+
+	project, ok := assignedProjectFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	folderPrefix, folderErr := utils.CleanFolderPath(payload.FolderPrefix)
+	if folderErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid folder prefix")
+		return
+	}
+
+	// A policy can only narrow what the project allows
+	maxUploadSize := project.MaxUploadSize << 20
+	maxSize := payload.MaxSize
+	if maxSize == 0 {
+		maxSize = maxUploadSize
+	}
+	if payload.MinSize < 0 || maxSize < payload.MinSize || maxSize > maxUploadSize {
+		WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("min_size and max_size must be a range within the maximum upload size of %d bytes", maxUploadSize))
+		return
+	}
+
+	for _, mimeType := range payload.MimeTypes {
+		if _, _, parseErr := mime.ParseMediaType(mimeType); parseErr != nil || !strings.Contains(mimeType, "/") {
+			WriteJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid MIME type: %s", mimeType))
+			return
+		}
+	}
+
+	expiresAt, expiryErr := presignExpiry(payload.ExpiresIn)
+	if expiryErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, expiryErr.Error())
+		return
+	}
+
+	policy := &UploadPolicy{
+		ProjectID:    project.ID,
+		Expiration:   expiresAt.UTC().Truncate(time.Second),
+		FolderPrefix: folderPrefix,
+		MinSize:      payload.MinSize,
+		MaxSize:      maxSize,
+		MimeTypes:    payload.MimeTypes,
+	}
+	document, err := json.Marshal(policy)
+	if err != nil {
+		WriteJsonError(w, http.StatusInternalServerError, "Unable to encode policy")
+		return
+	}
+
+	currentApp := app.GetCurrentApplication()
+	encoded := base64.StdEncoding.EncodeToString(document)
+	SendJsonWithoutMeta(w, http.StatusCreated, &UploadPolicyResponse{
+		Policy:    encoded,
+		Signature: currentApp.Signer.SignPolicy(encoded),
+		ExpiresAt: policy.Expiration,
+	})
+}
+
+// policyProjectFromForm checks the signature and expiry of a policy sent in
+// an upload form and loads the project it was issued for, writing the error
+// response when either fails
+func policyProjectFromForm(w http.ResponseWriter, r *http.Request, encoded string, signature string) (*store.Project, *UploadPolicy, bool) {
+	currentApp := app.GetCurrentApplication()
+
+	if err := currentApp.Signer.VerifyPolicy(encoded, signature); err != nil {
+		WriteJsonError(w, http.StatusForbidden, "Invalid policy signature")
+		return nil, nil, false
+	}
+
+	document, decodeErr := base64.StdEncoding.DecodeString(encoded)
+	if decodeErr != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid policy")
+		return nil, nil, false
+	}
+
+	policy := &UploadPolicy{}
+	if err := json.Unmarshal(document, policy); err != nil {
+		WriteJsonError(w, http.StatusBadRequest, "Invalid policy")
+		return nil, nil, false
+	}
+	if time.Now().After(policy.Expiration) {
+		WriteJsonError(w, http.StatusForbidden, "Policy has expired")
+		return nil, nil, false
+	}
+
+	project, projErr := currentApp.Store.Projects.GetById(r.Context(), policy.ProjectID)
+	if projErr != nil {
+		WriteJsonError(w, http.StatusNotFound, fmt.Sprintf("Unable to find project with id: %d", policy.ProjectID))
+		return nil, nil, false
+	}
+
+	return project, policy, true
+}
@@ -0,0 +1,34 @@
+// Package jobs holds the background work done by the server alongside
+// serving requests.
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+// ReplicaRepairGrace leaves blobs written recently out of replica repairs,
+// as their uploads may still be in progress
+const ReplicaRepairGrace = time.Hour
+
+// Every calls job once per interval until ctx is cancelled. The first call
+// happens one interval after start up, so restarts do not trigger a run.
+func Every(ctx context.Context, interval time.Duration, job func(ctx context.Context)) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				job(ctx)
+			}
+		}
+	}()
+}
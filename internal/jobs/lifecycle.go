@@ -0,0 +1,149 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+// lifecycleBatchSize is the number of matching files loaded at a time
+const lifecycleBatchSize = 100
+
+// LifecycleRunner applies the lifecycle rules of every project. Expired files
+// are moved to the trash, where the purger removes them later, and expired
+// previous versions are deleted straight away. Every application of a rule is
+// recorded as a run, with the files it expired.
+type LifecycleRunner struct {
+	store   *store.Storage
+	blobs   blobstore.BlobStore
+	running atomic.Bool
+}
+
+func NewLifecycleRunner(storage *store.Storage, blobs blobstore.BlobStore) *LifecycleRunner {
+	return &LifecycleRunner{
+		store: storage,
+		blobs: blobs,
+	}
+}
+
+// RunAll applies every enabled rule. Rules that fail are logged and recorded
+// on their run, and the other rules still run. A call made while an earlier
+// one is still going does nothing.
+func (l *LifecycleRunner) RunAll(ctx context.Context, now time.Time) error {
+	if !l.running.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer l.running.Store(false)
+
+	rules, err := l.store.LifecycleRules.GetEnabled(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		run, err := l.Run(ctx, rule, now)
+		if err != nil {
+			log.Printf("Error applying lifecycle rule %d: %v", rule.ID, err)
+			continue
+		}
+		log.Printf("Lifecycle rule %d of project %d expired %d of %d files (%d bytes), %d failed",
+			rule.ID, rule.ProjectID, run.FilesExpired, run.FilesMatched, run.BytesExpired, run.FilesFailed)
+	}
+
+	return nil
+}
+
+// Run applies one rule as of the given time and records the run
+func (l *LifecycleRunner) Run(ctx context.Context, rule *store.LifecycleRule, now time.Time) (*store.LifecycleRun, error) {
+	run := &store.LifecycleRun{}
+	if err := l.store.LifecycleRules.CreateRun(ctx, rule, run); err != nil {
+		return nil, err
+	}
+
+	run.Status = store.LifecycleCompleted
+	if err := l.apply(ctx, rule, now, run); err != nil {
+		run.Status = store.LifecycleFailed
+		run.Error = err.Error()
+	}
+
+	// Record the outcome even when ctx has been cancelled
+	if err := l.store.LifecycleRules.FinishRun(context.Background(), run); err != nil {
+		return run, err
+	}
+	if run.Status == store.LifecycleFailed {
+		return run, errors.New(run.Error)
+	}
+
+	return run, nil
+}
+
+func (l *LifecycleRunner) apply(ctx context.Context, rule *store.LifecycleRule, now time.Time, run *store.LifecycleRun) error {
+	after := uuid.Nil
+	for {
+		storedFiles, err := l.store.LifecycleRules.GetMatchBatch(ctx, rule, now, after, lifecycleBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(storedFiles) == 0 {
+			return nil
+		}
+
+		for _, storedFile := range storedFiles {
+			after = storedFile.ID
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := l.expire(ctx, rule, storedFile)
+			var lockErr *store.LockError
+			if errors.Is(err, store.ErrNotFound) || errors.As(err, &lockErr) {
+				// Deleted, replaced or locked in the meantime
+				continue
+			}
+			run.FilesMatched++
+
+			item := &store.LifecycleRunItem{
+				RunID:    run.ID,
+				FileID:   storedFile.ID,
+				FileName: storedFile.FileName,
+				Folder:   storedFile.Folder,
+				Version:  storedFile.Version,
+				FileSize: storedFile.FileSize,
+				Outcome:  store.LifecycleItemExpired,
+			}
+			if err != nil {
+				log.Printf("Error expiring file %s: %v", storedFile.ID, err)
+				item.Outcome = store.LifecycleItemFailed
+				item.Detail = err.Error()
+				run.FilesFailed++
+			} else {
+				run.FilesExpired++
+				run.BytesExpired += storedFile.FileSize
+			}
+
+			if err := l.store.LifecycleRules.AddRunItem(ctx, item); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (l *LifecycleRunner) expire(ctx context.Context, rule *store.LifecycleRule, storedFile *store.StoredFile) error {
+	if rule.Action == store.LifecycleExpireVersions {
+		return l.store.StoredFiles.Delete(ctx, storedFile.ID, func(storedFile *store.StoredFile) error {
+			return removeContent(ctx, l.blobs, storedFile)
+		})
+	}
+
+	return l.store.StoredFiles.Trash(ctx, storedFile.ID)
+}
@@ -0,0 +1,198 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// purgeBatchSize is the number of files loaded at a time
+const purgeBatchSize = 100
+
+// PurgeReport summarises one pass of the Purger
+type PurgeReport struct {
+	Files    int `json:"files"`
+	Projects int `json:"projects"`
+	Failed   int `json:"failed"`
+}
+
+// Purger removes files and projects for good once they have been in the
+// trash for longer than the retention period, deleting their content and
+// every row that depends on them
+type Purger struct {
+	store *store.Storage
+	blobs blobstore.BlobStore
+}
+
+func NewPurger(storage *store.Storage, blobs blobstore.BlobStore) *Purger {
+	return &Purger{
+		store: storage,
+		blobs: blobs,
+	}
+}
+
+// Purge removes the projects and files that were moved to the trash before
+// the given time
+func (p *Purger) Purge(ctx context.Context, before time.Time) (*PurgeReport, error) {
+	report := &PurgeReport{}
+
+	if err := p.purgeProjects(ctx, before, report); err != nil {
+		return report, err
+	}
+
+	return report, p.purgeFiles(ctx, 0, before, report)
+}
+
+// PurgeProjects removes the projects that were moved to the trash before the
+// given time, with all of their files
+func (p *Purger) PurgeProjects(ctx context.Context, before time.Time) (*PurgeReport, error) {
+	report := &PurgeReport{}
+	return report, p.purgeProjects(ctx, before, report)
+}
+
+// PurgeFiles removes the files of a project that were moved to the trash
+// before the given time
+func (p *Purger) PurgeFiles(ctx context.Context, projectId int64, before time.Time) (*PurgeReport, error) {
+	report := &PurgeReport{}
+	return report, p.purgeFiles(ctx, projectId, before, report)
+}
+
+func (p *Purger) purgeProjects(ctx context.Context, before time.Time, report *PurgeReport) error {
+	projectIds, err := p.store.Projects.GetTrashedBefore(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	for _, projectId := range projectIds {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := p.purgeProject(ctx, projectId, report); err != nil {
+			log.Printf("Error purging project %d: %v", projectId, err)
+			report.Failed++
+			continue
+		}
+		report.Projects++
+	}
+
+	return nil
+}
+
+// purgeProject removes every file of a project, whether it is in the trash
+// or not, and then the project itself
+func (p *Purger) purgeProject(ctx context.Context, projectId int64, report *PurgeReport) error {
+	for {
+		ids, err := p.store.StoredFiles.GetIdsByProjectId(ctx, projectId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			err := p.purgeFile(ctx, id)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			report.Files++
+		}
+	}
+
+	// Unfinished uploads have their chunks and parts in the blob store as well
+	for {
+		uploads, err := p.store.ResumableUploads.GetByProjectId(ctx, projectId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(uploads) == 0 {
+			break
+		}
+
+		for _, upload := range uploads {
+			if err := RemoveResumableUpload(ctx, p.store, p.blobs, upload, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		uploads, err := p.store.MultipartUploads.GetByProjectId(ctx, projectId, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(uploads) == 0 {
+			break
+		}
+
+		for _, upload := range uploads {
+			if err := AbortMultipartUpload(ctx, p.store, p.blobs, upload, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.store.Projects.Delete(ctx, projectId)
+}
+
+// purgeFiles removes the files in the trash of one project, or of every
+// project for projectId 0
+func (p *Purger) purgeFiles(ctx context.Context, projectId int64, before time.Time, report *PurgeReport) error {
+	for {
+		storedFiles, err := p.store.StoredFiles.GetTrashedBefore(ctx, projectId, before, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+
+		// Files that failed are loaded again, stop once nothing else is left
+		failed := 0
+		for _, storedFile := range storedFiles {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := p.purgeFile(ctx, storedFile.ID)
+			if errors.Is(err, store.ErrNotFound) {
+				// Restored or purged in the meantime
+				continue
+			}
+			if err != nil {
+				log.Printf("Error purging file %s: %v", storedFile.ID, err)
+				report.Failed++
+				failed++
+				continue
+			}
+			report.Files++
+		}
+
+		if len(storedFiles) == failed {
+			return nil
+		}
+	}
+}
+
+func (p *Purger) purgeFile(ctx context.Context, id uuid.UUID) error {
+	return p.store.StoredFiles.Purge(ctx, id, func(storedFile *store.StoredFile) error {
+		return removeContent(ctx, p.blobs, storedFile)
+	})
+}
+
+// removeContent deletes the content of a stored file that is being removed,
+// treating content that is already gone as removed
+func removeContent(ctx context.Context, blobs blobstore.BlobStore, storedFile *store.StoredFile) error {
+	err := blobs.Delete(ctx, utils.StoredFileKey(storedFile))
+	if err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+		return err
+	}
+	return nil
+}
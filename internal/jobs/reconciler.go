@@ -0,0 +1,200 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// ReconcileOptions controls what the reconciler repairs
+type ReconcileOptions struct {
+	// DryRun only reports drift without changing anything
+	DryRun bool
+	// GracePeriod protects uploads that are still in progress. Pending files
+	// and unreferenced blobs younger than this are left alone.
+	GracePeriod time.Duration
+	// DeleteMissing deletes files whose blob is gone instead of only marking
+	// them as missing
+	DeleteMissing bool
+}
+
+// ReconcileReport lists the drift found between stored files and blobs
+type ReconcileReport struct {
+	// StalePending are uploads that were never finalised
+	StalePending []*store.StoredFile
+	// MissingBlobs are files whose blob does not exist
+	MissingBlobs []*store.StoredFile
+	// OrphanedBlobs are blobs that no file references
+	OrphanedBlobs []*blobstore.BlobInfo
+	// ReferenceDrift are shared blobs with a wrong reference count
+	ReferenceDrift []*store.BlobDrift
+}
+
+// Reconciler finds and repairs stored files that point at no blob, and blobs
+// that no stored file points at
+type Reconciler struct {
+	store *store.Storage
+	blobs blobstore.BlobStore
+}
+
+func NewReconciler(storage *store.Storage, blobs blobstore.BlobStore) *Reconciler {
+	return &Reconciler{
+		store: storage,
+		blobs: blobs,
+	}
+}
+
+func (r *Reconciler) Run(ctx context.Context, options ReconcileOptions) (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+	cutoff := time.Now().Add(-options.GracePeriod)
+	referenced := make(map[string]bool)
+
+	// 1. Uploads that were abandoned before they were finalised
+	stalePending, err := r.store.StoredFiles.GetStalePending(ctx, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	report.StalePending = stalePending
+	for _, storedFile := range stalePending {
+		key := utils.StoredFileKey(storedFile)
+		referenced[key] = true
+
+		if options.DryRun {
+			continue
+		}
+		if err := r.store.StoredFiles.DeletePending(ctx, storedFile.ID); err != nil {
+			return nil, err
+		}
+		if err := r.removeBlob(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. Shared blobs whose reference count does not match their files
+	drifts, err := r.store.Blobs.GetReferenceDrift(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.ReferenceDrift = drifts
+	for _, drift := range drifts {
+		// Already reported, do not report the blob as orphaned as well
+		referenced[drift.Key] = true
+
+		if options.DryRun {
+			continue
+		}
+		err := r.store.Blobs.RepairReferences(ctx, drift.ID, func(blob *store.Blob) error {
+			return r.removeBlob(ctx, blob.Key)
+		})
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	// 3. Files whose blob is gone
+	checked := make(map[string]bool)
+	after := uuid.Nil
+	for {
+		storedFiles, err := r.store.StoredFiles.GetBatch(ctx, after, scrubBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(storedFiles) == 0 {
+			break
+		}
+		after = storedFiles[len(storedFiles)-1].ID
+
+		for _, storedFile := range storedFiles {
+			key := utils.StoredFileKey(storedFile)
+			referenced[key] = true
+
+			exists, seen := checked[key]
+			if !seen {
+				_, statErr := r.blobs.Stat(ctx, key)
+				if statErr != nil && !errors.Is(statErr, blobstore.ErrBlobNotFound) {
+					return nil, statErr
+				}
+				exists = statErr == nil
+				checked[key] = exists
+			}
+			if exists {
+				continue
+			}
+
+			report.MissingBlobs = append(report.MissingBlobs, storedFile)
+			if err := r.repairMissing(ctx, storedFile, options); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 4. Blobs that no file points at. The chunks of resumable uploads and
+	// the parts of multipart uploads are left to the upload janitor.
+	chunkKeys, err := r.store.ResumableUploads.GetChunkKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	partKeys, err := r.store.MultipartUploads.GetPartKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range append(chunkKeys, partKeys...) {
+		referenced[key] = true
+	}
+
+	blobs, err := r.blobs.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		if referenced[blob.Key] || !blob.ModifiedAt.Before(cutoff) {
+			continue
+		}
+
+		report.OrphanedBlobs = append(report.OrphanedBlobs, blob)
+		if options.DryRun {
+			continue
+		}
+		if err := r.removeBlob(ctx, blob.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Reconciler) repairMissing(ctx context.Context, storedFile *store.StoredFile, options ReconcileOptions) error {
+	if options.DryRun {
+		return nil
+	}
+
+	if !options.DeleteMissing {
+		return r.store.StoredFiles.SetIntegrity(ctx, storedFile.ID, store.IntegrityMissing, "blob does not exist")
+	}
+
+	err := r.store.StoredFiles.Delete(ctx, storedFile.ID, func(storedFile *store.StoredFile) error {
+		return r.removeBlob(ctx, utils.StoredFileKey(storedFile))
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	// Files under retention or legal hold are kept, only marked as missing
+	var lockErr *store.LockError
+	if errors.As(err, &lockErr) {
+		return r.store.StoredFiles.SetIntegrity(ctx, storedFile.ID, store.IntegrityMissing, "blob does not exist")
+	}
+	return err
+}
+
+// removeBlob deletes a blob, treating blobs that are already gone as removed
+func (r *Reconciler) removeBlob(ctx context.Context, key string) error {
+	if err := r.blobs.Delete(ctx, key); err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+		return err
+	}
+	return nil
+}
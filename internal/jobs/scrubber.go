@@ -0,0 +1,276 @@
+package jobs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+	"github.com/kudzaitsapo/fileflow-server/internal/encryption"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+	"github.com/kudzaitsapo/fileflow-server/internal/utils"
+)
+
+// scrubBatchSize is the number of stored files loaded at a time
+const scrubBatchSize = 100
+
+var ErrScrubInProgress = errors.New("an integrity scrub is already running")
+
+// Scrubber re-reads every stored file to find blobs that went missing or no
+// longer decompress to the recorded size and checksums, and blobs that no
+// file references. Results are recorded on the files and as findings of the
+// run.
+type Scrubber struct {
+	store   *store.Storage
+	blobs   blobstore.BlobStore
+	keyring *encryption.Keyring
+	running atomic.Bool
+}
+
+// scrubResult is the outcome of checking one blob
+type scrubResult struct {
+	status string
+	detail string
+}
+
+// NewScrubber creates a scrubber. keyring may be nil when encryption at rest
+// is disabled.
+func NewScrubber(storage *store.Storage, blobs blobstore.BlobStore, keyring *encryption.Keyring) *Scrubber {
+	return &Scrubber{
+		store:   storage,
+		blobs:   blobs,
+		keyring: keyring,
+	}
+}
+
+// Start records a new run and scrubs in the background. Only one run happens
+// at a time.
+func (s *Scrubber) Start() (*store.ScrubRun, error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, ErrScrubInProgress
+	}
+
+	run := &store.ScrubRun{}
+	if err := s.store.ScrubRuns.Create(context.Background(), run); err != nil {
+		s.running.Store(false)
+		return nil, err
+	}
+	started := *run
+
+	go func() {
+		defer s.running.Store(false)
+		s.scrub(context.Background(), run)
+	}()
+
+	return &started, nil
+}
+
+func (s *Scrubber) scrub(ctx context.Context, run *store.ScrubRun) {
+	log.Printf("Integrity scrub %d started", run.ID)
+
+	startedAt := time.Now()
+	err := s.scrubFiles(ctx, run, startedAt)
+
+	run.Status = store.ScrubCompleted
+	if err != nil {
+		run.Status = store.ScrubFailed
+		run.Error = err.Error()
+	}
+
+	if finishErr := s.store.ScrubRuns.Finish(ctx, run); finishErr != nil {
+		log.Printf("Error recording integrity scrub %d: %v", run.ID, finishErr)
+	}
+
+	log.Printf("Integrity scrub %d %s in %v: %d files checked, %d missing, %d corrupt, %d orphaned blobs",
+		run.ID, run.Status, time.Since(startedAt).Round(time.Second), run.FilesChecked, run.Missing, run.Corrupt, run.Orphaned)
+}
+
+func (s *Scrubber) scrubFiles(ctx context.Context, run *store.ScrubRun, startedAt time.Time) error {
+	// Files that share a blob are only read once per run
+	results := make(map[string]*scrubResult)
+	referenced := make(map[string]bool)
+
+	after := uuid.Nil
+	for {
+		storedFiles, err := s.store.StoredFiles.GetBatch(ctx, after, scrubBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(storedFiles) == 0 {
+			break
+		}
+		after = storedFiles[len(storedFiles)-1].ID
+
+		for _, storedFile := range storedFiles {
+			key := utils.StoredFileKey(storedFile)
+			referenced[key] = true
+
+			result, checked := results[key]
+			if !checked {
+				result, err = s.checkFile(ctx, storedFile, key)
+				if err != nil {
+					// Not the blob's fault, so leave the file's status alone
+					log.Printf("Error checking file %s: %v", storedFile.ID, err)
+					continue
+				}
+				results[key] = result
+			}
+
+			if err := s.record(ctx, run, storedFile, key, result); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.findOrphans(ctx, run, referenced, startedAt)
+}
+
+func (s *Scrubber) record(ctx context.Context, run *store.ScrubRun, storedFile *store.StoredFile, key string, result *scrubResult) error {
+	run.FilesChecked++
+	switch result.status {
+	case store.IntegrityOK:
+		run.Healthy++
+	case store.IntegrityMissing:
+		run.Missing++
+	case store.IntegrityCorrupt:
+		run.Corrupt++
+	case store.IntegrityUnverifiable:
+		run.Unverifiable++
+	}
+
+	if err := s.store.StoredFiles.SetIntegrity(ctx, storedFile.ID, result.status, result.detail); err != nil {
+		return err
+	}
+
+	if result.status != store.IntegrityMissing && result.status != store.IntegrityCorrupt {
+		return nil
+	}
+
+	return s.store.ScrubRuns.AddFinding(ctx, &store.ScrubFinding{
+		RunID:   run.ID,
+		FileID:  &storedFile.ID,
+		BlobKey: key,
+		Problem: result.status,
+		Detail:  result.detail,
+	})
+}
+
+// checkFile reads the whole blob of a file. Errors are only returned when the
+// blob could not be checked, not when it is damaged.
+func (s *Scrubber) checkFile(ctx context.Context, storedFile *store.StoredFile, key string) (*scrubResult, error) {
+	if _, err := s.blobs.Stat(ctx, key); err != nil {
+		if errors.Is(err, blobstore.ErrBlobNotFound) {
+			return &scrubResult{store.IntegrityMissing, "blob does not exist"}, nil
+		}
+		return nil, err
+	}
+
+	if storedFile.KeyFingerprint != "" {
+		return &scrubResult{store.IntegrityUnverifiable, "encrypted with a customer supplied key"}, nil
+	}
+
+	var content io.ReadCloser
+	if storedFile.StorageFormat == utils.StorageFormatFramed {
+		var sealers compression.SealerFactory
+		if storedFile.Encrypted {
+			if s.keyring == nil {
+				return &scrubResult{store.IntegrityUnverifiable, "encrypted but no master key is configured"}, nil
+			}
+			// Make sure key problems are not mistaken for corruption
+			if _, err := s.keyring.DataKey(ctx, storedFile.ProjectID); err != nil {
+				return nil, err
+			}
+			sealers = s.keyring.Sealers(ctx, storedFile.ProjectID)
+		}
+
+		framedFile, err := utils.OpenFramedFile(ctx, s.blobs, key, sealers)
+		if err != nil {
+			return &scrubResult{store.IntegrityCorrupt, err.Error()}, nil
+		}
+		if framedFile.Encrypted() != (sealers != nil) {
+			framedFile.Close()
+			return &scrubResult{store.IntegrityCorrupt, "container encryption does not match the file record"}, nil
+		}
+		content = framedFile
+	} else {
+		stream, err := utils.DecompressFileAndReturnStream(ctx, s.blobs, storedFile.SavedAs, storedFile.StorageFolder)
+		if err != nil {
+			return nil, err
+		}
+		content = stream
+	}
+	defer content.Close()
+
+	sha256Hasher := sha256.New()
+	md5Hasher := md5.New()
+	size, err := io.Copy(io.MultiWriter(sha256Hasher, md5Hasher), content)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return &scrubResult{store.IntegrityCorrupt, err.Error()}, nil
+	}
+
+	if size != storedFile.FileSize {
+		return &scrubResult{store.IntegrityCorrupt, fmt.Sprintf("decompressed to %d bytes, expected %d", size, storedFile.FileSize)}, nil
+	}
+	if sum := hex.EncodeToString(sha256Hasher.Sum(nil)); storedFile.SHA256 != "" && sum != storedFile.SHA256 {
+		return &scrubResult{store.IntegrityCorrupt, fmt.Sprintf("SHA-256 is %s, expected %s", sum, storedFile.SHA256)}, nil
+	}
+	if sum := hex.EncodeToString(md5Hasher.Sum(nil)); storedFile.MD5 != "" && sum != storedFile.MD5 {
+		return &scrubResult{store.IntegrityCorrupt, fmt.Sprintf("MD5 is %s, expected %s", sum, storedFile.MD5)}, nil
+	}
+
+	return &scrubResult{store.IntegrityOK, ""}, nil
+}
+
+// findOrphans reports blobs that no file referenced. Blobs written after the
+// run started are skipped, since their files may not have been listed.
+func (s *Scrubber) findOrphans(ctx context.Context, run *store.ScrubRun, referenced map[string]bool, startedAt time.Time) error {
+	// The chunks of resumable uploads and the parts of multipart uploads are
+	// not orphaned until the upload janitor removes the upload
+	chunkKeys, err := s.store.ResumableUploads.GetChunkKeys(ctx)
+	if err != nil {
+		return err
+	}
+	partKeys, err := s.store.MultipartUploads.GetPartKeys(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range append(chunkKeys, partKeys...) {
+		referenced[key] = true
+	}
+
+	blobs, err := s.blobs.List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if referenced[blob.Key] || !blob.ModifiedAt.Before(startedAt) {
+			continue
+		}
+
+		run.Orphaned++
+		err := s.store.ScrubRuns.AddFinding(ctx, &store.ScrubFinding{
+			RunID:   run.ID,
+			BlobKey: blob.Key,
+			Problem: store.IntegrityOrphaned,
+			Detail:  fmt.Sprintf("%d bytes, not referenced by any file", blob.Size),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+// tieringBatchSize is the number of blobs loaded at a time
+const tieringBatchSize = 100
+
+var ErrNotTiered = errors.New("file is not kept in tiered storage")
+
+// TieringReport summarises one pass of Tierer.Archive
+type TieringReport struct {
+	Archived int   `json:"archived"`
+	Failed   int   `json:"failed"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Tierer moves blobs between the hot and cold tiers of a
+// blobstore.TieredStore. Blobs go cold once none of their files has been
+// downloaded for a while, and come back when a file is restored.
+type Tierer struct {
+	store     *store.Storage
+	blobs     blobstore.BlobStore
+	restoring sync.Map
+}
+
+func NewTierer(storage *store.Storage, blobs blobstore.BlobStore) *Tierer {
+	return &Tierer{
+		store: storage,
+		blobs: blobs,
+	}
+}
+
+// Archive moves every hot blob whose files have not been downloaded or
+// uploaded since before to cold storage
+func (t *Tierer) Archive(ctx context.Context, before time.Time) (*TieringReport, error) {
+	report := &TieringReport{}
+	after := int64(0)
+
+	for {
+		blobs, err := t.store.Blobs.GetColdCandidates(ctx, before, after, tieringBatchSize)
+		if err != nil {
+			return report, err
+		}
+		if len(blobs) == 0 {
+			return report, nil
+		}
+
+		for _, blob := range blobs {
+			after = blob.ID
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			err := t.moveBlob(ctx, blob, blobstore.ColdKey(blob.Key), store.StorageClassCold, &before)
+			if errors.Is(err, store.ErrNotFound) {
+				// Downloaded, re-uploaded or deleted in the meantime
+				continue
+			}
+			if err != nil {
+				log.Printf("Error moving blob %s to cold storage: %v", blob.Key, err)
+				report.Failed++
+				continue
+			}
+
+			report.Archived++
+			report.Bytes += blob.StoredSize
+		}
+	}
+}
+
+// Restore starts moving the blob of a cold file back to hot storage. It
+// reports whether the file is still being restored, which is false once the
+// file is hot.
+func (t *Tierer) Restore(storedFile *store.StoredFile) (bool, error) {
+	if storedFile.StorageClass != store.StorageClassCold {
+		return false, nil
+	}
+	if storedFile.BlobID == 0 {
+		return false, ErrNotTiered
+	}
+
+	if _, running := t.restoring.LoadOrStore(storedFile.BlobID, true); running {
+		return true, nil
+	}
+
+	go func() {
+		defer t.restoring.Delete(storedFile.BlobID)
+
+		ctx := context.Background()
+		blob, err := t.store.Blobs.GetById(ctx, storedFile.BlobID)
+		if err != nil {
+			log.Printf("Error loading blob of file %s to restore: %v", storedFile.ID, err)
+			return
+		}
+		if blob.StorageClass != store.StorageClassCold {
+			return
+		}
+
+		if err := t.moveBlob(ctx, blob, blobstore.HotKey(blob.Key), store.StorageClassHot, nil); err != nil {
+			log.Printf("Error restoring blob %s from cold storage: %v", blob.Key, err)
+			return
+		}
+		log.Printf("Restored blob %s from cold storage", blob.Key)
+	}()
+
+	return true, nil
+}
+
+// moveBlob copies a blob to its key in the other tier, points the blob and
+// its files at the copy and then removes the original. The copy is removed
+// again when the blob changed in the meantime.
+func (t *Tierer) moveBlob(ctx context.Context, blob *store.Blob, toKey string, class string, idleSince *time.Time) error {
+	if _, err := blobstore.Copy(ctx, t.blobs, blob.Key, toKey); err != nil {
+		return err
+	}
+
+	if err := t.store.Blobs.ChangeStorageClass(ctx, blob.ID, blob.Key, toKey, class, idleSince); err != nil {
+		if removeErr := t.blobs.Delete(context.Background(), toKey); removeErr != nil {
+			log.Printf("Error removing copy %s of blob %d: %v", toKey, blob.ID, removeErr)
+		}
+		return err
+	}
+
+	if err := t.blobs.Delete(ctx, blob.Key); err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+		// Left for the reconcile command to remove as an orphan
+		log.Printf("Error removing blob %s after moving it to %s: %v", blob.Key, toKey, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
+)
+
+// UploadCleanupReport summarises one pass of the UploadJanitor
+type UploadCleanupReport struct {
+	// Uploads and Chunks count the resumable uploads removed
+	Uploads int `json:"uploads"`
+	Chunks  int `json:"chunks"`
+	// MultipartUploads and Parts count the multipart uploads aborted
+	MultipartUploads int `json:"multipart_uploads"`
+	Parts            int `json:"parts"`
+	Failed           int `json:"failed"`
+}
+
+// UploadJanitor removes resumable uploads once they have expired, with the
+// chunks received so far, and aborts multipart uploads that have not been
+// sent a part for as long
+type UploadJanitor struct {
+	store *store.Storage
+	blobs blobstore.BlobStore
+}
+
+func NewUploadJanitor(storage *store.Storage, blobs blobstore.BlobStore) *UploadJanitor {
+	return &UploadJanitor{
+		store: storage,
+		blobs: blobs,
+	}
+}
+
+// Clean removes the uploads that expired before the given time
+func (j *UploadJanitor) Clean(ctx context.Context, now time.Time) (*UploadCleanupReport, error) {
+	report := &UploadCleanupReport{}
+
+	if err := j.cleanResumable(ctx, now, report); err != nil {
+		return report, err
+	}
+	return report, j.cleanMultipart(ctx, now, report)
+}
+
+func (j *UploadJanitor) cleanResumable(ctx context.Context, now time.Time, report *UploadCleanupReport) error {
+	for {
+		uploads, err := j.store.ResumableUploads.GetExpired(ctx, now, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(uploads) == 0 {
+			return nil
+		}
+
+		failed := 0
+		for _, upload := range uploads {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := RemoveResumableUpload(ctx, j.store, j.blobs, upload, report); err != nil {
+				log.Printf("Error removing expired upload %s: %v", upload.ID, err)
+				report.Failed++
+				failed++
+			}
+		}
+
+		// The same uploads would be loaded again
+		if failed == len(uploads) {
+			return nil
+		}
+	}
+}
+
+func (j *UploadJanitor) cleanMultipart(ctx context.Context, now time.Time, report *UploadCleanupReport) error {
+	for {
+		uploads, err := j.store.MultipartUploads.GetExpired(ctx, now, purgeBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(uploads) == 0 {
+			return nil
+		}
+
+		failed := 0
+		for _, upload := range uploads {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := AbortMultipartUpload(ctx, j.store, j.blobs, upload, report); err != nil {
+				log.Printf("Error aborting stale multipart upload %s: %v", upload.ID, err)
+				report.Failed++
+				failed++
+			}
+		}
+
+		// The same uploads would be loaded again
+		if failed == len(uploads) {
+			return nil
+		}
+	}
+}
+
+// RemoveResumableUpload deletes the chunks of an upload and then the upload
+// itself. A report may be passed to count what was removed.
+func RemoveResumableUpload(ctx context.Context, storage *store.Storage, blobs blobstore.BlobStore, upload *store.ResumableUpload, report *UploadCleanupReport) error {
+	chunks, err := storage.ResumableUploads.GetChunks(ctx, upload.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		if err := blobs.Delete(ctx, chunk.BlobKey); err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+			return err
+		}
+		if report != nil {
+			report.Chunks++
+		}
+	}
+
+	err = storage.ResumableUploads.Delete(ctx, upload.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		report.Uploads++
+	}
+	return nil
+}
+
+// AbortMultipartUpload deletes the parts of a multipart upload and then the
+// upload itself. A report may be passed to count what was removed.
+func AbortMultipartUpload(ctx context.Context, storage *store.Storage, blobs blobstore.BlobStore, upload *store.MultipartUpload, report *UploadCleanupReport) error {
+	parts, err := storage.MultipartUploads.GetParts(ctx, upload.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if err := blobs.Delete(ctx, part.BlobKey); err != nil && !errors.Is(err, blobstore.ErrBlobNotFound) {
+			return err
+		}
+		if report != nil {
+			report.Parts++
+		}
+	}
+
+	err = storage.MultipartUploads.Delete(ctx, upload.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		report.MultipartUploads++
+	}
+	return nil
+}
@@ -46,10 +46,15 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
+		// Resumable upload clients in browsers read the progress from headers
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Checksum-Algorithm, ff-file-id")
 
 		if r.Method == "OPTIONS" {
+			if strings.HasPrefix(r.URL.Path, "/v1/uploads") {
+				handlers.SetTusOptionsHeaders(w.Header())
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"fmt"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 
@@ -27,6 +29,85 @@ func createOptionsHandler(allowedMethods []string) http.HandlerFunc {
 	}
 }
 
+// pathsConflict reports whether ServeMux would refuse to register both paths
+// for the same method: some request matches both, and neither only matches
+// requests the other one matches too. The routes here have no trailing
+// slashes or {name...} wildcards.
+func pathsConflict(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	aWider, bWider := false, false
+	for i := range a {
+		aWildcard, bWildcard := strings.HasPrefix(a[i], "{"), strings.HasPrefix(b[i], "{")
+		switch {
+		case aWildcard && !bWildcard:
+			aWider = true
+		case bWildcard && !aWildcard:
+			bWider = true
+		case !aWildcard && a[i] != b[i]:
+			return false
+		}
+	}
+	return aWider && bWider
+}
+
+// groupConflictingPaths groups the paths whose OPTIONS routes would conflict,
+// e.g. /v1/files/multipart/{id} and /v1/files/{id}/info. Every other path is
+// a group of its own.
+func groupConflictingPaths(methodMap map[string]map[string]struct{}) [][]string {
+	paths := make([]string, 0, len(methodMap))
+	for path := range methodMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	groups := make([][]string, 0, len(paths))
+	for _, path := range paths {
+		segments := strings.Split(path, "/")
+
+		merged := -1
+		for i := 0; i < len(groups); i++ {
+			conflicts := slices.ContainsFunc(groups[i], func(other string) bool {
+				return pathsConflict(segments, strings.Split(other, "/"))
+			})
+			if !conflicts {
+				continue
+			}
+			if merged < 0 {
+				groups[i] = append(groups[i], path)
+				merged = i
+				continue
+			}
+			// The path ties two groups together
+			groups[merged] = append(groups[merged], groups[i]...)
+			groups = slices.Delete(groups, i, i+1)
+			i--
+		}
+
+		if merged < 0 {
+			groups = append(groups, []string{path})
+		}
+	}
+
+	return groups
+}
+
+// generalisePaths returns a path matching every path of a group, with a
+// wildcard wherever they differ
+func generalisePaths(group []string) string {
+	segments := strings.Split(group[0], "/")
+	for _, path := range group[1:] {
+		for i, segment := range strings.Split(path, "/") {
+			if segment != segments[i] {
+				segments[i] = fmt.Sprintf("{segment%d}", i)
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 func CreateRoutes() []Route {
 	routes := []Route{}
 
@@ -60,6 +141,11 @@ func CreateRoutes() []Route {
 			Handler:      http.HandlerFunc(handlers.HandleProjectList),
 			RequiresAuth: true,
 		},
+		Route{
+			Pattern:      "DELETE /v1/projects/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleProjectDeletion),
+			RequiresAuth: true,
+		},
 		Route{
 			Pattern:      "GET /v1/projects/{id}/files",
 			Handler:      http.HandlerFunc(handlers.HandleFilesList),
@@ -75,21 +161,291 @@ func CreateRoutes() []Route {
 			Handler:      http.HandlerFunc(handlers.HandleGetProjectUsers),
 			RequiresAuth: true,
 		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/compression-policies",
+			Handler:      http.HandlerFunc(handlers.HandleGetCompressionPolicies),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/compression-policies",
+			Handler:      http.HandlerFunc(handlers.HandleCreateCompressionPolicy),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "DELETE /v1/projects/{id}/compression-policies/{policyId}",
+			Handler:      http.HandlerFunc(handlers.HandleDeleteCompressionPolicy),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/lifecycle-rules",
+			Handler:      http.HandlerFunc(handlers.HandleGetLifecycleRules),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/lifecycle-rules",
+			Handler:      http.HandlerFunc(handlers.HandleCreateLifecycleRule),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "PUT /v1/projects/{id}/lifecycle-rules/{ruleId}",
+			Handler:      http.HandlerFunc(handlers.HandleUpdateLifecycleRule),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "DELETE /v1/projects/{id}/lifecycle-rules/{ruleId}",
+			Handler:      http.HandlerFunc(handlers.HandleDeleteLifecycleRule),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/lifecycle-rules/{ruleId}/preview",
+			Handler:      http.HandlerFunc(handlers.HandlePreviewLifecycleRule),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/lifecycle-runs",
+			Handler:      http.HandlerFunc(handlers.HandleGetLifecycleRuns),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/lifecycle-runs/{runId}/items",
+			Handler:      http.HandlerFunc(handlers.HandleGetLifecycleRunItems),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "PUT /v1/projects/{id}/retention",
+			Handler:      http.HandlerFunc(handlers.HandleProjectRetention),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "PUT /v1/projects/{id}/files/{fileId}/legal-hold",
+			Handler:      http.HandlerFunc(handlers.HandleFileLegalHold),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/lock-audit-events",
+			Handler:      http.HandlerFunc(handlers.HandleGetLockAuditEvents),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/presigned-urls/download",
+			Handler:      http.HandlerFunc(handlers.HandlePresignDownload),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/presigned-urls/upload",
+			Handler:      http.HandlerFunc(handlers.HandlePresignUpload),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/upload-policies",
+			Handler:      http.HandlerFunc(handlers.HandleUploadPolicyCreation),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/share-links",
+			Handler:      http.HandlerFunc(handlers.HandleGetShareLinks),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/share-links",
+			Handler:      http.HandlerFunc(handlers.HandleCreateShareLink),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/projects/{id}/share-links/{linkId}",
+			Handler:      http.HandlerFunc(handlers.HandleGetShareLink),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/projects/{id}/share-links/{linkId}/revoke",
+			Handler:      http.HandlerFunc(handlers.HandleRevokeShareLink),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "DELETE /v1/projects/{id}/share-links/{linkId}",
+			Handler:      http.HandlerFunc(handlers.HandleDeleteShareLink),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/s/{token}",
+			Handler:      http.HandlerFunc(handlers.HandleShareLinkDownload),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/compression-codecs",
+			Handler:      http.HandlerFunc(handlers.HandleGetCompressionCodecs),
+			RequiresAuth: true,
+		},
 		Route{
 			Pattern:      "POST /v1/files",
 			Handler:      http.HandlerFunc(handlers.HandleFileUpload),
 			RequiresAuth: false,
 		},
+		Route{
+			Pattern:      "POST /v1/uploads",
+			Handler:      http.HandlerFunc(handlers.HandleTusCreation),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "HEAD /v1/uploads/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleTusHead),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "PATCH /v1/uploads/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleTusPatch),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "DELETE /v1/uploads/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleTusTermination),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/files/multipart",
+			Handler:      http.HandlerFunc(handlers.HandleMultipartInitiate),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "PUT /v1/files/multipart/{id}/parts/{partNumber}",
+			Handler:      http.HandlerFunc(handlers.HandleMultipartUploadPart),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/files/multipart/{id}/parts",
+			Handler:      http.HandlerFunc(handlers.HandleMultipartListParts),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/files/multipart/{id}/complete",
+			Handler:      http.HandlerFunc(handlers.HandleMultipartComplete),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "DELETE /v1/files/multipart/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleMultipartAbort),
+			RequiresAuth: false,
+		},
 		Route{
 			Pattern:      "GET /v1/files/{id}/download",
 			Handler:      http.HandlerFunc(handlers.HandleFileDownload),
 			RequiresAuth: false,
 		},
+		Route{
+			Pattern:      "POST /v1/files/{id}/restore",
+			Handler:      http.HandlerFunc(handlers.HandleFileRestore),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/files/{id}/versions",
+			Handler:      http.HandlerFunc(handlers.HandleFileVersions),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/files/{id}/versions/{version}/restore",
+			Handler:      http.HandlerFunc(handlers.HandleFileVersionRestore),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "DELETE /v1/files/{id}/versions/{version}",
+			Handler:      http.HandlerFunc(handlers.HandleFileVersionDeletion),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/files/{id}/move",
+			Handler:      http.HandlerFunc(handlers.HandleFileMove),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "DELETE /v1/files/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleFileDeletion),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/trash/files",
+			Handler:      http.HandlerFunc(handlers.HandleFileTrash),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "DELETE /v1/trash/files",
+			Handler:      http.HandlerFunc(handlers.HandleEmptyFileTrash),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/trash/files/{id}/restore",
+			Handler:      http.HandlerFunc(handlers.HandleFileTrashRestore),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/trash/projects",
+			Handler:      http.HandlerFunc(handlers.HandleProjectTrash),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "DELETE /v1/trash/projects",
+			Handler:      http.HandlerFunc(handlers.HandleEmptyProjectTrash),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/trash/projects/{id}/restore",
+			Handler:      http.HandlerFunc(handlers.HandleProjectTrashRestore),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/folders",
+			Handler:      http.HandlerFunc(handlers.HandleFolderChildren),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/folders",
+			Handler:      http.HandlerFunc(handlers.HandleFolderCreation),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/folders/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleGetFolder),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "GET /v1/folders/{id}/children",
+			Handler:      http.HandlerFunc(handlers.HandleFolderChildren),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/folders/{id}/rename",
+			Handler:      http.HandlerFunc(handlers.HandleFolderRename),
+			RequiresAuth: false,
+		},
+		Route{
+			Pattern:      "POST /v1/folders/{id}/move",
+			Handler:      http.HandlerFunc(handlers.HandleFolderMove),
+			RequiresAuth: false,
+		},
 		Route{
 			Pattern:      "GET /v1/files/{id}/info",
 			Handler:      http.HandlerFunc(handlers.HandleFileInfo),
 			RequiresAuth: true,
 		},
+		Route{
+			Pattern:      "GET /v1/admin/scrub-runs",
+			Handler:      http.HandlerFunc(handlers.HandleGetScrubRuns),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "POST /v1/admin/scrub-runs",
+			Handler:      http.HandlerFunc(handlers.HandleStartScrubRun),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/admin/scrub-runs/{id}",
+			Handler:      http.HandlerFunc(handlers.HandleGetScrubRun),
+			RequiresAuth: true,
+		},
+		Route{
+			Pattern:      "GET /v1/admin/scrub-runs/{id}/findings",
+			Handler:      http.HandlerFunc(handlers.HandleGetScrubFindings),
+			RequiresAuth: true,
+		},
 		Route{
 			Pattern:      "GET /v1/file-types",
 			Handler:      http.HandlerFunc(handlers.HandleGetAllFileTypes),
@@ -136,11 +492,15 @@ func CreateRoutes() []Route {
 		methodMap[path][method] = struct{}{}
 	}
 
-	for path, methods := range methodMap {
+	for _, group := range groupConflictingPaths(methodMap) {
 		// Collect allowed methods
-		allowedMethods := make([]string, 0, len(methods))
-		for m := range methods {
-			allowedMethods = append(allowedMethods, m)
+		allowedMethods := make([]string, 0)
+		for _, path := range group {
+			for m := range methodMap[path] {
+				if !slices.Contains(allowedMethods, m) {
+					allowedMethods = append(allowedMethods, m)
+				}
+			}
 		}
 
 		// Sort for consistent output
@@ -148,7 +508,7 @@ func CreateRoutes() []Route {
 
 		// Add OPTIONS route
 		routes = append(routes, Route{
-			Pattern:      "OPTIONS " + path,
+			Pattern:      "OPTIONS " + generalisePaths(group),
 			Handler:      createOptionsHandler(allowedMethods),
 			RequiresAuth: false,
 		})
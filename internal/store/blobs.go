@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxBlobLockAttempts bounds the retries when a blob is deleted while it is
+// being referenced
+const maxBlobLockAttempts = 3
+
+// Storage classes of blobs. Hot blobs are kept in the main blob store, cold
+// ones in the cheaper cold store.
+const (
+	StorageClassHot  = "hot"
+	StorageClassCold = "cold"
+)
+
+// Blob is content shared by every stored file with the same SHA-256 within a
+// scope. Files encrypted with different keys can not share content, so the
+// scope names the key the blob was encrypted with.
+type Blob struct {
+	ID               int64  `json:"id"`
+	SHA256           string `json:"sha256"`
+	Scope            string `json:"scope"`
+	Key              string `json:"key"`
+	Size             int64  `json:"size"`
+	StoredSize       int64  `json:"stored_size"`
+	StorageFormat    string `json:"storage_format"`
+	CompressionCodec string `json:"compression_codec"`
+	CompressionLevel int    `json:"compression_level"`
+	Encrypted        bool   `json:"encrypted"`
+	RefCount         int64  `json:"ref_count"`
+	StorageClass     string `json:"storage_class"`
+	CreatedAt        string `json:"created_at"`
+}
+
+const blobColumns = `id, sha256, scope, blob_key, size, stored_size, storage_format, compression_codec, compression_level, encrypted, ref_count, storage_class, created_at`
+
+func blobFields(blob *Blob) []any {
+	return []any{
+		&blob.ID,
+		&blob.SHA256,
+		&blob.Scope,
+		&blob.Key,
+		&blob.Size,
+		&blob.StoredSize,
+		&blob.StorageFormat,
+		&blob.CompressionCodec,
+		&blob.CompressionLevel,
+		&blob.Encrypted,
+		&blob.RefCount,
+		&blob.StorageClass,
+		&blob.CreatedAt,
+	}
+}
+
+// lockBlob locks the row of the blob with the content and scope of blob,
+// inserting it without references when there is none, and loads it into blob
+func lockBlob(ctx context.Context, tx *sql.Tx, blob *Blob) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	insertQuery := `INSERT INTO blobs (sha256, scope, blob_key, size, stored_size, storage_format, compression_codec, compression_level, encrypted)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+					ON CONFLICT (sha256, scope) DO NOTHING`
+	selectQuery := `SELECT ` + blobColumns + ` FROM blobs WHERE sha256 = $1 AND scope = $2 FOR UPDATE`
+
+	// The row can disappear between the two statements when its last
+	// reference is released concurrently, so try again
+	for attempt := 0; attempt < maxBlobLockAttempts; attempt++ {
+		_, err := tx.ExecContext(ctx, insertQuery,
+			blob.SHA256,
+			blob.Scope,
+			blob.Key,
+			blob.Size,
+			blob.StoredSize,
+			blob.StorageFormat,
+			blob.CompressionCodec,
+			blob.CompressionLevel,
+			blob.Encrypted,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, selectQuery, blob.SHA256, blob.Scope).Scan(blobFields(blob)...)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to lock blob %s", blob.SHA256)
+}
+
+func addBlobReferences(ctx context.Context, tx *sql.Tx, id int64, count int64) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, `UPDATE blobs SET ref_count = ref_count + $1 WHERE id = $2`, count, id)
+	return err
+}
+
+// releaseBlob drops a reference to a blob. When it was the last one, remove
+// is called while the row is still locked and the row is deleted, so a
+// concurrent upload of the same content waits for the blob to be gone.
+func releaseBlob(ctx context.Context, tx *sql.Tx, id int64, remove func() error) error {
+	queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var refCount int64
+	query := `UPDATE blobs SET ref_count = ref_count - 1 WHERE id = $1 RETURNING ref_count`
+	if err := tx.QueryRowContext(queryCtx, query, id).Scan(&refCount); err != nil {
+		return err
+	}
+
+	if refCount > 0 {
+		return nil
+	}
+
+	if err := remove(); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(queryCtx, `DELETE FROM blobs WHERE id = $1`, id)
+	return err
+}
+
+// BlobDrift is a blob whose reference count does not match the number of
+// files pointing at it
+type BlobDrift struct {
+	Blob
+	References int64 `json:"references"`
+}
+
+type BlobStore struct {
+	db *sql.DB
+}
+
+// GetReferenceDrift returns the blobs whose reference count is wrong
+func (s *BlobStore) GetReferenceDrift(ctx context.Context) ([]*BlobDrift, error) {
+	query := `SELECT b.id, b.sha256, b.scope, b.blob_key, b.size, b.stored_size, b.storage_format, b.compression_codec,
+			  b.compression_level, b.encrypted, b.ref_count, b.storage_class, b.created_at, COUNT(sf.id)
+			  FROM blobs b
+			  LEFT JOIN stored_files sf ON sf.blob_id = b.id
+			  GROUP BY b.id
+			  HAVING COUNT(sf.id) <> b.ref_count
+			  ORDER BY b.id`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drifts := make([]*BlobDrift, 0)
+	for rows.Next() {
+		drift := &BlobDrift{}
+		if err := rows.Scan(append(blobFields(&drift.Blob), &drift.References)...); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, drift)
+	}
+
+	return drifts, rows.Err()
+}
+
+// RepairReferences recounts the files pointing at a blob. A blob without any
+// is removed, calling remove to delete its content first.
+func (s *BlobStore) RepairReferences(ctx context.Context, id int64, remove func(blob *Blob) error) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		blob := &Blob{}
+		query := `SELECT ` + blobColumns + ` FROM blobs WHERE id = $1 FOR UPDATE`
+		if err := tx.QueryRowContext(queryCtx, query, id).Scan(blobFields(blob)...); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		var references int64
+		if err := tx.QueryRowContext(queryCtx, `SELECT COUNT(*) FROM stored_files WHERE blob_id = $1`, id).Scan(&references); err != nil {
+			return err
+		}
+
+		if references > 0 {
+			_, err := tx.ExecContext(queryCtx, `UPDATE blobs SET ref_count = $1 WHERE id = $2`, references, id)
+			return err
+		}
+
+		if err := remove(blob); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(queryCtx, `DELETE FROM blobs WHERE id = $1`, id)
+		return err
+	})
+}
+
+// GetById returns a blob
+func (s *BlobStore) GetById(ctx context.Context, id int64) (*Blob, error) {
+	query := `SELECT ` + blobColumns + ` FROM blobs WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	blob := &Blob{}
+	err := s.db.QueryRowContext(ctx, query, id).Scan(blobFields(blob)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return blob, err
+}
+
+// GetColdCandidates returns hot blobs, after the given id, that none of their
+// files has been downloaded or uploaded since before
+func (s *BlobStore) GetColdCandidates(ctx context.Context, before time.Time, after int64, limit int) ([]*Blob, error) {
+	query := `SELECT ` + blobColumns + ` FROM blobs b
+			  WHERE b.storage_class = $1 AND b.ref_count > 0 AND b.id > $2
+			  AND NOT EXISTS (SELECT 1 FROM stored_files sf WHERE sf.blob_id = b.id AND COALESCE(sf.last_accessed_at, sf.uploaded_at) >= $3)
+			  ORDER BY b.id
+			  LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, StorageClassHot, after, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := make([]*Blob, 0)
+	for rows.Next() {
+		blob := &Blob{}
+		if err := rows.Scan(blobFields(blob)...); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, rows.Err()
+}
+
+// ChangeStorageClass points a blob and its files at a copy of its content
+// under toKey in another storage class. It fails with ErrNotFound when the
+// blob was removed or moved in the meantime, or, with idleSince set, when one
+// of its files has been downloaded or uploaded since.
+func (s *BlobStore) ChangeStorageClass(ctx context.Context, id int64, fromKey string, toKey string, class string, idleSince *time.Time) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		query := `UPDATE blobs b SET blob_key = $1, storage_class = $2
+				  WHERE b.id = $3 AND b.blob_key = $4
+				  AND ($5::timestamptz IS NULL OR NOT EXISTS (
+					  SELECT 1 FROM stored_files sf WHERE sf.blob_id = b.id AND COALESCE(sf.last_accessed_at, sf.uploaded_at) >= $5))`
+
+		result, err := tx.ExecContext(ctx, query, toKey, class, id, fromKey, idleSince)
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE stored_files SET saved_as = $1, storage_class = $2 WHERE blob_id = $3`, toKey, class, id)
+		return err
+	})
+}
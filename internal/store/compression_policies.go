@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// CompressionPolicy picks the codec for uploads to a project, keyed either by
+// a MIME type pattern or by one of the configured file types
+type CompressionPolicy struct {
+	ID         int64    `json:"id"`
+	ProjectID  int64    `json:"project_id"`
+	MimeType   string   `json:"mime_type"`
+	FileTypeID int64    `json:"file_type_id"`
+	FileType   FileType `json:"file_type"`
+	Codec      string   `json:"codec"`
+	Level      int      `json:"level"`
+	CreatedAt  string   `json:"created_at"`
+}
+
+type CompressionPolicyStore struct {
+	db *sql.DB
+}
+
+func (s *CompressionPolicyStore) Create(ctx context.Context, policy *CompressionPolicy) error {
+	query := `INSERT INTO project_compression_policies (project_id, mime_type, file_type_id, codec, level, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	// Exactly one of mime_type and file_type_id is set, the other is NULL
+	var mimeType *string
+	var fileTypeId *int64
+	if policy.FileTypeID != 0 {
+		fileTypeId = &policy.FileTypeID
+	} else {
+		mimeType = &policy.MimeType
+	}
+
+	return s.db.QueryRowContext(ctx,
+		query,
+		policy.ProjectID,
+		mimeType,
+		fileTypeId,
+		policy.Codec,
+		policy.Level,
+		time.Now(),
+	).Scan(&policy.ID, &policy.CreatedAt)
+}
+
+func (s *CompressionPolicyStore) GetByProjectId(ctx context.Context, projectId int64) ([]*CompressionPolicy, error) {
+	query := `SELECT pcp.id, pcp.project_id, COALESCE(pcp.mime_type, ''), COALESCE(pcp.file_type_id, 0), pcp.codec, pcp.level, pcp.created_at,
+				COALESCE(ft.name, ''), COALESCE(ft.mimetype, '')
+			  FROM project_compression_policies pcp
+			  LEFT JOIN file_types ft ON pcp.file_type_id = ft.id
+			  WHERE pcp.project_id = $1
+			  ORDER BY pcp.id`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make([]*CompressionPolicy, 0)
+	for rows.Next() {
+		policy := &CompressionPolicy{}
+		err := rows.Scan(
+			&policy.ID,
+			&policy.ProjectID,
+			&policy.MimeType,
+			&policy.FileTypeID,
+			&policy.Codec,
+			&policy.Level,
+			&policy.CreatedAt,
+			&policy.FileType.Name,
+			&policy.FileType.MimeType,
+		)
+		if err != nil {
+			return nil, err
+		}
+		policy.FileType.ID = policy.FileTypeID
+		policies = append(policies, policy)
+	}
+
+	return policies, rows.Err()
+}
+
+func (s *CompressionPolicyStore) Delete(ctx context.Context, projectId int64, id int64) error {
+	query := `DELETE FROM project_compression_policies WHERE project_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, projectId, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var ErrFolderCycle = errors.New("a folder can not be moved into itself or one of its subfolders")
+
+// Folder is a folder of a project. Path is the slash separated path from the
+// root of the project, which is also kept on the files inside the folder.
+type Folder struct {
+	ID        int64 `json:"id"`
+	ProjectID int64 `json:"project_id"`
+	// ParentID is nil for folders at the root of the project
+	ParentID  *int64 `json:"parent_id"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	CreatedAt string `json:"created_at"`
+}
+
+type FolderStore struct {
+	db *sql.DB
+}
+
+const folderColumns = `id, project_id, parent_id, name, path, created_at`
+
+func folderFields(folder *Folder) []any {
+	return []any{
+		&folder.ID,
+		&folder.ProjectID,
+		&folder.ParentID,
+		&folder.Name,
+		&folder.Path,
+		&folder.CreatedAt,
+	}
+}
+
+// joinFolderPath returns the path of the folder called name inside the
+// folder at parent
+func joinFolderPath(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+// Create adds a folder inside the folder folder.ParentID, or at the root of
+// the project. It fails with ErrConflict when there already is a folder with
+// the same name there.
+func (s *FolderStore) Create(ctx context.Context, folder *Folder) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		// The parent is locked so that it is not moved while the path is used
+		parentPath := ""
+		if folder.ParentID != nil {
+			query := `SELECT path FROM folders WHERE id = $1 AND project_id = $2 FOR SHARE`
+			err := tx.QueryRowContext(ctx, query, *folder.ParentID, folder.ProjectID).Scan(&parentPath)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+		}
+		folder.Path = joinFolderPath(parentPath, folder.Name)
+
+		query := `INSERT INTO folders (project_id, parent_id, name, path) VALUES ($1, $2, $3, $4)
+				  ON CONFLICT (project_id, path) DO NOTHING
+				  RETURNING id, created_at`
+
+		err := tx.QueryRowContext(ctx, query, folder.ProjectID, folder.ParentID, folder.Name, folder.Path).Scan(&folder.ID, &folder.CreatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrConflict
+		}
+		return err
+	})
+}
+
+// EnsurePath returns the folder at a path, creating it and any missing
+// folders above it
+func (s *FolderStore) EnsurePath(ctx context.Context, projectId int64, path string) (*Folder, error) {
+	query := `INSERT INTO folders (project_id, parent_id, name, path) VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (project_id, path) DO NOTHING`
+
+	var folder *Folder
+	names := strings.Split(path, "/")
+	for i, name := range names {
+		var parentID *int64
+		if folder != nil {
+			parentID = &folder.ID
+		}
+
+		levelPath := strings.Join(names[:i+1], "/")
+		insertCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		_, err := s.db.ExecContext(insertCtx, query, projectId, parentID, name, levelPath)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		folder, err = s.GetByPath(ctx, projectId, levelPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return folder, nil
+}
+
+func (s *FolderStore) GetById(ctx context.Context, projectId int64, id int64) (*Folder, error) {
+	query := `SELECT ` + folderColumns + ` FROM folders WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	folder := &Folder{}
+	err := s.db.QueryRowContext(ctx, query, id, projectId).Scan(folderFields(folder)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return folder, err
+}
+
+func (s *FolderStore) GetByPath(ctx context.Context, projectId int64, path string) (*Folder, error) {
+	query := `SELECT ` + folderColumns + ` FROM folders WHERE project_id = $1 AND path = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	folder := &Folder{}
+	err := s.db.QueryRowContext(ctx, query, projectId, path).Scan(folderFields(folder)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return folder, err
+}
+
+// GetChildren returns the folders directly inside a folder, or at the root of
+// the project for parentId 0, ordered by name
+func (s *FolderStore) GetChildren(ctx context.Context, projectId int64, parentId int64) ([]*Folder, error) {
+	query := `SELECT ` + folderColumns + ` FROM folders
+			  WHERE project_id = $1 AND parent_id IS NOT DISTINCT FROM NULLIF($2::BIGINT, 0)
+			  ORDER BY name`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, parentId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := make([]*Folder, 0)
+	for rows.Next() {
+		folder := &Folder{}
+		if err := rows.Scan(folderFields(folder)...); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders, rows.Err()
+}
+
+// Relocate renames a folder and moves it inside the folder parentId, or to
+// the root of the project for parentId 0. The paths of the folders and files
+// inside it change along with it. It fails with ErrConflict when the
+// destination already has a folder with the same name.
+func (s *FolderStore) Relocate(ctx context.Context, folder *Folder, parentId int64, name string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		query := `SELECT ` + folderColumns + ` FROM folders WHERE id = $1 AND project_id = $2 FOR UPDATE`
+		err := tx.QueryRowContext(ctx, query, folder.ID, folder.ProjectID).Scan(folderFields(folder)...)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var parentID *int64
+		parentPath := ""
+		if parentId != 0 {
+			parentID = &parentId
+			query := `SELECT path FROM folders WHERE id = $1 AND project_id = $2 FOR SHARE`
+			err := tx.QueryRowContext(ctx, query, parentId, folder.ProjectID).Scan(&parentPath)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if parentPath == folder.Path || strings.HasPrefix(parentPath, folder.Path+"/") {
+			return ErrFolderCycle
+		}
+
+		oldPath := folder.Path
+		newPath := joinFolderPath(parentPath, name)
+		if newPath == oldPath {
+			return nil
+		}
+
+		var exists bool
+		query = `SELECT EXISTS(SELECT 1 FROM folders WHERE project_id = $1 AND path = $2)`
+		if err := tx.QueryRowContext(ctx, query, folder.ProjectID, newPath).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrConflict
+		}
+
+		// Replace the old path at the start of the folder's own path and of
+		// everything inside it
+		query = `UPDATE folders SET path = $1::TEXT || SUBSTRING(path FROM CHAR_LENGTH($2::TEXT) + 1)
+				 WHERE project_id = $3 AND (path = $2::TEXT OR LEFT(path, CHAR_LENGTH($2::TEXT) + 1) = $2::TEXT || '/')`
+		if _, err := tx.ExecContext(ctx, query, newPath, oldPath, folder.ProjectID); err != nil {
+			return err
+		}
+
+		query = `UPDATE folders SET parent_id = $1, name = $2 WHERE id = $3`
+		if _, err := tx.ExecContext(ctx, query, parentID, name, folder.ID); err != nil {
+			return err
+		}
+
+		query = `UPDATE stored_files SET folder = $1::TEXT || SUBSTRING(folder FROM CHAR_LENGTH($2::TEXT) + 1)
+				 WHERE project_id = $3 AND (folder = $2::TEXT OR LEFT(folder, CHAR_LENGTH($2::TEXT) + 1) = $2::TEXT || '/')`
+		if _, err := tx.ExecContext(ctx, query, newPath, oldPath, folder.ProjectID); err != nil {
+			return err
+		}
+
+		folder.ParentID = parentID
+		folder.Name = name
+		folder.Path = newPath
+		return nil
+	})
+}
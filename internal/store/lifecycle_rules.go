@@ -0,0 +1,465 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actions of lifecycle rules
+const (
+	// LifecycleExpireFiles moves files to the trash once they have not been
+	// uploaded to for the number of days of the rule
+	LifecycleExpireFiles = "expire_files"
+	// LifecycleExpireVersions deletes previous versions once they have not
+	// been current for the number of days of the rule
+	LifecycleExpireVersions = "expire_versions"
+)
+
+// Statuses of lifecycle runs
+const (
+	LifecycleRunning   = "running"
+	LifecycleCompleted = "completed"
+	LifecycleFailed    = "failed"
+)
+
+// Outcomes of the files of a lifecycle run
+const (
+	LifecycleItemExpired = "expired"
+	LifecycleItemFailed  = "failed"
+)
+
+// LifecycleRule expires the files or the previous versions of a project after
+// a number of days, like an S3 lifecycle configuration
+type LifecycleRule struct {
+	ID        int64  `json:"id"`
+	ProjectID int64  `json:"project_id"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	// Folder limits the rule to a folder and everything inside it, the whole
+	// project when empty
+	Folder    string `json:"folder"`
+	Days      int    `json:"days"`
+	Enabled   bool   `json:"enabled"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// LifecycleRun is one application of a rule. RuleID is nil once the rule has
+// been deleted.
+type LifecycleRun struct {
+	ID           int64   `json:"id"`
+	RuleID       *int64  `json:"rule_id"`
+	ProjectID    int64   `json:"project_id"`
+	Action       string  `json:"action"`
+	Status       string  `json:"status"`
+	FilesMatched int64   `json:"files_matched"`
+	FilesExpired int64   `json:"files_expired"`
+	FilesFailed  int64   `json:"files_failed"`
+	BytesExpired int64   `json:"bytes_expired"`
+	Error        string  `json:"error"`
+	StartedAt    string  `json:"started_at"`
+	FinishedAt   *string `json:"finished_at"`
+}
+
+// LifecycleRunItem is a file that a run expired or failed to expire
+type LifecycleRunItem struct {
+	ID        int64     `json:"id"`
+	RunID     int64     `json:"run_id"`
+	FileID    uuid.UUID `json:"file_id"`
+	FileName  string    `json:"name"`
+	Folder    string    `json:"folder"`
+	Version   int       `json:"version"`
+	FileSize  int64     `json:"size"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail"`
+	CreatedAt string    `json:"created_at"`
+}
+
+type LifecycleStore struct {
+	db *sql.DB
+}
+
+const lifecycleRuleColumns = `id, project_id, name, action, folder, days, enabled, created_at, updated_at`
+
+func lifecycleRuleFields(rule *LifecycleRule) []any {
+	return []any{
+		&rule.ID,
+		&rule.ProjectID,
+		&rule.Name,
+		&rule.Action,
+		&rule.Folder,
+		&rule.Days,
+		&rule.Enabled,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+	}
+}
+
+// Cutoff returns the time files must be older than for the rule to apply to
+// them at the given time
+func (rule *LifecycleRule) Cutoff(now time.Time) time.Time {
+	return now.AddDate(0, 0, -rule.Days)
+}
+
+const lifecycleRunColumns = `id, rule_id, project_id, action, status, files_matched, files_expired, files_failed, bytes_expired, error, started_at, finished_at`
+
+func lifecycleRunFields(run *LifecycleRun) []any {
+	return []any{
+		&run.ID,
+		&run.RuleID,
+		&run.ProjectID,
+		&run.Action,
+		&run.Status,
+		&run.FilesMatched,
+		&run.FilesExpired,
+		&run.FilesFailed,
+		&run.BytesExpired,
+		&run.Error,
+		&run.StartedAt,
+		&run.FinishedAt,
+	}
+}
+
+func (s *LifecycleStore) Create(ctx context.Context, rule *LifecycleRule) error {
+	query := `INSERT INTO lifecycle_rules (project_id, name, action, folder, days, enabled)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING ` + lifecycleRuleColumns
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query,
+		rule.ProjectID,
+		rule.Name,
+		rule.Action,
+		rule.Folder,
+		rule.Days,
+		rule.Enabled,
+	).Scan(lifecycleRuleFields(rule)...)
+}
+
+func (s *LifecycleStore) GetById(ctx context.Context, projectId int64, id int64) (*LifecycleRule, error) {
+	query := `SELECT ` + lifecycleRuleColumns + ` FROM lifecycle_rules WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rule := &LifecycleRule{}
+	err := s.db.QueryRowContext(ctx, query, id, projectId).Scan(lifecycleRuleFields(rule)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return rule, err
+}
+
+func (s *LifecycleStore) GetByProjectId(ctx context.Context, projectId int64) ([]*LifecycleRule, error) {
+	query := `SELECT ` + lifecycleRuleColumns + ` FROM lifecycle_rules WHERE project_id = $1 ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.queryRules(ctx, query, projectId)
+}
+
+// GetEnabled returns the enabled rules of every project that is not in the
+// trash
+func (s *LifecycleStore) GetEnabled(ctx context.Context) ([]*LifecycleRule, error) {
+	query := `SELECT lr.id, lr.project_id, lr.name, lr.action, lr.folder, lr.days, lr.enabled, lr.created_at, lr.updated_at
+			  FROM lifecycle_rules lr
+			  INNER JOIN projects p ON lr.project_id = p.id
+			  WHERE lr.enabled AND p.deleted_at IS NULL
+			  ORDER BY lr.id`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.queryRules(ctx, query)
+}
+
+func (s *LifecycleStore) queryRules(ctx context.Context, query string, args ...any) ([]*LifecycleRule, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]*LifecycleRule, 0)
+	for rows.Next() {
+		rule := &LifecycleRule{}
+		if err := rows.Scan(lifecycleRuleFields(rule)...); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *LifecycleStore) Update(ctx context.Context, rule *LifecycleRule) error {
+	query := `UPDATE lifecycle_rules SET name = $1, action = $2, folder = $3, days = $4, enabled = $5, updated_at = NOW()
+			  WHERE id = $6 AND project_id = $7 RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, query,
+		rule.Name,
+		rule.Action,
+		rule.Folder,
+		rule.Days,
+		rule.Enabled,
+		rule.ID,
+		rule.ProjectID,
+	).Scan(&rule.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (s *LifecycleStore) Delete(ctx context.Context, projectId int64, id int64) error {
+	query := `DELETE FROM lifecycle_rules WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, id, projectId)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// lifecycleMatchCondition returns the condition selecting the stored files a
+// rule applies to, given the project id as $1, the folder as $2 and the
+// time the files must be older than as $3
+func lifecycleMatchCondition(rule *LifecycleRule) string {
+	condition := `sf.project_id = $1 AND sf.status = 'available' AND sf.deleted_at IS NULL
+				  AND ($2::TEXT = '' OR sf.folder = $2::TEXT OR LEFT(sf.folder, CHAR_LENGTH($2::TEXT) + 1) = $2::TEXT || '/')`
+
+	// Files under retention or legal hold are left alone. A file is only
+	// expired when none of its versions is locked, as they go to the trash with
+	// it.
+	if rule.Action == LifecycleExpireVersions {
+		return condition + ` AND sf.version_of IS NOT NULL AND sf.superseded_at < $3 AND NOT ` + lockedCondition
+	}
+	return condition + ` AND sf.version_of IS NULL AND sf.uploaded_at < $3 AND NOT sf.legal_hold
+				  AND NOT EXISTS(SELECT 1 FROM stored_files v WHERE (v.id = sf.id OR v.version_of = sf.id) AND v.retain_until > NOW())`
+}
+
+// GetMatches returns the files a rule applies to at the given time, ordered
+// by id
+func (s *LifecycleStore) GetMatches(ctx context.Context, rule *LifecycleRule, now time.Time, limit int64, offset int64) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE ` + lifecycleMatchCondition(rule) + `
+			  ORDER BY sf.id
+			  LIMIT $4 OFFSET $5`
+
+	return s.queryMatches(ctx, query, rule.ProjectID, rule.Folder, rule.Cutoff(now), limit, offset)
+}
+
+// GetMatchBatch returns up to limit files a rule applies to at the given
+// time, ordered by id and starting after the given id. Pass uuid.Nil to start
+// from the beginning.
+func (s *LifecycleStore) GetMatchBatch(ctx context.Context, rule *LifecycleRule, now time.Time, after uuid.UUID, limit int64) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE ` + lifecycleMatchCondition(rule) + ` AND sf.id > $4
+			  ORDER BY sf.id
+			  LIMIT $5`
+
+	return s.queryMatches(ctx, query, rule.ProjectID, rule.Folder, rule.Cutoff(now), after, limit)
+}
+
+func (s *LifecycleStore) queryMatches(ctx context.Context, query string, args ...any) ([]*StoredFile, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+func (s *LifecycleStore) CountMatches(ctx context.Context, rule *LifecycleRule, now time.Time) (int64, error) {
+	query := `SELECT COUNT(*) FROM stored_files sf WHERE ` + lifecycleMatchCondition(rule)
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, rule.ProjectID, rule.Folder, rule.Cutoff(now)).Scan(&count)
+	return count, err
+}
+
+// CreateRun records the start of a run of a rule
+func (s *LifecycleStore) CreateRun(ctx context.Context, rule *LifecycleRule, run *LifecycleRun) error {
+	query := `INSERT INTO lifecycle_runs (rule_id, project_id, action, status) VALUES ($1, $2, $3, $4) RETURNING ` + lifecycleRunColumns
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query, rule.ID, rule.ProjectID, rule.Action, LifecycleRunning).Scan(lifecycleRunFields(run)...)
+}
+
+// FinishRun records the final counters and status of a run
+func (s *LifecycleStore) FinishRun(ctx context.Context, run *LifecycleRun) error {
+	query := `UPDATE lifecycle_runs SET status = $1, files_matched = $2, files_expired = $3, files_failed = $4,
+			  bytes_expired = $5, error = $6, finished_at = NOW()
+			  WHERE id = $7 RETURNING finished_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query,
+		run.Status,
+		run.FilesMatched,
+		run.FilesExpired,
+		run.FilesFailed,
+		run.BytesExpired,
+		run.Error,
+		run.ID,
+	).Scan(&run.FinishedAt)
+}
+
+func (s *LifecycleStore) GetRun(ctx context.Context, projectId int64, id int64) (*LifecycleRun, error) {
+	query := `SELECT ` + lifecycleRunColumns + ` FROM lifecycle_runs WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	run := &LifecycleRun{}
+	err := s.db.QueryRowContext(ctx, query, id, projectId).Scan(lifecycleRunFields(run)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return run, err
+}
+
+// GetRuns returns the runs of the rules of a project, newest first
+func (s *LifecycleStore) GetRuns(ctx context.Context, projectId int64, limit int64, offset int64) ([]*LifecycleRun, error) {
+	query := `SELECT ` + lifecycleRunColumns + ` FROM lifecycle_runs WHERE project_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*LifecycleRun, 0)
+	for rows.Next() {
+		run := &LifecycleRun{}
+		if err := rows.Scan(lifecycleRunFields(run)...); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *LifecycleStore) CountRuns(ctx context.Context, projectId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM lifecycle_runs WHERE project_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, projectId).Scan(&count)
+	return count, err
+}
+
+func (s *LifecycleStore) AddRunItem(ctx context.Context, item *LifecycleRunItem) error {
+	query := `INSERT INTO lifecycle_run_items (run_id, file_id, file_name, folder, version, file_size, outcome, detail)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query,
+		item.RunID,
+		item.FileID,
+		item.FileName,
+		item.Folder,
+		item.Version,
+		item.FileSize,
+		item.Outcome,
+		item.Detail,
+	).Scan(&item.ID, &item.CreatedAt)
+}
+
+func (s *LifecycleStore) GetRunItems(ctx context.Context, runId int64, limit int64, offset int64) ([]*LifecycleRunItem, error) {
+	query := `SELECT id, run_id, file_id, file_name, folder, version, file_size, outcome, detail, created_at
+			  FROM lifecycle_run_items WHERE run_id = $1 ORDER BY id LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, runId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]*LifecycleRunItem, 0)
+	for rows.Next() {
+		item := &LifecycleRunItem{}
+		err := rows.Scan(
+			&item.ID,
+			&item.RunID,
+			&item.FileID,
+			&item.FileName,
+			&item.Folder,
+			&item.Version,
+			&item.FileSize,
+			&item.Outcome,
+			&item.Detail,
+			&item.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *LifecycleStore) CountRunItems(ctx context.Context, runId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM lifecycle_run_items WHERE run_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, runId).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Locks that keep a file from being deleted or overwritten
+const (
+	LockRetention = "retention"
+	LockLegalHold = "legal_hold"
+)
+
+// LockError is returned when a file can not be deleted or overwritten because
+// a version of it is under retention or the file is under legal hold
+type LockError struct {
+	FileID  uuid.UUID
+	Version int
+	// Lock is LockRetention or LockLegalHold
+	Lock        string
+	RetainUntil string
+}
+
+func (e *LockError) Error() string {
+	if e.Lock == LockLegalHold {
+		return fmt.Sprintf("file %s is under legal hold and can not be deleted or overwritten until the hold is removed", e.FileID)
+	}
+	return fmt.Sprintf("version %d of file %s is under retention until %s and can not be deleted or overwritten", e.Version, e.FileID, e.RetainUntil)
+}
+
+// lockedCondition selects the stored_files rows sf that are locked, either
+// by their own retention or by a legal hold on their file
+const lockedCondition = `(sf.legal_hold OR sf.retain_until > NOW()
+	OR EXISTS(SELECT 1 FROM stored_files hf WHERE hf.id = sf.version_of AND hf.legal_hold))`
+
+// checkLocks returns a LockError for the rows sf selected by condition when
+// any of them is locked, reporting a legal hold before a retention
+func checkLocks(ctx context.Context, q rowQuerier, condition string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	query := `SELECT COALESCE(sf.version_of, sf.id), sf.version,
+			  sf.legal_hold OR EXISTS(SELECT 1 FROM stored_files hf WHERE hf.id = sf.version_of AND hf.legal_hold),
+			  COALESCE(TO_CHAR(sf.retain_until AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'), '')
+			  FROM stored_files sf
+			  WHERE (` + condition + `) AND ` + lockedCondition + `
+			  ORDER BY 3 DESC, sf.retain_until DESC NULLS LAST
+			  LIMIT 1`
+
+	lockErr := &LockError{}
+	var legalHold bool
+	err := q.QueryRowContext(ctx, query, args...).Scan(&lockErr.FileID, &lockErr.Version, &legalHold, &lockErr.RetainUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lockErr.Lock = LockRetention
+	if legalHold {
+		lockErr.Lock = LockLegalHold
+	}
+	return lockErr
+}
+
+// Operations of the audit events that record a change to the locks
+const (
+	LockOperationHoldOn    = "legal_hold_on"
+	LockOperationHoldOff   = "legal_hold_off"
+	LockOperationRetention = "retention_change"
+)
+
+// LockAuditEvent records an attempt to delete or overwrite a locked file, or
+// a change to the locks of a project
+type LockAuditEvent struct {
+	ID        int64 `json:"id"`
+	ProjectID int64 `json:"project_id"`
+	// FileID is nil for a change of the retention of the project
+	FileID  *uuid.UUID `json:"file_id"`
+	Version int        `json:"version"`
+	// Operation is what was attempted, such as "delete" or "upload", or one
+	// of the lock change operations
+	Operation string `json:"operation"`
+	Lock      string `json:"lock"`
+	// Actor is the user or project key that made the attempt or change
+	Actor      string `json:"actor"`
+	RemoteAddr string `json:"remote_addr"`
+	Detail     string `json:"detail"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type LockAuditStore struct {
+	db *sql.DB
+}
+
+func (s *LockAuditStore) Create(ctx context.Context, event *LockAuditEvent) error {
+	query := `INSERT INTO lock_audit_events (project_id, file_id, version, operation, lock_type, actor, remote_addr, detail)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query,
+		event.ProjectID,
+		event.FileID,
+		event.Version,
+		event.Operation,
+		event.Lock,
+		event.Actor,
+		event.RemoteAddr,
+		event.Detail,
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetByProjectId returns the audited attempts on the files of a project and
+// the changes to its locks, newest first
+func (s *LockAuditStore) GetByProjectId(ctx context.Context, projectId int64, limit int64, offset int64) ([]*LockAuditEvent, error) {
+	query := `SELECT id, project_id, file_id, version, operation, lock_type, actor, remote_addr, detail, created_at
+			  FROM lock_audit_events WHERE project_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*LockAuditEvent, 0)
+	for rows.Next() {
+		event := &LockAuditEvent{}
+		err := rows.Scan(
+			&event.ID,
+			&event.ProjectID,
+			&event.FileID,
+			&event.Version,
+			&event.Operation,
+			&event.Lock,
+			&event.Actor,
+			&event.RemoteAddr,
+			&event.Detail,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *LockAuditStore) CountByProjectId(ctx context.Context, projectId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM lock_audit_events WHERE project_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, projectId).Scan(&count)
+	return count, err
+}
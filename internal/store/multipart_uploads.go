@@ -0,0 +1,362 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxPartNumber is the highest number a part of a multipart upload can have
+const MaxPartNumber = 10000
+
+// ErrPartsTooLarge is returned when a part would take the parts of an upload
+// past the largest file it may be stitched into
+var ErrPartsTooLarge = errors.New("parts exceed the maximum size of the upload")
+
+// MultipartUpload is a file sent as numbered parts that are stitched together
+// when the upload is completed
+type MultipartUpload struct {
+	ID        uuid.UUID `json:"id"`
+	ProjectID int64     `json:"project_id"`
+	FileName  string    `json:"file_name"`
+	MimeType  string    `json:"mime_type"`
+	Folder    string    `json:"folder"`
+	// StoredFileID is the file the upload was stored as once completed
+	StoredFileID *uuid.UUID `json:"stored_file_id"`
+	CreatedAt    string     `json:"created_at"`
+	// ExpiresAt is when the upload is aborted unless another part is sent
+	ExpiresAt time.Time `json:"expires_at"`
+	// ClaimedAt is when a completion or abort of the upload started, nil
+	// while parts can be sent
+	ClaimedAt *time.Time `json:"claimed_at"`
+}
+
+// MultipartPart is one part of a multipart upload. Sending a part with the
+// same number again replaces it.
+type MultipartPart struct {
+	UploadID   uuid.UUID `json:"upload_id"`
+	PartNumber int       `json:"part_number"`
+	Size       int64     `json:"size"`
+	MD5        string    `json:"md5"`
+	SHA256     string    `json:"sha256"`
+	BlobKey    string    `json:"-"`
+	CreatedAt  string    `json:"created_at"`
+}
+
+// ETag identifies the content of a part, like the ETag of an S3 part
+func (p *MultipartPart) ETag() string {
+	return `"` + p.MD5 + `"`
+}
+
+type MultipartUploadStore struct {
+	db *sql.DB
+}
+
+const multipartUploadColumns = `id, project_id, file_name, mime_type, folder, stored_file_id, created_at, expires_at, claimed_at`
+
+func scanMultipartUpload(row interface{ Scan(dest ...any) error }) (*MultipartUpload, error) {
+	upload := &MultipartUpload{}
+	err := row.Scan(
+		&upload.ID,
+		&upload.ProjectID,
+		&upload.FileName,
+		&upload.MimeType,
+		&upload.Folder,
+		&upload.StoredFileID,
+		&upload.CreatedAt,
+		&upload.ExpiresAt,
+		&upload.ClaimedAt,
+	)
+	return upload, err
+}
+
+func (s *MultipartUploadStore) Create(ctx context.Context, upload *MultipartUpload) error {
+	query := `INSERT INTO multipart_uploads (id, project_id, file_name, mime_type, folder, expires_at)
+			  VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	upload.ID = uuid.New()
+	return s.db.QueryRowContext(ctx, query,
+		upload.ID,
+		upload.ProjectID,
+		upload.FileName,
+		upload.MimeType,
+		upload.Folder,
+		upload.ExpiresAt,
+	).Scan(&upload.CreatedAt)
+}
+
+// GetById returns an upload of a project, expired or not
+func (s *MultipartUploadStore) GetById(ctx context.Context, projectId int64, id uuid.UUID) (*MultipartUpload, error) {
+	query := `SELECT ` + multipartUploadColumns + ` FROM multipart_uploads WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	upload, err := scanMultipartUpload(s.db.QueryRowContext(ctx, query, id, projectId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// PutPart records a part, replacing any part with the same number, and moves
+// the expiry of the upload to expiresAt. The blob key of the replaced part is
+// returned so that its content can be removed. ErrConflict is returned when
+// the upload has been claimed by a completion or abort, which keeps the parts
+// a completion reads from being replaced, and ErrPartsTooLarge when the parts
+// would add up to more than maxSize bytes.
+func (s *MultipartUploadStore) PutPart(ctx context.Context, part *MultipartPart, expiresAt time.Time, maxSize int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var replacedKey string
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		query := `UPDATE multipart_uploads SET expires_at = $1 WHERE id = $2 AND stored_file_id IS NULL AND claimed_at IS NULL`
+		result, err := tx.ExecContext(ctx, query, expiresAt, part.UploadID)
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return ErrConflict
+		}
+
+		// The update locks the upload, so parts sent at the same time are
+		// counted one after the other
+		var otherParts int64
+		query = `SELECT COALESCE(SUM(size), 0) FROM multipart_upload_parts WHERE upload_id = $1 AND part_number <> $2`
+		if err := tx.QueryRowContext(ctx, query, part.UploadID, part.PartNumber).Scan(&otherParts); err != nil {
+			return err
+		}
+		if otherParts+part.Size > maxSize {
+			return ErrPartsTooLarge
+		}
+
+		query = `SELECT blob_key FROM multipart_upload_parts WHERE upload_id = $1 AND part_number = $2`
+		err = tx.QueryRowContext(ctx, query, part.UploadID, part.PartNumber).Scan(&replacedKey)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		query = `INSERT INTO multipart_upload_parts (upload_id, part_number, size, md5, sha256, blob_key)
+				 VALUES ($1, $2, $3, $4, $5, $6)
+				 ON CONFLICT (upload_id, part_number) DO UPDATE
+				 SET size = EXCLUDED.size, md5 = EXCLUDED.md5, sha256 = EXCLUDED.sha256,
+				 blob_key = EXCLUDED.blob_key, created_at = NOW()
+				 RETURNING created_at`
+		return tx.QueryRowContext(ctx, query,
+			part.UploadID,
+			part.PartNumber,
+			part.Size,
+			part.MD5,
+			part.SHA256,
+			part.BlobKey,
+		).Scan(&part.CreatedAt)
+	})
+
+	return replacedKey, err
+}
+
+// Claim marks an upload as being completed or aborted and moves its expiry to
+// expiresAt, so that it is not aborted while it is completed. ErrConflict is
+// returned when it has already been claimed or completed.
+func (s *MultipartUploadStore) Claim(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	query := `UPDATE multipart_uploads SET claimed_at = NOW(), expires_at = $1
+			  WHERE id = $2 AND stored_file_id IS NULL AND claimed_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, expiresAt, id)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Release gives up the claim on an upload whose completion failed, so that
+// parts can be sent again
+func (s *MultipartUploadStore) Release(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `UPDATE multipart_uploads SET claimed_at = NULL WHERE id = $1 AND stored_file_id IS NULL`, id)
+	return err
+}
+
+// GetParts returns the parts of an upload in the order of their number
+func (s *MultipartUploadStore) GetParts(ctx context.Context, id uuid.UUID) ([]*MultipartPart, error) {
+	query := `SELECT upload_id, part_number, size, md5, sha256, blob_key, created_at FROM multipart_upload_parts
+			  WHERE upload_id = $1 ORDER BY part_number`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := make([]*MultipartPart, 0)
+	for rows.Next() {
+		part := &MultipartPart{}
+		err := rows.Scan(
+			&part.UploadID,
+			&part.PartNumber,
+			&part.Size,
+			&part.MD5,
+			&part.SHA256,
+			&part.BlobKey,
+			&part.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+
+	return parts, rows.Err()
+}
+
+// GetPartKeys returns the blob keys of the parts of every upload
+func (s *MultipartUploadStore) GetPartKeys(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT blob_key FROM multipart_upload_parts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// SetStoredFile records the file a completed upload was stored as. Its parts
+// are no longer needed and are forgotten.
+func (s *MultipartUploadStore) SetStoredFile(ctx context.Context, id uuid.UUID, storedFileId uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE multipart_uploads SET stored_file_id = $1 WHERE id = $2 AND stored_file_id IS NULL`, storedFileId, id)
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return ErrConflict
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM multipart_upload_parts WHERE upload_id = $1`, id)
+		return err
+	})
+}
+
+// Delete removes an upload with its parts
+func (s *MultipartUploadStore) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM multipart_uploads WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetExpired returns up to limit uploads that expired before the given time
+func (s *MultipartUploadStore) GetExpired(ctx context.Context, before time.Time, limit int64) ([]*MultipartUpload, error) {
+	query := `SELECT ` + multipartUploadColumns + ` FROM multipart_uploads
+			  WHERE expires_at < $1 ORDER BY expires_at LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*MultipartUpload, 0)
+	for rows.Next() {
+		upload, err := scanMultipartUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
+
+// GetByProjectId returns up to limit multipart uploads of a project,
+// completed or not
+func (s *MultipartUploadStore) GetByProjectId(ctx context.Context, projectId int64, limit int64) ([]*MultipartUpload, error) {
+	query := `SELECT ` + multipartUploadColumns + ` FROM multipart_uploads
+			  WHERE project_id = $1 ORDER BY created_at LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*MultipartUpload, 0)
+	for rows.Next() {
+		upload, err := scanMultipartUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
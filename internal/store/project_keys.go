@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ProjectKey is the data key of a project, wrapped by the master key
+type ProjectKey struct {
+	ProjectID   int64  `json:"project_id"`
+	WrappedKey  []byte `json:"-"`
+	MasterKeyID string `json:"master_key_id"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type ProjectKeyStore struct {
+	db *sql.DB
+}
+
+func (s *ProjectKeyStore) GetByProjectId(ctx context.Context, projectId int64) (*ProjectKey, error) {
+	query := `SELECT project_id, wrapped_key, master_key_id, created_at FROM project_keys WHERE project_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	projectKey := &ProjectKey{}
+	err := s.db.QueryRowContext(ctx, query, projectId).Scan(
+		&projectKey.ProjectID,
+		&projectKey.WrappedKey,
+		&projectKey.MasterKeyID,
+		&projectKey.CreatedAt,
+	)
+
+	return projectKey, err
+}
+
+// Create stores a new project key, leaving an existing key for the project untouched
+func (s *ProjectKeyStore) Create(ctx context.Context, projectKey *ProjectKey) error {
+	query := `INSERT INTO project_keys (project_id, wrapped_key, master_key_id) VALUES ($1, $2, $3)
+			  ON CONFLICT (project_id) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, query, projectKey.ProjectID, projectKey.WrappedKey, projectKey.MasterKeyID)
+	return err
+}
+
+// RewrapAll replaces the wrapped form of every project key in a single
+// transaction. rewrap returns the new wrapped key and master key id, and
+// returning an error aborts the whole rotation.
+func (s *ProjectKeyStore) RewrapAll(ctx context.Context, rewrap func(projectKey *ProjectKey) ([]byte, string, error)) (int64, error) {
+	var rewrapped int64
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT project_id, wrapped_key, master_key_id, created_at FROM project_keys ORDER BY project_id FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+
+		projectKeys := make([]*ProjectKey, 0)
+		for rows.Next() {
+			projectKey := &ProjectKey{}
+			if err := rows.Scan(&projectKey.ProjectID, &projectKey.WrappedKey, &projectKey.MasterKeyID, &projectKey.CreatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			projectKeys = append(projectKeys, projectKey)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, projectKey := range projectKeys {
+			wrappedKey, masterKeyId, err := rewrap(projectKey)
+			if err != nil {
+				return err
+			}
+
+			query := `UPDATE project_keys SET wrapped_key = $1, master_key_id = $2, rotated_at = NOW() WHERE project_id = $3`
+			if _, err := tx.ExecContext(ctx, query, wrappedKey, masterKeyId, projectKey.ProjectID); err != nil {
+				return err
+			}
+			rewrapped++
+		}
+
+		return nil
+	})
+
+	return rewrapped, err
+}
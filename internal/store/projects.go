@@ -3,7 +3,9 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
+	"time"
 )
 
 type Project struct {
@@ -15,6 +17,17 @@ type Project struct {
 	CreatedBy     User   `json:"created_by"`
 	ProjectKey    string `json:"project_key"`
 	MaxUploadSize int64  `json:"max_upload_size"`
+	// DurabilityPolicy decides whether files are replicated or erasure coded
+	DurabilityPolicy string `json:"durability_policy"`
+	// MaxVersions is the number of versions of every file that are kept,
+	// including the current one
+	MaxVersions int `json:"max_versions"`
+	// RetentionDays is how long uploads can not be deleted or overwritten, 0
+	// for no retention
+	RetentionDays int `json:"retention_days"`
+	// DeletedAt is when the project was moved to the trash, nil for projects
+	// that are not deleted
+	DeletedAt *string `json:"deleted_at"`
 }
 
 type UserAssignedProject struct {
@@ -34,7 +47,7 @@ type UserProjectStore struct {
 }
 
 func (s *ProjectStore) Count(ctx context.Context) (int64, error) {
-	query := `SELECT COUNT(*) FROM projects`
+	query := `SELECT COUNT(*) FROM projects WHERE deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -50,7 +63,7 @@ func (s *ProjectStore) Create(ctx context.Context, project *Project) error {
 							description,
 							created_at,
 							created_by_id,
-							project_key, max_upload_size) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+							project_key, max_upload_size, durability_policy, max_versions, retention_days) VALUES ($1, $2, $3, $4, $5, $6, COALESCE(NULLIF($7, ''), 'replication'), COALESCE(NULLIF($8, 0), 10), $9) RETURNING id, created_at, durability_policy, max_versions`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -71,13 +84,16 @@ func (s *ProjectStore) Create(ctx context.Context, project *Project) error {
 		createdById,
 		project.ProjectKey,
 		project.MaxUploadSize,
-	).Scan(&project.ID, &project.CreatedAt)
+		project.DurabilityPolicy,
+		project.MaxVersions,
+		project.RetentionDays,
+	).Scan(&project.ID, &project.CreatedAt, &project.DurabilityPolicy, &project.MaxVersions)
 
 	return err
 }
 
 func (s *ProjectStore) GetById(ctx context.Context, id int64) (*Project, error) {
-	query := `SELECT id, name, description, created_at, COALESCE(created_by_id, 0), max_upload_size, project_key FROM projects WHERE id = $1`
+	query := `SELECT id, name, description, created_at, COALESCE(created_by_id, 0), max_upload_size, project_key, durability_policy, max_versions, retention_days FROM projects WHERE id = $1 AND deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -95,13 +111,16 @@ func (s *ProjectStore) GetById(ctx context.Context, id int64) (*Project, error)
 		&project.CreatedById,
 		&project.MaxUploadSize,
 		&project.ProjectKey,
+		&project.DurabilityPolicy,
+		&project.MaxVersions,
+		&project.RetentionDays,
 	)
 
 	return project, err
 }
 
 func (s *ProjectStore) GetByKey(ctx context.Context, key string) (*Project, error) {
-	query := `SELECT id, name, description, created_at, project_key, max_upload_size FROM projects WHERE project_key = $1`
+	query := `SELECT id, name, description, created_at, project_key, max_upload_size, durability_policy, max_versions, retention_days FROM projects WHERE project_key = $1 AND deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -117,7 +136,10 @@ func (s *ProjectStore) GetByKey(ctx context.Context, key string) (*Project, erro
 		&project.Description,
 		&project.CreatedAt,
 		&project.ProjectKey,
-		&project.MaxUploadSize)
+		&project.MaxUploadSize,
+		&project.DurabilityPolicy,
+		&project.MaxVersions,
+		&project.RetentionDays)
 
 	if err != nil {
 		log.Printf("Error getting project by key: %v", err)
@@ -127,7 +149,7 @@ func (s *ProjectStore) GetByKey(ctx context.Context, key string) (*Project, erro
 }
 
 func (s *ProjectStore) GetAll(ctx context.Context, limit int64, offset int64) ([]*Project, error) {
-	query := `SELECT id, name, description, created_at, COALESCE(created_by_id, 0), max_upload_size, project_key FROM projects ORDER BY created_at DESC LIMIT $1 OFFSET $2`
+	query := `SELECT id, name, description, created_at, COALESCE(created_by_id, 0), max_upload_size, project_key, durability_policy, max_versions, retention_days FROM projects WHERE deleted_at IS NULL ORDER BY created_at DESC LIMIT $1 OFFSET $2`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -149,6 +171,9 @@ func (s *ProjectStore) GetAll(ctx context.Context, limit int64, offset int64) ([
 			&project.CreatedById,
 			&project.MaxUploadSize,
 			&project.ProjectKey,
+			&project.DurabilityPolicy,
+			&project.MaxVersions,
+			&project.RetentionDays,
 		)
 		if err != nil {
 			return nil, err
@@ -160,23 +185,178 @@ func (s *ProjectStore) GetAll(ctx context.Context, limit int64, offset int64) ([
 }
 
 func (s *ProjectStore) Update(ctx context.Context, project *Project) error {
-	query := `UPDATE projects SET name = $1, description = $2, max_upload_size = $3, project_key = $4 WHERE id = $5`
+	query := `UPDATE projects SET name = $1, description = $2, max_upload_size = $3, project_key = $4, durability_policy = $5, max_versions = $6, retention_days = $7 WHERE id = $8`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
-	_, err := s.db.ExecContext(ctx, query, project.Name, project.Description, project.MaxUploadSize, project.ProjectKey, project.ID)
+	_, err := s.db.ExecContext(ctx, query, project.Name, project.Description, project.MaxUploadSize, project.ProjectKey, project.DurabilityPolicy, project.MaxVersions, project.RetentionDays, project.ID)
 	return err
 }
 
-func (s *ProjectStore) Delete(ctx context.Context, id int64) error {
-	query := `DELETE FROM projects WHERE id = $1`
+// Trash moves a project to the trash. Its files can no longer be uploaded,
+// listed or downloaded until the project is restored.
+func (s *ProjectStore) Trash(ctx context.Context, id int64) error {
+	query := `UPDATE projects SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
-	_, err := s.db.ExecContext(ctx, query, id)
-	return err
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Restore takes a project out of the trash
+func (s *ProjectStore) Restore(ctx context.Context, id int64) error {
+	query := `UPDATE projects SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetTrash returns the projects in the trash that are assigned to a user,
+// most recently deleted first
+func (s *ProjectStore) GetTrash(ctx context.Context, userId int64, limit int64, offset int64) ([]*Project, error) {
+	query := `SELECT id, name, description, created_at, COALESCE(created_by_id, 0), max_upload_size, project_key, durability_policy, max_versions, retention_days, deleted_at
+			  FROM projects p WHERE deleted_at IS NOT NULL
+			  AND EXISTS(SELECT 1 FROM user_assigned_projects uap WHERE uap.project_id = p.id AND uap.user_id = $1)
+			  ORDER BY deleted_at DESC LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, userId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := make([]*Project, 0)
+	for rows.Next() {
+		project := &Project{}
+		err := rows.Scan(
+			&project.ID,
+			&project.Name,
+			&project.Description,
+			&project.CreatedAt,
+			&project.CreatedById,
+			&project.MaxUploadSize,
+			&project.ProjectKey,
+			&project.DurabilityPolicy,
+			&project.MaxVersions,
+			&project.RetentionDays,
+			&project.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+
+	return projects, rows.Err()
+}
+
+func (s *ProjectStore) CountTrash(ctx context.Context, userId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM projects p WHERE deleted_at IS NOT NULL
+			  AND EXISTS(SELECT 1 FROM user_assigned_projects uap WHERE uap.project_id = p.id AND uap.user_id = $1)`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, userId).Scan(&count)
+	return count, err
+}
+
+// GetTrashedBefore returns the ids of the projects that were moved to the
+// trash before the given time
+func (s *ProjectStore) GetTrashedBefore(ctx context.Context, before time.Time) ([]int64, error) {
+	query := `SELECT id FROM projects WHERE deleted_at < $1 ORDER BY deleted_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Delete removes a project in the trash for good, along with its settings,
+// folders, lifecycle rules and user assignments. Its files have to be purged first.
+// The lock audit events are kept as the record of what happened to its files.
+func (s *ProjectStore) Delete(ctx context.Context, id int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		var projectId int64
+		query := `SELECT id FROM projects WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE`
+		if err := tx.QueryRowContext(ctx, query, id).Scan(&projectId); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		queries := []string{
+			`DELETE FROM project_allowed_file_types WHERE project_id = $1`,
+			`DELETE FROM project_compression_policies WHERE project_id = $1`,
+			`DELETE FROM user_assigned_projects WHERE project_id = $1`,
+			`DELETE FROM project_keys WHERE project_id = $1`,
+			`DELETE FROM folders WHERE project_id = $1`,
+			`DELETE FROM lifecycle_runs WHERE project_id = $1`,
+			`DELETE FROM lifecycle_rules WHERE project_id = $1`,
+			`DELETE FROM resumable_uploads WHERE project_id = $1`,
+			`DELETE FROM multipart_uploads WHERE project_id = $1`,
+			`DELETE FROM share_links WHERE project_id = $1`,
+			`DELETE FROM projects WHERE id = $1`,
+		}
+		for _, query := range queries {
+			if _, err := tx.ExecContext(ctx, query, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 func (s *UserProjectStore) Create(ctx context.Context, tx *sql.Tx, userAssignedProject *UserAssignedProject) error {
@@ -258,7 +438,7 @@ func (s *UserProjectStore) GetByUserId(ctx context.Context, userId int64) ([]*Us
 					p.max_upload_size
 			   FROM user_assigned_projects uap
 			   INNER JOIN projects p ON uap.project_id = p.id
-			   WHERE uap.user_id = $1`
+			   WHERE uap.user_id = $1 AND p.deleted_at IS NULL`
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
@@ -289,7 +469,9 @@ func (s *UserProjectStore) GetByUserId(ctx context.Context, userId int64) ([]*Us
 }
 
 func (s *UserProjectStore) CountByUserId(ctx context.Context, userId int64) (int64, error) {
-	query := `SELECT COUNT(*) FROM user_assigned_projects WHERE user_id = $1`
+	query := `SELECT COUNT(*) FROM user_assigned_projects uap
+				INNER JOIN projects p ON uap.project_id = p.id
+				WHERE uap.user_id = $1 AND p.deleted_at IS NULL`
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
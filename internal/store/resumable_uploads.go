@@ -0,0 +1,315 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ResumableUpload is a tus upload received in chunks over several requests
+type ResumableUpload struct {
+	ID        uuid.UUID `json:"id"`
+	ProjectID int64     `json:"project_id"`
+	// Length is the size of the whole upload in bytes
+	Length int64 `json:"length"`
+	// Offset is the number of bytes received so far
+	Offset   int64  `json:"offset"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	Folder   string `json:"folder"`
+	// Metadata is the Upload-Metadata header as sent by the client
+	Metadata string `json:"metadata"`
+	// StoredFileID is the file the upload was stored as once complete
+	StoredFileID *uuid.UUID `json:"stored_file_id"`
+	CreatedAt    string     `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	// ClaimedAt is when storing or terminating the upload started, nil while
+	// chunks can be sent
+	ClaimedAt *time.Time `json:"claimed_at"`
+}
+
+// Complete reports whether every byte of the upload has been received
+func (u *ResumableUpload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// UploadChunk is the content received by one request of a resumable upload
+type UploadChunk struct {
+	UploadID uuid.UUID `json:"upload_id"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size"`
+	BlobKey  string    `json:"blob_key"`
+}
+
+type ResumableUploadStore struct {
+	db *sql.DB
+}
+
+const resumableUploadColumns = `id, project_id, upload_length, upload_offset, file_name, mime_type, folder, metadata,
+	stored_file_id, created_at, expires_at, claimed_at`
+
+func scanResumableUpload(row interface{ Scan(dest ...any) error }) (*ResumableUpload, error) {
+	upload := &ResumableUpload{}
+	err := row.Scan(
+		&upload.ID,
+		&upload.ProjectID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.FileName,
+		&upload.MimeType,
+		&upload.Folder,
+		&upload.Metadata,
+		&upload.StoredFileID,
+		&upload.CreatedAt,
+		&upload.ExpiresAt,
+		&upload.ClaimedAt,
+	)
+	return upload, err
+}
+
+func (s *ResumableUploadStore) Create(ctx context.Context, upload *ResumableUpload) error {
+	query := `INSERT INTO resumable_uploads (id, project_id, upload_length, file_name, mime_type, folder, metadata, expires_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	upload.ID = uuid.New()
+	return s.db.QueryRowContext(ctx, query,
+		upload.ID,
+		upload.ProjectID,
+		upload.Length,
+		upload.FileName,
+		upload.MimeType,
+		upload.Folder,
+		upload.Metadata,
+		upload.ExpiresAt,
+	).Scan(&upload.CreatedAt)
+}
+
+// GetById returns an upload of a project, expired or not
+func (s *ResumableUploadStore) GetById(ctx context.Context, projectId int64, id uuid.UUID) (*ResumableUpload, error) {
+	query := `SELECT ` + resumableUploadColumns + ` FROM resumable_uploads WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	upload, err := scanResumableUpload(s.db.QueryRowContext(ctx, query, id, projectId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// AddChunk records a chunk received at the current offset of an upload and
+// moves the offset past it. ErrConflict is returned when the offset has moved
+// since the chunk was received, or the upload has been claimed or stored.
+func (s *ResumableUploadStore) AddChunk(ctx context.Context, upload *ResumableUpload, chunk *UploadChunk) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		query := `UPDATE resumable_uploads SET upload_offset = upload_offset + $1
+				  WHERE id = $2 AND upload_offset = $3 AND upload_offset + $1 <= upload_length AND stored_file_id IS NULL
+				  AND claimed_at IS NULL RETURNING upload_offset`
+
+		err := tx.QueryRowContext(ctx, query, chunk.Size, upload.ID, chunk.Offset).Scan(&upload.Offset)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+
+		query = `INSERT INTO resumable_upload_chunks (upload_id, chunk_offset, size, blob_key) VALUES ($1, $2, $3, $4)`
+		_, err = tx.ExecContext(ctx, query, upload.ID, chunk.Offset, chunk.Size, chunk.BlobKey)
+		return err
+	})
+}
+
+// GetChunks returns the chunks of an upload in the order of their offset
+func (s *ResumableUploadStore) GetChunks(ctx context.Context, id uuid.UUID) ([]*UploadChunk, error) {
+	query := `SELECT upload_id, chunk_offset, size, blob_key FROM resumable_upload_chunks
+			  WHERE upload_id = $1 ORDER BY chunk_offset`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := make([]*UploadChunk, 0)
+	for rows.Next() {
+		chunk := &UploadChunk{}
+		if err := rows.Scan(&chunk.UploadID, &chunk.Offset, &chunk.Size, &chunk.BlobKey); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// GetChunkKeys returns the blob keys of the chunks of every upload
+func (s *ResumableUploadStore) GetChunkKeys(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT blob_key FROM resumable_upload_chunks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Claim marks an upload as being stored or terminated and moves its expiry
+// to expiresAt, so that it is not removed while it is stored. ErrConflict is
+// returned when it has already been claimed or stored.
+func (s *ResumableUploadStore) Claim(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	query := `UPDATE resumable_uploads SET claimed_at = NOW(), expires_at = $1
+			  WHERE id = $2 AND stored_file_id IS NULL AND claimed_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, expiresAt, id)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Release gives up the claim on an upload that failed to be stored, so that
+// storing it can be retried
+func (s *ResumableUploadStore) Release(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `UPDATE resumable_uploads SET claimed_at = NULL WHERE id = $1 AND stored_file_id IS NULL`, id)
+	return err
+}
+
+// SetStoredFile records the file a complete upload was stored as. Its chunks
+// are no longer needed and are forgotten.
+func (s *ResumableUploadStore) SetStoredFile(ctx context.Context, id uuid.UUID, storedFileId uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE resumable_uploads SET stored_file_id = $1 WHERE id = $2 AND stored_file_id IS NULL`, storedFileId, id)
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return ErrConflict
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM resumable_upload_chunks WHERE upload_id = $1`, id)
+		return err
+	})
+}
+
+// Delete removes an upload with its chunks
+func (s *ResumableUploadStore) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM resumable_uploads WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetExpired returns up to limit uploads that expired before the given time
+func (s *ResumableUploadStore) GetExpired(ctx context.Context, before time.Time, limit int64) ([]*ResumableUpload, error) {
+	query := `SELECT ` + resumableUploadColumns + ` FROM resumable_uploads
+			  WHERE expires_at < $1 ORDER BY expires_at LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*ResumableUpload, 0)
+	for rows.Next() {
+		upload, err := scanResumableUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
+
+// GetByProjectId returns up to limit uploads of a project, finished or not
+func (s *ResumableUploadStore) GetByProjectId(ctx context.Context, projectId int64, limit int64) ([]*ResumableUpload, error) {
+	query := `SELECT ` + resumableUploadColumns + ` FROM resumable_uploads
+			  WHERE project_id = $1 ORDER BY created_at LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]*ResumableUpload, 0)
+	for rows.Next() {
+		upload, err := scanResumableUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
@@ -5,6 +5,10 @@ import (
 	"database/sql"
 )
 
+// AdminRole is the name of the role that administers the server, whatever
+// projects its users are assigned to
+const AdminRole = "admin"
+
 type Role struct {
 	ID          int64  `json:"id"`
 	Name        string `json:"name"`
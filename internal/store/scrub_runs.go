@@ -0,0 +1,216 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// Integrity statuses of stored files, as recorded by the scrubber
+const (
+	IntegrityUnchecked    = "unchecked"
+	IntegrityOK           = "ok"
+	IntegrityMissing      = "missing"
+	IntegrityCorrupt      = "corrupt"
+	IntegrityUnverifiable = "unverifiable"
+	// IntegrityOrphaned marks blobs that no stored file references
+	IntegrityOrphaned = "orphaned"
+)
+
+// Statuses of scrub runs
+const (
+	ScrubRunning   = "running"
+	ScrubCompleted = "completed"
+	ScrubFailed    = "failed"
+)
+
+// ScrubRun is one pass of the integrity scrubber over every stored file
+type ScrubRun struct {
+	ID           int64   `json:"id"`
+	Status       string  `json:"status"`
+	FilesChecked int64   `json:"files_checked"`
+	Healthy      int64   `json:"healthy"`
+	Missing      int64   `json:"missing"`
+	Corrupt      int64   `json:"corrupt"`
+	Unverifiable int64   `json:"unverifiable"`
+	Orphaned     int64   `json:"orphaned"`
+	Error        string  `json:"error"`
+	StartedAt    string  `json:"started_at"`
+	FinishedAt   *string `json:"finished_at"`
+}
+
+// ScrubFinding is a missing, corrupt or orphaned blob found by a run
+type ScrubFinding struct {
+	ID      int64      `json:"id"`
+	RunID   int64      `json:"run_id"`
+	FileID  *uuid.UUID `json:"file_id"`
+	BlobKey string     `json:"blob_key"`
+	Problem string     `json:"problem"`
+	Detail  string     `json:"detail"`
+	FoundAt string     `json:"found_at"`
+}
+
+type ScrubRunStore struct {
+	db *sql.DB
+}
+
+const scrubRunColumns = `id, status, files_checked, healthy, missing, corrupt, unverifiable, orphaned, error, started_at, finished_at`
+
+func scrubRunFields(run *ScrubRun) []any {
+	return []any{
+		&run.ID,
+		&run.Status,
+		&run.FilesChecked,
+		&run.Healthy,
+		&run.Missing,
+		&run.Corrupt,
+		&run.Unverifiable,
+		&run.Orphaned,
+		&run.Error,
+		&run.StartedAt,
+		&run.FinishedAt,
+	}
+}
+
+func (s *ScrubRunStore) Create(ctx context.Context, run *ScrubRun) error {
+	query := `INSERT INTO scrub_runs (status) VALUES ($1) RETURNING ` + scrubRunColumns
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query, ScrubRunning).Scan(scrubRunFields(run)...)
+}
+
+// Finish records the final counters and status of a run
+func (s *ScrubRunStore) Finish(ctx context.Context, run *ScrubRun) error {
+	query := `UPDATE scrub_runs SET status = $1, files_checked = $2, healthy = $3, missing = $4, corrupt = $5,
+			  unverifiable = $6, orphaned = $7, error = $8, finished_at = NOW()
+			  WHERE id = $9 RETURNING finished_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query,
+		run.Status,
+		run.FilesChecked,
+		run.Healthy,
+		run.Missing,
+		run.Corrupt,
+		run.Unverifiable,
+		run.Orphaned,
+		run.Error,
+		run.ID,
+	).Scan(&run.FinishedAt)
+}
+
+func (s *ScrubRunStore) GetById(ctx context.Context, id int64) (*ScrubRun, error) {
+	query := `SELECT ` + scrubRunColumns + ` FROM scrub_runs WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	run := &ScrubRun{}
+	err := s.db.QueryRowContext(ctx, query, id).Scan(scrubRunFields(run)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return run, err
+}
+
+func (s *ScrubRunStore) GetAll(ctx context.Context, limit int64, offset int64) ([]*ScrubRun, error) {
+	query := `SELECT ` + scrubRunColumns + ` FROM scrub_runs ORDER BY id DESC LIMIT $1 OFFSET $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*ScrubRun, 0)
+	for rows.Next() {
+		run := &ScrubRun{}
+		if err := rows.Scan(scrubRunFields(run)...); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *ScrubRunStore) Count(ctx context.Context) (int64, error) {
+	query := `SELECT COUNT(*) FROM scrub_runs`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query).Scan(&count)
+	return count, err
+}
+
+func (s *ScrubRunStore) AddFinding(ctx context.Context, finding *ScrubFinding) error {
+	query := `INSERT INTO scrub_findings (run_id, file_id, blob_key, problem, detail) VALUES ($1, $2, $3, $4, $5) RETURNING id, found_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return s.db.QueryRowContext(ctx, query,
+		finding.RunID,
+		finding.FileID,
+		finding.BlobKey,
+		finding.Problem,
+		finding.Detail,
+	).Scan(&finding.ID, &finding.FoundAt)
+}
+
+func (s *ScrubRunStore) GetFindings(ctx context.Context, runId int64, limit int64, offset int64) ([]*ScrubFinding, error) {
+	query := `SELECT id, run_id, file_id, blob_key, problem, detail, found_at FROM scrub_findings
+			  WHERE run_id = $1 ORDER BY id LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, runId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	findings := make([]*ScrubFinding, 0)
+	for rows.Next() {
+		finding := &ScrubFinding{}
+		err := rows.Scan(
+			&finding.ID,
+			&finding.RunID,
+			&finding.FileID,
+			&finding.BlobKey,
+			&finding.Problem,
+			&finding.Detail,
+			&finding.FoundAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, rows.Err()
+}
+
+func (s *ScrubRunStore) CountFindings(ctx context.Context, runId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM scrub_findings WHERE run_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, runId).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShareLink is a public link to a file for people without access to its
+// project
+type ShareLink struct {
+	ID           int64     `json:"id"`
+	ProjectID    int64     `json:"project_id"`
+	StoredFileID uuid.UUID `json:"stored_file_id"`
+	// Token is only sent to the client when the link is created
+	Token    string   `json:"-"`
+	Password password `json:"-"`
+	// PasswordProtected reports whether the link asks for a password
+	PasswordProtected bool       `json:"password_protected"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	// MaxDownloads is the number of times the file can be downloaded, any
+	// number when nil
+	MaxDownloads  *int64 `json:"max_downloads"`
+	DownloadCount int64  `json:"download_count"`
+	// AccessCount counts every use of the link, including those that were
+	// refused
+	AccessCount    int64      `json:"access_count"`
+	LastAccessedAt *time.Time `json:"last_accessed_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	CreatedById    int64      `json:"created_by_id"`
+	CreatedAt      string     `json:"created_at"`
+}
+
+// SetPassword protects the link with a password, which is kept as a bcrypt
+// hash
+func (l *ShareLink) SetPassword(text string) error {
+	if err := l.Password.Set(text); err != nil {
+		return err
+	}
+	l.PasswordProtected = true
+	return nil
+}
+
+// CheckPassword reports whether text is the password of the link
+func (l *ShareLink) CheckPassword(text string) bool {
+	return l.Password.Compare(text) == nil
+}
+
+type ShareLinkStore struct {
+	db *sql.DB
+}
+
+const shareLinkColumns = `id, project_id, stored_file_id, token, password_hash, expires_at, max_downloads, download_count,
+	access_count, last_accessed_at, revoked_at, COALESCE(created_by_id, 0), created_at`
+
+func scanShareLink(row interface{ Scan(dest ...any) error }) (*ShareLink, error) {
+	link := &ShareLink{}
+	err := row.Scan(
+		&link.ID,
+		&link.ProjectID,
+		&link.StoredFileID,
+		&link.Token,
+		&link.Password.hash,
+		&link.ExpiresAt,
+		&link.MaxDownloads,
+		&link.DownloadCount,
+		&link.AccessCount,
+		&link.LastAccessedAt,
+		&link.RevokedAt,
+		&link.CreatedById,
+		&link.CreatedAt,
+	)
+	link.PasswordProtected = len(link.Password.hash) > 0
+	return link, err
+}
+
+// newShareToken returns a random token that can not be guessed
+func newShareToken() (string, error) {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func (s *ShareLinkStore) Create(ctx context.Context, link *ShareLink) error {
+	query := `INSERT INTO share_links (project_id, stored_file_id, token, password_hash, expires_at, max_downloads, created_by_id)
+			  VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0)) RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	token, err := newShareToken()
+	if err != nil {
+		return err
+	}
+	link.Token = token
+
+	// Links without a password have no hash at all
+	var passwordHash any
+	if link.PasswordProtected {
+		passwordHash = link.Password.hash
+	}
+
+	return s.db.QueryRowContext(ctx, query,
+		link.ProjectID,
+		link.StoredFileID,
+		link.Token,
+		passwordHash,
+		link.ExpiresAt,
+		link.MaxDownloads,
+		link.CreatedById,
+	).Scan(&link.ID, &link.CreatedAt)
+}
+
+func (s *ShareLinkStore) GetById(ctx context.Context, projectId int64, id int64) (*ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	link, err := scanShareLink(s.db.QueryRowContext(ctx, query, id, projectId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// GetByToken returns the link with the given token, revoked or expired or not
+func (s *ShareLinkStore) GetByToken(ctx context.Context, token string) (*ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links WHERE token = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	link, err := scanShareLink(s.db.QueryRowContext(ctx, query, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// GetByProjectId returns the links to the files of a project, newest first
+func (s *ShareLinkStore) GetByProjectId(ctx context.Context, projectId int64, limit int64, offset int64) ([]*ShareLink, error) {
+	query := `SELECT ` + shareLinkColumns + ` FROM share_links
+			  WHERE project_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]*ShareLink, 0)
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+func (s *ShareLinkStore) CountByProjectId(ctx context.Context, projectId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM share_links WHERE project_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, projectId).Scan(&count)
+	return count, err
+}
+
+// RecordAccess counts a use of a link that did not download the file
+func (s *ShareLinkStore) RecordAccess(ctx context.Context, id int64) error {
+	query := `UPDATE share_links SET access_count = access_count + 1, last_accessed_at = NOW() WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, query, id)
+	return err
+}
+
+// RecordDownload counts a download through a link, as long as the link is
+// still usable. ErrConflict is returned when it has been revoked, has expired
+// or has no downloads left, which may have happened since it was loaded.
+func (s *ShareLinkStore) RecordDownload(ctx context.Context, id int64) error {
+	query := `UPDATE share_links
+			  SET download_count = download_count + 1, access_count = access_count + 1, last_accessed_at = NOW()
+			  WHERE id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+			  AND (max_downloads IS NULL OR download_count < max_downloads)`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// Revoke stops a link from being used, keeping it and its counts
+func (s *ShareLinkStore) Revoke(ctx context.Context, projectId int64, id int64) error {
+	query := `UPDATE share_links SET revoked_at = COALESCE(revoked_at, NOW()) WHERE id = $1 AND project_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, id, projectId)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *ShareLinkStore) Delete(ctx context.Context, projectId int64, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM share_links WHERE id = $1 AND project_id = $2`, id, projectId)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -42,6 +42,11 @@ type Storage struct {
 		GetByKey(ctx context.Context, key string) (*Project, error)
 		GetAll(ctx context.Context, limit int64, offset int64) ([]*Project, error)
 		Update(ctx context.Context, project *Project) error
+		Trash(ctx context.Context, id int64) error
+		Restore(ctx context.Context, id int64) error
+		GetTrash(ctx context.Context, userId int64, limit int64, offset int64) ([]*Project, error)
+		CountTrash(ctx context.Context, userId int64) (int64, error)
+		GetTrashedBefore(ctx context.Context, before time.Time) ([]int64, error)
 		Delete(ctx context.Context, id int64) error
 	}
 
@@ -51,7 +56,127 @@ type Storage struct {
 		GetAllByProjectId(ctx context.Context, projectId int64, limit int64, offset int64) ([]*StoredFile, error)
 		CountProjectFiles(ctx context.Context, projectId int64) (int64, error)
 		GetByIdAndProjectKey(ctx context.Context, id uuid.UUID, projectKey string) (*StoredFile, error)
+		GetByIdAndProjectId(ctx context.Context, id uuid.UUID, projectId int64) (*StoredFile, error)
 		GetAllByProjectKey(ctx context.Context, projectKey string, limit int64, offset int64) ([]*StoredFile, error)
+		CreatePending(ctx context.Context, storedFile *StoredFile) error
+		Finalise(ctx context.Context, storedFile *StoredFile, blob *Blob, place func(blob *Blob) error) (bool, error)
+		DeletePending(ctx context.Context, id uuid.UUID) error
+		GetStalePending(ctx context.Context, before time.Time) ([]*StoredFile, error)
+		Delete(ctx context.Context, id uuid.UUID, remove func(storedFile *StoredFile) error) error
+		StorageUsedByProject(ctx context.Context, projectId int64) (int64, error)
+		GetBatch(ctx context.Context, after uuid.UUID, limit int64) ([]*StoredFile, error)
+		SetIntegrity(ctx context.Context, id uuid.UUID, status string, detail string) error
+		TouchAccessed(ctx context.Context, id uuid.UUID) error
+		GetVersions(ctx context.Context, id uuid.UUID) ([]*StoredFile, error)
+		GetVersion(ctx context.Context, id uuid.UUID, version int) (*StoredFile, error)
+		RestoreVersion(ctx context.Context, id uuid.UUID, version int) error
+		PruneVersions(ctx context.Context, id uuid.UUID, keep int, remove func(storedFile *StoredFile) error) (int64, error)
+		GetByFolder(ctx context.Context, projectId int64, folderId int64, limit int64, offset int64) ([]*StoredFile, error)
+		CountByFolder(ctx context.Context, projectId int64, folderId int64) (int64, error)
+		Move(ctx context.Context, storedFile *StoredFile, folderId int64) error
+		Trash(ctx context.Context, id uuid.UUID) error
+		RestoreFromTrash(ctx context.Context, projectId int64, id uuid.UUID) error
+		GetTrash(ctx context.Context, projectId int64, limit int64, offset int64) ([]*StoredFile, error)
+		CountTrash(ctx context.Context, projectId int64) (int64, error)
+		GetTrashedBefore(ctx context.Context, projectId int64, before time.Time, limit int64) ([]*StoredFile, error)
+		GetIdsByProjectId(ctx context.Context, projectId int64, limit int64) ([]uuid.UUID, error)
+		Purge(ctx context.Context, id uuid.UUID, remove func(storedFile *StoredFile) error) error
+		SetLegalHold(ctx context.Context, id uuid.UUID, hold bool) error
+		CheckProjectLocks(ctx context.Context, projectId int64) error
+	}
+
+	Folders interface {
+		Create(ctx context.Context, folder *Folder) error
+		EnsurePath(ctx context.Context, projectId int64, path string) (*Folder, error)
+		GetById(ctx context.Context, projectId int64, id int64) (*Folder, error)
+		GetByPath(ctx context.Context, projectId int64, path string) (*Folder, error)
+		GetChildren(ctx context.Context, projectId int64, parentId int64) ([]*Folder, error)
+		Relocate(ctx context.Context, folder *Folder, parentId int64, name string) error
+	}
+
+	LifecycleRules interface {
+		Create(ctx context.Context, rule *LifecycleRule) error
+		GetById(ctx context.Context, projectId int64, id int64) (*LifecycleRule, error)
+		GetByProjectId(ctx context.Context, projectId int64) ([]*LifecycleRule, error)
+		GetEnabled(ctx context.Context) ([]*LifecycleRule, error)
+		Update(ctx context.Context, rule *LifecycleRule) error
+		Delete(ctx context.Context, projectId int64, id int64) error
+		GetMatches(ctx context.Context, rule *LifecycleRule, now time.Time, limit int64, offset int64) ([]*StoredFile, error)
+		GetMatchBatch(ctx context.Context, rule *LifecycleRule, now time.Time, after uuid.UUID, limit int64) ([]*StoredFile, error)
+		CountMatches(ctx context.Context, rule *LifecycleRule, now time.Time) (int64, error)
+		CreateRun(ctx context.Context, rule *LifecycleRule, run *LifecycleRun) error
+		FinishRun(ctx context.Context, run *LifecycleRun) error
+		GetRun(ctx context.Context, projectId int64, id int64) (*LifecycleRun, error)
+		GetRuns(ctx context.Context, projectId int64, limit int64, offset int64) ([]*LifecycleRun, error)
+		CountRuns(ctx context.Context, projectId int64) (int64, error)
+		AddRunItem(ctx context.Context, item *LifecycleRunItem) error
+		GetRunItems(ctx context.Context, runId int64, limit int64, offset int64) ([]*LifecycleRunItem, error)
+		CountRunItems(ctx context.Context, runId int64) (int64, error)
+	}
+
+	LockAudit interface {
+		Create(ctx context.Context, event *LockAuditEvent) error
+		GetByProjectId(ctx context.Context, projectId int64, limit int64, offset int64) ([]*LockAuditEvent, error)
+		CountByProjectId(ctx context.Context, projectId int64) (int64, error)
+	}
+
+	ResumableUploads interface {
+		Create(ctx context.Context, upload *ResumableUpload) error
+		GetById(ctx context.Context, projectId int64, id uuid.UUID) (*ResumableUpload, error)
+		AddChunk(ctx context.Context, upload *ResumableUpload, chunk *UploadChunk) error
+		Claim(ctx context.Context, id uuid.UUID, expiresAt time.Time) error
+		Release(ctx context.Context, id uuid.UUID) error
+		GetChunks(ctx context.Context, id uuid.UUID) ([]*UploadChunk, error)
+		GetChunkKeys(ctx context.Context) ([]string, error)
+		SetStoredFile(ctx context.Context, id uuid.UUID, storedFileId uuid.UUID) error
+		Delete(ctx context.Context, id uuid.UUID) error
+		GetExpired(ctx context.Context, before time.Time, limit int64) ([]*ResumableUpload, error)
+		GetByProjectId(ctx context.Context, projectId int64, limit int64) ([]*ResumableUpload, error)
+	}
+
+	MultipartUploads interface {
+		Create(ctx context.Context, upload *MultipartUpload) error
+		GetById(ctx context.Context, projectId int64, id uuid.UUID) (*MultipartUpload, error)
+		PutPart(ctx context.Context, part *MultipartPart, expiresAt time.Time, maxSize int64) (string, error)
+		Claim(ctx context.Context, id uuid.UUID, expiresAt time.Time) error
+		Release(ctx context.Context, id uuid.UUID) error
+		GetParts(ctx context.Context, id uuid.UUID) ([]*MultipartPart, error)
+		GetPartKeys(ctx context.Context) ([]string, error)
+		SetStoredFile(ctx context.Context, id uuid.UUID, storedFileId uuid.UUID) error
+		Delete(ctx context.Context, id uuid.UUID) error
+		GetExpired(ctx context.Context, before time.Time, limit int64) ([]*MultipartUpload, error)
+		GetByProjectId(ctx context.Context, projectId int64, limit int64) ([]*MultipartUpload, error)
+	}
+
+	ShareLinks interface {
+		Create(ctx context.Context, link *ShareLink) error
+		GetById(ctx context.Context, projectId int64, id int64) (*ShareLink, error)
+		GetByToken(ctx context.Context, token string) (*ShareLink, error)
+		GetByProjectId(ctx context.Context, projectId int64, limit int64, offset int64) ([]*ShareLink, error)
+		CountByProjectId(ctx context.Context, projectId int64) (int64, error)
+		RecordAccess(ctx context.Context, id int64) error
+		RecordDownload(ctx context.Context, id int64) error
+		Revoke(ctx context.Context, projectId int64, id int64) error
+		Delete(ctx context.Context, projectId int64, id int64) error
+	}
+
+	Blobs interface {
+		GetReferenceDrift(ctx context.Context) ([]*BlobDrift, error)
+		RepairReferences(ctx context.Context, id int64, remove func(blob *Blob) error) error
+		GetById(ctx context.Context, id int64) (*Blob, error)
+		GetColdCandidates(ctx context.Context, before time.Time, after int64, limit int) ([]*Blob, error)
+		ChangeStorageClass(ctx context.Context, id int64, fromKey string, toKey string, class string, idleSince *time.Time) error
+	}
+
+	ScrubRuns interface {
+		Counter
+		Create(ctx context.Context, run *ScrubRun) error
+		Finish(ctx context.Context, run *ScrubRun) error
+		GetById(ctx context.Context, id int64) (*ScrubRun, error)
+		GetAll(ctx context.Context, limit int64, offset int64) ([]*ScrubRun, error)
+		AddFinding(ctx context.Context, finding *ScrubFinding) error
+		GetFindings(ctx context.Context, runId int64, limit int64, offset int64) ([]*ScrubFinding, error)
+		CountFindings(ctx context.Context, runId int64) (int64, error)
 	}
 
 	FileTypes interface {
@@ -68,6 +193,18 @@ type Storage struct {
 		FileTypeIsAllowed(ctx context.Context, projectId int64, mimetype string) (bool, error)
 	}
 
+	CompressionPolicies interface {
+		Create(ctx context.Context, policy *CompressionPolicy) error
+		GetByProjectId(ctx context.Context, projectId int64) ([]*CompressionPolicy, error)
+		Delete(ctx context.Context, projectId int64, id int64) error
+	}
+
+	ProjectKeys interface {
+		GetByProjectId(ctx context.Context, projectId int64) (*ProjectKey, error)
+		Create(ctx context.Context, projectKey *ProjectKey) error
+		RewrapAll(ctx context.Context, rewrap func(projectKey *ProjectKey) ([]byte, string, error)) (int64, error)
+	}
+
 	UserAssignedProjects interface {
 		Create(ctx context.Context, tx *sql.Tx, userAssignedProject *UserAssignedProject) error
 		CreateWithoutTx(ctx context.Context, userAssignedProject *UserAssignedProject) error
@@ -88,6 +225,16 @@ func InitialiseStorage(db *sql.DB) *Storage {
 		FileTypes:               &FileTypeStore{db},
 		ProjectAllowedFileTypes: &ProjectAllowedFileTypeStore{db},
 		UserAssignedProjects:    &UserProjectStore{db},
+		CompressionPolicies:     &CompressionPolicyStore{db},
+		ProjectKeys:             &ProjectKeyStore{db},
+		ScrubRuns:               &ScrubRunStore{db},
+		Blobs:                   &BlobStore{db},
+		Folders:                 &FolderStore{db},
+		LifecycleRules:          &LifecycleStore{db},
+		LockAudit:               &LockAuditStore{db},
+		ResumableUploads:        &ResumableUploadStore{db},
+		MultipartUploads:        &MultipartUploadStore{db},
+		ShareLinks:              &ShareLinkStore{db},
 	}
 }
 
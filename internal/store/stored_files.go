@@ -3,6 +3,8 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,14 +23,124 @@ type StoredFile struct {
 	ProjectID         int64     `json:"project_id"`
 	Icon              string    `json:"icon"`
 	FileType          FileType  `json:"file_type"`
+	StorageFormat     string    `json:"storage_format"`
+	CompressionCodec  string    `json:"compression_codec"`
+	CompressionLevel  int       `json:"compression_level"`
+	Encrypted         bool      `json:"encrypted"`
+	// FolderID is the folder at Folder, 0 for files at the root of the project
+	FolderID int64 `json:"folder_id"`
+	// StorageFolder is the folder the content of a file that owns its blob is
+	// kept under, which stays the same when the file is moved
+	StorageFolder string `json:"-"`
+	// KeyFingerprint identifies the customer supplied key of the file, if any
+	KeyFingerprint string `json:"-"`
+	// SHA256 and MD5 are hex encoded checksums of the original content, empty
+	// for files uploaded before checksums were recorded
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+	// Status is FileStatusPending until the upload has been finalised
+	Status string `json:"status"`
+	// IntegrityStatus is the result of the last check by the scrubber
+	IntegrityStatus    string  `json:"integrity_status"`
+	IntegrityDetail    string  `json:"integrity_detail"`
+	IntegrityCheckedAt *string `json:"integrity_checked_at"`
+	// DurabilityPolicy is the durability policy of the project when the file
+	// was uploaded
+	DurabilityPolicy string `json:"durability_policy"`
+	// StorageClass is StorageClassHot or StorageClassCold
+	StorageClass string `json:"storage_class"`
+	// LastAccessedAt is when the file was last downloaded
+	LastAccessedAt *string `json:"last_accessed_at"`
+	// Version counts the uploads to the path of the file, starting at 1
+	Version int `json:"version"`
+	// DeletedAt is when the file was moved to the trash, nil for files that
+	// are not deleted
+	DeletedAt *string `json:"deleted_at"`
+	// RetainUntil is when the retention period of the version ends, nil when
+	// its project had none at upload
+	RetainUntil *string `json:"retain_until"`
+	// LegalHold keeps every version of the file until it is switched off. It
+	// is only set on the file, not on its previous versions.
+	LegalHold bool `json:"legal_hold"`
+	// BlobID is the shared blob holding the content, 0 for files that own
+	// their blob
+	BlobID int64 `json:"-"`
 }
 
+// ErrVersionNotShared is returned when restoring a version whose content is
+// not kept in a shared blob
+var ErrVersionNotShared = errors.New("version was stored before content could be shared and can not be restored")
+
+// Statuses of stored files. Only available files are listed and served.
+const (
+	FileStatusPending   = "pending"
+	FileStatusAvailable = "available"
+)
+
 type StoredFileStore struct {
 	db *sql.DB
 }
 
+// versionColumns lists the stored_files columns that differ between the
+// versions of a file
+const versionColumns = `file_size, mime_type, saved_as, original_extension, uploaded_at, icon, storage_format, compression_codec, compression_level, encrypted, encryption_key_fingerprint, blob_id, sha256, md5, integrity_status, integrity_detail, integrity_checked_at, durability_policy, storage_class, last_accessed_at, version, storage_folder, retain_until`
+
+// storedFileColumns lists the stored_files columns read by every query, in
+// the order expected by storedFileFields
+const storedFileColumns = `sf.id, sf.file_name, sf.file_size, sf.mime_type, sf.folder, sf.saved_as, sf.original_extension, sf.uploaded_at, sf.project_id, sf.icon, sf.storage_format, sf.compression_codec, sf.compression_level, sf.encrypted, COALESCE(sf.encryption_key_fingerprint, ''), COALESCE(sf.blob_id, 0), COALESCE(sf.sha256, ''), COALESCE(sf.md5, ''), sf.integrity_status, sf.integrity_detail, sf.integrity_checked_at, sf.status, sf.durability_policy, sf.storage_class, sf.last_accessed_at, sf.version, COALESCE(sf.folder_id, 0), sf.storage_folder, sf.deleted_at, sf.retain_until, sf.legal_hold`
+
+// storedFileFields returns the scan destinations matching storedFileColumns
+func storedFileFields(storedFile *StoredFile) []any {
+	return []any{
+		&storedFile.ID,
+		&storedFile.FileName,
+		&storedFile.FileSize,
+		&storedFile.MimeType,
+		&storedFile.Folder,
+		&storedFile.SavedAs,
+		&storedFile.OriginalExtension,
+		&storedFile.UploadedAt,
+		&storedFile.ProjectID,
+		&storedFile.Icon,
+		&storedFile.StorageFormat,
+		&storedFile.CompressionCodec,
+		&storedFile.CompressionLevel,
+		&storedFile.Encrypted,
+		&storedFile.KeyFingerprint,
+		&storedFile.BlobID,
+		&storedFile.SHA256,
+		&storedFile.MD5,
+		&storedFile.IntegrityStatus,
+		&storedFile.IntegrityDetail,
+		&storedFile.IntegrityCheckedAt,
+		&storedFile.Status,
+		&storedFile.DurabilityPolicy,
+		&storedFile.StorageClass,
+		&storedFile.LastAccessedAt,
+		&storedFile.Version,
+		&storedFile.FolderID,
+		&storedFile.StorageFolder,
+		&storedFile.DeletedAt,
+		&storedFile.RetainUntil,
+		&storedFile.LegalHold,
+	}
+}
+
 func (s *StoredFileStore) Create(ctx context.Context, storedFile *StoredFile) error {
+	storedFile.Status = FileStatusAvailable
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
 
+	return insertStoredFile(ctx, s.db, storedFile)
+}
+
+// rowQuerier is implemented by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertStoredFile(ctx context.Context, q rowQuerier, storedFile *StoredFile) error {
 	query := `INSERT INTO stored_files (file_name,
 							file_size,
 							mime_type,
@@ -37,12 +149,20 @@ func (s *StoredFileStore) Create(ctx context.Context, storedFile *StoredFile) er
 							original_extension,
 							uploaded_at,
 							project_id,
-							icon) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, file_name`
-
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
-	defer cancel()
+							icon,
+							storage_format,
+							compression_codec,
+							compression_level,
+							encrypted,
+							encryption_key_fingerprint,
+							blob_id,
+							sha256,
+							md5,
+							status,
+							durability_policy,
+							folder_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, ''), NULLIF($15, 0), NULLIF($16, ''), NULLIF($17, ''), $18, COALESCE(NULLIF($19, ''), 'replication'), NULLIF($20, 0)) RETURNING id, file_name, uploaded_at`
 
-	err := s.db.QueryRowContext(ctx,
+	return q.QueryRowContext(ctx,
 		query,
 		storedFile.FileName,
 		storedFile.FileSize,
@@ -53,19 +173,466 @@ func (s *StoredFileStore) Create(ctx context.Context, storedFile *StoredFile) er
 		time.Now(),
 		storedFile.ProjectID,
 		storedFile.Icon,
+		storedFile.StorageFormat,
+		storedFile.CompressionCodec,
+		storedFile.CompressionLevel,
+		storedFile.Encrypted,
+		storedFile.KeyFingerprint,
+		storedFile.BlobID,
+		storedFile.SHA256,
+		storedFile.MD5,
+		storedFile.Status,
+		storedFile.DurabilityPolicy,
+		storedFile.FolderID,
 	).Scan(
 		&storedFile.ID,
 		&storedFile.FileName,
+		&storedFile.UploadedAt,
 	)
+}
+
+// CreatePending records a file whose content is still being uploaded
+func (s *StoredFileStore) CreatePending(ctx context.Context, storedFile *StoredFile) error {
+	storedFile.Status = FileStatusPending
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	return insertStoredFile(ctx, s.db, storedFile)
+}
+
+// Finalise makes a pending file available with its content kept in a shared
+// blob. The blob with the same content and scope is reused when there is
+// one, otherwise it is created and place is called, with the blob row
+// locked, to move the uploaded content to blob.Key. It reports whether an
+// existing blob was reused, in which case the caller should discard its copy.
+//
+// When a file already exists at the same path, the upload becomes its new
+// version instead: the file keeps its id, its current content is kept as a
+// previous version and storedFile is updated to describe the file.
+func (s *StoredFileStore) Finalise(ctx context.Context, storedFile *StoredFile, blob *Blob, place func(blob *Blob) error) (bool, error) {
+	reused := false
+	fileID := storedFile.ID
+	version := 1
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		// The folder may have been renamed or moved during the upload
+		query := `SELECT folder, COALESCE(folder_id, 0) FROM stored_files WHERE id = $1`
+		if err := tx.QueryRowContext(queryCtx, query, storedFile.ID).Scan(&storedFile.Folder, &storedFile.FolderID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if err := lockPath(ctx, tx, storedFile); err != nil {
+			return err
+		}
 
+		// Uploads can not overwrite a file under retention or legal hold
+		err := checkLocks(ctx, tx, `sf.project_id = $1 AND sf.folder = $2 AND sf.file_name = $3 AND sf.id <> $4
+			AND sf.status = 'available' AND sf.version_of IS NULL AND sf.deleted_at IS NULL`,
+			storedFile.ProjectID, storedFile.Folder, storedFile.FileName, storedFile.ID)
+		if err != nil {
+			return err
+		}
+
+		if err := lockBlob(ctx, tx, blob); err != nil {
+			return err
+		}
+
+		reused = blob.RefCount > 0
+		if !reused {
+			if err := place(blob); err != nil {
+				return err
+			}
+		}
+
+		if err := addBlobReferences(ctx, tx, blob.ID, 1); err != nil {
+			return err
+		}
+
+		// The blob may have been stored with other settings by an earlier upload
+		storedFile.BlobID = blob.ID
+		storedFile.SavedAs = blob.Key
+		storedFile.StorageFormat = blob.StorageFormat
+		storedFile.CompressionCodec = blob.CompressionCodec
+		storedFile.CompressionLevel = blob.CompressionLevel
+		storedFile.Encrypted = blob.Encrypted
+		storedFile.StorageClass = blob.StorageClass
+		storedFile.Status = FileStatusAvailable
+
+		query = `UPDATE stored_files SET file_size = $1, saved_as = $2, blob_id = $3, storage_format = $4,
+				  compression_codec = $5, compression_level = $6, encrypted = $7, sha256 = $8, md5 = $9,
+				  status = $10, uploaded_at = $11, storage_class = $12,
+				  retain_until = (SELECT CASE WHEN p.retention_days > 0 THEN NOW() + p.retention_days * INTERVAL '1 day' END
+				  FROM projects p WHERE p.id = stored_files.project_id)
+				  WHERE id = $13 AND status = $14
+				  RETURNING uploaded_at, retain_until`
+
+		err = tx.QueryRowContext(queryCtx, query,
+			storedFile.FileSize,
+			storedFile.SavedAs,
+			storedFile.BlobID,
+			storedFile.StorageFormat,
+			storedFile.CompressionCodec,
+			storedFile.CompressionLevel,
+			storedFile.Encrypted,
+			storedFile.SHA256,
+			storedFile.MD5,
+			FileStatusAvailable,
+			time.Now(),
+			storedFile.StorageClass,
+			storedFile.ID,
+			FileStatusPending,
+		).Scan(&storedFile.UploadedAt, &storedFile.RetainUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The pending file was cleaned up while it was being uploaded
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// Add a version to the file already at the same path, if any
+		query = `SELECT id, version FROM stored_files
+				 WHERE project_id = $1 AND folder = $2 AND file_name = $3 AND id <> $4
+				 AND status = $5 AND version_of IS NULL AND deleted_at IS NULL
+				 ORDER BY uploaded_at DESC
+				 LIMIT 1
+				 FOR UPDATE`
+		var current int
+		err = tx.QueryRowContext(queryCtx, query,
+			storedFile.ProjectID,
+			storedFile.Folder,
+			storedFile.FileName,
+			storedFile.ID,
+			FileStatusAvailable,
+		).Scan(&fileID, &current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		version = current + 1
+		if err := archiveVersion(ctx, tx, fileID); err != nil {
+			return err
+		}
+		if err := copyVersion(ctx, tx, fileID, storedFile.ID, version); err != nil {
+			return err
+		}
+
+		// The reference to the blob moved to the file along with the content
+		_, err = tx.ExecContext(queryCtx, `DELETE FROM stored_files WHERE id = $1`, storedFile.ID)
+		return err
+	})
+	if err != nil {
+		return reused, err
+	}
+
+	storedFile.ID = fileID
+	storedFile.Version = version
+	return reused, nil
+}
+
+// lockPath serialises the changes to the versions of the file at the path of
+// storedFile until the transaction ends
+func lockPath(ctx context.Context, tx *sql.Tx, storedFile *StoredFile) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	key := fmt.Sprintf("%d/%s/%s", storedFile.ProjectID, storedFile.Folder, storedFile.FileName)
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key)
+	return err
+}
+
+// archiveVersion keeps the current content of a file as a previous version
+func archiveVersion(ctx context.Context, tx *sql.Tx, fileID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	query := `INSERT INTO stored_files (file_name, folder, folder_id, project_id, status, version_of, superseded_at, ` + versionColumns + `)
+			  SELECT file_name, folder, folder_id, project_id, status, id, NOW(), ` + versionColumns + ` FROM stored_files WHERE id = $1`
+
+	_, err := tx.ExecContext(ctx, query, fileID)
+	return err
+}
+
+// copyVersion replaces the content of a file with the content of another row
+// and numbers it as the given version
+func copyVersion(ctx context.Context, tx *sql.Tx, fileID uuid.UUID, fromID uuid.UUID, version int) error {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	query := `UPDATE stored_files SET (` + versionColumns + `) = (SELECT ` + versionColumns + ` FROM stored_files WHERE id = $2) WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, fileID, fromID); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `UPDATE stored_files SET version = $1 WHERE id = $2`, version, fileID)
+	return err
+}
+
+// DeletePending removes a file that was never finalised
+func (s *StoredFileStore) DeletePending(ctx context.Context, id uuid.UUID) error {
+	query := `DELETE FROM stored_files WHERE id = $1 AND status = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, query, id, FileStatusPending)
 	return err
 }
 
+// GetStalePending returns the files that have been pending since before the
+// given time, which are uploads that will never be finalised
+func (s *StoredFileStore) GetStalePending(ctx context.Context, before time.Time) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf WHERE sf.status = $1 AND sf.uploaded_at < $2 ORDER BY sf.uploaded_at`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, FileStatusPending, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+// Delete removes a stored file, or one version of it. When the current
+// version of a file is deleted, its newest previous version becomes current
+// and the file keeps its id. remove is called to delete the content when
+// nothing else references it any more, and the row is kept if that fails.
+func (s *StoredFileStore) Delete(ctx context.Context, id uuid.UUID, remove func(storedFile *StoredFile) error) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		storedFile := &StoredFile{}
+		var versionOf uuid.NullUUID
+		query := `SELECT ` + storedFileColumns + `, sf.version_of FROM stored_files sf WHERE sf.id = $1 FOR UPDATE`
+		if err := tx.QueryRowContext(queryCtx, query, id).Scan(append(storedFileFields(storedFile), &versionOf)...); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if err := checkLocks(ctx, tx, `sf.id = $1`, id); err != nil {
+			return err
+		}
+
+		deleteID := id
+		if !versionOf.Valid {
+			var previousID uuid.UUID
+			var previousVersion int
+			query = `SELECT id, version FROM stored_files WHERE version_of = $1 ORDER BY version DESC LIMIT 1 FOR UPDATE`
+			err := tx.QueryRowContext(queryCtx, query, id).Scan(&previousID, &previousVersion)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if err == nil {
+				if err := copyVersion(ctx, tx, id, previousID, previousVersion); err != nil {
+					return err
+				}
+				deleteID = previousID
+			}
+		}
+
+		if _, err := tx.ExecContext(queryCtx, `DELETE FROM stored_files WHERE id = $1`, deleteID); err != nil {
+			return err
+		}
+
+		// Files stored before deduplication own their blob
+		if storedFile.BlobID == 0 {
+			return remove(storedFile)
+		}
+
+		return releaseBlob(ctx, tx, storedFile.BlobID, func() error {
+			return remove(storedFile)
+		})
+	})
+}
+
+// GetVersions returns every version of a file, newest first
+func (s *StoredFileStore) GetVersions(ctx context.Context, id uuid.UUID) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE (sf.id = $1 OR sf.version_of = $1) AND sf.status = 'available' AND sf.deleted_at IS NULL
+			  ORDER BY sf.version DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+// GetVersion returns one version of a file. The id of a previous version is
+// its own, not the id of the file.
+func (s *StoredFileStore) GetVersion(ctx context.Context, id uuid.UUID, version int) (*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE (sf.id = $1 OR sf.version_of = $1) AND sf.version = $2 AND sf.status = 'available' AND sf.deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	storedFile := &StoredFile{}
+	err := s.db.QueryRowContext(ctx, query, id, version).Scan(storedFileFields(storedFile)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return storedFile, err
+}
+
+// RestoreVersion makes a copy of a previous version of a file its new
+// current version. The version restored is kept as it is.
+func (s *StoredFileStore) RestoreVersion(ctx context.Context, id uuid.UUID, version int) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		storedFile := &StoredFile{}
+		query := `SELECT ` + storedFileColumns + ` FROM stored_files sf WHERE sf.id = $1 AND sf.version_of IS NULL AND sf.deleted_at IS NULL`
+		if err := tx.QueryRowContext(queryCtx, query, id).Scan(storedFileFields(storedFile)...); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if err := lockPath(ctx, tx, storedFile); err != nil {
+			return err
+		}
+
+		// The file may have changed before the lock was taken
+		var current int
+		if err := tx.QueryRowContext(queryCtx, `SELECT version FROM stored_files WHERE id = $1 FOR UPDATE`, id).Scan(&current); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		// Restoring a version overwrites the current one
+		if err := checkLocks(ctx, tx, `sf.id = $1`, id); err != nil {
+			return err
+		}
+
+		var versionID uuid.UUID
+		var blobID int64
+		query = `SELECT id, COALESCE(blob_id, 0) FROM stored_files WHERE version_of = $1 AND version = $2 AND status = $3 FOR UPDATE`
+		if err := tx.QueryRowContext(queryCtx, query, id, version, FileStatusAvailable).Scan(&versionID, &blobID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		// Files stored before deduplication own their blob, which can not be
+		// shared with a copy
+		if blobID == 0 {
+			return ErrVersionNotShared
+		}
+
+		if err := archiveVersion(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := copyVersion(ctx, tx, id, versionID, current+1); err != nil {
+			return err
+		}
+		// The copy is a new upload as far as retention is concerned
+		query = `UPDATE stored_files SET uploaded_at = $1, last_accessed_at = NULL,
+				 retain_until = (SELECT CASE WHEN p.retention_days > 0 THEN NOW() + p.retention_days * INTERVAL '1 day' END
+				 FROM projects p WHERE p.id = stored_files.project_id)
+				 WHERE id = $2`
+		if _, err := tx.ExecContext(queryCtx, query, time.Now(), id); err != nil {
+			return err
+		}
+
+		return addBlobReferences(ctx, tx, blobID, 1)
+	})
+}
+
+// PruneVersions deletes the oldest previous versions of a file until no more
+// than keep versions are left, counting the current one. remove is called as
+// for Delete. It returns the number of versions deleted.
+func (s *StoredFileStore) PruneVersions(ctx context.Context, id uuid.UUID, keep int, remove func(storedFile *StoredFile) error) (int64, error) {
+	query := `SELECT id FROM stored_files WHERE version_of = $1 ORDER BY version DESC OFFSET $2`
+
+	queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(queryCtx, query, id, max(keep-1, 0))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var versionID uuid.UUID
+		if err := rows.Scan(&versionID); err != nil {
+			return 0, err
+		}
+		ids = append(ids, versionID)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	pruned := int64(0)
+	for _, versionID := range ids {
+		err := s.Delete(ctx, versionID, remove)
+		var lockErr *LockError
+		if errors.Is(err, ErrNotFound) || errors.As(err, &lockErr) {
+			// Versions under retention or legal hold are kept
+			continue
+		}
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
 func (s *StoredFileStore) GetById(ctx context.Context, id uuid.UUID) (*StoredFile, error) {
-	query := `SELECT sf.id, sf.file_name, sf.file_size, sf.mime_type, sf.folder, sf.saved_as, sf.original_extension, sf.uploaded_at, sf.project_id, sf.icon, p.name, p.description, p.created_at, COALESCE(p.created_by_id, 0)
+	query := `SELECT ` + storedFileColumns + `, p.name, p.description, p.created_at, COALESCE(p.created_by_id, 0)
 	FROM stored_files sf
 	INNER JOIN projects p ON sf.project_id = p.id
-	WHERE sf.id = $1`
+	WHERE sf.id = $1 AND sf.status = 'available' AND sf.version_of IS NULL AND sf.deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -75,31 +642,22 @@ func (s *StoredFileStore) GetById(ctx context.Context, id uuid.UUID) (*StoredFil
 		ctx,
 		query,
 		id,
-	).Scan(
-		&storedFile.ID,
-		&storedFile.FileName,
-		&storedFile.FileSize,
-		&storedFile.MimeType,
-		&storedFile.Folder,
-		&storedFile.SavedAs,
-		&storedFile.OriginalExtension,
-		&storedFile.UploadedAt,
-		&storedFile.ProjectID,
-		&storedFile.Icon,
+	).Scan(append(storedFileFields(storedFile),
 		&storedFile.Project.Name,
 		&storedFile.Project.Description,
 		&storedFile.Project.CreatedAt,
 		&storedFile.Project.CreatedById,
-	)
+	)...)
 
 	return storedFile, err
 }
 
 func (s *StoredFileStore) GetByIdAndProjectKey(ctx context.Context, id uuid.UUID, projectKey string) (*StoredFile, error) {
-	query := `SELECT sf.id, sf.file_name, sf.file_size, sf.mime_type, sf.folder, sf.saved_as, sf.original_extension, sf.uploaded_at, sf.project_id, sf.icon
+	query := `SELECT ` + storedFileColumns + `
 	FROM stored_files sf
 	JOIN projects p ON sf.project_id = p.id
-	WHERE sf.id = $1 AND p.project_key = $2`
+	WHERE sf.id = $1 AND p.project_key = $2 AND sf.status = 'available' AND sf.version_of IS NULL
+	AND sf.deleted_at IS NULL AND p.deleted_at IS NULL`
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
 
@@ -109,28 +667,40 @@ func (s *StoredFileStore) GetByIdAndProjectKey(ctx context.Context, id uuid.UUID
 		query,
 		id,
 		projectKey,
-	).Scan(
-		&storedFile.ID,
-		&storedFile.FileName,
-		&storedFile.FileSize,
-		&storedFile.MimeType,
-		&storedFile.Folder,
-		&storedFile.SavedAs,
-		&storedFile.OriginalExtension,
-		&storedFile.UploadedAt,
-		&storedFile.ProjectID,
-		&storedFile.Icon,
-	)
+	).Scan(storedFileFields(storedFile)...)
+
+	return storedFile, err
+}
+
+// GetByIdAndProjectId returns the current version of a file of a project
+// that is not in the trash
+func (s *StoredFileStore) GetByIdAndProjectId(ctx context.Context, id uuid.UUID, projectId int64) (*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + `
+	FROM stored_files sf
+	JOIN projects p ON sf.project_id = p.id
+	WHERE sf.id = $1 AND p.id = $2 AND sf.status = 'available' AND sf.version_of IS NULL
+	AND sf.deleted_at IS NULL AND p.deleted_at IS NULL`
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	storedFile := &StoredFile{}
+	err := s.db.QueryRowContext(
+		ctx,
+		query,
+		id,
+		projectId,
+	).Scan(storedFileFields(storedFile)...)
 
 	return storedFile, err
 }
 
 func (s *StoredFileStore) GetAllByProjectKey(ctx context.Context,
 	projectKey string, limit int64, offset int64) ([]*StoredFile, error) {
-	query := `SELECT sf.id, sf.file_name, sf.file_size, sf.mime_type, sf.folder, sf.saved_as, sf.original_extension, sf.uploaded_at, sf.project_id, sf.icon
+	query := `SELECT ` + storedFileColumns + `
 	FROM stored_files sf
 	JOIN projects p ON sf.project_id = p.id
-	WHERE p.project_key = $1
+	WHERE p.project_key = $1 AND sf.status = 'available' AND sf.version_of IS NULL
+	AND sf.deleted_at IS NULL AND p.deleted_at IS NULL
 	ORDER BY sf.uploaded_at DESC
 	LIMIT $2 OFFSET $3`
 
@@ -146,18 +716,7 @@ func (s *StoredFileStore) GetAllByProjectKey(ctx context.Context,
 	storedFiles := make([]*StoredFile, 0)
 	for rows.Next() {
 		storedFile := &StoredFile{}
-		err := rows.Scan(
-			&storedFile.ID,
-			&storedFile.FileName,
-			&storedFile.FileSize,
-			&storedFile.MimeType,
-			&storedFile.Folder,
-			&storedFile.SavedAs,
-			&storedFile.OriginalExtension,
-			&storedFile.UploadedAt,
-			&storedFile.ProjectID,
-			&storedFile.Icon,
-		)
+		err := rows.Scan(storedFileFields(storedFile)...)
 		if err != nil {
 			return nil, err
 		}
@@ -168,8 +727,7 @@ func (s *StoredFileStore) GetAllByProjectKey(ctx context.Context,
 }
 
 func (s *StoredFileStore) GetAllByProjectId(ctx context.Context, projectId int64, limit int64, offset int64) ([]*StoredFile, error) {
-	query := `SELECT sf.id, sf.file_name, sf.file_size, sf.mime_type, sf.folder, sf.saved_as, sf.original_extension, sf.uploaded_at, sf.project_id, 
-	sf.icon, ft.name, ft.id, ft.mimetype FROM stored_files sf LEFT JOIN file_types ft on sf.mime_type = ft.mimetype WHERE sf.project_id = $1 ORDER BY uploaded_at DESC LIMIT $2 OFFSET $3`
+	query := `SELECT ` + storedFileColumns + `, ft.name, ft.id, ft.mimetype FROM stored_files sf LEFT JOIN file_types ft on sf.mime_type = ft.mimetype WHERE sf.project_id = $1 AND sf.status = 'available' AND sf.version_of IS NULL AND sf.deleted_at IS NULL ORDER BY uploaded_at DESC LIMIT $2 OFFSET $3`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -183,21 +741,11 @@ func (s *StoredFileStore) GetAllByProjectId(ctx context.Context, projectId int64
 	storedFiles := make([]*StoredFile, 0)
 	for rows.Next() {
 		storedFile := &StoredFile{}
-		err := rows.Scan(
-			&storedFile.ID,
-			&storedFile.FileName,
-			&storedFile.FileSize,
-			&storedFile.MimeType,
-			&storedFile.Folder,
-			&storedFile.SavedAs,
-			&storedFile.OriginalExtension,
-			&storedFile.UploadedAt,
-			&storedFile.ProjectID,
-			&storedFile.Icon,
+		err := rows.Scan(append(storedFileFields(storedFile),
 			&storedFile.FileType.Name,
 			&storedFile.FileType.ID,
 			&storedFile.FileType.MimeType,
-		)
+		)...)
 		if err != nil {
 			return nil, err
 		}
@@ -208,7 +756,282 @@ func (s *StoredFileStore) GetAllByProjectId(ctx context.Context, projectId int64
 }
 
 func (s *StoredFileStore) CountProjectFiles(ctx context.Context, projectId int64) (int64, error) {
-	query := `SELECT COUNT(*) FROM stored_files WHERE project_id = $1`
+	query := `SELECT COUNT(*) FROM stored_files WHERE project_id = $1 AND status = 'available' AND version_of IS NULL AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, projectId).Scan(&count)
+	return count, err
+}
+
+// StorageUsedByProject sums the logical size of a project's files and their
+// previous versions, counting shared content once for every file that
+// references it. Files in the trash are counted until they are purged.
+func (s *StoredFileStore) StorageUsedByProject(ctx context.Context, projectId int64) (int64, error) {
+	query := `SELECT COALESCE(SUM(file_size), 0) FROM stored_files WHERE project_id = $1 AND status = 'available'`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var used int64
+	err := s.db.QueryRowContext(ctx, query, projectId).Scan(&used)
+	return used, err
+}
+
+// GetBatch returns up to limit files ordered by id, starting after the given
+// id. Pass uuid.Nil to start from the beginning.
+func (s *StoredFileStore) GetBatch(ctx context.Context, after uuid.UUID, limit int64) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf WHERE sf.id > $1 AND sf.status = 'available' ORDER BY sf.id LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+// SetIntegrity records the result of an integrity check of a file
+func (s *StoredFileStore) SetIntegrity(ctx context.Context, id uuid.UUID, status string, detail string) error {
+	query := `UPDATE stored_files SET integrity_status = $1, integrity_detail = $2, integrity_checked_at = NOW() WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, query, status, detail, id)
+	return err
+}
+
+// TouchAccessed records that a file was downloaded
+func (s *StoredFileStore) TouchAccessed(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE stored_files SET last_accessed_at = NOW() WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, query, id)
+	return err
+}
+
+// GetByFolder returns the files directly inside a folder, or at the root of
+// the project for folderId 0, ordered by name
+func (s *StoredFileStore) GetByFolder(ctx context.Context, projectId int64, folderId int64, limit int64, offset int64) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE sf.project_id = $1 AND sf.folder_id IS NOT DISTINCT FROM NULLIF($2::BIGINT, 0)
+			  AND sf.status = 'available' AND sf.version_of IS NULL AND sf.deleted_at IS NULL
+			  ORDER BY sf.file_name, sf.uploaded_at
+			  LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, folderId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+func (s *StoredFileStore) CountByFolder(ctx context.Context, projectId int64, folderId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM stored_files
+			  WHERE project_id = $1 AND folder_id IS NOT DISTINCT FROM NULLIF($2::BIGINT, 0)
+			  AND status = 'available' AND version_of IS NULL AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, query, projectId, folderId).Scan(&count)
+	return count, err
+}
+
+// Move moves a file and its previous versions into a folder, or to the root
+// of the project for folderId 0. It fails with ErrConflict when the folder
+// already has a file with the same name.
+func (s *StoredFileStore) Move(ctx context.Context, storedFile *StoredFile, folderId int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		// The folder is locked so that it is not moved while its path is used
+		folder := ""
+		if folderId != 0 {
+			query := `SELECT path FROM folders WHERE id = $1 AND project_id = $2 FOR SHARE`
+			err := tx.QueryRowContext(queryCtx, query, folderId, storedFile.ProjectID).Scan(&folder)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		moved := *storedFile
+		moved.Folder = folder
+		moved.FolderID = folderId
+		if err := lockPath(ctx, tx, &moved); err != nil {
+			return err
+		}
+
+		var exists bool
+		query := `SELECT EXISTS(SELECT 1 FROM stored_files WHERE project_id = $1 AND folder = $2 AND file_name = $3
+				  AND id <> $4 AND status = $5 AND version_of IS NULL AND deleted_at IS NULL)`
+		err := tx.QueryRowContext(queryCtx, query, storedFile.ProjectID, folder, storedFile.FileName, storedFile.ID, FileStatusAvailable).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrConflict
+		}
+
+		query = `UPDATE stored_files SET folder = $1, folder_id = NULLIF($2, 0) WHERE id = $3 OR version_of = $3`
+		if _, err := tx.ExecContext(queryCtx, query, folder, folderId, storedFile.ID); err != nil {
+			return err
+		}
+
+		storedFile.Folder = folder
+		storedFile.FolderID = folderId
+		return nil
+	})
+}
+
+// Trash moves a file and its previous versions to the trash
+func (s *StoredFileStore) Trash(ctx context.Context, id uuid.UUID) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		storedFile := &StoredFile{}
+		query := `SELECT ` + storedFileColumns + ` FROM stored_files sf WHERE sf.id = $1 AND sf.version_of IS NULL AND sf.deleted_at IS NULL`
+		if err := tx.QueryRowContext(queryCtx, query, id).Scan(storedFileFields(storedFile)...); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		// No version can be added while the file is being deleted
+		if err := lockPath(ctx, tx, storedFile); err != nil {
+			return err
+		}
+
+		if err := checkLocks(ctx, tx, `sf.id = $1 OR sf.version_of = $1`, id); err != nil {
+			return err
+		}
+
+		query = `UPDATE stored_files SET deleted_at = NOW() WHERE (id = $1 OR version_of = $1) AND deleted_at IS NULL`
+		result, err := tx.ExecContext(queryCtx, query, id)
+		if err != nil {
+			return err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// RestoreFromTrash takes a file of a project and its previous versions out of
+// the trash. It fails with ErrConflict when another file has been uploaded to
+// the same path since the file was deleted.
+func (s *StoredFileStore) RestoreFromTrash(ctx context.Context, projectId int64, id uuid.UUID) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		storedFile := &StoredFile{}
+		query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+				  WHERE sf.id = $1 AND sf.project_id = $2 AND sf.version_of IS NULL AND sf.deleted_at IS NOT NULL`
+		if err := tx.QueryRowContext(queryCtx, query, id, projectId).Scan(storedFileFields(storedFile)...); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		if err := lockPath(ctx, tx, storedFile); err != nil {
+			return err
+		}
+
+		var exists bool
+		query = `SELECT EXISTS(SELECT 1 FROM stored_files WHERE project_id = $1 AND folder = $2 AND file_name = $3
+				 AND id <> $4 AND status = $5 AND version_of IS NULL AND deleted_at IS NULL)`
+		err := tx.QueryRowContext(queryCtx, query, storedFile.ProjectID, storedFile.Folder, storedFile.FileName, storedFile.ID, FileStatusAvailable).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrConflict
+		}
+
+		query = `UPDATE stored_files SET deleted_at = NULL WHERE id = $1 OR version_of = $1`
+		_, err = tx.ExecContext(queryCtx, query, id)
+		return err
+	})
+}
+
+// GetTrash returns the files of a project that are in the trash, most
+// recently deleted first
+func (s *StoredFileStore) GetTrash(ctx context.Context, projectId int64, limit int64, offset int64) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE sf.project_id = $1 AND sf.version_of IS NULL AND sf.deleted_at IS NOT NULL
+			  ORDER BY sf.deleted_at DESC
+			  LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+func (s *StoredFileStore) CountTrash(ctx context.Context, projectId int64) (int64, error) {
+	query := `SELECT COUNT(*) FROM stored_files WHERE project_id = $1 AND version_of IS NULL AND deleted_at IS NOT NULL`
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
 	defer cancel()
@@ -217,3 +1040,151 @@ func (s *StoredFileStore) CountProjectFiles(ctx context.Context, projectId int64
 	err := s.db.QueryRowContext(ctx, query, projectId).Scan(&count)
 	return count, err
 }
+
+// GetTrashedBefore returns up to limit files that were moved to the trash
+// before the given time, of one project or of every project for projectId 0
+func (s *StoredFileStore) GetTrashedBefore(ctx context.Context, projectId int64, before time.Time, limit int64) ([]*StoredFile, error) {
+	query := `SELECT ` + storedFileColumns + ` FROM stored_files sf
+			  WHERE sf.version_of IS NULL AND sf.deleted_at < $1 AND ($2::INT = 0 OR sf.project_id = $2)
+			  ORDER BY sf.deleted_at
+			  LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, before, projectId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	storedFiles := make([]*StoredFile, 0)
+	for rows.Next() {
+		storedFile := &StoredFile{}
+		if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+			return nil, err
+		}
+		storedFiles = append(storedFiles, storedFile)
+	}
+
+	return storedFiles, rows.Err()
+}
+
+// GetIdsByProjectId returns the ids of up to limit files of a project,
+// whatever their status, for removing the project
+func (s *StoredFileStore) GetIdsByProjectId(ctx context.Context, projectId int64, limit int64) ([]uuid.UUID, error) {
+	query := `SELECT id FROM stored_files WHERE project_id = $1 AND version_of IS NULL ORDER BY id LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, projectId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Purge removes a file and all of its previous versions for good. remove is
+// called as for Delete, once for every version whose content is no longer
+// referenced.
+func (s *StoredFileStore) Purge(ctx context.Context, id uuid.UUID, remove func(storedFile *StoredFile) error) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		queryCtx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+		defer cancel()
+
+		query := `SELECT ` + storedFileColumns + ` FROM stored_files sf WHERE sf.id = $1 OR sf.version_of = $1 FOR UPDATE`
+		rows, err := tx.QueryContext(queryCtx, query, id)
+		if err != nil {
+			return err
+		}
+
+		storedFiles := make([]*StoredFile, 0)
+		for rows.Next() {
+			storedFile := &StoredFile{}
+			if err := rows.Scan(storedFileFields(storedFile)...); err != nil {
+				rows.Close()
+				return err
+			}
+			storedFiles = append(storedFiles, storedFile)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(storedFiles) == 0 {
+			return ErrNotFound
+		}
+
+		if err := checkLocks(ctx, tx, `sf.id = $1 OR sf.version_of = $1`, id); err != nil {
+			return err
+		}
+
+		// Previous versions reference the file, so they go first
+		if _, err := tx.ExecContext(queryCtx, `DELETE FROM stored_files WHERE version_of = $1`, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(queryCtx, `DELETE FROM stored_files WHERE id = $1`, id); err != nil {
+			return err
+		}
+
+		for _, storedFile := range storedFiles {
+			// Files stored before deduplication, and pending uploads, own
+			// their blob
+			if storedFile.BlobID == 0 {
+				if err := remove(storedFile); err != nil {
+					return err
+				}
+				continue
+			}
+
+			err := releaseBlob(ctx, tx, storedFile.BlobID, func() error {
+				return remove(storedFile)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// SetLegalHold switches the legal hold of a file on or off
+func (s *StoredFileStore) SetLegalHold(ctx context.Context, id uuid.UUID, hold bool) error {
+	query := `UPDATE stored_files SET legal_hold = $1 WHERE id = $2 AND version_of IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuration)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, hold, id)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CheckProjectLocks returns a LockError when any file of a project is under
+// retention or legal hold, as the project can then not be deleted
+func (s *StoredFileStore) CheckProjectLocks(ctx context.Context, projectId int64) error {
+	return checkLocks(ctx, s.db, `sf.project_id = $1`, projectId)
+}
@@ -1,14 +1,22 @@
 package utils
 
 import (
-	"bytes"
 	"compress/flate"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
 	"os"
+	"path"
 	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/kudzaitsapo/fileflow-server/internal/blobstore"
+	"github.com/kudzaitsapo/fileflow-server/internal/compression"
+	"github.com/kudzaitsapo/fileflow-server/internal/store"
 )
 
 // customReadCloser combines an io.Reader with a custom close function
@@ -17,63 +25,163 @@ type customReadCloser struct {
 	closeFunc func() error
 }
 
-func CompressAndSaveFile(file multipart.File, savedFileName string, saveFolder string) error {
+// Storage formats of stored files
+const (
+	// StorageFormatDeflate is a single raw deflate stream, used by older uploads
+	StorageFormatDeflate = "deflate"
+	// StorageFormatFramed is the seekable container from the compression package
+	StorageFormatFramed = "framed"
+)
 
-	outputFileName := filepath.Base(savedFileName)
+var ErrFileTooLarge = errors.New("file exceeds the maximum upload size")
 
-	if _, dirErr := os.Stat("uploads"); os.IsNotExist(dirErr) {
-        os.Mkdir("uploads", 0755)
-    }
+// SaveOptions controls how CompressAndSaveFile stores a file
+type SaveOptions struct {
+	// MaxSize is the largest accepted file in bytes, 0 disables the limit
+	MaxSize int64
+	Codec   compression.Codec
+	Level   int
+	// Sealer and Salt encrypt the stored frames when set
+	Sealer compression.FrameSealer
+	Salt   []byte
+}
 
-	if saveFolder != "" {
-		if _, dirCreateErr := os.Stat(filepath.Join("uploads", saveFolder)); os.IsNotExist(dirCreateErr) {
-			createDirErr := os.MkdirAll(filepath.Join("uploads", saveFolder), 0755)
-			if createDirErr != nil {
-				log.Printf("Error creating directory: %v", createDirErr)
-				return createDirErr
-			}
-		}
-		outputFileName = filepath.Join("uploads", saveFolder, outputFileName)
-	} else {
-		outputFileName = filepath.Join("uploads", outputFileName)
+// SaveResult describes a file once it has been written to the blob store
+type SaveResult struct {
+	Size       int64
+	StoredSize int64
+	SHA256     string
+	MD5        string
+}
+
+// sizeLimitedReader counts the bytes read and fails once the limit is passed
+type sizeLimitedReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	if l.limit > 0 && l.read > l.limit {
+		return n, ErrFileTooLarge
 	}
+	return n, err
+}
 
-	// Read file content (already an io.ReadCloser)
-    content, err := io.ReadAll(file)
-    if err != nil {
-        return err
-    }
-    defer file.Close()
-
-    // Compress using deflate
-    var b bytes.Buffer
-    w, flateErr := flate.NewWriter(&b, flate.BestCompression)
-	if flateErr != nil {
-		return flateErr
+// BlobKey returns the key a stored file is kept under in the blob store
+func BlobKey(savedFileName string, folder string) string {
+	fileName := filepath.Base(savedFileName)
+	if folder != "" {
+		return path.Join(filepath.ToSlash(folder), fileName)
 	}
+	return fileName
+}
+
+// UploadKey returns the key an upload is written to before its content hash
+// is known and it is moved to its ContentBlobKey
+func UploadKey(savedFileName string) string {
+	return path.Join("incoming", filepath.Base(savedFileName))
+}
 
-    if _, err := w.Write(content); err != nil {
-        return err
-    }
-    if err := w.Close(); err != nil {
-        return err
-    }
-    compressed := b.Bytes()
+// UploadChunkKey returns a new key for a chunk of a resumable upload received
+// at offset. Every attempt gets its own key, so that a chunk that is not
+// accepted never replaces one that was.
+func UploadChunkKey(uploadID uuid.UUID, offset int64) string {
+	return path.Join("chunks", uploadID.String(), fmt.Sprintf("%020d-%s", offset, uuid.New()))
+}
 
-    return os.WriteFile(outputFileName, compressed, 0644)
+// MultipartPartKey returns a new key for a part of a multipart upload. Every
+// attempt gets its own key, so that a part that is sent again never replaces
+// the content of the part while it is being read.
+func MultipartPartKey(uploadID uuid.UUID, partNumber int) string {
+	return path.Join("parts", uploadID.String(), fmt.Sprintf("%05d-%s", partNumber, uuid.New()))
+}
 
+// ContentBlobKey returns the key of the shared blob for content with the
+// given SHA-256 in a scope. Scoped keys are hashed again so that the content
+// hash of encrypted files is not visible in the blob store.
+func ContentBlobKey(contentSHA256 string, scope string) string {
+	name := contentSHA256
+	if scope != "" {
+		sum := sha256.Sum256([]byte(scope + "/" + contentSHA256))
+		name = hex.EncodeToString(sum[:])
+	}
+	return path.Join("blobs", name[:2], name+".ffs")
 }
 
-func DecompressFile(compressedFileName string, folder string) (*os.File, error) {
-	// Create a temporary file for the decompressed output
-	fileNameWithFolder := filepath.Base(compressedFileName)
-	if folder != "" {
-		fileNameWithFolder = filepath.Join("uploads", folder, fileNameWithFolder)
-	} else {
-		fileNameWithFolder = filepath.Join("uploads", fileNameWithFolder)
+// StoredFileKey returns the blob store key holding the content of a file
+func StoredFileKey(storedFile *store.StoredFile) string {
+	if storedFile.Status == store.FileStatusPending {
+		return blobstore.DurabilityKey(storedFile.DurabilityPolicy, UploadKey(storedFile.SavedAs))
+	}
+	if storedFile.BlobID != 0 {
+		return storedFile.SavedAs
+	}
+	return BlobKey(storedFile.SavedAs, storedFile.StorageFolder)
+}
+
+// CompressAndSaveFile streams the content through the hashers and the chosen
+// compression codec straight into the blob store under key, using the framed container
+// format (StorageFormatFramed). Memory use does not depend on the size of the
+// file, and reading stops with ErrFileTooLarge as soon as more than
+// options.MaxSize bytes have been received.
+func CompressAndSaveFile(ctx context.Context, blobs blobstore.BlobStore, file io.Reader, key string, options SaveOptions) (*SaveResult, error) {
+	limitedFile := &sizeLimitedReader{reader: file, limit: options.MaxSize}
+	sha256Hasher := sha256.New()
+	md5Hasher := md5.New()
+
+	pipeReader, pipeWriter := io.Pipe()
+	compressDone := make(chan error, 1)
+
+	// Compress into frames while the blob store consumes the other end of the pipe
+	go func() {
+		w, writerErr := compression.NewFrameWriter(pipeWriter, compression.FrameOptions{
+			FrameSize: compression.DefaultFrameSize,
+			Codec:     options.Codec,
+			Level:     options.Level,
+			Sealer:    options.Sealer,
+			Salt:      options.Salt,
+		})
+		if writerErr != nil {
+			pipeWriter.CloseWithError(writerErr)
+			compressDone <- writerErr
+			return
+		}
+
+		_, err := io.Copy(w, io.TeeReader(limitedFile, io.MultiWriter(sha256Hasher, md5Hasher)))
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+
+		pipeWriter.CloseWithError(err)
+		compressDone <- err
+	}()
+
+	storedSize, putErr := blobs.Put(ctx, key, pipeReader)
+	// Unblock the compressor if the store gave up before reading everything
+	pipeReader.CloseWithError(putErr)
+
+	if compressErr := <-compressDone; compressErr != nil && !errors.Is(compressErr, io.ErrClosedPipe) {
+		return nil, compressErr
+	}
+	if putErr != nil {
+		return nil, putErr
 	}
 
+	return &SaveResult{
+		Size:       limitedFile.read,
+		StoredSize: storedSize,
+		SHA256:     hex.EncodeToString(sha256Hasher.Sum(nil)),
+		MD5:        hex.EncodeToString(md5Hasher.Sum(nil)),
+	}, nil
+}
 
+// DecompressFile inflates a stored file into a temporary file that supports
+// seeking. The caller is responsible for closing and removing it.
+func DecompressFile(ctx context.Context, blobs blobstore.BlobStore, compressedFileName string, folder string) (*os.File, error) {
+	// Create a temporary file for the decompressed output
 	tempDir := os.TempDir()
 
 	// Ensure the temp directory exists.
@@ -90,7 +198,7 @@ func DecompressFile(compressedFileName string, folder string) (*os.File, error)
 	}
 
 	// Open the compressed file
-	compressedFile, err := os.Open(fileNameWithFolder)
+	compressedFile, err := blobs.Get(ctx, BlobKey(compressedFileName, folder))
 	if err != nil {
 		outputFile.Close()
 		os.Remove(outputFile.Name())
@@ -123,17 +231,9 @@ func DecompressFile(compressedFileName string, folder string) (*os.File, error)
 
 // DecompressFileAndReturnStream decompresses a file and returns a ReadCloser.
 // This is an alternative implementation that returns a stream instead of a file.
-func DecompressFileAndReturnStream(compressedFileName string, folder string) (io.ReadCloser, error) {
+func DecompressFileAndReturnStream(ctx context.Context, blobs blobstore.BlobStore, compressedFileName string, folder string) (io.ReadCloser, error) {
 	// Open the compressed file
-
-	fileNameWithFolder := filepath.Base(compressedFileName)
-	if folder != "" {
-		fileNameWithFolder = filepath.Join("uploads", folder, fileNameWithFolder)
-	} else {
-		fileNameWithFolder = filepath.Join("uploads", fileNameWithFolder)
-	}
-
-	compressedFile, err := os.Open(fileNameWithFolder)
+	compressedFile, err := blobs.Get(ctx, BlobKey(compressedFileName, folder))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open compressed file: %w", err)
 	}
@@ -155,12 +255,42 @@ func DecompressFileAndReturnStream(compressedFileName string, folder string) (io
 	}, nil
 }
 
+// blobSource exposes a blob as a compression.Source
+type blobSource struct {
+	ctx   context.Context
+	blobs blobstore.BlobStore
+	key   string
+	size  int64
+}
+
+func (b *blobSource) Size() int64 {
+	return b.size
+}
+
+func (b *blobSource) ReadRange(offset int64, length int64) (io.ReadCloser, error) {
+	return b.blobs.GetRange(b.ctx, b.key, offset, length)
+}
+
+// OpenFramedFile opens a file stored in the framed format for random access.
+// sealers provides the key for encrypted files and may be nil otherwise.
+func OpenFramedFile(ctx context.Context, blobs blobstore.BlobStore, key string, sealers compression.SealerFactory) (*compression.FrameReader, error) {
+	info, err := blobs.Stat(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open compressed file: %w", err)
+	}
+
+	return compression.NewFrameReader(&blobSource{
+		ctx:   ctx,
+		blobs: blobs,
+		key:   key,
+		size:  info.Size,
+	}, sealers)
+}
 
 func (c *customReadCloser) Close() error {
 	return c.closeFunc()
 }
 
-
 func GetFileExtension(fileName string) string {
 	return filepath.Ext(fileName)
-}
\ No newline at end of file
+}
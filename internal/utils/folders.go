@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// maxFolderPathLength matches the size of the folder path columns
+const maxFolderPathLength = 1024
+
+var ErrInvalidFolder = errors.New("invalid folder")
+
+// ValidFolderName reports whether name can be the name of a folder. Names
+// can not contain slashes or control characters, and "." and ".." are
+// reserved so that paths can never point outside their project.
+func ValidFolderName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 255 {
+		return false
+	}
+
+	for _, r := range name {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CleanFolderPath normalises a slash separated folder path, dropping leading,
+// trailing and repeated slashes. The root of a project is the empty path.
+func CleanFolderPath(folder string) (string, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(folder, "/") {
+		if name == "" {
+			continue
+		}
+		if !ValidFolderName(name) {
+			return "", ErrInvalidFolder
+		}
+		names = append(names, name)
+	}
+
+	cleaned := strings.Join(names, "/")
+	if len(cleaned) > maxFolderPathLength {
+		return "", ErrInvalidFolder
+	}
+
+	return cleaned, nil
+}
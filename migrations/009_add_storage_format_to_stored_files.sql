@@ -0,0 +1,5 @@
+-- Files uploaded before this migration are single deflate streams
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN storage_format VARCHAR(32) NOT NULL DEFAULT 'deflate';
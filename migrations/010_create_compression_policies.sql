@@ -0,0 +1,17 @@
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN compression_codec VARCHAR(32) NOT NULL DEFAULT 'deflate',
+ADD
+    COLUMN compression_level INT NOT NULL DEFAULT 9;
+
+CREATE TABLE IF NOT EXISTS project_compression_policies (
+    id SERIAL PRIMARY KEY,
+    project_id INT NOT NULL REFERENCES projects(id),
+    mime_type VARCHAR(255),
+    file_type_id INT REFERENCES file_types(id),
+    codec VARCHAR(32) NOT NULL,
+    level INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CHECK ((mime_type IS NULL) <> (file_type_id IS NULL))
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS project_keys (
+    project_id INT PRIMARY KEY REFERENCES projects(id),
+    wrapped_key BYTEA NOT NULL,
+    master_key_id VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    rotated_at TIMESTAMP WITH TIME ZONE
+);
+
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN encrypted BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,5 @@
+-- Set for files encrypted with a key supplied by the client, which is never stored
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN encryption_key_fingerprint VARCHAR(64);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS blobs (
+    id BIGSERIAL PRIMARY KEY,
+    sha256 CHAR(64) NOT NULL,
+    -- Files encrypted with different keys can not share content
+    scope VARCHAR(100) NOT NULL DEFAULT '',
+    blob_key TEXT NOT NULL UNIQUE,
+    size BIGINT NOT NULL,
+    stored_size BIGINT NOT NULL,
+    storage_format VARCHAR(20) NOT NULL,
+    compression_codec VARCHAR(20) NOT NULL,
+    compression_level INT NOT NULL DEFAULT 0,
+    encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+    ref_count BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (sha256, scope)
+);
+
+-- Files uploaded before deduplication keep owning their blob and have no blob_id
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN blob_id BIGINT REFERENCES blobs(id);
+
+CREATE INDEX IF NOT EXISTS idx_stored_files_blob_id ON stored_files(blob_id);
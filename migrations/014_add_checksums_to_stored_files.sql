@@ -0,0 +1,7 @@
+-- Hex encoded checksums of the original content, computed while uploading
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN sha256 CHAR(64),
+ADD
+    COLUMN md5 CHAR(32);
@@ -0,0 +1,37 @@
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN integrity_status VARCHAR(20) NOT NULL DEFAULT 'unchecked',
+ADD
+    COLUMN integrity_detail TEXT NOT NULL DEFAULT '',
+ADD
+    COLUMN integrity_checked_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_stored_files_integrity_status ON stored_files(integrity_status);
+
+CREATE TABLE IF NOT EXISTS scrub_runs (
+    id BIGSERIAL PRIMARY KEY,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',
+    files_checked BIGINT NOT NULL DEFAULT 0,
+    healthy BIGINT NOT NULL DEFAULT 0,
+    missing BIGINT NOT NULL DEFAULT 0,
+    corrupt BIGINT NOT NULL DEFAULT 0,
+    unverifiable BIGINT NOT NULL DEFAULT 0,
+    orphaned BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Problems found by a run. Orphaned blobs have no file.
+CREATE TABLE IF NOT EXISTS scrub_findings (
+    id BIGSERIAL PRIMARY KEY,
+    run_id BIGINT NOT NULL REFERENCES scrub_runs(id) ON DELETE CASCADE,
+    file_id UUID REFERENCES stored_files(id) ON DELETE SET NULL,
+    blob_key TEXT NOT NULL,
+    problem VARCHAR(20) NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    found_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_scrub_findings_run_id ON scrub_findings(run_id);
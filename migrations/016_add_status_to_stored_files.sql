@@ -0,0 +1,8 @@
+-- Uploads are recorded as pending before their content is written and only
+-- become available once finalised
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN status VARCHAR(20) NOT NULL DEFAULT 'available';
+
+CREATE INDEX IF NOT EXISTS idx_stored_files_status ON stored_files(status);
@@ -0,0 +1,11 @@
+-- Projects choose whether their files are replicated or erasure coded
+ALTER TABLE
+    projects
+ADD
+    COLUMN durability_policy VARCHAR(20) NOT NULL DEFAULT 'replication';
+
+-- The policy of a file decides where its pending upload is written
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN durability_policy VARCHAR(20) NOT NULL DEFAULT 'replication';
@@ -0,0 +1,19 @@
+-- Blobs move between the hot and cold storage backends, and every file
+-- records the class of its blob
+ALTER TABLE
+    blobs
+ADD
+    COLUMN storage_class VARCHAR(20) NOT NULL DEFAULT 'hot';
+
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN storage_class VARCHAR(20) NOT NULL DEFAULT 'hot';
+
+-- Files that are not downloaded for a while are moved to cold storage
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN last_accessed_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_blobs_storage_class ON blobs(storage_class);
@@ -0,0 +1,18 @@
+-- Uploads to a path that already exists add a version of the file. The file
+-- keeps its id and holds the current version, previous versions are rows
+-- pointing at it with version_of.
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN version INT NOT NULL DEFAULT 1,
+ADD
+    COLUMN version_of UUID REFERENCES stored_files(id);
+
+CREATE INDEX IF NOT EXISTS idx_stored_files_version_of ON stored_files(version_of);
+CREATE INDEX IF NOT EXISTS idx_stored_files_path ON stored_files(project_id, folder, file_name);
+
+-- Number of versions of every file a project keeps, including the current one
+ALTER TABLE
+    projects
+ADD
+    COLUMN max_versions INT NOT NULL DEFAULT 10;
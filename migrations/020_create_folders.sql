@@ -0,0 +1,83 @@
+-- Folders of a project form a tree. path is the slash separated path from the
+-- root of the project, which is kept on every folder and file so that they
+-- can be looked up without walking the tree.
+CREATE TABLE IF NOT EXISTS folders (
+    id BIGSERIAL PRIMARY KEY,
+    project_id INT NOT NULL REFERENCES projects(id),
+    -- NULL for folders at the root of the project
+    parent_id BIGINT REFERENCES folders(id),
+    name VARCHAR(255) NOT NULL,
+    path VARCHAR(1024) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (project_id, path)
+);
+
+CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(project_id, parent_id);
+
+ALTER TABLE
+    stored_files
+ALTER COLUMN
+    folder TYPE VARCHAR(1024);
+
+-- Files stored before deduplication own a blob kept under their folder, which
+-- must not change when the file is moved
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN storage_folder VARCHAR(255) NOT NULL DEFAULT '',
+ADD
+    COLUMN folder_id BIGINT REFERENCES folders(id);
+
+UPDATE
+    stored_files
+SET
+    storage_folder = COALESCE(folder, '')
+WHERE
+    blob_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_stored_files_folder_id ON stored_files(project_id, folder_id);
+
+-- Create the folders of existing files, every level of their path included
+UPDATE
+    stored_files
+SET
+    folder = COALESCE(TRIM(BOTH '/' FROM folder), '');
+
+INSERT INTO
+    folders (project_id, name, path)
+SELECT
+    DISTINCT sf.project_id,
+    sf.parts [i],
+    ARRAY_TO_STRING(sf.parts [1:i], '/')
+FROM
+    (
+        SELECT
+            project_id,
+            STRING_TO_ARRAY(folder, '/') AS parts
+        FROM
+            stored_files
+        WHERE
+            folder <> ''
+    ) sf,
+    GENERATE_SERIES(1, ARRAY_LENGTH(sf.parts, 1)) AS i ON CONFLICT (project_id, path) DO NOTHING;
+
+UPDATE
+    folders f
+SET
+    parent_id = p.id
+FROM
+    folders p
+WHERE
+    p.project_id = f.project_id
+    AND f.path LIKE '%/%'
+    AND p.path = REGEXP_REPLACE(f.path, '/[^/]*$', '');
+
+UPDATE
+    stored_files sf
+SET
+    folder_id = f.id
+FROM
+    folders f
+WHERE
+    f.project_id = sf.project_id
+    AND f.path = sf.folder;
@@ -0,0 +1,19 @@
+-- Deleted files and projects are kept in the trash until the purger removes
+-- them for good. Every version of a deleted file carries the same deleted_at.
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE
+    projects
+ADD
+    COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_stored_files_deleted_at ON stored_files(deleted_at)
+WHERE
+    deleted_at IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_projects_deleted_at ON projects(deleted_at)
+WHERE
+    deleted_at IS NOT NULL;
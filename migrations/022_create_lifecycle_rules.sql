@@ -0,0 +1,84 @@
+-- A previous version stops being current when a newer version is uploaded or
+-- restored, which is what lifecycle rules for versions count from
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN superseded_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE
+    stored_files v
+SET
+    superseded_at = (
+        SELECT
+            MIN(n.uploaded_at)
+        FROM
+            stored_files n
+        WHERE
+            (
+                n.id = v.version_of
+                OR n.version_of = v.version_of
+            )
+            AND n.version > v.version
+    )
+WHERE
+    v.version_of IS NOT NULL;
+
+UPDATE
+    stored_files
+SET
+    superseded_at = uploaded_at
+WHERE
+    version_of IS NOT NULL
+    AND superseded_at IS NULL;
+
+-- Rules expiring the files or the previous versions of a project, optionally
+-- limited to a folder and everything inside it
+CREATE TABLE IF NOT EXISTS lifecycle_rules (
+    id BIGSERIAL PRIMARY KEY,
+    project_id INT NOT NULL REFERENCES projects(id),
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    action VARCHAR(32) NOT NULL,
+    -- Empty for the whole project
+    folder VARCHAR(1024) NOT NULL DEFAULT '',
+    days INT NOT NULL CHECK (days > 0),
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_lifecycle_rules_project_id ON lifecycle_rules(project_id);
+
+-- One application of a rule. Runs are kept when their rule is deleted.
+CREATE TABLE IF NOT EXISTS lifecycle_runs (
+    id BIGSERIAL PRIMARY KEY,
+    rule_id BIGINT REFERENCES lifecycle_rules(id) ON DELETE SET NULL,
+    project_id INT NOT NULL REFERENCES projects(id),
+    action VARCHAR(32) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',
+    files_matched BIGINT NOT NULL DEFAULT 0,
+    files_expired BIGINT NOT NULL DEFAULT 0,
+    files_failed BIGINT NOT NULL DEFAULT 0,
+    bytes_expired BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_lifecycle_runs_project_id ON lifecycle_runs(project_id);
+
+-- The files a run expired or failed to expire. file_id has no foreign key as
+-- expired files are purged later on.
+CREATE TABLE IF NOT EXISTS lifecycle_run_items (
+    id BIGSERIAL PRIMARY KEY,
+    run_id BIGINT NOT NULL REFERENCES lifecycle_runs(id) ON DELETE CASCADE,
+    file_id UUID NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    folder VARCHAR(1024) NOT NULL DEFAULT '',
+    version INT NOT NULL,
+    file_size BIGINT NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_lifecycle_run_items_run_id ON lifecycle_run_items(run_id);
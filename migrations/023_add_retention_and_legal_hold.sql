@@ -0,0 +1,34 @@
+-- Files uploaded to a project with a retention period can not be deleted or
+-- overwritten until retain_until, which every version keeps from its upload
+ALTER TABLE
+    projects
+ADD
+    COLUMN retention_days INT NOT NULL DEFAULT 0;
+
+-- A legal hold is set on the file row and covers all of its versions
+ALTER TABLE
+    stored_files
+ADD
+    COLUMN retain_until TIMESTAMP WITH TIME ZONE,
+ADD
+    COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Attempts to delete or overwrite files that are under retention or legal
+-- hold, and the changes to the holds and the retention period. project_id
+-- and file_id have no foreign keys so that the events outlive the projects
+-- and the files. file_id is NULL for a change of retention, and version is 0
+-- for events about a whole file.
+CREATE TABLE IF NOT EXISTS lock_audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    project_id INT NOT NULL,
+    file_id UUID,
+    version INT NOT NULL DEFAULT 0,
+    operation VARCHAR(32) NOT NULL,
+    lock_type VARCHAR(20) NOT NULL,
+    actor VARCHAR(255) NOT NULL DEFAULT '',
+    remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_lock_audit_events_project_id ON lock_audit_events(project_id);
@@ -0,0 +1,28 @@
+-- Uploads received in chunks over several requests with the tus protocol.
+-- Chunks are kept in the blob store until the upload is complete and is
+-- stored as a file.
+CREATE TABLE IF NOT EXISTS resumable_uploads (
+    id UUID PRIMARY KEY,
+    project_id INT NOT NULL REFERENCES projects(id),
+    upload_length BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    file_name VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(255) NOT NULL,
+    folder VARCHAR(1024) NOT NULL DEFAULT '',
+    -- The Upload-Metadata header as sent by the client
+    metadata TEXT NOT NULL DEFAULT '',
+    -- The file the upload was stored as once complete
+    stored_file_id UUID REFERENCES stored_files(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_resumable_uploads_expires_at ON resumable_uploads(expires_at);
+
+CREATE TABLE IF NOT EXISTS resumable_upload_chunks (
+    upload_id UUID NOT NULL REFERENCES resumable_uploads(id) ON DELETE CASCADE,
+    chunk_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    blob_key VARCHAR(1024) NOT NULL,
+    PRIMARY KEY (upload_id, chunk_offset)
+);
@@ -0,0 +1,27 @@
+-- Uploads sent as numbered parts, possibly in parallel, and stitched into one
+-- file when completed. Parts are kept in the blob store until then.
+CREATE TABLE IF NOT EXISTS multipart_uploads (
+    id UUID PRIMARY KEY,
+    project_id INT NOT NULL REFERENCES projects(id),
+    file_name VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(255) NOT NULL,
+    folder VARCHAR(1024) NOT NULL DEFAULT '',
+    -- The file the upload was stored as once completed
+    stored_file_id UUID REFERENCES stored_files(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    -- Moved forward by every part, so that only idle uploads expire
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_multipart_uploads_expires_at ON multipart_uploads(expires_at);
+
+CREATE TABLE IF NOT EXISTS multipart_upload_parts (
+    upload_id UUID NOT NULL REFERENCES multipart_uploads(id) ON DELETE CASCADE,
+    part_number INT NOT NULL CHECK (part_number > 0),
+    size BIGINT NOT NULL,
+    md5 CHAR(32) NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    blob_key VARCHAR(1024) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (upload_id, part_number)
+);
@@ -0,0 +1,23 @@
+-- Public links to a file for people without access to the project. A link
+-- serves whatever version of the file is current when it is used.
+CREATE TABLE IF NOT EXISTS share_links (
+    id BIGSERIAL PRIMARY KEY,
+    project_id INT NOT NULL REFERENCES projects(id),
+    stored_file_id UUID NOT NULL REFERENCES stored_files(id) ON DELETE CASCADE,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    -- bcrypt hash of the password, NULL for links without one
+    password_hash BYTEA,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    -- NULL for links that can be downloaded any number of times
+    max_downloads INT CHECK (max_downloads > 0),
+    download_count INT NOT NULL DEFAULT 0,
+    -- Every use of the link, including those that were refused
+    access_count INT NOT NULL DEFAULT 0,
+    last_accessed_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_by_id INT NULL REFERENCES users(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_project_id ON share_links(project_id);
+CREATE INDEX IF NOT EXISTS idx_share_links_stored_file_id ON share_links(stored_file_id);
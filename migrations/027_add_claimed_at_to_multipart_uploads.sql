@@ -0,0 +1,6 @@
+-- A multipart upload is claimed while it is completed or aborted, so that no
+-- part can be sent and no other completion can start in the meantime
+ALTER TABLE
+    multipart_uploads
+ADD
+    COLUMN claimed_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,6 @@
+-- A resumable upload is claimed while it is stored as a file or terminated,
+-- so that no other request can store it a second time in the meantime
+ALTER TABLE
+    resumable_uploads
+ADD
+    COLUMN claimed_at TIMESTAMP WITH TIME ZONE;